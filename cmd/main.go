@@ -1,69 +1,128 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/opentracing/opentracing-go"
-	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 	"gopkg.in/alexcesaro/statsd.v2"
 
-	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/admin"
+	"github.com/Lookyan/netramesh/pkg/config"
 	"github.com/Lookyan/netramesh/pkg/estabcache"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 	"github.com/Lookyan/netramesh/pkg/protocol"
+	"github.com/Lookyan/netramesh/pkg/proxy"
 	"github.com/Lookyan/netramesh/pkg/transport"
 )
 
+// version is set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
 func main() {
+	// invalid level from environment is reported by configuration loading
 	logger, err := log.Init("NETRA", os.Getenv(log.EnvNetraLoggerLevel), os.Stderr)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger, err = log.Init("NETRA", "", os.Stderr)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
 	}
-	serviceName := flag.String("service-name", "", "service name for jaeger")
+	serviceName := flag.String("service-name", "", "service name for jaeger (overrides service_name of config file)")
+	configFile := flag.String("config", os.Getenv(config.EnvConfigFile), "path to YAML or JSON configuration file, environment variables override its values")
+	checkConfig := flag.Bool("check-config", false, "print effective configuration and exit, exit code is non-zero in case of problems")
 	flag.Parse()
-	if *serviceName == "" {
-		logger.Fatal("service-name flag should be set")
-	}
-	config.SetServiceName(*serviceName)
 
-	err = config.GlobalConfigFromENV(logger)
+	netraConfig, err := config.Load(*configFile, logger)
+	if err == nil {
+		err = protocol.ValidateConfig(netraConfig)
+	}
+	if *checkConfig {
+		os.Exit(runCheckConfig(netraConfig, err))
+	}
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	if *serviceName != "" {
+		netraConfig.Netra.ServiceName = *serviceName
+	}
+	if netraConfig.Netra.ServiceName == "" {
+		logger.Fatal("service-name flag or service_name config field should be set")
+	}
+	logger.SetLevel(netraConfig.Netra.LoggerLevel)
+	configureLogger(logger, netraConfig)
 
 	// init statsd client
-	statsdMetricsClient, err := statsd.New(statsd.Mute(!config.GetNetraConfig().StatsdEnabled),
-		statsd.Address(config.GetNetraConfig().StatsdAddress),
-		statsd.Prefix(config.GetNetraConfig().StatsdPrefix))
+	statsdOptions := []statsd.Option{
+		statsd.Mute(!netraConfig.Netra.StatsdEnabled),
+		statsd.Address(netraConfig.Netra.StatsdAddress),
+		statsd.Prefix(netraConfig.Netra.StatsdPrefix),
+	}
+	switch netraConfig.Netra.StatsdTagFormat {
+	case config.StatsdTagFormatDatadog:
+		statsdOptions = append(statsdOptions, statsd.TagsFormat(statsd.Datadog))
+	case config.StatsdTagFormatInfluxDB:
+		statsdOptions = append(statsdOptions, statsd.TagsFormat(statsd.InfluxDB))
+	}
+	statsdMetricsClient, err := statsd.New(statsdOptions...)
 	if err != nil {
 		logger.Errorf("Can not init statsd metrics: %s", err.Error())
 	}
 
-	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-		logger.Error(
-			http.ListenAndServe(
-				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().PprofPort), mux))
-	}()
+	establishedCache := estabcache.NewEstablishedCache()
+
+	debugMux := http.NewServeMux()
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	go func() {
 		logger.Error(
 			http.ListenAndServe(
-				fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().PrometheusPort), promhttp.Handler()))
+				fmt.Sprintf("0.0.0.0:%d", netraConfig.Netra.PprofPort), debugMux))
 	}()
 
-	os.Setenv("JAEGER_SERVICE_NAME", *serviceName)
+	// admin server is started before tracer and listeners, so /healthz responds during initialization
+	tracerInitialized := int32(0)
+	adminServer := admin.New(logger, version)
+	adminServer.Handle("/debug/pprof/", debugMux)
+	// connections can be closed with registry handler, so it's served only by admin server
+	connectionsHandler := estabcache.NewHandler(establishedCache, "/connections")
+	adminServer.Handle("/connections", connectionsHandler)
+	adminServer.Handle("/connections/close", connectionsHandler)
+	adminServer.Handle("/metrics", promhttp.Handler())
+	adminServer.AddReadinessCheck("tracer", func() error {
+		if atomic.LoadInt32(&tracerInitialized) == 0 {
+			return errors.New("isn't initialized yet")
+		}
+		return nil
+	})
+	if netraConfig.Netra.AdminPort != 0 {
+		go func() {
+			logger.Error(
+				http.ListenAndServe(
+					net.JoinHostPort(netraConfig.Netra.AdminHost, strconv.Itoa(int(netraConfig.Netra.AdminPort))),
+					adminServer))
+		}()
+	}
+
+	os.Setenv("JAEGER_SERVICE_NAME", netraConfig.Netra.ServiceName)
 	cfg, err := jaegercfg.FromEnv()
 	if err != nil {
 		// parsing errors might happen here, such as when we get a string where we expect a number
@@ -73,46 +132,144 @@ func main() {
 	if err != nil {
 		logger.Fatalf("Could not initialize jaeger tracer: %s", err.Error())
 	}
-	defer closer.Close()
 	opentracing.SetGlobalTracer(tracer)
+	atomic.StoreInt32(&tracerInitialized, 1)
 
-	addr := fmt.Sprintf("0.0.0.0:%d", config.GetNetraConfig().Port)
-	lAddr, err := net.ResolveTCPAddr("tcp", addr)
+	transparent := netraConfig.Netra.InterceptionMode == config.InterceptionModeTProxy
+	ln, err := transport.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", netraConfig.Netra.Port), transparent)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
+	listeners := []*net.TCPListener{ln}
+
+	if netraConfig.Netra.IPv6Enabled {
+		ln6, err := transport.Listen("tcp6", fmt.Sprintf("[::]:%d", netraConfig.Netra.Port), transparent)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		listeners = append(listeners, ln6)
+	}
 
-	ln, err := net.ListenTCP("tcp", lAddr)
+	proxyMetrics, err := metrics.New(prometheus.DefaultRegisterer, statsdMetricsClient, netraConfig)
 	if err != nil {
 		logger.Fatal(err.Error())
 	}
 
-	establishedCache := estabcache.NewEstablishedCache()
-
-	tracingContextMapping := cache.New(
-		config.GetNetraConfig().TracingContextExpiration,
-		config.GetNetraConfig().TracingContextCleanupInterval,
-	)
+	var accessLog *accesslog.Logger
+	if netraConfig.Netra.AccessLogEnabled {
+		accessLog, err = accesslog.New(logger, netraConfig.Netra)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+	}
 
-	routingInfoContextMapping := cache.New(
-		config.GetNetraConfig().RoutingContextExpiration,
-		config.GetNetraConfig().RoutingContextCleanupInterval,
-	)
+	p, err := proxy.New(proxy.Options{
+		Listeners:        listeners,
+		Config:           netraConfig,
+		Logger:           logger,
+		Tracer:           tracer,
+		StatsdMetrics:    statsdMetricsClient,
+		Metrics:          proxyMetrics,
+		AccessLog:        accessLog,
+		EstablishedCache: establishedCache,
+	})
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	adminServer.SetProxy(p)
 
-	protocol.InitHandlerRequest(logger, statsdMetricsClient, tracingContextMapping, routingInfoContextMapping)
+	go func() {
+		logger.Error(
+			http.ListenAndServe(
+				fmt.Sprintf("0.0.0.0:%d", netraConfig.Netra.PrometheusPort), promhttp.Handler()))
+	}()
 
-	for {
-		conn, err := ln.AcceptTCP()
+	reload := func(reason string) {
+		var changes []config.Change
+		cfg, err := config.Load(*configFile, logger)
+		if err != nil {
+			// configuration which couldn't be loaded doesn't reach proxy, count failure here
+			proxyMetrics.ConfigReload(err)
+		} else {
+			if *serviceName != "" {
+				cfg.Netra.ServiceName = *serviceName
+			}
+			changes, err = p.Reload(cfg)
+		}
 		if err != nil {
-			logger.Warning(err.Error())
-			continue
+			logger.Errorf("Config reload on %s failed: %s", reason, err.Error())
+			return
+		}
+		configureLogger(logger, cfg)
+		// level changed at runtime with admin server is kept until log_level is changed in configuration
+		for _, c := range changes {
+			if c.Field == "log_level" {
+				logger.SetLevel(cfg.Netra.LoggerLevel)
+			}
+		}
+	}
+
+	stopWatch := make(chan struct{})
+	if *configFile != "" && netraConfig.Netra.ConfigReloadInterval > 0 {
+		go config.Watch(*configFile, netraConfig.Netra.ConfigReloadInterval, stopWatch, func() {
+			reload("file change")
+		})
+	}
+
+	go p.Serve()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sig := <-sigCh
+	for sig == syscall.SIGHUP {
+		reload(sig.String())
+		sig = <-sigCh
+	}
+	close(stopWatch)
+
+	logger.Infof("Received %s, draining %d active connections", sig, p.ActiveConnections())
+	ctx, cancel := context.WithTimeout(context.Background(), p.Config().Netra.DrainTimeout)
+	if err := p.Shutdown(ctx); err != nil {
+		logger.Warningf("Drain timeout exceeded, closing %d active connections", p.ActiveConnections())
+	} else {
+		logger.Info("All connections are drained")
+	}
+	cancel()
+
+	if err := closer.Close(); err != nil {
+		logger.Errorf("Error while closing tracer: %s", err.Error())
+	}
+	statsdMetricsClient.Close()
+	if err := accessLog.Close(); err != nil {
+		logger.Errorf("Error while closing access log: %s", err.Error())
+	}
+}
+
+// configureLogger applies logger settings of configuration except log level,
+// it can be changed at runtime with admin server
+func configureLogger(logger *log.Logger, cfg *config.Config) {
+	logger.SetFormat(cfg.Netra.LoggerFormat)
+	logger.SetSubsystemLevels(cfg.Netra.LoggerLevels)
+	logger.SetWarningRateLimit(cfg.Netra.LoggerWarningRateLimit)
+}
+
+// runCheckConfig prints effective configuration or its problems and returns process exit code
+func runCheckConfig(cfg *config.Config, err error) int {
+	if err != nil {
+		if validationErr, ok := err.(*config.ValidationError); ok {
+			for _, problem := range validationErr.Problems {
+				fmt.Fprintln(os.Stderr, problem)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, err.Error())
 		}
-		go transport.HandleConnection(
-			logger,
-			conn,
-			establishedCache,
-			tracingContextMapping,
-			routingInfoContextMapping,
-			statsdMetricsClient)
+		return 1
+	}
+	data, err := config.Marshal(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
 	}
+	os.Stdout.Write(data)
+	return 0
 }
@@ -10,42 +10,137 @@ OUTBOUND_INTERCEPT_PORTS=${OUTBOUND_INTERCEPT_PORTS:-*}
 NETRA_INBOUND_PROBABILITY=${NETRA_INBOUND_PROBABILITY:-1}
 NETRA_OUTBOUND_PROBABILITY=${NETRA_OUTBOUND_PROBABILITY:-1}
 
+NETRA_IPV6_ENABLED=${NETRA_IPV6_ENABLED:-false}
+
+NETRA_INTERCEPTION_MODE=${NETRA_INTERCEPTION_MODE:-redirect}
+NETRA_TPROXY_MARK=${NETRA_TPROXY_MARK:-1337}
+NETRA_TPROXY_ROUTE_TABLE=${NETRA_TPROXY_ROUTE_TABLE:-133}
+
 function dump {
     iptables-save
+    if [ "${NETRA_IPV6_ENABLED}" == "true" ]; then
+        ip6tables-save
+    fi
+    if [ "${NETRA_INTERCEPTION_MODE}" == "tproxy" ]; then
+        ip rule list
+        ip route list table ${NETRA_TPROXY_ROUTE_TABLE}
+    fi
 }
 
 trap dump EXIT
 
 IFS=,
 
-iptables -t nat -N NETRA_INBOUND
-iptables -t nat -N NETRA_OUTBOUND
+# $1 - iptables binary (iptables or ip6tables), $2 - loopback address
+function apply_rules {
+    local ipt=$1
+    local loopback=$2
 
-iptables -t nat -A PREROUTING \
-    -m statistic --mode random --probability ${NETRA_INBOUND_PROBABILITY} \
-    -j NETRA_INBOUND
+    ${ipt} -t nat -N NETRA_INBOUND
+    ${ipt} -t nat -N NETRA_OUTBOUND
 
-iptables -t nat -A OUTPUT \
-    -m statistic --mode random --probability ${NETRA_OUTBOUND_PROBABILITY} \
-    -j NETRA_OUTBOUND
+    ${ipt} -t nat -A PREROUTING \
+        -m statistic --mode random --probability ${NETRA_INBOUND_PROBABILITY} \
+        -j NETRA_INBOUND
 
-if [ "${INBOUND_INTERCEPT_PORTS}" == "*" ]; then
-    iptables -t nat -A NETRA_INBOUND -p tcp -m tcp -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
-else
-    for port in ${INBOUND_INTERCEPT_PORTS}; do
-        iptables -t nat -A NETRA_INBOUND -p tcp -m tcp --dport ${port} -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
-    done
-fi
+    ${ipt} -t nat -A OUTPUT \
+        -m statistic --mode random --probability ${NETRA_OUTBOUND_PROBABILITY} \
+        -j NETRA_OUTBOUND
+
+    if [ "${INBOUND_INTERCEPT_PORTS}" == "*" ]; then
+        ${ipt} -t nat -A NETRA_INBOUND -p tcp -m tcp -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
+    else
+        for port in ${INBOUND_INTERCEPT_PORTS}; do
+            ${ipt} -t nat -A NETRA_INBOUND -p tcp -m tcp --dport ${port} -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
+        done
+    fi
+
+    # avoid loops
+    ${ipt} -t nat -A NETRA_OUTBOUND -m owner --uid-owner ${NETRA_SIDECAR_USER_ID} -j RETURN
+    ${ipt} -t nat -A NETRA_OUTBOUND -m owner --gid-owner ${NETRA_SIDECAR_GROUP_ID} -j RETURN
+    ${ipt} -t nat -A NETRA_OUTBOUND -p tcp -o lo -d ${loopback} -j RETURN
+
+    if [ "${OUTBOUND_INTERCEPT_PORTS}" == "*" ]; then
+        ${ipt} -t nat -A NETRA_OUTBOUND -p tcp -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
+    else
+        for port in ${OUTBOUND_INTERCEPT_PORTS}; do
+            ${ipt} -t nat -A NETRA_OUTBOUND -p tcp --dport ${port} -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
+        done
+    fi
+}
+
+# $1 - iptables binary (iptables or ip6tables), $2 - ip family flag (-4 or -6), $3 - loopback address
+function apply_tproxy_rules {
+    local ipt=$1
+    local family=$2
+    local loopback=$3
+
+    # marked packets are delivered locally, so transparent sockets can accept them
+    ip ${family} rule add fwmark ${NETRA_TPROXY_MARK} lookup ${NETRA_TPROXY_ROUTE_TABLE}
+    ip ${family} route add local default dev lo table ${NETRA_TPROXY_ROUTE_TABLE}
 
-# avoid loops
-iptables -t nat -A NETRA_OUTBOUND -m owner --uid-owner ${NETRA_SIDECAR_USER_ID} -j RETURN
-iptables -t nat -A NETRA_OUTBOUND -m owner --gid-owner ${NETRA_SIDECAR_GROUP_ID} -j RETURN
-iptables -t nat -A NETRA_OUTBOUND -p tcp -o lo -d 127.0.0.1 -j RETURN
+    ${ipt} -t mangle -N NETRA_DIVERT
+    ${ipt} -t mangle -N NETRA_INBOUND
+    ${ipt} -t mangle -N NETRA_OUTBOUND
+
+    ${ipt} -t mangle -A NETRA_DIVERT -j MARK --set-mark ${NETRA_TPROXY_MARK}
+    ${ipt} -t mangle -A NETRA_DIVERT -j ACCEPT
+
+    # packets of connections already handled by netra transparent sockets
+    ${ipt} -t mangle -A PREROUTING -p tcp -m socket --transparent -j NETRA_DIVERT
+
+    # outbound packets rerouted to loopback by mark
+    ${ipt} -t mangle -A PREROUTING -p tcp -i lo -m mark --mark ${NETRA_TPROXY_MARK} \
+        -j TPROXY --on-port ${NETRA_SIDECAR_PORT} --tproxy-mark ${NETRA_TPROXY_MARK}
+
+    ${ipt} -t mangle -A PREROUTING ! -i lo \
+        -m statistic --mode random --probability ${NETRA_INBOUND_PROBABILITY} \
+        -j NETRA_INBOUND
+
+    if [ "${INBOUND_INTERCEPT_PORTS}" == "*" ]; then
+        ${ipt} -t mangle -A NETRA_INBOUND -p tcp -m tcp \
+            -j TPROXY --on-port ${NETRA_SIDECAR_PORT} --tproxy-mark ${NETRA_TPROXY_MARK}
+    else
+        for port in ${INBOUND_INTERCEPT_PORTS}; do
+            ${ipt} -t mangle -A NETRA_INBOUND -p tcp -m tcp --dport ${port} \
+                -j TPROXY --on-port ${NETRA_SIDECAR_PORT} --tproxy-mark ${NETRA_TPROXY_MARK}
+        done
+    fi
+
+    # netra connects to application using client source address,
+    # application replies to such connections should be routed back to netra
+    ${ipt} -t mangle -A OUTPUT -p tcp -o lo -m owner --uid-owner ${NETRA_SIDECAR_USER_ID} \
+        -j CONNMARK --set-mark ${NETRA_TPROXY_MARK}
+    ${ipt} -t mangle -A OUTPUT -p tcp -m connmark --mark ${NETRA_TPROXY_MARK} -j CONNMARK --restore-mark
+
+    ${ipt} -t mangle -A OUTPUT \
+        -m statistic --mode random --probability ${NETRA_OUTBOUND_PROBABILITY} \
+        -j NETRA_OUTBOUND
+
+    # avoid loops
+    ${ipt} -t mangle -A NETRA_OUTBOUND -m mark --mark ${NETRA_TPROXY_MARK} -j RETURN
+    ${ipt} -t mangle -A NETRA_OUTBOUND -m owner --uid-owner ${NETRA_SIDECAR_USER_ID} -j RETURN
+    ${ipt} -t mangle -A NETRA_OUTBOUND -m owner --gid-owner ${NETRA_SIDECAR_GROUP_ID} -j RETURN
+    ${ipt} -t mangle -A NETRA_OUTBOUND -p tcp -o lo -d ${loopback} -j RETURN
+    ${ipt} -t mangle -A NETRA_OUTBOUND -m conntrack --ctdir REPLY -j RETURN
+
+    if [ "${OUTBOUND_INTERCEPT_PORTS}" == "*" ]; then
+        ${ipt} -t mangle -A NETRA_OUTBOUND -p tcp -j MARK --set-mark ${NETRA_TPROXY_MARK}
+    else
+        for port in ${OUTBOUND_INTERCEPT_PORTS}; do
+            ${ipt} -t mangle -A NETRA_OUTBOUND -p tcp --dport ${port} -j MARK --set-mark ${NETRA_TPROXY_MARK}
+        done
+    fi
+}
 
-if [ "${OUTBOUND_INTERCEPT_PORTS}" == "*" ]; then
-    iptables -t nat -A NETRA_OUTBOUND -p tcp -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
+if [ "${NETRA_INTERCEPTION_MODE}" == "tproxy" ]; then
+    apply_tproxy_rules iptables -4 127.0.0.1
+    if [ "${NETRA_IPV6_ENABLED}" == "true" ]; then
+        apply_tproxy_rules ip6tables -6 ::1
+    fi
 else
-    for port in ${OUTBOUND_INTERCEPT_PORTS}; do
-        iptables -t nat -A NETRA_OUTBOUND -p tcp --dport ${port} -j REDIRECT --to-ports ${NETRA_SIDECAR_PORT}
-    done
+    apply_rules iptables 127.0.0.1
+    if [ "${NETRA_IPV6_ENABLED}" == "true" ]; then
+        apply_rules ip6tables ::1
+    fi
 fi
@@ -0,0 +1,131 @@
+// Package accesslog writes a line per proxied HTTP request/response pair.
+// Entries are formatted as JSON or with text/template and written to stdout
+// or to a file rotated by size.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// Entry describes completed HTTP request, field names are used by text template
+type Entry struct {
+	// Time is a time request was read from client
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	// RequestSize and ResponseSize are body sizes, they are -1 in case size is unknown (e.g. chunked body)
+	RequestSize  int64         `json:"request_size"`
+	ResponseSize int64         `json:"response_size"`
+	Duration     time.Duration `json:"-"`
+	RequestID    string        `json:"request_id"`
+	TraceID      string        `json:"trace_id,omitempty"`
+	// Source is X-Source header value of request
+	Source       string `json:"x_source"`
+	UpstreamAddr string `json:"upstream_addr"`
+}
+
+// jsonEntry writes duration as milliseconds
+type jsonEntry struct {
+	Entry
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// Logger writes access log entries, nil Logger discards them
+type Logger struct {
+	logger     *log.Logger
+	template   *template.Template
+	sampleRate float64
+
+	mu  sync.Mutex
+	out io.Writer
+	// file is nil in case entries are written to stdout
+	file *rotatingFile
+}
+
+// New creates access log of configuration, file output is opened immediately
+func New(logger *log.Logger, n config.NetraConfig) (*Logger, error) {
+	l := &Logger{
+		logger:     logger,
+		sampleRate: n.AccessLogSampleRate,
+		out:        os.Stdout,
+	}
+	if n.AccessLogFormat == config.AccessLogFormatText {
+		t, err := template.New("access_log").Parse(n.AccessLogTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %s", err.Error())
+		}
+		// unknown fields are reported only when template is executed
+		if err := t.Execute(ioutil.Discard, Entry{}); err != nil {
+			return nil, fmt.Errorf("access log: %s", err.Error())
+		}
+		l.template = t
+	}
+	if n.AccessLogOutput != config.AccessLogOutputStdout {
+		f, err := openRotatingFile(n.AccessLogOutput, int64(n.AccessLogMaxSizeMB)<<20, n.AccessLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %s", err.Error())
+		}
+		l.out = f
+		l.file = f
+	}
+	return l, nil
+}
+
+// Log writes entry in case it's sampled
+func (l *Logger) Log(e Entry) {
+	if l == nil {
+		return
+	}
+	if l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+	var buf bytes.Buffer
+	if l.template != nil {
+		if err := l.template.Execute(&buf, e); err != nil {
+			l.logger.Warningf("Access log entry formatting error: %s", err.Error())
+			return
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(jsonEntry{Entry: e, DurationMs: float64(e.Duration) / float64(time.Millisecond)}); err != nil {
+			l.logger.Warningf("Access log entry formatting error: %s", err.Error())
+			return
+		}
+	}
+
+	l.mu.Lock()
+	_, err := l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+	if err != nil {
+		l.logger.Warningf("Access log write error: %s", err.Error())
+	}
+}
+
+// Close closes access log file, entries written after it are lost
+func (l *Logger) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,119 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func newTestLogger(t *testing.T, modify func(n *config.NetraConfig)) (*Logger, string) {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := config.DefaultNetraConfig()
+	n.AccessLogOutput = tempLogPath(t)
+	modify(&n)
+	l, err := New(logger, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, n.AccessLogOutput
+}
+
+var testEntry = Entry{
+	Time:         time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	Direction:    "outbound",
+	Method:       "GET",
+	Host:         "api",
+	Path:         "/users/1",
+	Status:       200,
+	RequestSize:  0,
+	ResponseSize: -1,
+	Duration:     1500 * time.Microsecond,
+	RequestID:    "req-1",
+	Source:       "web",
+	UpstreamAddr: "10.0.0.1:80",
+}
+
+func TestLogText(t *testing.T) {
+	l, path := newTestLogger(t, func(n *config.NetraConfig) {
+		n.AccessLogFormat = config.AccessLogFormatText
+	})
+	l.Log(testEntry)
+	expectFile(t, path, "2020-01-02T03:04:05.000Z outbound GET api/users/1 200 0 -1 1.5ms request_id=req-1 trace_id= "+
+		"source=web upstream=10.0.0.1:80\n")
+}
+
+func TestLogTextCustomTemplate(t *testing.T) {
+	l, path := newTestLogger(t, func(n *config.NetraConfig) {
+		n.AccessLogFormat = config.AccessLogFormatText
+		// trailing newline isn't duplicated
+		n.AccessLogTemplate = "{{.Method}} {{.Status}}\n"
+	})
+	l.Log(testEntry)
+	expectFile(t, path, "GET 200\n")
+}
+
+func TestLogJSON(t *testing.T) {
+	l, path := newTestLogger(t, func(n *config.NetraConfig) {})
+	l.Log(testEntry)
+	expectFile(t, path, `{"time":"2020-01-02T03:04:05Z","direction":"outbound","method":"GET","host":"api",`+
+		`"path":"/users/1","status":200,"request_size":0,"response_size":-1,"request_id":"req-1",`+
+		`"x_source":"web","upstream_addr":"10.0.0.1:80","duration_ms":1.5}`+"\n")
+}
+
+func TestNewInvalidTemplate(t *testing.T) {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{.Method", "access log: template: access_log:1: unclosed action"},
+		// unknown fields are detected by executing template with empty entry
+		{"{{.Verb}}", "can't evaluate field Verb"},
+	}
+	for _, tt := range tests {
+		n := config.DefaultNetraConfig()
+		n.AccessLogFormat = config.AccessLogFormatText
+		n.AccessLogTemplate = tt.template
+		if _, err := New(logger, n); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.template, tt.expected, err)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	l, path := newTestLogger(t, func(n *config.NetraConfig) {
+		n.AccessLogSampleRate = 0.5
+	})
+	const entries = 1000
+	for i := 0; i < entries; i++ {
+		l.Log(testEntry)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// probability of sampling outside of the range is negligible
+	if written := strings.Count(string(data), "\n"); written < entries/4 || written > entries*3/4 {
+		t.Errorf("expected about %d of %d entries to be written, got %d", entries/2, entries, written)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.Log(testEntry)
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
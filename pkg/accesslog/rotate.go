@@ -0,0 +1,118 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile is a file which is renamed to <path>.1 when it reaches max size,
+// older backups are shifted to <path>.2 and so on, the oldest one is removed.
+// It isn't safe for concurrent use.
+type rotatingFile struct {
+	path string
+	// maxSize is in bytes, 0 disables rotation
+	maxSize    int64
+	maxBackups int
+	// file is nil after Close or in case it couldn't be reopened on rotation
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write rotates file before write in case write exceeds max size, entry is never split between files.
+// In case rotation fails entry is still written to original path and rotation is retried on next write.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if f.file == nil {
+		// previous rotation couldn't reopen the file
+		if rotateErr = f.open(); rotateErr != nil {
+			return 0, rotateErr
+		}
+	} else if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if rotateErr = f.rotate(); f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts backups and reopens file, original path is reopened even if backups couldn't be shifted
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err == nil {
+		err = f.shift()
+	}
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (f *rotatingFile) shift() error {
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.backup(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+func (f *rotatingFile) Close() error {
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,152 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempLogPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "access.log")
+}
+
+// expectFile checks file content, empty content means file must be absent
+func expectFile(t *testing.T, path string, content string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if content == "" {
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: expected file to be absent, got %q, %v", filepath.Base(path), data, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("%s: expected %q, got %q", filepath.Base(path), content, data)
+	}
+}
+
+func writeEntries(t *testing.T, f *rotatingFile, entries ...string) {
+	t.Helper()
+	for _, e := range entries {
+		n, err := f.Write([]byte(e))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(e) {
+			t.Fatalf("expected %d bytes written, got %d", len(e), n)
+		}
+	}
+}
+
+func TestRotatingFileShiftsBackups(t *testing.T) {
+	path := tempLogPath(t)
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// each entry exceeds max size together with the previous one, so it's never split between files
+	writeEntries(t, f, "first\n", "second\n", "third\n", "fourth\n")
+	expectFile(t, path, "fourth\n")
+	expectFile(t, path+".1", "third\n")
+	expectFile(t, path+".2", "second\n")
+	expectFile(t, path+".3", "")
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := tempLogPath(t)
+	f, err := openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeEntries(t, f, "first\n", "second\n")
+	expectFile(t, path, "second\n")
+	expectFile(t, path+".1", "")
+}
+
+func TestRotatingFileKeepsLargeEntry(t *testing.T) {
+	path := tempLogPath(t)
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// entry larger than max size is written whole to empty file instead of rotating it
+	writeEntries(t, f, "entry larger than max size\n", "next\n", "last\n")
+	expectFile(t, path+".1", "entry larger than max size\n")
+	expectFile(t, path, "next\nlast\n")
+}
+
+func TestRotatingFileShiftFailure(t *testing.T) {
+	path := tempLogPath(t)
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeEntries(t, f, "first\n")
+	// non-empty directory can't be replaced by backup
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	n, err := f.Write([]byte("second\n"))
+	if err == nil {
+		t.Error("expected rotation error")
+	}
+	if n != len("second\n") {
+		t.Errorf("expected entry to be written to original path, got %d bytes written", n)
+	}
+	expectFile(t, path, "first\nsecond\n")
+
+	// rotation is retried on next write
+	os.RemoveAll(path + ".1")
+	writeEntries(t, f, "third\n")
+	expectFile(t, path+".1", "first\nsecond\n")
+	expectFile(t, path, "third\n")
+}
+
+func TestRotatingFileReopenFailure(t *testing.T) {
+	path := tempLogPath(t)
+	f, err := openRotatingFile(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeEntries(t, f, "first\n")
+	// path replaced by directory can be neither removed nor reopened
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Write([]byte("second\n")); err == nil || n != 0 {
+		t.Errorf("expected write to fail, got %d bytes written, %v", n, err)
+	}
+
+	// file is reopened on next write
+	os.RemoveAll(path)
+	writeEntries(t, f, "third\n")
+	expectFile(t, path, "third\n")
+}
+
+func TestRotatingFileClosed(t *testing.T) {
+	f, err := openRotatingFile(tempLogPath(t), 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := f.Write([]byte("entry\n")); err != os.ErrClosed {
+		t.Errorf("expected %v, got %v", os.ErrClosed, err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package admin implements sidecar administration HTTP server.
+// It serves health and readiness probes, effective configuration, version,
+// runtime log level changes and draining trigger, other handlers (e.g. pprof and metrics)
+// can be mounted on it.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/proxy"
+)
+
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// Server is administration HTTP handler:
+//
+//	GET      /healthz  reports that process is alive
+//	GET      /ready    reports readiness checks, status is 503 in case any of them fails
+//	GET      /config   returns effective configuration in configuration file format with secrets masked
+//	GET      /version  returns netra and Go versions as JSON
+//	GET      /loglevel returns current log level
+//	PUT|POST /loglevel changes log level to level query parameter value
+//	GET|POST /drain    stops accepting connections and waits for active ones up to drain timeout,
+//	                   it's intended for Kubernetes preStop hook
+type Server struct {
+	logger  *log.Logger
+	version string
+	mux     *http.ServeMux
+
+	mu     sync.RWMutex
+	checks []readinessCheck
+	proxy  *proxy.Proxy
+}
+
+// New creates administration server, version is reported by /version
+func New(logger *log.Logger, version string) *Server {
+	s := &Server{
+		logger:  logger,
+		version: version,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/ready", s.handleReady)
+	s.mux.HandleFunc("/config", s.handleConfig)
+	s.mux.HandleFunc("/version", s.handleVersion)
+	s.mux.HandleFunc("/loglevel", s.handleLogLevel)
+	s.mux.HandleFunc("/drain", s.handleDrain)
+	return s
+}
+
+// Handle mounts additional handler, e.g. pprof or metrics
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// AddReadinessCheck registers check reported by /ready, check returns error while component isn't ready
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.mu.Lock()
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
+	s.mu.Unlock()
+}
+
+// SetProxy attaches started proxy. Until it's attached /ready reports listener isn't ready,
+// /config and /drain respond with 503.
+func (s *Server) SetProxy(p *proxy.Proxy) {
+	s.mu.Lock()
+	s.proxy = p
+	s.mu.Unlock()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) getProxy() *proxy.Proxy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proxy
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	s.mu.RLock()
+	checks := append([]readinessCheck{{name: "listener", check: s.proxyReady}}, s.checks...)
+	s.mu.RUnlock()
+
+	ready := true
+	lines := make([]string, 0, len(checks))
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			ready = false
+			lines = append(lines, fmt.Sprintf("%s: %s", c.name, err.Error()))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: ok", c.name))
+	}
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func (s *Server) proxyReady() error {
+	p := s.getProxy()
+	if p == nil {
+		return errors.New("proxy isn't started")
+	}
+	return p.Ready()
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	p := s.getProxy()
+	if p == nil {
+		http.Error(w, "proxy isn't started", http.StatusServiceUnavailable)
+		return
+	}
+	data, err := config.MarshalMasked(p.Config())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+	}{
+		Version:   s.version,
+		GoVersion: runtime.Version(),
+	})
+}
+
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		v := r.URL.Query().Get("level")
+		level, err := log.ParseLevel(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid level '%s'", v), http.StatusBadRequest)
+			return
+		}
+		if current := s.logger.Level(); current != level {
+			s.logger.SetLevel(level)
+			s.logger.Warningf("Log level is changed from %s to %s", current, level)
+		}
+	}
+	fmt.Fprintln(w, s.logger.Level())
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	// Kubernetes httpGet preStop hook uses GET
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	p := s.getProxy()
+	if p == nil {
+		http.Error(w, "proxy isn't started", http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Infof("Drain is requested from %s, draining %d active connections", r.RemoteAddr, p.ActiveConnections())
+	ctx, cancel := context.WithTimeout(r.Context(), p.Config().Netra.DrainTimeout)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		msg := fmt.Sprintf("drain timeout exceeded, %d active connections", p.ActiveConnections())
+		s.logger.Warning(msg)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Info("All connections are drained")
+	fmt.Fprintln(w, "drained")
+}
+
+// allowMethods responds with 405 and returns false in case request method isn't allowed
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+const (
+	defaultRequestIdHeaderName = "X-Request-Id"
+	defaultXSourceName         = "X-Source"
+	defaultRoutingHeaderName   = "X-Route"
+	defaultXSourceValue        = "netra"
+	defaultRoutingCookieName   = "X-Route"
+)
+
+// Statsd tag formats, empty format means tag values are embedded into dotted metric names
+const (
+	StatsdTagFormatDatadog  = "datadog"
+	StatsdTagFormatInfluxDB = "influxdb"
+)
+
+// Statsd metrics which names are configured with templates
+const (
+	StatsdInboundStatus   = "inbound_status"
+	StatsdOutboundStatus  = "outbound_status"
+	StatsdRequestDuration = "request_duration"
+	StatsdConnectionOpen  = "connection_open"
+	StatsdConnectionClose = "connection_close"
+	StatsdConnectionError = "connection_error"
+	StatsdGRPCStatus      = "grpc_status"
+)
+
+// DefaultStatsdTemplates returns default statsd metric name templates.
+// {name} segment is replaced with value or it's sent as tag in case tag format is set.
+func DefaultStatsdTemplates() map[string]string {
+	return map[string]string{
+		StatsdInboundStatus:   "inbound.{status}",
+		StatsdOutboundStatus:  "outbound.{host}.{status}",
+		StatsdRequestDuration: "{direction}.{host}.request_duration",
+		StatsdConnectionOpen:  "connection.{direction}.{protocol}.open",
+		StatsdConnectionClose: "connection.{direction}.{protocol}.close",
+		StatsdConnectionError: "connection.{direction}.{reason}.error",
+		StatsdGRPCStatus:      "{direction}.grpc.{service}.{method}.{code}",
+	}
+}
+
+// StatsdTemplateVars are placeholders allowed in templates of statsd metrics
+var StatsdTemplateVars = map[string][]string{
+	StatsdInboundStatus:   {"direction", "method", "host", "caller", "status", "status_class"},
+	StatsdOutboundStatus:  {"direction", "method", "host", "caller", "status", "status_class"},
+	StatsdRequestDuration: {"direction", "method", "host", "caller", "status", "status_class"},
+	StatsdConnectionOpen:  {"direction", "protocol"},
+	StatsdConnectionClose: {"direction", "protocol"},
+	StatsdConnectionError: {"direction", "reason"},
+	StatsdGRPCStatus:      {"direction", "host", "caller", "service", "method", "code"},
+}
+
+// Access log formats
+const (
+	AccessLogFormatJSON = "json"
+	AccessLogFormatText = "text"
+)
+
+// AccessLogOutputStdout writes access log to stdout, other outputs are file paths
+const AccessLogOutputStdout = "stdout"
+
+// DefaultAccessLogTemplate is a text/template of access log entry used by text format
+const DefaultAccessLogTemplate = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} {{.Direction}} {{.Method}} {{.Host}}{{.Path}} {{.Status}} ` +
+	`{{.RequestSize}} {{.ResponseSize}} {{.Duration}} request_id={{.RequestID}} trace_id={{.TraceID}} ` +
+	`source={{.Source}} upstream={{.UpstreamAddr}}`
+
+type InterceptionMode string
+
+const (
+	// InterceptionModeRedirect is used with iptables nat REDIRECT rules, original destination is retrieved with SO_ORIGINAL_DST
+	InterceptionModeRedirect InterceptionMode = "redirect"
+	// InterceptionModeTProxy is used with iptables mangle TPROXY rules, it preserves client source address
+	InterceptionModeTProxy InterceptionMode = "tproxy"
+)
+
+type NetraConfig struct {
+	Port                            uint16
+	PprofPort                       uint16
+	PrometheusPort                  uint16
+	AdminPort                       uint16
+	ServiceName                     string
+	TracingContextExpiration        time.Duration
+	TracingContextCleanupInterval   time.Duration
+	RoutingContextExpiration        time.Duration
+	RoutingContextCleanupInterval   time.Duration
+	LoggerLevel                     log.Level
+	HTTPProtoPorts                  map[string]struct{}
+	StatsdEnabled                   bool
+	StatsdAddress                   string
+	StatsdPrefix                    string
+	StatsdTagFormat                 string
+	StatsdTemplates                 map[string]string
+	IPv6Enabled                     bool
+	InterceptionMode                InterceptionMode
+	DrainTimeout                    time.Duration
+	DialTimeout                     time.Duration
+	IdleTimeout                     time.Duration
+	MaxConnectionLifetime           time.Duration
+	TCPProtoPorts                   map[string]struct{}
+	ProtocolSniffingEnabled         bool
+	ProtocolSniffingTimeout         time.Duration
+	ProtocolSniffingMaxBytes        int
+	ProtocolSniffingCacheExpiration time.Duration
+	// ProtocolMap maps destination port or ip:port to registered protocol name
+	ProtocolMap map[string]string
+	// TLSInspectionEnabled enables SNI and ALPN extraction from ClientHello of outbound TCP connections
+	TLSInspectionEnabled bool
+	// AdminHost is IP address admin server listens on, it's loopback by default
+	// because admin server allows draining and changing log level without authentication
+	AdminHost string
+	// ConfigReloadInterval is an interval of configuration file change checks, 0 disables them
+	ConfigReloadInterval time.Duration
+	// ProxyProtocolAcceptPorts are inbound ports where PROXY protocol v1/v2 header is parsed if it's present
+	ProxyProtocolAcceptPorts map[string]struct{}
+	// ProxyProtocolSendPorts are inbound ports where PROXY protocol v2 header is sent to application
+	ProxyProtocolSendPorts map[string]struct{}
+	ProxyProtocolTimeout   time.Duration
+	// MetricsHostAllowlist limits host label values of HTTP metrics, other hosts are reported as "other".
+	// Empty list allows any host.
+	MetricsHostAllowlist []string
+	// MetricsCallerAllowlist limits caller label values of HTTP metrics the same way
+	MetricsCallerAllowlist []string
+	// MetricsPathTemplates are path label values of HTTP metrics like /users/{id}, first matching one is used,
+	// unmatched paths are reported as "other"
+	MetricsPathTemplates []string
+	// MetricsGRPCServiceAllowlist limits service label values of gRPC metrics, other services are reported as "other"
+	// together with their methods. Empty list allows any service.
+	MetricsGRPCServiceAllowlist []string
+	AccessLogEnabled            bool
+	AccessLogFormat             string
+	// AccessLogTemplate is a text/template of entry used by text format
+	AccessLogTemplate string
+	// AccessLogOutput is either "stdout" or file path
+	AccessLogOutput string
+	// AccessLogMaxSizeMB is a size of access log file which triggers rotation, 0 disables rotation
+	AccessLogMaxSizeMB  int
+	AccessLogMaxBackups int
+	// AccessLogSampleRate is a fraction of requests written to access log, 1 writes all of them
+	AccessLogSampleRate float64
+	LoggerFormat        log.Format
+	// LoggerLevels override LoggerLevel for subsystems like transport or http
+	LoggerLevels map[string]log.Level
+	// LoggerWarningRateLimit is a number of warnings with the same message format written per second, 0 disables limiting
+	LoggerWarningRateLimit int
+	// MTLSEnabled turns on mutual TLS between sidecars, workload certificate and CA bundle are PEM files
+	MTLSEnabled  bool
+	MTLSCertFile string
+	MTLSKeyFile  string
+	MTLSCAFile   string
+	// MTLSReloadInterval is an interval of certificate files change checks
+	MTLSReloadInterval   time.Duration
+	MTLSHandshakeTimeout time.Duration
+	// MTLSInboundPorts are inbound ports where TLS of peer sidecars is terminated
+	MTLSInboundPorts map[string]struct{}
+	// MTLSPermissive accepts plaintext connections on inbound mTLS ports too, e.g. while clients are migrated
+	MTLSPermissive bool
+	// MTLSDestinations are outbound destinations served by sidecars: port, ip[:port] or cidr[:port]
+	MTLSDestinations []string
+	// MTLSAllowedPeers are peer identities allowed to connect to inbound mTLS ports and to be dialed as
+	// mTLS destinations, trailing * matches prefix. Empty list allows any peer with certificate issued by CA.
+	MTLSAllowedPeers []string
+}
+
+// DefaultNetraConfig returns netra config with default values
+func DefaultNetraConfig() NetraConfig {
+	return NetraConfig{
+		Port:                            14956,
+		PprofPort:                       14957,
+		PrometheusPort:                  14958,
+		AdminPort:                       14959,
+		AdminHost:                       "127.0.0.1",
+		TracingContextExpiration:        5 * time.Second,
+		TracingContextCleanupInterval:   1 * time.Second,
+		RoutingContextExpiration:        5 * time.Second,
+		RoutingContextCleanupInterval:   1 * time.Second,
+		LoggerLevel:                     log.InfoLevel,
+		HTTPProtoPorts:                  make(map[string]struct{}),
+		InterceptionMode:                InterceptionModeRedirect,
+		DrainTimeout:                    10 * time.Second,
+		DialTimeout:                     5 * time.Second,
+		TCPProtoPorts:                   make(map[string]struct{}),
+		ProtocolSniffingTimeout:         100 * time.Millisecond,
+		ProtocolSniffingMaxBytes:        64,
+		ProtocolSniffingCacheExpiration: time.Minute,
+		ProtocolMap:                     make(map[string]string),
+		StatsdTemplates:                 DefaultStatsdTemplates(),
+		ConfigReloadInterval:            5 * time.Second,
+		ProxyProtocolAcceptPorts:        make(map[string]struct{}),
+		ProxyProtocolSendPorts:          make(map[string]struct{}),
+		ProxyProtocolTimeout:            time.Second,
+		AccessLogFormat:                 AccessLogFormatJSON,
+		AccessLogTemplate:               DefaultAccessLogTemplate,
+		AccessLogOutput:                 AccessLogOutputStdout,
+		AccessLogMaxSizeMB:              100,
+		AccessLogMaxBackups:             3,
+		AccessLogSampleRate:             1,
+		LoggerLevels:                    make(map[string]log.Level),
+		LoggerWarningRateLimit:          log.DefaultWarningRateLimit,
+		MTLSReloadInterval:              10 * time.Second,
+		MTLSHandshakeTimeout:            3 * time.Second,
+		MTLSInboundPorts:                make(map[string]struct{}),
+	}
+}
+
+type HTTPConfig struct {
+	HeadersMap           map[string]string
+	CookiesMap           map[string]string
+	RequestIdHeaderName  string
+	XSourceHeaderName    string
+	XSourceValue         string
+	RoutingEnabled       bool
+	RoutingHeaderName    string
+	RoutingCookieEnabled bool
+	RoutingCookieName    string
+	TracingIgnoredPaths  map[string]bool
+	// TLSOrigination rules make outbound HTTP handler open TLS connections to upstream
+	// for plaintext requests to matching hosts
+	TLSOrigination []TLSOriginationRule
+}
+
+// DefaultTLSOriginationPort is upstream port of TLS origination rules without port
+const DefaultTLSOriginationPort = 443
+
+// TLSOriginationRule describes TLS connection opened to upstream for plaintext requests to host
+type TLSOriginationRule struct {
+	// Host matches request host exactly or by suffix in case it starts with "*."
+	Host string
+	// Port is upstream TLS port, upstream IP is the same as original destination one
+	Port uint16
+	// ServerName is sent as SNI and verified in server certificate, request host is used by default
+	ServerName string
+	// CAFile is PEM bundle verifying server certificate, system roots are used by default
+	CAFile string
+	// CertFile and KeyFile are optional client certificate and its key
+	CertFile string
+	KeyFile  string
+}
+
+// DefaultHTTPConfig returns HTTP config with default values
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		HeadersMap:           map[string]string{},
+		CookiesMap:           map[string]string{},
+		RequestIdHeaderName:  defaultRequestIdHeaderName,
+		XSourceHeaderName:    defaultXSourceName,
+		XSourceValue:         defaultXSourceValue,
+		RoutingEnabled:       false,
+		RoutingHeaderName:    defaultRoutingHeaderName,
+		RoutingCookieEnabled: false,
+		RoutingCookieName:    defaultRoutingCookieName,
+		TracingIgnoredPaths:  map[string]bool{},
+	}
+}
+
+// Config is a complete netra configuration
+type Config struct {
+	Netra NetraConfig
+	HTTP  HTTPConfig
+}
+
+// Default returns configuration with default values
+func Default() *Config {
+	return &Config{
+		Netra: DefaultNetraConfig(),
+		HTTP:  DefaultHTTPConfig(),
+	}
+}
+
+// Holder keeps configuration snapshot shared by proxy components
+type Holder struct {
+	v atomic.Value
+}
+
+// NewHolder creates holder with initial configuration
+func NewHolder(cfg *Config) *Holder {
+	h := &Holder{}
+	h.v.Store(cfg)
+	return h
+}
+
+// Set atomically replaces configuration snapshot, components see the new one on next Get
+func (h *Holder) Set(cfg *Config) {
+	h.v.Store(cfg)
+}
+
+// Get returns current configuration snapshot, it must not be modified
+func (h *Holder) Get() *Config {
+	return h.v.Load().(*Config)
+}
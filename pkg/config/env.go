@@ -0,0 +1,388 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+const (
+	envNetraPort                            = "NETRA_PORT"
+	envNetraLoggerFormat                    = "NETRA_LOGGER_FORMAT"
+	envNetraLoggerLevels                    = "NETRA_LOGGER_LEVELS"
+	envNetraLoggerWarningRateLimit          = "NETRA_LOGGER_WARNING_RATE_LIMIT"
+	envNetraPprofPort                       = "NETRA_PPROF_PORT"
+	envNetraPrometheusPort                  = "NETRA_PROMETHEUS_PORT"
+	envNetraAdminPort                       = "NETRA_ADMIN_PORT"
+	envNetraAdminHost                       = "NETRA_ADMIN_HOST"
+	envNetraTracingContextExpiration        = "NETRA_TRACING_CONTEXT_EXPIRATION_MILLISECONDS"
+	envNetraTracingContextCleanupInterval   = "NETRA_TRACING_CONTEXT_CLEANUP_INTERVAL"
+	envNetraRoutingContextExpiration        = "NETRA_ROUTING_CONTEXT_EXPIRATION_MILLISECONDS"
+	envNetraRoutingContextCleanupInterval   = "NETRA_ROUTING_CONTEXT_CLEANUP_INTERVAL"
+	envNetraHTTPPorts                       = "NETRA_HTTP_PORTS"
+	envNetraStatsdEnabled                   = "NETRA_STATSD_ENABLED"
+	envNetraStatsdAddress                   = "NETRA_STATSD_ADDRESS"
+	envNetraStatsdPrefix                    = "NETRA_STATSD_PREFIX"
+	envNetraStatsdTagFormat                 = "NETRA_STATSD_TAG_FORMAT"
+	envNetraStatsdTemplates                 = "NETRA_STATSD_TEMPLATES"
+	envNetraIPv6Enabled                     = "NETRA_IPV6_ENABLED"
+	envNetraInterceptionMode                = "NETRA_INTERCEPTION_MODE"
+	envNetraDrainTimeout                    = "NETRA_DRAIN_TIMEOUT_MILLISECONDS"
+	envNetraDialTimeout                     = "NETRA_DIAL_TIMEOUT_MILLISECONDS"
+	envNetraIdleTimeout                     = "NETRA_IDLE_TIMEOUT_MILLISECONDS"
+	envNetraMaxConnectionLifetime           = "NETRA_MAX_CONNECTION_LIFETIME_MILLISECONDS"
+	envNetraTCPPorts                        = "NETRA_TCP_PORTS"
+	envNetraProtocolSniffingEnabled         = "NETRA_PROTOCOL_SNIFFING_ENABLED"
+	envNetraProtocolSniffingTimeout         = "NETRA_PROTOCOL_SNIFFING_TIMEOUT_MILLISECONDS"
+	envNetraProtocolSniffingMaxBytes        = "NETRA_PROTOCOL_SNIFFING_MAX_BYTES"
+	envNetraProtocolSniffingCacheExpiration = "NETRA_PROTOCOL_SNIFFING_CACHE_EXPIRATION_MILLISECONDS"
+	envNetraProtocolMap                     = "NETRA_PROTOCOL_MAP"
+	envNetraTLSInspectionEnabled            = "NETRA_TLS_INSPECTION_ENABLED"
+	envHttpHeaderTagMap                     = "HTTP_HEADER_TAG_MAP"
+	envHttpCookieTagMap                     = "HTTP_COOKIE_TAG_MAP"
+	envHttpRequestIdHeaderName              = "NETRA_HTTP_REQUEST_ID_HEADER_NAME"
+	envHttpXSourceHeaderName                = "NETRA_HTTP_X_SOURCE_HEADER_NAME"
+	envHTTPXSourceValue                     = "NETRA_HTTP_X_SOURCE_VALUE"
+	envHTTPRoutingEnabled                   = "NETRA_HTTP_ROUTING_ENABLED"
+	envHTTPRoutingHeader                    = "NETRA_HTTP_ROUTING_HEADER_NAME"
+	envHTTPRoutingCookieEnabled             = "NETRA_HTTP_ROUTING_COOKIE_ENABLED"
+	envHTTPRoutingCookieName                = "NETRA_HTTP_ROUTING_COOKIE_NAME"
+	envHTTPTracingIgnoredPaths              = "NETRA_HTTP_TRACING_IGNORED_PATHS"
+	envHTTPTLSOrigination                   = "NETRA_HTTP_TLS_ORIGINATION"
+	envNetraConfigReloadInterval            = "NETRA_CONFIG_RELOAD_INTERVAL_MILLISECONDS"
+	envNetraProxyProtocolAcceptPorts        = "NETRA_PROXY_PROTOCOL_ACCEPT_PORTS"
+	envNetraProxyProtocolSendPorts          = "NETRA_PROXY_PROTOCOL_SEND_PORTS"
+	envNetraProxyProtocolTimeout            = "NETRA_PROXY_PROTOCOL_TIMEOUT_MILLISECONDS"
+	envNetraMetricsHostAllowlist            = "NETRA_METRICS_HOST_ALLOWLIST"
+	envNetraMetricsCallerAllowlist          = "NETRA_METRICS_CALLER_ALLOWLIST"
+	envNetraMetricsPathTemplates            = "NETRA_METRICS_PATH_TEMPLATES"
+	envNetraMetricsGRPCServiceAllowlist     = "NETRA_METRICS_GRPC_SERVICE_ALLOWLIST"
+	envNetraAccessLogEnabled                = "NETRA_ACCESS_LOG_ENABLED"
+	envNetraAccessLogFormat                 = "NETRA_ACCESS_LOG_FORMAT"
+	envNetraAccessLogTemplate               = "NETRA_ACCESS_LOG_TEMPLATE"
+	envNetraAccessLogOutput                 = "NETRA_ACCESS_LOG_OUTPUT"
+	envNetraAccessLogMaxSizeMB              = "NETRA_ACCESS_LOG_MAX_SIZE_MB"
+	envNetraAccessLogMaxBackups             = "NETRA_ACCESS_LOG_MAX_BACKUPS"
+	envNetraAccessLogSampleRate             = "NETRA_ACCESS_LOG_SAMPLE_RATE"
+	envNetraMTLSEnabled                     = "NETRA_MTLS_ENABLED"
+	envNetraMTLSCertFile                    = "NETRA_MTLS_CERT_FILE"
+	envNetraMTLSKeyFile                     = "NETRA_MTLS_KEY_FILE"
+	envNetraMTLSCAFile                      = "NETRA_MTLS_CA_FILE"
+	envNetraMTLSReloadInterval              = "NETRA_MTLS_RELOAD_INTERVAL_MILLISECONDS"
+	envNetraMTLSHandshakeTimeout            = "NETRA_MTLS_HANDSHAKE_TIMEOUT_MILLISECONDS"
+	envNetraMTLSInboundPorts                = "NETRA_MTLS_INBOUND_PORTS"
+	envNetraMTLSPermissive                  = "NETRA_MTLS_PERMISSIVE"
+	envNetraMTLSDestinations                = "NETRA_MTLS_DESTINATIONS"
+	envNetraMTLSAllowedPeers                = "NETRA_MTLS_ALLOWED_PEERS"
+
+	// EnvConfigFile is a path of configuration file, environment variables override its values
+	EnvConfigFile = "NETRA_CONFIG_FILE"
+)
+
+// FromENV returns default configuration overridden by environment variables
+func FromENV(logger *log.Logger) (*Config, error) {
+	cfg := Default()
+	if err := ApplyENV(cfg, logger); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyENV overrides cfg values with environment variables which are set
+func ApplyENV(cfg *Config, logger *log.Logger) error {
+	if v := os.Getenv(envHttpHeaderTagMap); v != "" {
+		m, err := parseTagMap(envHttpHeaderTagMap, v)
+		if err != nil {
+			return err
+		}
+		for header, tag := range m {
+			cfg.HTTP.HeadersMap[header] = tag
+			logger.Infof("loaded header to tag mapping: %s => %s", header, tag)
+		}
+	}
+	if v := os.Getenv(envHttpCookieTagMap); v != "" {
+		m, err := parseTagMap(envHttpCookieTagMap, v)
+		if err != nil {
+			return err
+		}
+		for cookie, tag := range m {
+			cfg.HTTP.CookiesMap[cookie] = tag
+			logger.Infof("loaded cookie to tag mapping: %s => %s", cookie, tag)
+		}
+	}
+	if v := os.Getenv(log.EnvNetraLoggerLevel); v != "" {
+		level, err := log.ParseLevel(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", log.EnvNetraLoggerLevel, err.Error())
+		}
+		cfg.Netra.LoggerLevel = level
+	}
+	if v := os.Getenv(envNetraLoggerFormat); v != "" {
+		format, err := log.ParseFormat(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s", envNetraLoggerFormat, err.Error())
+		}
+		cfg.Netra.LoggerFormat = format
+	}
+	if v := os.Getenv(envNetraLoggerLevels); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) < 2 || kv[0] == "" {
+				return fmt.Errorf("%s: malformed level '%s', expected <subsystem>=<level>", envNetraLoggerLevels, pair)
+			}
+			level, err := log.ParseLevel(kv[1])
+			if err != nil {
+				return fmt.Errorf("%s: %s", envNetraLoggerLevels, err.Error())
+			}
+			cfg.Netra.LoggerLevels[kv[0]] = level
+		}
+	}
+
+	ports := []struct {
+		env string
+		dst *uint16
+	}{
+		{envNetraPort, &cfg.Netra.Port},
+		{envNetraPprofPort, &cfg.Netra.PprofPort},
+		{envNetraPrometheusPort, &cfg.Netra.PrometheusPort},
+		{envNetraAdminPort, &cfg.Netra.AdminPort},
+	}
+	for _, p := range ports {
+		if v := os.Getenv(p.env); v != "" {
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return fmt.Errorf("%s: invalid port '%s'", p.env, v)
+			}
+			*p.dst = uint16(port)
+		}
+	}
+
+	durations := []struct {
+		env string
+		dst *time.Duration
+	}{
+		{envNetraTracingContextExpiration, &cfg.Netra.TracingContextExpiration},
+		{envNetraTracingContextCleanupInterval, &cfg.Netra.TracingContextCleanupInterval},
+		{envNetraRoutingContextExpiration, &cfg.Netra.RoutingContextExpiration},
+		{envNetraRoutingContextCleanupInterval, &cfg.Netra.RoutingContextCleanupInterval},
+		{envNetraDrainTimeout, &cfg.Netra.DrainTimeout},
+		{envNetraDialTimeout, &cfg.Netra.DialTimeout},
+		{envNetraIdleTimeout, &cfg.Netra.IdleTimeout},
+		{envNetraMaxConnectionLifetime, &cfg.Netra.MaxConnectionLifetime},
+		{envNetraProtocolSniffingTimeout, &cfg.Netra.ProtocolSniffingTimeout},
+		{envNetraProtocolSniffingCacheExpiration, &cfg.Netra.ProtocolSniffingCacheExpiration},
+		{envNetraConfigReloadInterval, &cfg.Netra.ConfigReloadInterval},
+		{envNetraProxyProtocolTimeout, &cfg.Netra.ProxyProtocolTimeout},
+		{envNetraMTLSReloadInterval, &cfg.Netra.MTLSReloadInterval},
+		{envNetraMTLSHandshakeTimeout, &cfg.Netra.MTLSHandshakeTimeout},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.env); v != "" {
+			ms, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number of milliseconds '%s'", d.env, v)
+			}
+			*d.dst = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	flags := []struct {
+		env string
+		dst *bool
+	}{
+		{envHTTPRoutingEnabled, &cfg.HTTP.RoutingEnabled},
+		{envHTTPRoutingCookieEnabled, &cfg.HTTP.RoutingCookieEnabled},
+		{envNetraStatsdEnabled, &cfg.Netra.StatsdEnabled},
+		{envNetraIPv6Enabled, &cfg.Netra.IPv6Enabled},
+		{envNetraProtocolSniffingEnabled, &cfg.Netra.ProtocolSniffingEnabled},
+		{envNetraTLSInspectionEnabled, &cfg.Netra.TLSInspectionEnabled},
+		{envNetraAccessLogEnabled, &cfg.Netra.AccessLogEnabled},
+		{envNetraMTLSEnabled, &cfg.Netra.MTLSEnabled},
+		{envNetraMTLSPermissive, &cfg.Netra.MTLSPermissive},
+	}
+	for _, f := range flags {
+		if v := os.Getenv(f.env); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid boolean '%s'", f.env, v)
+			}
+			*f.dst = enabled
+		}
+	}
+
+	values := []struct {
+		env string
+		dst *string
+	}{
+		{envHttpRequestIdHeaderName, &cfg.HTTP.RequestIdHeaderName},
+		{envHttpXSourceHeaderName, &cfg.HTTP.XSourceHeaderName},
+		{envHTTPXSourceValue, &cfg.HTTP.XSourceValue},
+		{envHTTPRoutingHeader, &cfg.HTTP.RoutingHeaderName},
+		{envHTTPRoutingCookieName, &cfg.HTTP.RoutingCookieName},
+		{envNetraAdminHost, &cfg.Netra.AdminHost},
+		{envNetraStatsdAddress, &cfg.Netra.StatsdAddress},
+		{envNetraStatsdPrefix, &cfg.Netra.StatsdPrefix},
+		{envNetraStatsdTagFormat, &cfg.Netra.StatsdTagFormat},
+		{envNetraAccessLogFormat, &cfg.Netra.AccessLogFormat},
+		{envNetraAccessLogTemplate, &cfg.Netra.AccessLogTemplate},
+		{envNetraAccessLogOutput, &cfg.Netra.AccessLogOutput},
+		{envNetraMTLSCertFile, &cfg.Netra.MTLSCertFile},
+		{envNetraMTLSKeyFile, &cfg.Netra.MTLSKeyFile},
+		{envNetraMTLSCAFile, &cfg.Netra.MTLSCAFile},
+	}
+	for _, val := range values {
+		if v := os.Getenv(val.env); v != "" {
+			*val.dst = v
+		}
+	}
+
+	lists := []struct {
+		env string
+		dst *[]string
+	}{
+		{envNetraMetricsHostAllowlist, &cfg.Netra.MetricsHostAllowlist},
+		{envNetraMetricsCallerAllowlist, &cfg.Netra.MetricsCallerAllowlist},
+		{envNetraMetricsPathTemplates, &cfg.Netra.MetricsPathTemplates},
+		{envNetraMetricsGRPCServiceAllowlist, &cfg.Netra.MetricsGRPCServiceAllowlist},
+		{envNetraMTLSDestinations, &cfg.Netra.MTLSDestinations},
+		{envNetraMTLSAllowedPeers, &cfg.Netra.MTLSAllowedPeers},
+	}
+	for _, l := range lists {
+		if v := os.Getenv(l.env); v != "" {
+			*l.dst = strings.Split(v, ",")
+		}
+	}
+
+	portSets := []struct {
+		env string
+		dst *map[string]struct{}
+	}{
+		{envNetraHTTPPorts, &cfg.Netra.HTTPProtoPorts},
+		{envNetraTCPPorts, &cfg.Netra.TCPProtoPorts},
+		{envNetraProxyProtocolAcceptPorts, &cfg.Netra.ProxyProtocolAcceptPorts},
+		{envNetraProxyProtocolSendPorts, &cfg.Netra.ProxyProtocolSendPorts},
+		{envNetraMTLSInboundPorts, &cfg.Netra.MTLSInboundPorts},
+	}
+	for _, ps := range portSets {
+		if v := os.Getenv(ps.env); v != "" {
+			if err := parsePorts(ps.env, v, ps.dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	if v := os.Getenv(envHTTPTracingIgnoredPaths); v != "" {
+		paths := strings.Split(v, ",")
+		for _, path := range paths {
+			cfg.HTTP.TracingIgnoredPaths[path] = true
+			logger.Infof("loaded ignored path: %s", path)
+		}
+	}
+
+	if v := os.Getenv(envHTTPTLSOrigination); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			rule := TLSOriginationRule{Host: kv[0], Port: DefaultTLSOriginationPort}
+			if len(kv) == 2 {
+				port, err := strconv.ParseUint(kv[1], 10, 16)
+				if err != nil || port == 0 {
+					return fmt.Errorf("%s: malformed rule '%s', expected <host>[=<port>]", envHTTPTLSOrigination, pair)
+				}
+				rule.Port = uint16(port)
+			}
+			cfg.HTTP.TLSOrigination = append(cfg.HTTP.TLSOrigination, rule)
+			logger.Infof("loaded TLS origination rule: %s => %d", rule.Host, rule.Port)
+		}
+	}
+
+	if v := os.Getenv(envNetraInterceptionMode); v != "" {
+		cfg.Netra.InterceptionMode = InterceptionMode(strings.ToLower(v))
+	}
+
+	numbers := []struct {
+		env string
+		dst *int
+	}{
+		{envNetraProtocolSniffingMaxBytes, &cfg.Netra.ProtocolSniffingMaxBytes},
+		{envNetraLoggerWarningRateLimit, &cfg.Netra.LoggerWarningRateLimit},
+		{envNetraAccessLogMaxSizeMB, &cfg.Netra.AccessLogMaxSizeMB},
+		{envNetraAccessLogMaxBackups, &cfg.Netra.AccessLogMaxBackups},
+	}
+	for _, num := range numbers {
+		if v := os.Getenv(num.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number '%s'", num.env, v)
+			}
+			*num.dst = n
+		}
+	}
+
+	if v := os.Getenv(envNetraAccessLogSampleRate); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid rate '%s'", envNetraAccessLogSampleRate, v)
+		}
+		cfg.Netra.AccessLogSampleRate = rate
+	}
+
+	if v := os.Getenv(envNetraProtocolMap); v != "" {
+		pairs := strings.Split(v, ",")
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) < 2 || kv[1] == "" {
+				return fmt.Errorf("%s: malformed protocol mapping '%s', expected <port|ip:port>=<protocol>", envNetraProtocolMap, pair)
+			}
+			cfg.Netra.ProtocolMap[kv[0]] = kv[1]
+			logger.Infof("loaded protocol mapping: %s => %s", kv[0], kv[1])
+		}
+	}
+
+	if v := os.Getenv(envNetraStatsdTemplates); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) < 2 || kv[0] == "" || kv[1] == "" {
+				return fmt.Errorf("%s: malformed template '%s', expected <metric>=<template>", envNetraStatsdTemplates, pair)
+			}
+			cfg.Netra.StatsdTemplates[kv[0]] = kv[1]
+		}
+	}
+
+	return nil
+}
+
+// parseTagMap parses comma separated name:tag pairs
+func parseTagMap(env string, v string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) < 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%s: malformed mapping '%s', expected <name>:<tag>", env, pair)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// parsePorts adds comma separated ports to set, ports are stored in canonical form
+// to match ports of destination addresses (e.g. " 080" is stored as "80"). Set is allocated in case it's nil.
+func parsePorts(env string, v string, ports *map[string]struct{}) error {
+	if *ports == nil {
+		*ports = make(map[string]struct{})
+	}
+	for _, port := range strings.Split(v, ",") {
+		p, err := strconv.ParseUint(strings.TrimSpace(port), 10, 16)
+		if err != nil {
+			return fmt.Errorf("%s: invalid port '%s'", env, port)
+		}
+		(*ports)[strconv.FormatUint(p, 10)] = struct{}{}
+	}
+	return nil
+}
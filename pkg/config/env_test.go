@@ -0,0 +1,84 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestApplyENVOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "netra.yaml", fullConfigFile)
+	tests := []struct {
+		env      string
+		value    string
+		field    func(cfg *Config) interface{}
+		expected interface{}
+	}{
+		{envNetraPort, "16000", func(cfg *Config) interface{} { return cfg.Netra.Port }, uint16(16000)},
+		{envNetraAdminHost, "127.0.0.2", func(cfg *Config) interface{} { return cfg.Netra.AdminHost }, "127.0.0.2"},
+		{envNetraDialTimeout, "250", func(cfg *Config) interface{} { return cfg.Netra.DialTimeout }, 250 * time.Millisecond},
+		{envHTTPRoutingCookieEnabled, "0", func(cfg *Config) interface{} { return cfg.HTTP.RoutingCookieEnabled }, false},
+		{envNetraMTLSPermissive, "FALSE", func(cfg *Config) interface{} { return cfg.Netra.MTLSPermissive }, false},
+		{envNetraStatsdPrefix, "mesh", func(cfg *Config) interface{} { return cfg.Netra.StatsdPrefix }, "mesh"},
+		{envNetraMetricsHostAllowlist, "a,b", func(cfg *Config) interface{} { return cfg.Netra.MetricsHostAllowlist }, []string{"a", "b"}},
+		{envNetraHTTPPorts, "8081", func(cfg *Config) interface{} { return cfg.Netra.HTTPProtoPorts }, portSet([]uint16{8080, 8081})},
+		{envNetraMTLSInboundPorts, "9001", func(cfg *Config) interface{} { return cfg.Netra.MTLSInboundPorts }, portSet([]uint16{9000, 9001})},
+		{envHttpHeaderTagMap, "X-Tenant:client", func(cfg *Config) interface{} { return cfg.HTTP.HeadersMap }, map[string]string{"X-Tenant": "client"}},
+		{envNetraProtocolMap, "5672=amqp", func(cfg *Config) interface{} { return cfg.Netra.ProtocolMap }, map[string]string{"6379": "redis", "5672": "amqp"}},
+		{envNetraInterceptionMode, "REDIRECT", func(cfg *Config) interface{} { return cfg.Netra.InterceptionMode }, InterceptionModeRedirect},
+		{envNetraAccessLogMaxBackups, "5", func(cfg *Config) interface{} { return cfg.Netra.AccessLogMaxBackups }, 5},
+		{envNetraAccessLogSampleRate, "0.25", func(cfg *Config) interface{} { return cfg.Netra.AccessLogSampleRate }, 0.25},
+		{envNetraLoggerLevels, "http=info,tcp=warn", func(cfg *Config) interface{} { return cfg.Netra.LoggerLevels },
+			map[string]log.Level{"http": log.InfoLevel, "tcp": log.WarnLevel}},
+		{envNetraStatsdTemplates, "inbound_status=inbound.{status_class}", func(cfg *Config) interface{} {
+			return cfg.Netra.StatsdTemplates[StatsdInboundStatus]
+		}, "inbound.{status_class}"},
+		{envHTTPTLSOrigination, "internal.example.com=8443", func(cfg *Config) interface{} { return len(cfg.HTTP.TLSOrigination) }, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			setenv(t, tt.env, tt.value)
+			cfg, err := Load(path, testLogger(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value := tt.field(cfg); !reflect.DeepEqual(value, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestApplyENVMalformed(t *testing.T) {
+	tests := []struct {
+		env      string
+		value    string
+		expected string
+	}{
+		{envNetraPort, "http", "NETRA_PORT: invalid port 'http'"},
+		{envNetraDialTimeout, "5s", "NETRA_DIAL_TIMEOUT_MILLISECONDS: invalid number of milliseconds '5s'"},
+		{envNetraStatsdEnabled, "on", "NETRA_STATSD_ENABLED: invalid boolean 'on'"},
+		{envNetraTCPPorts, "5432,redis", "NETRA_TCP_PORTS: invalid port 'redis'"},
+		{envHttpHeaderTagMap, "X-Tenant", "HTTP_HEADER_TAG_MAP: malformed mapping 'X-Tenant', expected <name>:<tag>"},
+		{envHttpCookieTagMap, "session:", "HTTP_COOKIE_TAG_MAP: malformed mapping 'session:', expected <name>:<tag>"},
+		{envNetraProtocolMap, "5672", "NETRA_PROTOCOL_MAP: malformed protocol mapping '5672', expected <port|ip:port>=<protocol>"},
+		{envNetraStatsdTemplates, "=a.b", "NETRA_STATSD_TEMPLATES: malformed template '=a.b', expected <metric>=<template>"},
+		{envNetraLoggerLevels, "debug", "NETRA_LOGGER_LEVELS: malformed level 'debug', expected <subsystem>=<level>"},
+		{envNetraLoggerLevels, "http=loud", "NETRA_LOGGER_LEVELS: invalid logger level loud"},
+		{envNetraLoggerFormat, "xml", "NETRA_LOGGER_FORMAT: invalid logger format xml"},
+		{envHTTPTLSOrigination, "api.example.com=https", "NETRA_HTTP_TLS_ORIGINATION: malformed rule 'api.example.com=https', expected <host>[=<port>]"},
+		{envNetraAccessLogMaxSizeMB, "1GB", "NETRA_ACCESS_LOG_MAX_SIZE_MB: invalid number '1GB'"},
+		{envNetraAccessLogSampleRate, "half", "NETRA_ACCESS_LOG_SAMPLE_RATE: invalid rate 'half'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			setenv(t, tt.env, tt.value)
+			err := ApplyENV(Default(), testLogger(t))
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("expected error %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
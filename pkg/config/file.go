@@ -0,0 +1,457 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// fileConfig is a configuration file schema.
+// JSON documents are valid YAML, so the same schema is used for both formats.
+// Durations are written as strings like "300ms" or "1.5s".
+type fileConfig struct {
+	ServiceName      string            `yaml:"service_name"`
+	LogLevel         string            `yaml:"log_level"`
+	LogFormat        string            `yaml:"log_format"`
+	LogLevels        map[string]string `yaml:"log_levels"`
+	LogRateLimit     int               `yaml:"log_warning_rate_limit"`
+	Port             uint16            `yaml:"port"`
+	PprofPort        uint16            `yaml:"pprof_port"`
+	PrometheusPort   uint16            `yaml:"prometheus_port"`
+	AdminPort        uint16            `yaml:"admin_port"`
+	AdminHost        string            `yaml:"admin_host"`
+	IPv6Enabled      bool              `yaml:"ipv6_enabled"`
+	InterceptionMode InterceptionMode  `yaml:"interception_mode"`
+	DrainTimeout     string            `yaml:"drain_timeout"`
+	ReloadInterval   string            `yaml:"config_reload_interval"`
+	Timeouts         fileTimeouts      `yaml:"timeouts"`
+	TracingContext   fileContextCache  `yaml:"tracing_context"`
+	RoutingContext   fileContextCache  `yaml:"routing_context"`
+	Statsd           fileStatsd        `yaml:"statsd"`
+	Protocols        fileProtocols     `yaml:"protocols"`
+	ProxyProtocol    fileProxyProtocol `yaml:"proxy_protocol"`
+	Metrics          fileMetrics       `yaml:"metrics"`
+	AccessLog        fileAccessLog     `yaml:"access_log"`
+	MTLS             fileMTLS          `yaml:"mtls"`
+	HTTP             fileHTTP          `yaml:"http"`
+}
+
+type fileTimeouts struct {
+	Dial                  string `yaml:"dial"`
+	Idle                  string `yaml:"idle"`
+	MaxConnectionLifetime string `yaml:"max_connection_lifetime"`
+}
+
+type fileContextCache struct {
+	Expiration      string `yaml:"expiration"`
+	CleanupInterval string `yaml:"cleanup_interval"`
+}
+
+type fileStatsd struct {
+	Enabled   bool              `yaml:"enabled"`
+	Address   string            `yaml:"address"`
+	Prefix    string            `yaml:"prefix"`
+	TagFormat string            `yaml:"tag_format"`
+	Templates map[string]string `yaml:"templates"`
+}
+
+type fileProtocols struct {
+	HTTPPorts []uint16          `yaml:"http_ports"`
+	TCPPorts  []uint16          `yaml:"tcp_ports"`
+	Map       map[string]string `yaml:"map"`
+	Sniffing  fileSniffing      `yaml:"sniffing"`
+	// TLSInspection enables SNI and ALPN extraction from ClientHello of outbound TCP connections
+	TLSInspection bool `yaml:"tls_inspection"`
+}
+
+type fileSniffing struct {
+	Enabled         bool   `yaml:"enabled"`
+	Timeout         string `yaml:"timeout"`
+	MaxBytes        int    `yaml:"max_bytes"`
+	CacheExpiration string `yaml:"cache_expiration"`
+}
+
+type fileProxyProtocol struct {
+	AcceptPorts []uint16 `yaml:"accept_ports"`
+	SendPorts   []uint16 `yaml:"send_ports"`
+	Timeout     string   `yaml:"timeout"`
+}
+
+type fileMetrics struct {
+	HostAllowlist        []string `yaml:"host_allowlist"`
+	CallerAllowlist      []string `yaml:"caller_allowlist"`
+	PathTemplates        []string `yaml:"path_templates"`
+	GRPCServiceAllowlist []string `yaml:"grpc_service_allowlist"`
+}
+
+type fileAccessLog struct {
+	Enabled    bool    `yaml:"enabled"`
+	Format     string  `yaml:"format"`
+	Template   string  `yaml:"template"`
+	Output     string  `yaml:"output"`
+	MaxSizeMB  int     `yaml:"max_size_mb"`
+	MaxBackups int     `yaml:"max_backups"`
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+type fileMTLS struct {
+	Enabled          bool     `yaml:"enabled"`
+	CertFile         string   `yaml:"cert_file"`
+	KeyFile          string   `yaml:"key_file"`
+	CAFile           string   `yaml:"ca_file"`
+	ReloadInterval   string   `yaml:"reload_interval"`
+	HandshakeTimeout string   `yaml:"handshake_timeout"`
+	InboundPorts     []uint16 `yaml:"inbound_ports"`
+	Permissive       bool     `yaml:"permissive"`
+	Destinations     []string `yaml:"destinations"`
+	AllowedPeers     []string `yaml:"allowed_peers"`
+}
+
+type fileHTTP struct {
+	RequestIDHeaderName string               `yaml:"request_id_header_name"`
+	XSourceHeaderName   string               `yaml:"x_source_header_name"`
+	XSourceValue        string               `yaml:"x_source_value"`
+	HeaderTagMap        map[string]string    `yaml:"header_tag_map"`
+	CookieTagMap        map[string]string    `yaml:"cookie_tag_map"`
+	TracingIgnoredPaths []string             `yaml:"tracing_ignored_paths"`
+	Routing             fileRouting          `yaml:"routing"`
+	TLSOrigination      []fileTLSOrigination `yaml:"tls_origination"`
+}
+
+type fileTLSOrigination struct {
+	Host       string `yaml:"host"`
+	Port       uint16 `yaml:"port"`
+	ServerName string `yaml:"server_name,omitempty"`
+	CAFile     string `yaml:"ca_file,omitempty"`
+	CertFile   string `yaml:"cert_file,omitempty"`
+	KeyFile    string `yaml:"key_file,omitempty"`
+}
+
+type fileRouting struct {
+	Enabled       bool   `yaml:"enabled"`
+	HeaderName    string `yaml:"header_name"`
+	CookieEnabled bool   `yaml:"cookie_enabled"`
+	CookieName    string `yaml:"cookie_name"`
+}
+
+func newFileConfig(cfg *Config) *fileConfig {
+	fc := &fileConfig{
+		ServiceName:      cfg.Netra.ServiceName,
+		LogLevel:         cfg.Netra.LoggerLevel.String(),
+		LogFormat:        cfg.Netra.LoggerFormat.String(),
+		LogRateLimit:     cfg.Netra.LoggerWarningRateLimit,
+		Port:             cfg.Netra.Port,
+		PprofPort:        cfg.Netra.PprofPort,
+		PrometheusPort:   cfg.Netra.PrometheusPort,
+		AdminPort:        cfg.Netra.AdminPort,
+		AdminHost:        cfg.Netra.AdminHost,
+		IPv6Enabled:      cfg.Netra.IPv6Enabled,
+		InterceptionMode: cfg.Netra.InterceptionMode,
+		DrainTimeout:     cfg.Netra.DrainTimeout.String(),
+		ReloadInterval:   cfg.Netra.ConfigReloadInterval.String(),
+		Timeouts: fileTimeouts{
+			Dial:                  cfg.Netra.DialTimeout.String(),
+			Idle:                  cfg.Netra.IdleTimeout.String(),
+			MaxConnectionLifetime: cfg.Netra.MaxConnectionLifetime.String(),
+		},
+		TracingContext: fileContextCache{
+			Expiration:      cfg.Netra.TracingContextExpiration.String(),
+			CleanupInterval: cfg.Netra.TracingContextCleanupInterval.String(),
+		},
+		RoutingContext: fileContextCache{
+			Expiration:      cfg.Netra.RoutingContextExpiration.String(),
+			CleanupInterval: cfg.Netra.RoutingContextCleanupInterval.String(),
+		},
+		Statsd: fileStatsd{
+			Enabled:   cfg.Netra.StatsdEnabled,
+			Address:   cfg.Netra.StatsdAddress,
+			Prefix:    cfg.Netra.StatsdPrefix,
+			TagFormat: cfg.Netra.StatsdTagFormat,
+			Templates: copyStringMap(cfg.Netra.StatsdTemplates),
+		},
+		Protocols: fileProtocols{
+			HTTPPorts: sortedPorts(cfg.Netra.HTTPProtoPorts),
+			TCPPorts:  sortedPorts(cfg.Netra.TCPProtoPorts),
+			Map:       copyStringMap(cfg.Netra.ProtocolMap),
+			Sniffing: fileSniffing{
+				Enabled:         cfg.Netra.ProtocolSniffingEnabled,
+				Timeout:         cfg.Netra.ProtocolSniffingTimeout.String(),
+				MaxBytes:        cfg.Netra.ProtocolSniffingMaxBytes,
+				CacheExpiration: cfg.Netra.ProtocolSniffingCacheExpiration.String(),
+			},
+			TLSInspection: cfg.Netra.TLSInspectionEnabled,
+		},
+		ProxyProtocol: fileProxyProtocol{
+			AcceptPorts: sortedPorts(cfg.Netra.ProxyProtocolAcceptPorts),
+			SendPorts:   sortedPorts(cfg.Netra.ProxyProtocolSendPorts),
+			Timeout:     cfg.Netra.ProxyProtocolTimeout.String(),
+		},
+		Metrics: fileMetrics{
+			HostAllowlist:        copyStrings(cfg.Netra.MetricsHostAllowlist),
+			CallerAllowlist:      copyStrings(cfg.Netra.MetricsCallerAllowlist),
+			PathTemplates:        copyStrings(cfg.Netra.MetricsPathTemplates),
+			GRPCServiceAllowlist: copyStrings(cfg.Netra.MetricsGRPCServiceAllowlist),
+		},
+		AccessLog: fileAccessLog{
+			Enabled:    cfg.Netra.AccessLogEnabled,
+			Format:     cfg.Netra.AccessLogFormat,
+			Template:   cfg.Netra.AccessLogTemplate,
+			Output:     cfg.Netra.AccessLogOutput,
+			MaxSizeMB:  cfg.Netra.AccessLogMaxSizeMB,
+			MaxBackups: cfg.Netra.AccessLogMaxBackups,
+			SampleRate: cfg.Netra.AccessLogSampleRate,
+		},
+		MTLS: fileMTLS{
+			Enabled:          cfg.Netra.MTLSEnabled,
+			CertFile:         cfg.Netra.MTLSCertFile,
+			KeyFile:          cfg.Netra.MTLSKeyFile,
+			CAFile:           cfg.Netra.MTLSCAFile,
+			ReloadInterval:   cfg.Netra.MTLSReloadInterval.String(),
+			HandshakeTimeout: cfg.Netra.MTLSHandshakeTimeout.String(),
+			InboundPorts:     sortedPorts(cfg.Netra.MTLSInboundPorts),
+			Permissive:       cfg.Netra.MTLSPermissive,
+			Destinations:     copyStrings(cfg.Netra.MTLSDestinations),
+			AllowedPeers:     copyStrings(cfg.Netra.MTLSAllowedPeers),
+		},
+		HTTP: fileHTTP{
+			RequestIDHeaderName: cfg.HTTP.RequestIdHeaderName,
+			XSourceHeaderName:   cfg.HTTP.XSourceHeaderName,
+			XSourceValue:        cfg.HTTP.XSourceValue,
+			HeaderTagMap:        copyStringMap(cfg.HTTP.HeadersMap),
+			CookieTagMap:        copyStringMap(cfg.HTTP.CookiesMap),
+			Routing: fileRouting{
+				Enabled:       cfg.HTTP.RoutingEnabled,
+				HeaderName:    cfg.HTTP.RoutingHeaderName,
+				CookieEnabled: cfg.HTTP.RoutingCookieEnabled,
+				CookieName:    cfg.HTTP.RoutingCookieName,
+			},
+		},
+	}
+	if len(cfg.Netra.LoggerLevels) > 0 {
+		fc.LogLevels = make(map[string]string, len(cfg.Netra.LoggerLevels))
+		for subsystem, level := range cfg.Netra.LoggerLevels {
+			fc.LogLevels[subsystem] = level.String()
+		}
+	}
+	for _, rule := range cfg.HTTP.TLSOrigination {
+		fc.HTTP.TLSOrigination = append(fc.HTTP.TLSOrigination, fileTLSOrigination(rule))
+	}
+	for path := range cfg.HTTP.TracingIgnoredPaths {
+		fc.HTTP.TracingIgnoredPaths = append(fc.HTTP.TracingIgnoredPaths, path)
+	}
+	sort.Strings(fc.HTTP.TracingIgnoredPaths)
+	return fc
+}
+
+// config converts file values into configuration, it returns *ValidationError in case values can't be parsed
+func (fc *fileConfig) config() (*Config, error) {
+	e := &ValidationError{}
+	level, err := log.ParseLevel(fc.LogLevel)
+	if err != nil {
+		e.addf("log_level: %s", err.Error())
+	}
+	format, err := log.ParseFormat(fc.LogFormat)
+	if err != nil {
+		e.addf("log_format: %s", err.Error())
+	}
+	levels := make(map[string]log.Level, len(fc.LogLevels))
+	for _, subsystem := range sortedKeys(fc.LogLevels) {
+		level, err := log.ParseLevel(fc.LogLevels[subsystem])
+		if err != nil {
+			e.addf("log_levels: %s: %s", subsystem, err.Error())
+			continue
+		}
+		levels[subsystem] = level
+	}
+	cfg := &Config{
+		Netra: NetraConfig{
+			Port:                        fc.Port,
+			PprofPort:                   fc.PprofPort,
+			PrometheusPort:              fc.PrometheusPort,
+			AdminPort:                   fc.AdminPort,
+			AdminHost:                   fc.AdminHost,
+			ServiceName:                 fc.ServiceName,
+			LoggerLevel:                 level,
+			LoggerFormat:                format,
+			LoggerLevels:                levels,
+			LoggerWarningRateLimit:      fc.LogRateLimit,
+			HTTPProtoPorts:              portSet(fc.Protocols.HTTPPorts),
+			StatsdEnabled:               fc.Statsd.Enabled,
+			StatsdAddress:               fc.Statsd.Address,
+			StatsdPrefix:                fc.Statsd.Prefix,
+			StatsdTagFormat:             fc.Statsd.TagFormat,
+			StatsdTemplates:             copyStringMap(fc.Statsd.Templates),
+			IPv6Enabled:                 fc.IPv6Enabled,
+			InterceptionMode:            fc.InterceptionMode,
+			TCPProtoPorts:               portSet(fc.Protocols.TCPPorts),
+			ProtocolSniffingEnabled:     fc.Protocols.Sniffing.Enabled,
+			ProtocolSniffingMaxBytes:    fc.Protocols.Sniffing.MaxBytes,
+			ProtocolMap:                 copyStringMap(fc.Protocols.Map),
+			TLSInspectionEnabled:        fc.Protocols.TLSInspection,
+			ProxyProtocolAcceptPorts:    portSet(fc.ProxyProtocol.AcceptPorts),
+			ProxyProtocolSendPorts:      portSet(fc.ProxyProtocol.SendPorts),
+			MetricsHostAllowlist:        copyStrings(fc.Metrics.HostAllowlist),
+			MetricsCallerAllowlist:      copyStrings(fc.Metrics.CallerAllowlist),
+			MetricsPathTemplates:        copyStrings(fc.Metrics.PathTemplates),
+			MetricsGRPCServiceAllowlist: copyStrings(fc.Metrics.GRPCServiceAllowlist),
+			AccessLogEnabled:            fc.AccessLog.Enabled,
+			AccessLogFormat:             fc.AccessLog.Format,
+			AccessLogTemplate:           fc.AccessLog.Template,
+			AccessLogOutput:             fc.AccessLog.Output,
+			AccessLogMaxSizeMB:          fc.AccessLog.MaxSizeMB,
+			AccessLogMaxBackups:         fc.AccessLog.MaxBackups,
+			AccessLogSampleRate:         fc.AccessLog.SampleRate,
+			MTLSEnabled:                 fc.MTLS.Enabled,
+			MTLSCertFile:                fc.MTLS.CertFile,
+			MTLSKeyFile:                 fc.MTLS.KeyFile,
+			MTLSCAFile:                  fc.MTLS.CAFile,
+			MTLSInboundPorts:            portSet(fc.MTLS.InboundPorts),
+			MTLSPermissive:              fc.MTLS.Permissive,
+			MTLSDestinations:            copyStrings(fc.MTLS.Destinations),
+			MTLSAllowedPeers:            copyStrings(fc.MTLS.AllowedPeers),
+		},
+		HTTP: HTTPConfig{
+			HeadersMap:           copyStringMap(fc.HTTP.HeaderTagMap),
+			CookiesMap:           copyStringMap(fc.HTTP.CookieTagMap),
+			RequestIdHeaderName:  fc.HTTP.RequestIDHeaderName,
+			XSourceHeaderName:    fc.HTTP.XSourceHeaderName,
+			XSourceValue:         fc.HTTP.XSourceValue,
+			RoutingEnabled:       fc.HTTP.Routing.Enabled,
+			RoutingHeaderName:    fc.HTTP.Routing.HeaderName,
+			RoutingCookieEnabled: fc.HTTP.Routing.CookieEnabled,
+			RoutingCookieName:    fc.HTTP.Routing.CookieName,
+			TracingIgnoredPaths:  make(map[string]bool, len(fc.HTTP.TracingIgnoredPaths)),
+		},
+	}
+	for _, path := range fc.HTTP.TracingIgnoredPaths {
+		cfg.HTTP.TracingIgnoredPaths[path] = true
+	}
+	for _, rule := range fc.HTTP.TLSOrigination {
+		if rule.Port == 0 {
+			rule.Port = DefaultTLSOriginationPort
+		}
+		cfg.HTTP.TLSOrigination = append(cfg.HTTP.TLSOrigination, TLSOriginationRule(rule))
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"drain_timeout", fc.DrainTimeout, &cfg.Netra.DrainTimeout},
+		{"config_reload_interval", fc.ReloadInterval, &cfg.Netra.ConfigReloadInterval},
+		{"timeouts.dial", fc.Timeouts.Dial, &cfg.Netra.DialTimeout},
+		{"timeouts.idle", fc.Timeouts.Idle, &cfg.Netra.IdleTimeout},
+		{"timeouts.max_connection_lifetime", fc.Timeouts.MaxConnectionLifetime, &cfg.Netra.MaxConnectionLifetime},
+		{"tracing_context.expiration", fc.TracingContext.Expiration, &cfg.Netra.TracingContextExpiration},
+		{"tracing_context.cleanup_interval", fc.TracingContext.CleanupInterval, &cfg.Netra.TracingContextCleanupInterval},
+		{"routing_context.expiration", fc.RoutingContext.Expiration, &cfg.Netra.RoutingContextExpiration},
+		{"routing_context.cleanup_interval", fc.RoutingContext.CleanupInterval, &cfg.Netra.RoutingContextCleanupInterval},
+		{"protocols.sniffing.timeout", fc.Protocols.Sniffing.Timeout, &cfg.Netra.ProtocolSniffingTimeout},
+		{"protocols.sniffing.cache_expiration", fc.Protocols.Sniffing.CacheExpiration, &cfg.Netra.ProtocolSniffingCacheExpiration},
+		{"proxy_protocol.timeout", fc.ProxyProtocol.Timeout, &cfg.Netra.ProxyProtocolTimeout},
+		{"mtls.reload_interval", fc.MTLS.ReloadInterval, &cfg.Netra.MTLSReloadInterval},
+		{"mtls.handshake_timeout", fc.MTLS.HandshakeTimeout, &cfg.Netra.MTLSHandshakeTimeout},
+	}
+	for _, d := range durations {
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			e.addf("%s: invalid duration '%s', expected value like 300ms or 5s", d.name, d.value)
+			continue
+		}
+		*d.dst = v
+	}
+
+	if len(e.Problems) > 0 {
+		return nil, e
+	}
+	return cfg, nil
+}
+
+// FromFile returns default configuration overridden by values of YAML or JSON file.
+// Unknown fields are reported as errors.
+func FromFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fc := newFileConfig(Default())
+	// strict decoding rejects keys already present in map, so default templates are merged after it
+	fc.Statsd.Templates = nil
+	if err := yaml.UnmarshalStrict(data, fc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	templates := DefaultStatsdTemplates()
+	for metric, template := range fc.Statsd.Templates {
+		templates[metric] = template
+	}
+	fc.Statsd.Templates = templates
+	return fc.config()
+}
+
+// Load returns configuration read from file (if path is not empty) overridden by environment variables.
+// Resulting configuration is validated.
+func Load(path string, logger *log.Logger) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		var err error
+		cfg, err = FromFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ApplyENV(cfg, logger); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Marshal returns configuration in configuration file format
+func Marshal(cfg *Config) ([]byte, error) {
+	return yaml.Marshal(newFileConfig(cfg))
+}
+
+func sortedPorts(ports map[string]struct{}) []uint16 {
+	res := make([]uint16, 0, len(ports))
+	for port := range ports {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		res = append(res, uint16(p))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func portSet(ports []uint16) map[string]struct{} {
+	res := make(map[string]struct{}, len(ports))
+	for _, port := range ports {
+		res[strconv.Itoa(int(port))] = struct{}{}
+	}
+	return res
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+func copyStrings(s []string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return append([]string(nil), s...)
+}
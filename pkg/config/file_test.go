@@ -0,0 +1,367 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// writeConfigFile writes configuration file content into temporary directory and returns its path
+func writeConfigFile(t *testing.T, name string, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setenv sets environment variable until the end of test
+func setenv(t *testing.T, key string, value string) {
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func testLogger(t *testing.T) *log.Logger {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logger
+}
+
+func TestLoadProxyProtocolPorts(t *testing.T) {
+	path := writeConfigFile(t, "netra.yaml", `
+proxy_protocol:
+  accept_ports: [8080]
+  send_ports: [9090]
+`)
+	setenv(t, envNetraProxyProtocolAcceptPorts, "8081")
+	setenv(t, envNetraProxyProtocolSendPorts, "9091")
+	cfg, err := Load(path, testLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := portSet([]uint16{8080, 8081}); !reflect.DeepEqual(cfg.Netra.ProxyProtocolAcceptPorts, expected) {
+		t.Errorf("expected accept ports %v, got %v", expected, cfg.Netra.ProxyProtocolAcceptPorts)
+	}
+	if expected := portSet([]uint16{9090, 9091}); !reflect.DeepEqual(cfg.Netra.ProxyProtocolSendPorts, expected) {
+		t.Errorf("expected send ports %v, got %v", expected, cfg.Netra.ProxyProtocolSendPorts)
+	}
+}
+
+func TestParsePortsAllocatesSet(t *testing.T) {
+	var ports map[string]struct{}
+	if err := parsePorts(envNetraTCPPorts, "080, 9000", &ports); err != nil {
+		t.Fatal(err)
+	}
+	if expected := portSet([]uint16{80, 9000}); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected %v, got %v", expected, ports)
+	}
+}
+
+func TestApplyENVFlags(t *testing.T) {
+	path := writeConfigFile(t, "netra.yaml", `
+statsd:
+  enabled: true
+  address: localhost:8125
+`)
+	cfg, err := FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, envNetraStatsdEnabled, "false")
+	setenv(t, envNetraIPv6Enabled, "1")
+	if err := ApplyENV(cfg, testLogger(t)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Netra.StatsdEnabled {
+		t.Error("expected statsd enabled in file to be disabled by env")
+	}
+	if !cfg.Netra.IPv6Enabled {
+		t.Error("expected IPv6 to be enabled by env")
+	}
+
+	setenv(t, envNetraIPv6Enabled, "yes")
+	err = ApplyENV(Default(), testLogger(t))
+	if expected := "NETRA_IPV6_ENABLED: invalid boolean 'yes'"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestFromFileStatsdTemplates(t *testing.T) {
+	path := writeConfigFile(t, "netra.yaml", `
+statsd:
+  templates:
+    inbound_status: in.{status}
+`)
+	cfg, err := FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultStatsdTemplates()
+	expected[StatsdInboundStatus] = "in.{status}"
+	if !reflect.DeepEqual(cfg.Netra.StatsdTemplates, expected) {
+		t.Errorf("expected templates %v, got %v", expected, cfg.Netra.StatsdTemplates)
+	}
+}
+
+// fullConfigFile sets every section of configuration file to non-default values
+const fullConfigFile = `
+service_name: billing
+log_level: debug
+log_format: logfmt
+log_levels:
+  http: error
+log_warning_rate_limit: 7
+port: 15000
+pprof_port: 15001
+prometheus_port: 15002
+admin_port: 15003
+admin_host: 0.0.0.0
+ipv6_enabled: true
+interception_mode: tproxy
+drain_timeout: 20s
+config_reload_interval: 1m
+timeouts:
+  dial: 2s
+  idle: 30s
+  max_connection_lifetime: 1h
+tracing_context:
+  expiration: 6s
+  cleanup_interval: 2s
+routing_context:
+  expiration: 7s
+  cleanup_interval: 3s
+statsd:
+  enabled: true
+  address: statsd:8125
+  prefix: netra
+  tag_format: datadog
+  templates:
+    inbound_status: in.{status}
+protocols:
+  http_ports: [8080]
+  tcp_ports: [5432]
+  map:
+    "6379": redis
+  sniffing:
+    enabled: true
+    timeout: 50ms
+    max_bytes: 32
+    cache_expiration: 2m
+  tls_inspection: true
+proxy_protocol:
+  accept_ports: [8443]
+  send_ports: [8444]
+  timeout: 500ms
+metrics:
+  host_allowlist: [api]
+  caller_allowlist: [web]
+  path_templates: ['/users/{id}']
+  grpc_service_allowlist: [billing.Payments]
+access_log:
+  enabled: true
+  format: text
+  template: '{{.Method}}'
+  output: /var/log/netra.log
+  max_size_mb: 10
+  max_backups: 0
+  sample_rate: 0.5
+mtls:
+  enabled: true
+  cert_file: cert.pem
+  key_file: key.pem
+  ca_file: ca.pem
+  reload_interval: 30s
+  handshake_timeout: 1s
+  inbound_ports: [9000]
+  permissive: true
+  destinations: [10.0.0.0/8]
+  allowed_peers: [frontend*]
+http:
+  request_id_header_name: X-Req
+  x_source_header_name: X-Src
+  x_source_value: billing
+  header_tag_map:
+    X-Tenant: tenant
+  cookie_tag_map:
+    session: session
+  tracing_ignored_paths: [/health]
+  routing:
+    enabled: true
+    header_name: X-Branch
+    cookie_enabled: true
+    cookie_name: branch
+  tls_origination:
+  - host: '*.partner.com'
+  - host: api.example.com
+    port: 8443
+    server_name: example.com
+`
+
+func TestFromFileSections(t *testing.T) {
+	cfg, err := FromFile(writeConfigFile(t, "netra.yaml", fullConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, h := cfg.Netra, cfg.HTTP
+	tests := []struct {
+		field    string
+		value    interface{}
+		expected interface{}
+	}{
+		{"service_name", n.ServiceName, "billing"},
+		{"log_level", n.LoggerLevel, log.DebugLevel},
+		{"log_format", n.LoggerFormat, log.LogfmtFormat},
+		{"log_levels", n.LoggerLevels, map[string]log.Level{"http": log.ErrorLevel}},
+		{"log_warning_rate_limit", n.LoggerWarningRateLimit, 7},
+		{"port", n.Port, uint16(15000)},
+		{"pprof_port", n.PprofPort, uint16(15001)},
+		{"prometheus_port", n.PrometheusPort, uint16(15002)},
+		{"admin_port", n.AdminPort, uint16(15003)},
+		{"admin_host", n.AdminHost, "0.0.0.0"},
+		{"ipv6_enabled", n.IPv6Enabled, true},
+		{"interception_mode", n.InterceptionMode, InterceptionModeTProxy},
+		{"drain_timeout", n.DrainTimeout, 20 * time.Second},
+		{"config_reload_interval", n.ConfigReloadInterval, time.Minute},
+		{"timeouts.dial", n.DialTimeout, 2 * time.Second},
+		{"timeouts.idle", n.IdleTimeout, 30 * time.Second},
+		{"timeouts.max_connection_lifetime", n.MaxConnectionLifetime, time.Hour},
+		{"tracing_context.expiration", n.TracingContextExpiration, 6 * time.Second},
+		{"tracing_context.cleanup_interval", n.TracingContextCleanupInterval, 2 * time.Second},
+		{"routing_context.expiration", n.RoutingContextExpiration, 7 * time.Second},
+		{"routing_context.cleanup_interval", n.RoutingContextCleanupInterval, 3 * time.Second},
+		{"statsd.enabled", n.StatsdEnabled, true},
+		{"statsd.address", n.StatsdAddress, "statsd:8125"},
+		{"statsd.prefix", n.StatsdPrefix, "netra"},
+		{"statsd.tag_format", n.StatsdTagFormat, StatsdTagFormatDatadog},
+		{"statsd.templates", n.StatsdTemplates[StatsdInboundStatus], "in.{status}"},
+		{"protocols.http_ports", n.HTTPProtoPorts, portSet([]uint16{8080})},
+		{"protocols.tcp_ports", n.TCPProtoPorts, portSet([]uint16{5432})},
+		{"protocols.map", n.ProtocolMap, map[string]string{"6379": "redis"}},
+		{"protocols.sniffing.enabled", n.ProtocolSniffingEnabled, true},
+		{"protocols.sniffing.timeout", n.ProtocolSniffingTimeout, 50 * time.Millisecond},
+		{"protocols.sniffing.max_bytes", n.ProtocolSniffingMaxBytes, 32},
+		{"protocols.sniffing.cache_expiration", n.ProtocolSniffingCacheExpiration, 2 * time.Minute},
+		{"protocols.tls_inspection", n.TLSInspectionEnabled, true},
+		{"proxy_protocol.accept_ports", n.ProxyProtocolAcceptPorts, portSet([]uint16{8443})},
+		{"proxy_protocol.send_ports", n.ProxyProtocolSendPorts, portSet([]uint16{8444})},
+		{"proxy_protocol.timeout", n.ProxyProtocolTimeout, 500 * time.Millisecond},
+		{"metrics.host_allowlist", n.MetricsHostAllowlist, []string{"api"}},
+		{"metrics.caller_allowlist", n.MetricsCallerAllowlist, []string{"web"}},
+		{"metrics.path_templates", n.MetricsPathTemplates, []string{"/users/{id}"}},
+		{"metrics.grpc_service_allowlist", n.MetricsGRPCServiceAllowlist, []string{"billing.Payments"}},
+		{"access_log.enabled", n.AccessLogEnabled, true},
+		{"access_log.format", n.AccessLogFormat, AccessLogFormatText},
+		{"access_log.template", n.AccessLogTemplate, "{{.Method}}"},
+		{"access_log.output", n.AccessLogOutput, "/var/log/netra.log"},
+		{"access_log.max_size_mb", n.AccessLogMaxSizeMB, 10},
+		{"access_log.max_backups", n.AccessLogMaxBackups, 0},
+		{"access_log.sample_rate", n.AccessLogSampleRate, 0.5},
+		{"mtls.enabled", n.MTLSEnabled, true},
+		{"mtls.cert_file", n.MTLSCertFile, "cert.pem"},
+		{"mtls.key_file", n.MTLSKeyFile, "key.pem"},
+		{"mtls.ca_file", n.MTLSCAFile, "ca.pem"},
+		{"mtls.reload_interval", n.MTLSReloadInterval, 30 * time.Second},
+		{"mtls.handshake_timeout", n.MTLSHandshakeTimeout, time.Second},
+		{"mtls.inbound_ports", n.MTLSInboundPorts, portSet([]uint16{9000})},
+		{"mtls.permissive", n.MTLSPermissive, true},
+		{"mtls.destinations", n.MTLSDestinations, []string{"10.0.0.0/8"}},
+		{"mtls.allowed_peers", n.MTLSAllowedPeers, []string{"frontend*"}},
+		{"http.request_id_header_name", h.RequestIdHeaderName, "X-Req"},
+		{"http.x_source_header_name", h.XSourceHeaderName, "X-Src"},
+		{"http.x_source_value", h.XSourceValue, "billing"},
+		{"http.header_tag_map", h.HeadersMap, map[string]string{"X-Tenant": "tenant"}},
+		{"http.cookie_tag_map", h.CookiesMap, map[string]string{"session": "session"}},
+		{"http.tracing_ignored_paths", h.TracingIgnoredPaths, map[string]bool{"/health": true}},
+		{"http.routing.enabled", h.RoutingEnabled, true},
+		{"http.routing.header_name", h.RoutingHeaderName, "X-Branch"},
+		{"http.routing.cookie_enabled", h.RoutingCookieEnabled, true},
+		{"http.routing.cookie_name", h.RoutingCookieName, "branch"},
+		{"http.tls_origination", h.TLSOrigination, []TLSOriginationRule{
+			{Host: "*.partner.com", Port: DefaultTLSOriginationPort},
+			{Host: "api.example.com", Port: 8443, ServerName: "example.com"},
+		}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.value, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.field, tt.expected, tt.value)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected valid configuration, got %v", err)
+	}
+}
+
+// TestMarshalRoundTrip checks that configuration printed by -check-config is read back unchanged
+func TestMarshalRoundTrip(t *testing.T) {
+	for name, content := range map[string]string{"defaults": "", "full": fullConfigFile} {
+		cfg, err := FromFile(writeConfigFile(t, "netra.yaml", content))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		data, err := Marshal(cfg)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		again, err := FromFile(writeConfigFile(t, "netra.yaml", string(data)))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(cfg, again) {
+			t.Errorf("%s: configuration changed after round trip:\n%s", name, data)
+		}
+	}
+}
+
+func TestFromFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"unknown field", "prot: 8080\n", "field prot not found"},
+		{"malformed duration", "timeouts:\n  dial: 5\n", "timeouts.dial: invalid duration '5', expected value like 300ms or 5s"},
+		{"malformed level", "log_levels:\n  http: loud\n", "log_levels: http: invalid logger level loud"},
+		{"malformed format", "log_format: xml\n", "log_format:"},
+	}
+	for _, tt := range tests {
+		_, err := FromFile(writeConfigFile(t, "netra.yaml", tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestFromFileJSON(t *testing.T) {
+	cfg, err := FromFile(writeConfigFile(t, "netra.json", `{"port": 15000, "http": {"routing": {"enabled": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Netra.Port != 15000 || !cfg.HTTP.RoutingEnabled {
+		t.Errorf("expected JSON values to be applied, got port %d and routing %t", cfg.Netra.Port, cfg.HTTP.RoutingEnabled)
+	}
+	if cfg.Netra.PprofPort != DefaultNetraConfig().PprofPort {
+		t.Errorf("expected default pprof port, got %d", cfg.Netra.PprofPort)
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maskedValue replaces values of secret fields
+const maskedValue = "******"
+
+// secretMarkers are parts of field names holding credentials
+var secretMarkers = []string{"password", "secret", "token", "private_key"}
+
+// MarshalMasked returns configuration in configuration file format with secret values masked,
+// it's used to show effective configuration to operators
+func MarshalMasked(cfg *Config) ([]byte, error) {
+	data, err := Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	maskSecrets(doc)
+	return yaml.Marshal(doc)
+}
+
+func maskSecrets(doc yaml.MapSlice) {
+	for i, item := range doc {
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			maskSecrets(nested)
+			continue
+		}
+		if isSecret(fmt.Sprint(item.Key)) && item.Value != nil && item.Value != "" {
+			doc[i].Value = maskedValue
+		}
+	}
+}
+
+// isSecret checks whether field holds credentials, name is either field name or "section.field" path
+func isSecret(name string) bool {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, marker := range secretMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// staticFields can't be changed without restart, nested fields are matched by prefix
+var staticFields = []string{
+	"service_name",
+	"port",
+	"pprof_port",
+	"prometheus_port",
+	"admin_port",
+	"admin_host",
+	"ipv6_enabled",
+	"interception_mode",
+	"config_reload_interval",
+	"statsd.",
+	"access_log.",
+	"tracing_context.",
+	"routing_context.",
+	"protocols.sniffing.cache_expiration",
+	"mtls.enabled",
+	"mtls.cert_file",
+	"mtls.key_file",
+	"mtls.ca_file",
+	"mtls.reload_interval",
+}
+
+// Change is a changed configuration field, fields are named the same way as in configuration file
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+// CheckReload returns changes between configurations.
+// It returns *ValidationError in case fields which require restart are changed.
+func CheckReload(current *Config, next *Config) ([]Change, error) {
+	changes, err := Diff(current, next)
+	if err != nil {
+		return nil, err
+	}
+	e := &ValidationError{}
+	for _, c := range changes {
+		if !isStatic(c.Field) {
+			continue
+		}
+		if c.Field == "port" {
+			e.addf("port: listener port can't be changed without restart (%s -> %s)", c.Old, c.New)
+			continue
+		}
+		e.addf("%s: can't be changed without restart (%s -> %s)", c.Field, c.Old, c.New)
+	}
+	if len(e.Problems) > 0 {
+		return nil, e
+	}
+	return changes, nil
+}
+
+// Diff returns changed fields of configurations in configuration file order, secret values are masked
+func Diff(current *Config, next *Config) ([]Change, error) {
+	oldFields, err := flatten(current)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flatten(next)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, f := range append(oldFields, newFields...) {
+		if seen[f.name] {
+			continue
+		}
+		seen[f.name] = true
+		oldValue, newValue := fieldValue(oldFields, f.name), fieldValue(newFields, f.name)
+		if oldValue != newValue {
+			if isSecret(f.name) {
+				oldValue, newValue = maskedValue, maskedValue
+			}
+			changes = append(changes, Change{Field: f.name, Old: oldValue, New: newValue})
+		}
+	}
+	return changes, nil
+}
+
+func isStatic(name string) bool {
+	for _, f := range staticFields {
+		if name == f || (strings.HasSuffix(f, ".") && strings.HasPrefix(name, f)) {
+			return true
+		}
+	}
+	return false
+}
+
+type field struct {
+	name  string
+	value string
+}
+
+// flatten returns configuration fields as "section.field" names with string values
+func flatten(cfg *Config) ([]field, error) {
+	data, err := yaml.Marshal(newFileConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var fields []field
+	flattenInto(&fields, "", doc)
+	return fields, nil
+}
+
+func flattenInto(fields *[]field, prefix string, doc yaml.MapSlice) {
+	for _, item := range doc {
+		name := prefix + fmt.Sprint(item.Key)
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			flattenInto(fields, name+".", nested)
+			continue
+		}
+		*fields = append(*fields, field{name: name, value: fmt.Sprint(item.Value)})
+	}
+}
+
+func fieldValue(fields []field, name string) string {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return "<unset>"
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestCheckReloadRejectsStaticFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config)
+		expected string
+	}{
+		{"port", func(cfg *Config) { cfg.Netra.Port = 15000 },
+			"port: listener port can't be changed without restart (14956 -> 15000)"},
+		{"admin port", func(cfg *Config) { cfg.Netra.AdminPort = 15003 },
+			"admin_port: can't be changed without restart (14959 -> 15003)"},
+		{"admin host", func(cfg *Config) { cfg.Netra.AdminHost = "0.0.0.0" },
+			"admin_host: can't be changed without restart (127.0.0.1 -> 0.0.0.0)"},
+		{"interception mode", func(cfg *Config) { cfg.Netra.InterceptionMode = InterceptionModeTProxy },
+			"interception_mode: can't be changed without restart (redirect -> tproxy)"},
+		{"nested field", func(cfg *Config) { cfg.Netra.StatsdPrefix = "mesh" },
+			"statsd.prefix: can't be changed without restart ( -> mesh)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := Default()
+			tt.modify(next)
+			changes, err := CheckReload(Default(), next)
+			if changes != nil {
+				t.Errorf("expected no changes to be applied, got %v", changes)
+			}
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(validationErr.Problems, []string{tt.expected}) {
+				t.Errorf("expected problem %q, got %v", tt.expected, validationErr.Problems)
+			}
+		})
+	}
+}
+
+func TestCheckReloadDynamicFields(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.Netra.DialTimeout = 0
+	next.HTTP.RoutingEnabled = true
+	next.Netra.ProxyProtocolAcceptPorts = portSet([]uint16{8080})
+	next.Netra.LoggerLevels["http"] = log.DebugLevel
+	changes, err := CheckReload(current, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.String())
+	}
+	// changes are listed in configuration file order, fields absent in current configuration are listed last
+	expected := []string{
+		"timeouts.dial: 5s -> 0s",
+		"proxy_protocol.accept_ports: [] -> [8080]",
+		"http.routing.enabled: false -> true",
+		"log_levels.http: <unset> -> debug",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected changes:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestDiffMasksSecrets(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.HTTP.HeadersMap["x-api-token"] = "token"
+	next.HTTP.HeadersMap["X-Tenant"] = "tenant"
+	changes, err := Diff(current, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Field: "http.header_tag_map.X-Tenant", Old: "<unset>", New: "tenant"},
+		{Field: "http.header_tag_map.x-api-token", Old: maskedValue, New: maskedValue},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestCheckReloadNoChanges(t *testing.T) {
+	changes, err := CheckReload(Default(), Default())
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes, got %v, %v", changes, err)
+	}
+}
@@ -0,0 +1,326 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/mtls"
+)
+
+// ValidationError lists all problems found in configuration.
+// Fields are named the same way as in configuration file.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ValidationError) addf(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate checks configuration consistency, it returns *ValidationError in case of problems
+func (c *Config) Validate() error {
+	e := &ValidationError{}
+	n := c.Netra
+
+	if n.LoggerWarningRateLimit < 0 {
+		e.addf("log_warning_rate_limit: must not be negative, got %d", n.LoggerWarningRateLimit)
+	}
+	for subsystem := range n.LoggerLevels {
+		if subsystem == "" {
+			e.addf("log_levels: empty subsystem")
+		}
+	}
+
+	if n.Port == 0 {
+		e.addf("port: must be set")
+	}
+	ports := []struct {
+		name  string
+		value uint16
+	}{
+		{"port", n.Port},
+		{"pprof_port", n.PprofPort},
+		{"prometheus_port", n.PrometheusPort},
+		{"admin_port", n.AdminPort},
+	}
+	for i, p := range ports {
+		for _, other := range ports[i+1:] {
+			if p.value != 0 && p.value == other.value {
+				e.addf("%s: %d is already used by %s", p.name, p.value, other.name)
+			}
+		}
+	}
+	if n.AdminPort != 0 && net.ParseIP(n.AdminHost) == nil {
+		e.addf("admin_host: invalid IP address '%s'", n.AdminHost)
+	}
+	switch n.InterceptionMode {
+	case InterceptionModeRedirect, InterceptionModeTProxy:
+	default:
+		e.addf("interception_mode: unknown mode '%s', expected %s or %s",
+			n.InterceptionMode, InterceptionModeRedirect, InterceptionModeTProxy)
+	}
+
+	nonNegative := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"drain_timeout", n.DrainTimeout},
+		{"config_reload_interval", n.ConfigReloadInterval},
+		{"timeouts.dial", n.DialTimeout},
+		{"timeouts.idle", n.IdleTimeout},
+		{"timeouts.max_connection_lifetime", n.MaxConnectionLifetime},
+		{"protocols.sniffing.cache_expiration", n.ProtocolSniffingCacheExpiration},
+	}
+	for _, d := range nonNegative {
+		if d.value < 0 {
+			e.addf("%s: must not be negative, got %s", d.name, d.value)
+		}
+	}
+	positive := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"tracing_context.expiration", n.TracingContextExpiration},
+		{"tracing_context.cleanup_interval", n.TracingContextCleanupInterval},
+		{"routing_context.expiration", n.RoutingContextExpiration},
+		{"routing_context.cleanup_interval", n.RoutingContextCleanupInterval},
+		{"protocols.sniffing.timeout", n.ProtocolSniffingTimeout},
+		{"proxy_protocol.timeout", n.ProxyProtocolTimeout},
+		{"mtls.reload_interval", n.MTLSReloadInterval},
+		{"mtls.handshake_timeout", n.MTLSHandshakeTimeout},
+	}
+	for _, d := range positive {
+		if d.value <= 0 {
+			e.addf("%s: must be positive, got %s", d.name, d.value)
+		}
+	}
+
+	if n.StatsdEnabled && n.StatsdAddress == "" {
+		e.addf("statsd.address: must be set when statsd is enabled")
+	}
+	switch n.StatsdTagFormat {
+	case "", StatsdTagFormatDatadog, StatsdTagFormatInfluxDB:
+	default:
+		e.addf("statsd.tag_format: unknown format '%s', expected %s or %s",
+			n.StatsdTagFormat, StatsdTagFormatDatadog, StatsdTagFormatInfluxDB)
+	}
+	for _, metric := range sortedKeys(n.StatsdTemplates) {
+		if err := validateStatsdTemplate(metric, n.StatsdTemplates[metric]); err != nil {
+			e.addf("statsd.templates: %s", err.Error())
+		}
+	}
+
+	for _, port := range sortedPorts(n.HTTPProtoPorts) {
+		if _, ok := n.TCPProtoPorts[strconv.Itoa(int(port))]; ok {
+			e.addf("protocols.tcp_ports: port %d is also listed in protocols.http_ports", port)
+		}
+	}
+	if n.ProtocolSniffingMaxBytes <= 0 {
+		e.addf("protocols.sniffing.max_bytes: must be positive, got %d", n.ProtocolSniffingMaxBytes)
+	}
+	for _, dst := range sortedKeys(n.ProtocolMap) {
+		if err := validateDestination(dst); err != nil {
+			e.addf("protocols.map: %s", err.Error())
+		}
+		if n.ProtocolMap[dst] == "" {
+			e.addf("protocols.map: empty protocol for %s", dst)
+		}
+	}
+
+	lists := []struct {
+		name   string
+		values []string
+	}{
+		{"metrics.host_allowlist", n.MetricsHostAllowlist},
+		{"metrics.caller_allowlist", n.MetricsCallerAllowlist},
+		{"metrics.path_templates", n.MetricsPathTemplates},
+		{"metrics.grpc_service_allowlist", n.MetricsGRPCServiceAllowlist},
+		{"mtls.allowed_peers", n.MTLSAllowedPeers},
+	}
+	for _, l := range lists {
+		for _, v := range l.values {
+			if v == "" {
+				e.addf("%s: empty value", l.name)
+			}
+		}
+	}
+	for _, template := range n.MetricsPathTemplates {
+		if template != "" && !strings.HasPrefix(template, "/") {
+			e.addf("metrics.path_templates: template '%s' must start with /", template)
+		}
+	}
+
+	switch n.AccessLogFormat {
+	case AccessLogFormatJSON:
+	case AccessLogFormatText:
+		if _, err := template.New("access_log").Parse(n.AccessLogTemplate); err != nil {
+			e.addf("access_log.template: %s", err.Error())
+		}
+	default:
+		e.addf("access_log.format: unknown format '%s', expected %s or %s",
+			n.AccessLogFormat, AccessLogFormatJSON, AccessLogFormatText)
+	}
+	if n.AccessLogOutput == "" {
+		e.addf("access_log.output: must be set, use %s or file path", AccessLogOutputStdout)
+	}
+	if n.AccessLogMaxSizeMB < 0 {
+		e.addf("access_log.max_size_mb: must not be negative, got %d", n.AccessLogMaxSizeMB)
+	}
+	if n.AccessLogMaxBackups < 0 {
+		e.addf("access_log.max_backups: must not be negative, got %d", n.AccessLogMaxBackups)
+	}
+	if n.AccessLogSampleRate <= 0 || n.AccessLogSampleRate > 1 {
+		e.addf("access_log.sample_rate: must be in (0, 1], got %g", n.AccessLogSampleRate)
+	}
+
+	if n.MTLSEnabled {
+		files := []struct {
+			name  string
+			value string
+		}{
+			{"mtls.cert_file", n.MTLSCertFile},
+			{"mtls.key_file", n.MTLSKeyFile},
+			{"mtls.ca_file", n.MTLSCAFile},
+		}
+		for _, f := range files {
+			if f.value == "" {
+				e.addf("%s: must be set when mtls is enabled", f.name)
+			}
+		}
+	}
+	for _, dst := range n.MTLSDestinations {
+		if _, err := mtls.ParseDestination(dst); err != nil {
+			e.addf("mtls.destinations: %s", err.Error())
+		}
+	}
+
+	h := c.HTTP
+	if h.RequestIdHeaderName == "" {
+		e.addf("http.request_id_header_name: must be set")
+	}
+	if h.XSourceHeaderName == "" {
+		e.addf("http.x_source_header_name: must be set")
+	}
+	for _, header := range sortedKeys(h.HeadersMap) {
+		if header == "" || h.HeadersMap[header] == "" {
+			e.addf("http.header_tag_map: header and tag must be set, got '%s: %s'", header, h.HeadersMap[header])
+		}
+	}
+	for _, cookie := range sortedKeys(h.CookiesMap) {
+		if cookie == "" || h.CookiesMap[cookie] == "" {
+			e.addf("http.cookie_tag_map: cookie and tag must be set, got '%s: %s'", cookie, h.CookiesMap[cookie])
+		}
+	}
+	paths := make([]string, 0, len(h.TracingIgnoredPaths))
+	for path := range h.TracingIgnoredPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			e.addf("http.tracing_ignored_paths: path '%s' must start with /", path)
+		}
+	}
+	if h.RoutingEnabled && h.RoutingHeaderName == "" {
+		e.addf("http.routing.header_name: must be set when routing is enabled")
+	}
+	if h.RoutingCookieEnabled {
+		if !h.RoutingEnabled {
+			e.addf("http.routing.cookie_enabled: requires http.routing.enabled")
+		}
+		if h.RoutingCookieName == "" {
+			e.addf("http.routing.cookie_name: must be set when routing cookie is enabled")
+		}
+	}
+
+	for i, rule := range h.TLSOrigination {
+		if err := validateHostPattern(rule.Host); err != nil {
+			e.addf("http.tls_origination[%d].host: %s", i, err.Error())
+		}
+		if rule.Port == 0 {
+			e.addf("http.tls_origination[%d].port: must be set", i)
+		}
+		if (rule.CertFile == "") != (rule.KeyFile == "") {
+			e.addf("http.tls_origination[%d]: cert_file and key_file must be set together", i)
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// validateHostPattern checks that pattern is host name without port, optionally starting with "*."
+func validateHostPattern(pattern string) error {
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" {
+		return fmt.Errorf("must be set")
+	}
+	if strings.ContainsAny(host, ":/*") {
+		return fmt.Errorf("invalid host '%s', expected host name or *.<domain> without port", pattern)
+	}
+	return nil
+}
+
+// validateDestination checks that destination is either port or ip:port
+func validateDestination(dst string) error {
+	port := dst
+	if host, p, err := net.SplitHostPort(dst); err == nil {
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid ip in destination '%s'", dst)
+		}
+		port = p
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in destination '%s', expected <port> or <ip:port>", dst)
+	}
+	return nil
+}
+
+// validateStatsdTemplate checks that template consists of non-empty dot separated segments
+// and placeholders are whole segments allowed for metric
+func validateStatsdTemplate(metric string, template string) error {
+	vars, ok := StatsdTemplateVars[metric]
+	if !ok {
+		return fmt.Errorf("unknown metric %s", metric)
+	}
+	for _, segment := range strings.Split(template, ".") {
+		if segment == "" {
+			return fmt.Errorf("%s: empty segment in template '%s'", metric, template)
+		}
+		if !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			return fmt.Errorf("%s: placeholder must be whole segment in template '%s'", metric, template)
+		}
+		name := segment[1 : len(segment)-1]
+		allowed := false
+		for _, v := range vars {
+			allowed = allowed || v == name
+		}
+		if !allowed {
+			return fmt.Errorf("%s: unknown placeholder {%s}, expected one of %s", metric, name, strings.Join(vars, ", "))
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *Config)
+		expected string
+	}{
+		{"port", func(cfg *Config) { cfg.Netra.Port = 0 }, "port: must be set"},
+		{"port conflict", func(cfg *Config) { cfg.Netra.AdminPort = cfg.Netra.Port }, "port: 14956 is already used by admin_port"},
+		{"admin host", func(cfg *Config) { cfg.Netra.AdminHost = "localhost" }, "admin_host: invalid IP address 'localhost'"},
+		{"interception mode", func(cfg *Config) { cfg.Netra.InterceptionMode = "nat" },
+			"interception_mode: unknown mode 'nat', expected redirect or tproxy"},
+		{"negative duration", func(cfg *Config) { cfg.Netra.DialTimeout = -time.Second }, "timeouts.dial: must not be negative, got -1s"},
+		{"zero duration", func(cfg *Config) { cfg.Netra.ProxyProtocolTimeout = 0 }, "proxy_protocol.timeout: must be positive, got 0s"},
+		{"statsd address", func(cfg *Config) { cfg.Netra.StatsdEnabled = true }, "statsd.address: must be set when statsd is enabled"},
+		{"statsd template", func(cfg *Config) { cfg.Netra.StatsdTemplates[StatsdInboundStatus] = "inbound.{path}" },
+			"statsd.templates: inbound_status: unknown placeholder {path}"},
+		{"statsd metric", func(cfg *Config) { cfg.Netra.StatsdTemplates["latency"] = "latency" }, "statsd.templates: unknown metric latency"},
+		{"port lists", func(cfg *Config) {
+			cfg.Netra.HTTPProtoPorts = portSet([]uint16{8080})
+			cfg.Netra.TCPProtoPorts = portSet([]uint16{8080})
+		}, "protocols.tcp_ports: port 8080 is also listed in protocols.http_ports"},
+		{"protocol map", func(cfg *Config) { cfg.Netra.ProtocolMap["db:5432"] = "postgres" }, "protocols.map: invalid ip in destination 'db:5432'"},
+		{"path template", func(cfg *Config) { cfg.Netra.MetricsPathTemplates = []string{"users/{id}"} },
+			"metrics.path_templates: template 'users/{id}' must start with /"},
+		{"access log template", func(cfg *Config) {
+			cfg.Netra.AccessLogFormat = AccessLogFormatText
+			cfg.Netra.AccessLogTemplate = "{{.Method"
+		}, "access_log.template: "},
+		{"access log sample rate", func(cfg *Config) { cfg.Netra.AccessLogSampleRate = 0 }, "access_log.sample_rate: must be in (0, 1], got 0"},
+		{"mtls files", func(cfg *Config) { cfg.Netra.MTLSEnabled = true }, "mtls.cert_file: must be set when mtls is enabled"},
+		{"mtls destination", func(cfg *Config) { cfg.Netra.MTLSDestinations = []string{"mesh"} }, "mtls.destinations: invalid destination 'mesh'"},
+		{"routing cookie", func(cfg *Config) { cfg.HTTP.RoutingCookieEnabled = true }, "http.routing.cookie_enabled: requires http.routing.enabled"},
+		{"ignored path", func(cfg *Config) { cfg.HTTP.TracingIgnoredPaths["health"] = true },
+			"http.tracing_ignored_paths: path 'health' must start with /"},
+		{"origination host", func(cfg *Config) {
+			cfg.HTTP.TLSOrigination = []TLSOriginationRule{{Host: "api.example.com:443", Port: 443}}
+		}, "http.tls_origination[0].host: invalid host 'api.example.com:443'"},
+		{"origination key", func(cfg *Config) {
+			cfg.HTTP.TLSOrigination = []TLSOriginationRule{{Host: "api.example.com", Port: 443, CertFile: "cert.pem"}}
+		}, "http.tls_origination[0]: cert_file and key_file must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("expected *ValidationError, got %v", err)
+			}
+			for _, problem := range validationErr.Problems {
+				if strings.HasPrefix(problem, tt.expected) {
+					return
+				}
+			}
+			t.Errorf("expected problem starting with %q, got %v", tt.expected, validationErr.Problems)
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	cfg := Default()
+	cfg.Netra.Port = 0
+	cfg.HTTP.RequestIdHeaderName = ""
+	cfg.Netra.AccessLogFormat = "csv"
+	err, ok := cfg.Validate().(*ValidationError)
+	if !ok {
+		t.Fatal("expected *ValidationError")
+	}
+	if len(err.Problems) != 3 {
+		t.Errorf("expected 3 problems, got %v", err.Problems)
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("expected default configuration to be valid, got %v", err)
+	}
+}
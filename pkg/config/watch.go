@@ -0,0 +1,40 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+)
+
+// Watch checks configuration file every interval and calls onChange when its content is changed.
+// Content is compared instead of modification time, so files replaced by symlink swap
+// (e.g. kubernetes ConfigMap volumes) are handled too. It returns when done is closed.
+func Watch(path string, interval time.Duration, done <-chan struct{}, onChange func()) {
+	last := fileHash(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			h := fileHash(path)
+			// file can be absent for a moment while being replaced
+			if h == nil || bytes.Equal(h, last) {
+				continue
+			}
+			last = h
+			onChange()
+		}
+	}
+}
+
+func fileHash(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	h := sha256.Sum256(data)
+	return h[:]
+}
@@ -0,0 +1,87 @@
+package drain
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker tracks active connections of proxy instance and its draining state.
+// Connections can be added while Wait is waiting, e.g. accepted right before listeners are closed.
+type Tracker struct {
+	draining int32
+	mu       sync.Mutex
+	active   int64
+	// idle is signaled when the last active connection is finished
+	idle *sync.Cond
+}
+
+// NewTracker creates connection tracker
+func NewTracker() *Tracker {
+	t := &Tracker{}
+	t.idle = sync.NewCond(&t.mu)
+	return t
+}
+
+// Start switches proxy into draining mode: no new connections should be accepted
+// and keep-alive connections should be closed at the next response boundary
+func (t *Tracker) Start() {
+	atomic.StoreInt32(&t.draining, 1)
+}
+
+// Draining reports whether draining was started
+func (t *Tracker) Draining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+// Add registers new active connection
+func (t *Tracker) Add() {
+	t.mu.Lock()
+	t.active++
+	t.mu.Unlock()
+}
+
+// Done unregisters finished connection
+func (t *Tracker) Done() {
+	t.mu.Lock()
+	t.active--
+	if t.active == 0 {
+		t.idle.Broadcast()
+	}
+	t.mu.Unlock()
+}
+
+// Active returns number of active connections
+func (t *Tracker) Active() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// Wait waits for all active connections to finish, but not longer than until done is closed.
+// progress is called every interval with the current number of active connections.
+// It returns false if done is closed before all connections are finished.
+func (t *Tracker) Wait(done <-chan struct{}, interval time.Duration, progress func(active int64)) bool {
+	finished := make(chan struct{})
+	go func() {
+		t.mu.Lock()
+		for t.active > 0 {
+			t.idle.Wait()
+		}
+		t.mu.Unlock()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-finished:
+			return true
+		case <-done:
+			return false
+		case <-ticker.C:
+			progress(t.Active())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package drain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrackerAddWhileWaiting(t *testing.T) {
+	tracker := NewTracker()
+	tracker.Add()
+	result := make(chan bool)
+	go func() {
+		result <- tracker.Wait(nil, time.Hour, func(int64) {})
+	}()
+	// connection accepted right before listeners are closed is registered while Wait is blocked
+	time.Sleep(10 * time.Millisecond)
+	tracker.Add()
+	tracker.Done()
+	select {
+	case <-result:
+		t.Fatal("Wait returned while connection is active")
+	case <-time.After(10 * time.Millisecond):
+	}
+	tracker.Done()
+	select {
+	case drained := <-result:
+		if !drained {
+			t.Error("expected drained result")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after the last connection finished")
+	}
+	if active := tracker.Active(); active != 0 {
+		t.Errorf("expected no active connections, got %d", active)
+	}
+}
@@ -1,38 +1,188 @@
 package estabcache
 
 import (
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Lookyan/netramesh/pkg/log"
 )
 
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// Connection describes active proxied connection
+type Connection struct {
+	ID uint64 `json:"id"`
+	// Source is client address, it's taken from PROXY protocol header if it was received
+	Source              string `json:"source"`
+	OriginalDestination string `json:"original_destination"`
+	// Destination is actual upstream address, it differs from original one in case of routing
+	Destination string `json:"destination"`
+	Direction   string `json:"direction"`
+	Protocol    string `json:"protocol"`
+	// PeerIdentity is identity of mutual TLS peer sidecar
+	PeerIdentity string    `json:"peer_identity,omitempty"`
+	StartTime    time.Time `json:"start_time"`
+	// BytesFromSource and BytesToSource are bytes received from and sent to client
+	BytesFromSource uint64 `json:"bytes_from_source"`
+	BytesToSource   uint64 `json:"bytes_to_source"`
+	HTTPRequests    int64  `json:"http_requests"`
+}
+
+// Filter selects connections, empty fields match any connection
+type Filter struct {
+	Direction string
+	Protocol  string
+	// Source and Destination match substring of address, Destination matches original destination too
+	Source      string
+	Destination string
+	// MinAge selects connections started at least MinAge ago
+	MinAge time.Duration
+}
+
+func (f Filter) match(c *Connection, now time.Time) bool {
+	if f.Direction != "" && f.Direction != c.Direction {
+		return false
+	}
+	if f.Protocol != "" && f.Protocol != c.Protocol {
+		return false
+	}
+	if f.Source != "" && !strings.Contains(c.Source, f.Source) {
+		return false
+	}
+	if f.Destination != "" &&
+		!strings.Contains(c.Destination, f.Destination) &&
+		!strings.Contains(c.OriginalDestination, f.Destination) {
+		return false
+	}
+	return now.Sub(c.StartTime) >= f.MinAge
+}
+
+// Entry is registered connection, it's updated by connection handler
+type Entry struct {
+	mu           sync.Mutex
+	conn         Connection
+	httpRequests int64
+	closeFunc    func()
+	counters     func() (fromSource uint64, toSource uint64)
+}
+
+// ID returns connection id
+func (en *Entry) ID() uint64 {
+	return en.conn.ID
+}
+
+// SetDestination updates actual upstream address
+func (en *Entry) SetDestination(addr string) {
+	en.mu.Lock()
+	en.conn.Destination = addr
+	en.mu.Unlock()
+}
+
+// SetPeerIdentity updates identity of mutual TLS peer sidecar
+func (en *Entry) SetPeerIdentity(identity string) {
+	en.mu.Lock()
+	en.conn.PeerIdentity = identity
+	en.mu.Unlock()
+}
+
+// IncHTTPRequests counts HTTP request read from client
+func (en *Entry) IncHTTPRequests() {
+	atomic.AddInt64(&en.httpRequests, 1)
+}
+
+func (en *Entry) snapshot() Connection {
+	en.mu.Lock()
+	c := en.conn
+	en.mu.Unlock()
+	c.HTTPRequests = atomic.LoadInt64(&en.httpRequests)
+	if en.counters != nil {
+		c.BytesFromSource, c.BytesToSource = en.counters()
+	}
+	return c
+}
+
+// EstablishedCache is a registry of active proxied connections
 type EstablishedCache struct {
-	rw sync.RWMutex
-	m  map[string]string
+	rw     sync.RWMutex
+	m      map[uint64]*Entry
+	lastID uint64
 }
 
 func NewEstablishedCache() *EstablishedCache {
 	return &EstablishedCache{
 		rw: sync.RWMutex{},
-		m:  make(map[string]string),
+		m:  make(map[uint64]*Entry),
 	}
 }
 
-func (e *EstablishedCache) Add(addr string) {
+// Add registers connection, StartTime is set to current time.
+// closeFunc forcibly closes connection, counters returns bytes received from and sent to client.
+func (e *EstablishedCache) Add(
+	conn Connection,
+	closeFunc func(),
+	counters func() (fromSource uint64, toSource uint64)) *Entry {
+	conn.ID = atomic.AddUint64(&e.lastID, 1)
+	conn.StartTime = time.Now()
+	en := &Entry{
+		conn:      conn,
+		closeFunc: closeFunc,
+		counters:  counters,
+	}
 	e.rw.Lock()
-	e.m[addr] = time.Now().String()
+	e.m[conn.ID] = en
 	e.rw.Unlock()
+	return en
 }
 
-func (e *EstablishedCache) Remove(addr string) {
+// Remove unregisters finished connection
+func (e *EstablishedCache) Remove(en *Entry) {
 	e.rw.Lock()
-	delete(e.m, addr)
+	delete(e.m, en.conn.ID)
 	e.rw.Unlock()
 }
 
-func (e *EstablishedCache) PrintConnections(logger *log.Logger) {
+// List returns connections matching filter ordered by start time
+func (e *EstablishedCache) List(f Filter) []Connection {
 	e.rw.RLock()
-	logger.Info(e.m)
+	entries := make([]*Entry, 0, len(e.m))
+	for _, en := range e.m {
+		entries = append(entries, en)
+	}
 	e.rw.RUnlock()
+
+	now := time.Now()
+	res := make([]Connection, 0, len(entries))
+	for _, en := range entries {
+		c := en.snapshot()
+		if f.match(&c, now) {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Close forcibly closes connection, it returns false if there is no active connection with id
+func (e *EstablishedCache) Close(id uint64) bool {
+	e.rw.RLock()
+	en, ok := e.m[id]
+	e.rw.RUnlock()
+	if !ok {
+		return false
+	}
+	en.closeFunc()
+	return true
+}
+
+func (e *EstablishedCache) PrintConnections(logger *log.Logger) {
+	for _, c := range e.List(Filter{}) {
+		logger.Infof("%d %s %s -> %s (%s) %s since %s",
+			c.ID, c.Direction, c.Source, c.Destination, c.OriginalDestination, c.Protocol, c.StartTime)
+	}
 }
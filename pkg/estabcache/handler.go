@@ -0,0 +1,59 @@
+package estabcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NewHandler returns HTTP handler exposing connections registry:
+//
+//	GET  <prefix>       lists active connections as JSON, query parameters direction, protocol,
+//	                    source, destination and min_age (e.g. 10s) filter them
+//	POST <prefix>/close closes connection with id query parameter
+func NewHandler(e *EstablishedCache, prefix string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		f := Filter{
+			Direction:   q.Get("direction"),
+			Protocol:    q.Get("protocol"),
+			Source:      q.Get("source"),
+			Destination: q.Get("destination"),
+		}
+		if v := q.Get("min_age"); v != "" {
+			minAge, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid min_age '%s'", v), http.StatusBadRequest)
+				return
+			}
+			f.MinAge = minAge
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.List(f))
+	})
+	mux.HandleFunc(prefix+"/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v := r.URL.Query().Get("id")
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id '%s'", v), http.StatusBadRequest)
+			return
+		}
+		if !e.Close(id) {
+			http.Error(w, fmt.Sprintf("connection %d not found", id), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "connection %d closed\n", id)
+	})
+	return mux
+}
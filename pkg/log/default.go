@@ -5,8 +5,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -16,6 +21,17 @@ var (
 
 type Level int
 
+// switchFrameLvl is a number of stack frames from inner logger Output to caller of Logger method
+const switchFrameLvl = 3
+
+var levelPrefixes = map[Level]string{
+	FatalLevel: "FATAL: ",
+	ErrorLevel: "ERROR: ",
+	WarnLevel:  "WARN: ",
+	InfoLevel:  "INFO: ",
+	DebugLevel: "DEBUG: ",
+}
+
 const (
 	initText                  = "Logger Init wasn't called"
 	flags                     = log.Ldate | log.Lmicroseconds | log.Lshortfile
@@ -27,294 +43,403 @@ const (
 	DebugLevel
 )
 
+// Logger writes leveled messages. Loggers created with With and Named share
+// output, format and levels with their parent.
 type Logger struct {
-	outputLevel Level
+	core *core
+	// subsystem selects level override and is written as subsystem field
+	subsystem string
+	// fields are key-value pairs bound to logger
+	fields []interface{}
+}
+
+// core is a state shared by logger and its children
+type core struct {
+	// outputLevel is accessed atomically, level can be changed at runtime
+	outputLevel int32
+	// levels is map[string]Level of subsystem level overrides
+	levels      atomic.Value
+	format      int32
 	inner       *log.Logger
 	closer      io.Closer
+	limiter     *rateLimiter
 	initialized bool
 }
 
+func newCore(name string, level Level, out io.Writer) *core {
+	c := &core{
+		outputLevel: int32(level),
+		format:      int32(TextFormat),
+		inner:       log.New(out, name, flags),
+		limiter:     newRateLimiter(),
+	}
+	c.levels.Store(map[string]Level(nil))
+	return c
+}
+
 func init() {
-	defaultLogger = &Logger{
-		outputLevel: DebugLevel,
-		inner:       log.New(os.Stderr, initText, flags),
+	defaultLogger = &Logger{core: newCore(initText, DebugLevel, os.Stderr)}
+}
+
+// ParseLevel converts level name (fatal, error, warning, warn, info, debug) to Level
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "fatal":
+		return FatalLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "warning", "warn":
+		return WarnLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "debug":
+		return DebugLevel, nil
 	}
+	return 0, fmt.Errorf("invalid logger level %s", name)
+}
+
+func (l Level) String() string {
+	switch l {
+	case FatalLevel:
+		return "fatal"
+	case ErrorLevel:
+		return "error"
+	case WarnLevel:
+		return "warning"
+	case InfoLevel:
+		return "info"
+	case DebugLevel:
+		return "debug"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
 }
 
 func Init(name string, errorLevel string, logFile io.Writer) (*Logger, error) {
 	level := InfoLevel
 	if errorLevel != "" {
-		errorLevel = strings.ToLower(errorLevel)
-		switch errorLevel {
-		case "fatal":
-			level = FatalLevel
-		case "error":
-			level = ErrorLevel
-		case "warning":
-			level = WarnLevel
-		case "warn":
-			level = WarnLevel
-		case "info":
-			level = InfoLevel
-		case "debug":
-			level = DebugLevel
-		default:
-			return nil, fmt.Errorf("invalid logger level %s", errorLevel)
+		var err error
+		level, err = ParseLevel(errorLevel)
+		if err != nil {
+			return nil, err
 		}
 	}
-	var il io.Writer
-
-	iLogs := []io.Writer{logFile}
-	if il != nil {
-		iLogs = append(iLogs, il)
+	l := Logger{core: newCore(name, level, logFile)}
+	if closer, ok := logFile.(io.Closer); ok {
+		l.core.closer = closer
 	}
-
-	l := Logger{
-		outputLevel: level,
-		inner:       log.New(io.MultiWriter(iLogs...), name, flags),
-	}
-	l.closer = logFile.(io.Closer)
-	l.initialized = true
+	l.core.initialized = true
 
 	logLock.Lock()
 	defer logLock.Unlock()
-	if !defaultLogger.initialized {
+	if !defaultLogger.core.initialized {
 		defaultLogger = &l
 	}
 
 	return &l, nil
 }
 
+// Level returns current output level of logger, it's subsystem level in case it's overridden
+func (l *Logger) Level() Level {
+	if l.subsystem != "" {
+		if level, ok := l.core.levels.Load().(map[string]Level)[l.subsystem]; ok {
+			return level
+		}
+	}
+	return Level(atomic.LoadInt32(&l.core.outputLevel))
+}
+
+// SetLevel changes output level of logger and all its children without subsystem level override
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.core.outputLevel, int32(level))
+}
+
+// SetSubsystemLevels replaces level overrides of subsystems, see Named
+func (l *Logger) SetSubsystemLevels(levels map[string]Level) {
+	copied := make(map[string]Level, len(levels))
+	for subsystem, level := range levels {
+		copied[subsystem] = level
+	}
+	l.core.levels.Store(copied)
+}
+
+// SetFormat changes output format of logger and all its children
+func (l *Logger) SetFormat(format Format) {
+	atomic.StoreInt32(&l.core.format, int32(format))
+}
+
+// SetWarningRateLimit limits number of warnings with the same message format written per second,
+// suppressed warnings are counted in suppressed field of the next written one. 0 disables limiting.
+func (l *Logger) SetWarningRateLimit(perSecond int) {
+	l.core.limiter.setLimit(perSecond)
+}
+
 func (l *Logger) Close() {
 	logLock.Lock()
 	defer logLock.Unlock()
-	if err := l.closer.Close(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error on log %v closing %v\n", l.closer, err)
+	if l.core.closer == nil {
+		return
+	}
+	if err := l.core.closer.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error on log %v closing %v\n", l.core.closer, err)
 	}
 }
 
 func (l *Logger) Debug(v ...interface{}) {
-	if l.outputLevel < DebugLevel {
+	if l.Level() < DebugLevel {
 		return
 	}
-	l.output(DebugLevel, 0, fmt.Sprint(v...))
+	l.output(DebugLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) DebugDepth(depth int, v ...interface{}) {
-	if l.outputLevel < DebugLevel {
+	if l.Level() < DebugLevel {
 		return
 	}
-	l.output(DebugLevel, depth, fmt.Sprint(v...))
+	l.output(DebugLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) Debugln(v ...interface{}) {
-	if l.outputLevel < DebugLevel {
+	if l.Level() < DebugLevel {
 		return
 	}
-	l.output(DebugLevel, 0, fmt.Sprintln(v...))
+	l.output(DebugLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.outputLevel < DebugLevel {
+	if l.Level() < DebugLevel {
 		return
 	}
-	l.output(DebugLevel, 0, fmt.Sprintf(format, v...))
+	l.output(DebugLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func (l *Logger) Info(v ...interface{}) {
-	if l.outputLevel < InfoLevel {
+	if l.Level() < InfoLevel {
 		return
 	}
-	l.output(InfoLevel, 0, fmt.Sprint(v...))
+	l.output(InfoLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) InfoDepth(depth int, v ...interface{}) {
-	if l.outputLevel < InfoLevel {
+	if l.Level() < InfoLevel {
 		return
 	}
-	l.output(InfoLevel, depth, fmt.Sprint(v...))
+	l.output(InfoLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) Infoln(v ...interface{}) {
-	if l.outputLevel < InfoLevel {
+	if l.Level() < InfoLevel {
 		return
 	}
-	l.output(InfoLevel, 0, fmt.Sprintln(v...))
+	l.output(InfoLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.outputLevel < InfoLevel {
+	if l.Level() < InfoLevel {
 		return
 	}
-	l.output(InfoLevel, 0, fmt.Sprintf(format, v...))
+	l.output(InfoLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func (l *Logger) Warning(v ...interface{}) {
-	if l.outputLevel < WarnLevel {
+	if l.Level() < WarnLevel {
 		return
 	}
-	l.output(WarnLevel, 0, fmt.Sprint(v...))
+	l.output(WarnLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) WarningDepth(depth int, v ...interface{}) {
-	if l.outputLevel < WarnLevel {
+	if l.Level() < WarnLevel {
 		return
 	}
-	l.output(WarnLevel, depth, fmt.Sprint(v...))
+	l.output(WarnLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) Warningln(v ...interface{}) {
-	if l.outputLevel < WarnLevel {
+	if l.Level() < WarnLevel {
 		return
 	}
-	l.output(WarnLevel, 0, fmt.Sprintln(v...))
+	l.output(WarnLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func (l *Logger) Warningf(format string, v ...interface{}) {
-	if l.outputLevel < WarnLevel {
+	if l.Level() < WarnLevel {
 		return
 	}
-	l.output(WarnLevel, 0, fmt.Sprintf(format, v...))
+	l.output(WarnLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func (l *Logger) Error(v ...interface{}) {
-	if l.outputLevel < ErrorLevel {
+	if l.Level() < ErrorLevel {
 		return
 	}
-	l.output(ErrorLevel, 0, fmt.Sprint(v...))
+	l.output(ErrorLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) ErrorDepth(depth int, v ...interface{}) {
-	if l.outputLevel < ErrorLevel {
+	if l.Level() < ErrorLevel {
 		return
 	}
-	l.output(ErrorLevel, depth, fmt.Sprint(v...))
+	l.output(ErrorLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func (l *Logger) Errorln(v ...interface{}) {
-	if l.outputLevel < ErrorLevel {
+	if l.Level() < ErrorLevel {
 		return
 	}
-	l.output(ErrorLevel, 0, fmt.Sprintln(v...))
+	l.output(ErrorLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.outputLevel < ErrorLevel {
+	if l.Level() < ErrorLevel {
 		return
 	}
-	l.output(ErrorLevel, 0, fmt.Sprintf(format, v...))
+	l.output(ErrorLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func (l *Logger) Fatal(v ...interface{}) {
-	l.output(FatalLevel, 0, fmt.Sprint(v...))
+	l.output(FatalLevel, 0, "", fmt.Sprint(v...), nil)
 	l.Close()
 	os.Exit(1)
 }
 
 func (l *Logger) FatalDepth(depth int, v ...interface{}) {
-	l.output(FatalLevel, depth, fmt.Sprint(v...))
+	l.output(FatalLevel, depth, "", fmt.Sprint(v...), nil)
 	l.Close()
 	os.Exit(1)
 }
 
 func (l *Logger) Fatalln(v ...interface{}) {
-	l.output(FatalLevel, 0, fmt.Sprintln(v...))
+	l.output(FatalLevel, 0, "", fmt.Sprintln(v...), nil)
 	l.Close()
 	os.Exit(1)
 }
 
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	l.output(FatalLevel, 0, fmt.Sprintf(format, v...))
+	l.output(FatalLevel, 0, format, fmt.Sprintf(format, v...), nil)
 	l.Close()
 	os.Exit(1)
 }
 
 func Info(v ...interface{}) {
-	defaultLogger.output(InfoLevel, 0, fmt.Sprint(v...))
+	defaultLogger.output(InfoLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func InfoDepth(depth int, v ...interface{}) {
-	defaultLogger.output(InfoLevel, depth, fmt.Sprint(v...))
+	defaultLogger.output(InfoLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func Infoln(v ...interface{}) {
-	defaultLogger.output(InfoLevel, 0, fmt.Sprintln(v...))
+	defaultLogger.output(InfoLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func Infof(format string, v ...interface{}) {
-	defaultLogger.output(InfoLevel, 0, fmt.Sprintf(format, v...))
+	defaultLogger.output(InfoLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func Warning(v ...interface{}) {
-	defaultLogger.output(WarnLevel, 0, fmt.Sprint(v...))
+	defaultLogger.output(WarnLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func WarningDepth(depth int, v ...interface{}) {
-	defaultLogger.output(WarnLevel, depth, fmt.Sprint(v...))
+	defaultLogger.output(WarnLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func Warningln(v ...interface{}) {
-	defaultLogger.output(WarnLevel, 0, fmt.Sprintln(v...))
+	defaultLogger.output(WarnLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func Warningf(format string, v ...interface{}) {
-	defaultLogger.output(WarnLevel, 0, fmt.Sprintf(format, v...))
+	defaultLogger.output(WarnLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func Error(v ...interface{}) {
-	defaultLogger.output(ErrorLevel, 0, fmt.Sprint(v...))
+	defaultLogger.output(ErrorLevel, 0, "", fmt.Sprint(v...), nil)
 }
 
 func ErrorDepth(depth int, v ...interface{}) {
-	defaultLogger.output(ErrorLevel, depth, fmt.Sprint(v...))
+	defaultLogger.output(ErrorLevel, depth, "", fmt.Sprint(v...), nil)
 }
 
 func Errorln(v ...interface{}) {
-	defaultLogger.output(ErrorLevel, 0, fmt.Sprintln(v...))
+	defaultLogger.output(ErrorLevel, 0, "", fmt.Sprintln(v...), nil)
 }
 
 func Errorf(format string, v ...interface{}) {
-	defaultLogger.output(ErrorLevel, 0, fmt.Sprintf(format, v...))
+	defaultLogger.output(ErrorLevel, 0, format, fmt.Sprintf(format, v...), nil)
 }
 
 func Fatal(v ...interface{}) {
-	defaultLogger.output(FatalLevel, 0, fmt.Sprint(v...))
+	defaultLogger.output(FatalLevel, 0, "", fmt.Sprint(v...), nil)
 	defaultLogger.Close()
 	os.Exit(1)
 }
 
 func FatalDepth(depth int, v ...interface{}) {
-	defaultLogger.output(FatalLevel, depth, fmt.Sprint(v...))
+	defaultLogger.output(FatalLevel, depth, "", fmt.Sprint(v...), nil)
 	defaultLogger.Close()
 	os.Exit(1)
 }
 
 func Fatalln(v ...interface{}) {
-	defaultLogger.output(FatalLevel, 0, fmt.Sprintln(v...))
+	defaultLogger.output(FatalLevel, 0, "", fmt.Sprintln(v...), nil)
 	defaultLogger.Close()
 	os.Exit(1)
 }
 
 func Fatalf(format string, v ...interface{}) {
-	defaultLogger.output(FatalLevel, 0, fmt.Sprintf(format, v...))
+	defaultLogger.output(FatalLevel, 0, format, fmt.Sprintf(format, v...), nil)
 	defaultLogger.Close()
 	os.Exit(1)
 }
 
-func (l *Logger) output(s Level, depth int, txt string) {
+// output writes message of level s, key identifies message for warnings rate limiting
+func (l *Logger) output(s Level, depth int, key string, txt string, kv []interface{}) {
+	if l.Level() < s {
+		return
+	}
+	if s == WarnLevel {
+		if key == "" {
+			key = txt
+		}
+		allowed, suppressed := l.core.limiter.allow(key, time.Now())
+		if !allowed {
+			return
+		}
+		if suppressed > 0 {
+			kv = append(kv[:len(kv):len(kv)], "suppressed", suppressed)
+		}
+	}
+	fields := l.fields
+	if l.subsystem != "" {
+		fields = append([]interface{}{"subsystem", l.subsystem}, fields...)
+	}
+	if len(kv) > 0 {
+		fields = append(fields[:len(fields):len(fields)], kv...)
+	}
+	txt = strings.TrimSuffix(txt, "\n")
+
 	logLock.Lock()
-	var switchFrameLvl = 3
-	switch {
-	case s == FatalLevel && l.outputLevel >= FatalLevel:
-		l.inner.Output(switchFrameLvl+depth, "FATAL: "+txt)
-	case s == ErrorLevel && l.outputLevel >= ErrorLevel:
-		l.inner.Output(switchFrameLvl+depth, "ERROR: "+txt)
-	case s == WarnLevel && l.outputLevel >= WarnLevel:
-		l.inner.Output(switchFrameLvl+depth, "WARN: "+txt)
-	case s == InfoLevel && l.outputLevel >= InfoLevel:
-		l.inner.Output(switchFrameLvl+depth, "INFO: "+txt)
-	case s == DebugLevel && l.outputLevel >= DebugLevel:
-		l.inner.Output(switchFrameLvl+depth, "DEBUG: "+txt)
-	}
-	logLock.Unlock()
+	defer logLock.Unlock()
+	format := Format(atomic.LoadInt32(&l.core.format))
+	if format == TextFormat {
+		l.core.inner.Output(switchFrameLvl+depth, levelPrefixes[s]+txt+encodeText(fields))
+		return
+	}
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(switchFrameLvl - 1 + depth); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	e := entry{
+		time:    time.Now(),
+		level:   s,
+		name:    l.core.inner.Prefix(),
+		caller:  caller,
+		message: txt,
+		fields:  fields,
+	}
+	if format == JSONFormat {
+		l.core.inner.Writer().Write(e.json())
+		return
+	}
+	l.core.inner.Writer().Write(e.logfmt())
 }
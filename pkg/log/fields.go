@@ -0,0 +1,185 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is an output format of logger
+type Format int32
+
+const (
+	// TextFormat is a classic "<name><date> <file:line>: LEVEL: message key=value" line
+	TextFormat Format = iota
+	// JSONFormat writes JSON object per line with time, level, logger, caller, msg and fields keys
+	JSONFormat
+	// LogfmtFormat writes key=value pairs with the same keys as JSONFormat
+	LogfmtFormat
+)
+
+// ParseFormat converts format name (text, json, logfmt) to Format
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JSONFormat, nil
+	case "logfmt":
+		return LogfmtFormat, nil
+	}
+	return 0, fmt.Errorf("invalid logger format %s", name)
+}
+
+func (f Format) String() string {
+	switch f {
+	case TextFormat:
+		return "text"
+	case JSONFormat:
+		return "json"
+	case LogfmtFormat:
+		return "logfmt"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// With returns child logger which writes key-value pairs with each message,
+// e.g. logger.With("conn_id", id, "original_dst", dst)
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	return &child
+}
+
+// Named returns child logger of subsystem, its level can be overridden with SetSubsystemLevels
+func (l *Logger) Named(subsystem string) *Logger {
+	child := *l
+	child.subsystem = subsystem
+	return &child
+}
+
+// Debugw writes message with key-value pairs
+func (l *Logger) Debugw(msg string, kv ...interface{}) {
+	l.output(DebugLevel, 0, msg, msg, kv)
+}
+
+// Infow writes message with key-value pairs
+func (l *Logger) Infow(msg string, kv ...interface{}) {
+	l.output(InfoLevel, 0, msg, msg, kv)
+}
+
+// Warningw writes message with key-value pairs, warnings are rate limited by message
+func (l *Logger) Warningw(msg string, kv ...interface{}) {
+	l.output(WarnLevel, 0, msg, msg, kv)
+}
+
+// Errorw writes message with key-value pairs
+func (l *Logger) Errorw(msg string, kv ...interface{}) {
+	l.output(ErrorLevel, 0, msg, msg, kv)
+}
+
+// entry is a message of structured formats
+type entry struct {
+	time    time.Time
+	level   Level
+	name    string
+	caller  string
+	message string
+	fields  []interface{}
+}
+
+func (e entry) json() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONField(&buf, "time", e.time.Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONField(&buf, "level", e.level.String())
+	buf.WriteByte(',')
+	writeJSONField(&buf, "logger", e.name)
+	buf.WriteByte(',')
+	writeJSONField(&buf, "caller", e.caller)
+	buf.WriteByte(',')
+	writeJSONField(&buf, "msg", e.message)
+	forEachField(e.fields, func(key string, value interface{}) {
+		buf.WriteByte(',')
+		writeJSONField(&buf, key, value)
+	})
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func (e entry) logfmt() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("time=" + e.time.Format(time.RFC3339Nano))
+	buf.WriteString(" level=" + e.level.String())
+	buf.WriteString(" logger=" + logfmtValue(e.name))
+	buf.WriteString(" caller=" + logfmtValue(e.caller))
+	buf.WriteString(" msg=" + logfmtValue(e.message))
+	buf.WriteString(encodeText(e.fields))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// encodeText returns " key=value" pairs appended to text and logfmt lines
+func encodeText(fields []interface{}) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	forEachField(fields, func(key string, value interface{}) {
+		b.WriteString(" " + logfmtValue(key) + "=" + logfmtValue(fmt.Sprint(fieldValue(value))))
+	})
+	return b.String()
+}
+
+// forEachField calls f for key-value pairs, value without key is reported with "extra" key
+func forEachField(fields []interface{}, f func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			f("extra", fields[i])
+			return
+		}
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		f(key, fields[i+1])
+	}
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return v
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+	v, err := json.Marshal(fieldValue(value))
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(v)
+}
+
+// logfmtValue quotes value in case it's empty or contains spaces, quotes, equal signs or control characters
+func logfmtValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, r := range v {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,181 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+
+func TestEntryJSON(t *testing.T) {
+	e := entry{
+		time:    testTime,
+		level:   WarnLevel,
+		name:    "NETRA",
+		caller:  "handler.go:10",
+		message: `dial "db" failed`,
+		fields: []interface{}{
+			"conn_id", 7,
+			"err", errors.New("refused"),
+			"timeout", time.Second,
+			// value which can't be marshaled is written as string
+			"ratio", math.NaN(),
+			42, "non-string key",
+			"odd",
+		},
+	}
+	expected := `{"time":"2020-01-02T03:04:05.0000006Z","level":"warning","logger":"NETRA","caller":"handler.go:10",` +
+		`"msg":"dial \"db\" failed","conn_id":7,"err":"refused","timeout":"1s","ratio":"NaN",` +
+		`"42":"non-string key","extra":"odd"}` + "\n"
+	if got := string(e.json()); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestEntryLogfmt(t *testing.T) {
+	e := entry{
+		time:    testTime,
+		level:   InfoLevel,
+		name:    "",
+		caller:  "proxy.go:1",
+		message: "connection closed",
+		fields:  []interface{}{"dst", "10.0.0.1:80", "query", "a=b", "empty", "", "err", errors.New(`bad "quote"`)},
+	}
+	expected := `time=2020-01-02T03:04:05.0000006Z level=info logger="" caller=proxy.go:1 msg="connection closed" ` +
+		`dst=10.0.0.1:80 query="a=b" empty="" err="bad \"quote\""` + "\n"
+	if got := string(e.logfmt()); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+// newJSONLogger returns logger writing JSON lines to buffer
+func newJSONLogger(t *testing.T, level string) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l, err := Init("TEST", level, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetFormat(JSONFormat)
+	return l, &buf
+}
+
+// lines returns decoded JSON lines written to buffer and resets it
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid JSON line %s: %s", line, err)
+		}
+		res = append(res, m)
+	}
+	buf.Reset()
+	return res
+}
+
+func TestLoggerWithNamed(t *testing.T) {
+	l, buf := newJSONLogger(t, "info")
+	conn := l.With("conn_id", 1).Named("http")
+	// children of the same parent don't share fields
+	first := conn.With("stream", 1)
+	second := conn.With("stream", 2)
+	first.Infow("request", "method", "GET")
+	second.Info("response")
+	l.Info("parent")
+
+	got := lines(t, buf)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 lines, got %v", got)
+	}
+	expected := []map[string]interface{}{
+		{"subsystem": "http", "conn_id": 1.0, "stream": 1.0, "method": "GET", "msg": "request"},
+		{"subsystem": "http", "conn_id": 1.0, "stream": 2.0, "msg": "response"},
+		{"msg": "parent"},
+	}
+	for i, fields := range expected {
+		for key, value := range fields {
+			if got[i][key] != value {
+				t.Errorf("line %d: expected %s=%v, got %v", i, key, value, got[i][key])
+			}
+		}
+	}
+	if _, ok := got[1]["method"]; ok {
+		t.Error("expected message fields not to be inherited")
+	}
+	if _, ok := got[2]["conn_id"]; ok {
+		t.Error("expected child fields not to be written by parent")
+	}
+	if got[0]["level"] != "info" || got[0]["logger"] != "TEST" || !strings.HasPrefix(got[0]["caller"].(string), "fields_test.go:") {
+		t.Errorf("expected level, logger and caller of message, got %v", got[0])
+	}
+}
+
+func TestLoggerSubsystemLevels(t *testing.T) {
+	l, buf := newJSONLogger(t, "info")
+	httpLogger := l.Named("http")
+	tcpLogger := l.Named("tcp")
+	l.SetSubsystemLevels(map[string]Level{"http": DebugLevel, "tcp": ErrorLevel})
+	httpLogger.Debug("http debug")
+	tcpLogger.Warning("tcp warning")
+	tcpLogger.Error("tcp error")
+	l.Debug("parent debug")
+	l.Named("transport").Info("transport info")
+
+	var messages []string
+	for _, line := range lines(t, buf) {
+		messages = append(messages, line["msg"].(string))
+	}
+	expected := "http debug,tcp error,transport info"
+	if got := strings.Join(messages, ","); got != expected {
+		t.Errorf("expected messages %s, got %s", expected, got)
+	}
+
+	// level of parent applies to subsystems without override
+	l.SetLevel(DebugLevel)
+	l.Named("transport").Debug("transport debug")
+	if got := lines(t, buf); len(got) != 1 {
+		t.Errorf("expected transport debug message, got %v", got)
+	}
+	if level := tcpLogger.Level(); level != ErrorLevel {
+		t.Errorf("expected tcp level %s, got %s", ErrorLevel, level)
+	}
+}
+
+func TestLoggerTextFields(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := Init("TEST", "info", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Named("http").With("conn_id", 3).Infow("request done", "path", "/a b")
+	if got := buf.String(); !strings.HasSuffix(got, `INFO: request done subsystem=http conn_id=3 path="/a b"`+"\n") {
+		t.Errorf("unexpected text line %q", got)
+	}
+}
+
+func TestLoggerSuppressedWarnings(t *testing.T) {
+	l, buf := newJSONLogger(t, "info")
+	l.SetWarningRateLimit(1)
+	for i := 0; i < 3; i++ {
+		l.Warningf("dial %d failed", i)
+	}
+	got := lines(t, buf)
+	if len(got) != 1 || got[0]["msg"] != "dial 0 failed" {
+		t.Fatalf("expected only the first warning with the same format, got %v", got)
+	}
+	// suppressed count is written with the first warning of the next window
+	l.core.limiter.windows["dial %d failed"].start = time.Now().Add(-rateLimitWindow)
+	l.Warningf("dial %d failed", 3)
+	got = lines(t, buf)
+	if len(got) != 1 || got[0]["suppressed"] != 2.0 {
+		t.Errorf("expected warning with 2 suppressed ones, got %v", got)
+	}
+}
@@ -0,0 +1,71 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultWarningRateLimit is a number of warnings with the same message format written per second
+	DefaultWarningRateLimit = 10
+
+	rateLimitWindow = time.Second
+	// maxRateLimitKeys bounds memory used by messages without format, e.g. Warning(err.Error())
+	maxRateLimitKeys = 1024
+)
+
+type rateWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// rateLimiter limits number of messages with the same key per window
+type rateLimiter struct {
+	// limit is accessed atomically, 0 disables limiting
+	limit int32
+
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		limit:   DefaultWarningRateLimit,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+func (r *rateLimiter) setLimit(limit int) {
+	atomic.StoreInt32(&r.limit, int32(limit))
+}
+
+// allow reports whether message should be written and number of messages suppressed since previous written one
+func (r *rateLimiter) allow(key string, now time.Time) (bool, int) {
+	limit := int(atomic.LoadInt32(&r.limit))
+	if limit <= 0 {
+		return true, 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w, ok := r.windows[key]
+	if !ok {
+		if len(r.windows) >= maxRateLimitKeys {
+			r.windows = make(map[string]*rateWindow)
+		}
+		w = &rateWindow{start: now}
+		r.windows[key] = w
+	}
+	if now.Sub(w.start) >= rateLimitWindow {
+		suppressed := w.suppressed
+		*w = rateWindow{start: now, count: 1}
+		return true, suppressed
+	}
+	if w.count < limit {
+		w.count++
+		return true, 0
+	}
+	w.suppressed++
+	return false, 0
+}
@@ -0,0 +1,75 @@
+package log
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	r := newRateLimiter()
+	r.setLimit(2)
+	now := time.Now()
+	tests := []struct {
+		offset     time.Duration
+		allowed    bool
+		suppressed int
+	}{
+		{0, true, 0},
+		{100 * time.Millisecond, true, 0},
+		{200 * time.Millisecond, false, 0},
+		{900 * time.Millisecond, false, 0},
+		// the first message of the next window reports suppressed ones
+		{rateLimitWindow, true, 2},
+		{rateLimitWindow + time.Millisecond, true, 0},
+		{rateLimitWindow + 2*time.Millisecond, false, 0},
+	}
+	for i, tt := range tests {
+		allowed, suppressed := r.allow("key", now.Add(tt.offset))
+		if allowed != tt.allowed || suppressed != tt.suppressed {
+			t.Errorf("message %d: expected (%t, %d), got (%t, %d)", i, tt.allowed, tt.suppressed, allowed, suppressed)
+		}
+	}
+	// keys are limited independently
+	if allowed, _ := r.allow("other", now.Add(rateLimitWindow)); !allowed {
+		t.Error("expected message of other key to be allowed")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := newRateLimiter()
+	r.setLimit(0)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if allowed, _ := r.allow("key", now); !allowed {
+			t.Fatal("expected all messages to be allowed")
+		}
+	}
+	if len(r.windows) != 0 {
+		t.Errorf("expected no windows to be tracked, got %d", len(r.windows))
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	r := newRateLimiter()
+	r.setLimit(1)
+	now := time.Now()
+	r.allow("key", now)
+	if allowed, _ := r.allow("key", now); allowed {
+		t.Fatal("expected message over limit to be suppressed")
+	}
+	for i := 1; i < maxRateLimitKeys; i++ {
+		r.allow(strconv.Itoa(i), now)
+	}
+	if len(r.windows) != maxRateLimitKeys {
+		t.Fatalf("expected %d windows, got %d", maxRateLimitKeys, len(r.windows))
+	}
+	// windows are dropped when new key exceeds the bound
+	r.allow("new", now)
+	if len(r.windows) != 1 {
+		t.Errorf("expected windows to be reset, got %d", len(r.windows))
+	}
+	if allowed, _ := r.allow("key", now); !allowed {
+		t.Error("expected limit of evicted key to start over")
+	}
+}
@@ -0,0 +1,530 @@
+// Package metrics reports proxied HTTP and TCP traffic to Prometheus and statsd.
+// Label values taken from traffic are limited by configuration (host and caller allowlists,
+// path templates) to keep metrics cardinality bounded.
+package metrics
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+)
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+
+	// labelOther replaces label values which aren't allowed by configuration
+	labelOther = "other"
+	// labelUnknown replaces empty label values
+	labelUnknown = "unknown"
+)
+
+// Dial error reasons
+const (
+	DialErrorTimeout = "timeout"
+	DialErrorRefused = "refused"
+	DialErrorResolve = "resolve"
+	DialErrorOther   = "other"
+)
+
+var knownMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// HTTPRequest describes finished proxied HTTP request
+type HTTPRequest struct {
+	IsInbound bool
+	Method    string
+	// StatusCode is 0 in case response wasn't received
+	StatusCode int
+	Host       string
+	Path       string
+	// Caller is X-Source header value of request
+	Caller   string
+	Duration time.Duration
+}
+
+// GRPCRequest describes finished proxied gRPC call
+type GRPCRequest struct {
+	IsInbound bool
+	Host      string
+	Caller    string
+	Service   string
+	Method    string
+	// Code is grpc-status of response, it's -1 in case status wasn't received
+	Code     int
+	Duration time.Duration
+	// RequestMessages and ResponseMessages are numbers of length-prefixed messages sent in both directions
+	RequestMessages  int
+	ResponseMessages int
+}
+
+// TLSConnection describes finished outbound TLS connection inspected without decryption
+type TLSConnection struct {
+	// ServerName is SNI of ClientHello
+	ServerName string
+	// Version is negotiated version, it's empty in case ServerHello wasn't received
+	Version string
+	// HandshakeDuration is 0 in case handshake wasn't finished
+	HandshakeDuration time.Duration
+	// SentBytes and ReceivedBytes are bytes sent to and received from server including handshake
+	SentBytes     int64
+	ReceivedBytes int64
+}
+
+// grpcCodes are names of gRPC status codes
+var grpcCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// GRPCCodeName returns name of gRPC status code like UNAVAILABLE
+func GRPCCodeName(code int) string {
+	if code < 0 {
+		return "none"
+	}
+	if code >= len(grpcCodes) {
+		return labelOther
+	}
+	return grpcCodes[code]
+}
+
+// Metrics keeps Prometheus collectors and statsd client of a single proxy instance
+type Metrics struct {
+	statsd *statsd.Client
+
+	httpRequests      *prometheus.CounterVec
+	httpDuration      *prometheus.HistogramVec
+	connections       *prometheus.CounterVec
+	activeConnections *prometheus.GaugeVec
+	receivedBytes     *prometheus.CounterVec
+	sentBytes         *prometheus.CounterVec
+	dialErrors        *prometheus.CounterVec
+	grpcRequests      *prometheus.CounterVec
+	grpcDuration      *prometheus.HistogramVec
+	grpcMessages      *prometheus.CounterVec
+	mtlsHandshakes    *prometheus.CounterVec
+	tlsConnections    *prometheus.CounterVec
+	tlsHandshake      *prometheus.HistogramVec
+	tlsSentBytes      *prometheus.CounterVec
+	tlsReceivedBytes  *prometheus.CounterVec
+	configReloads     *prometheus.CounterVec
+
+	// rules is *labelRules of current configuration
+	rules atomic.Value
+}
+
+// New creates metrics and registers them with registerer, nil registerer leaves metrics unregistered.
+// statsdClient should be created with tags format of configuration, nil client mutes statsd metrics.
+func New(registerer prometheus.Registerer, statsdClient *statsd.Client, cfg *config.Config) (*Metrics, error) {
+	if statsdClient == nil {
+		var err error
+		statsdClient, err = statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
+	}
+	httpLabels := []string{"direction", "method", "status_class", "host", "caller", "path"}
+	connLabels := []string{"direction", "protocol"}
+	grpcLabels := []string{"direction", "service", "method", "code"}
+	m := &Metrics{
+		statsd: statsdClient,
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_http_requests_total",
+			Help: "Number of proxied HTTP requests",
+		}, httpLabels),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "netra_http_request_duration_seconds",
+			Help:    "Time from proxied HTTP request read to its response written",
+			Buckets: prometheus.DefBuckets,
+		}, httpLabels),
+		connections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_connections_total",
+			Help: "Number of accepted proxied TCP connections",
+		}, connLabels),
+		activeConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "netra_active_connections",
+			Help: "Number of active proxied TCP connections",
+		}, connLabels),
+		receivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_received_bytes_total",
+			Help: "Bytes received from clients of closed proxied connections",
+		}, connLabels),
+		sentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_sent_bytes_total",
+			Help: "Bytes sent to clients of closed proxied connections",
+		}, connLabels),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_dial_errors_total",
+			Help: "Number of failed upstream connection attempts",
+		}, []string{"direction", "reason"}),
+		grpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_grpc_requests_total",
+			Help: "Number of proxied gRPC calls",
+		}, grpcLabels),
+		grpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "netra_grpc_request_duration_seconds",
+			Help:    "Time from proxied gRPC call start to its end of stream",
+			Buckets: prometheus.DefBuckets,
+		}, grpcLabels),
+		grpcMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_grpc_messages_total",
+			Help: "Number of messages of proxied gRPC calls",
+		}, []string{"direction", "service", "method", "type"}),
+		mtlsHandshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_mtls_handshakes_total",
+			Help: "Number of mutual TLS handshakes between sidecars by result",
+		}, []string{"direction", "result"}),
+		tlsConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_tls_connections_total",
+			Help: "Number of outbound TLS connections by server name and negotiated version",
+		}, []string{"sni", "version"}),
+		tlsHandshake: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "netra_tls_handshake_duration_seconds",
+			Help:    "Time from ClientHello to first encrypted application data of outbound TLS connections",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"sni", "version"}),
+		tlsSentBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_tls_sent_bytes_total",
+			Help: "Bytes sent to servers of closed outbound TLS connections",
+		}, []string{"sni"}),
+		tlsReceivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_tls_received_bytes_total",
+			Help: "Bytes received from servers of closed outbound TLS connections",
+		}, []string{"sni"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "netra_config_reloads_total",
+			Help: "Number of configuration reloads by result",
+		}, []string{"result"}),
+	}
+	m.Configure(cfg)
+	if registerer == nil {
+		return m, nil
+	}
+	collectors := []prometheus.Collector{
+		m.httpRequests,
+		m.httpDuration,
+		m.connections,
+		m.activeConnections,
+		m.receivedBytes,
+		m.sentBytes,
+		m.dialErrors,
+		m.grpcRequests,
+		m.grpcDuration,
+		m.grpcMessages,
+		m.mtlsHandshakes,
+		m.tlsConnections,
+		m.tlsHandshake,
+		m.tlsSentBytes,
+		m.tlsReceivedBytes,
+		m.configReloads,
+	}
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Configure applies label cardinality settings of configuration
+func (m *Metrics) Configure(cfg *config.Config) {
+	m.rules.Store(newLabelRules(cfg.Netra))
+}
+
+// ObserveHTTPRequest counts finished HTTP request and its duration
+func (m *Metrics) ObserveHTTPRequest(r HTTPRequest) {
+	rules := m.rules.Load().(*labelRules)
+	method := strings.ToUpper(r.Method)
+	if !knownMethods[method] {
+		method = labelOther
+	}
+	labels := prometheus.Labels{
+		"direction":    direction(r.IsInbound),
+		"method":       method,
+		"status_class": statusClass(r.StatusCode),
+		"host":         rules.host(r.Host),
+		"caller":       rules.caller(r.Caller),
+		"path":         rules.path(r.Path),
+	}
+	m.httpRequests.With(labels).Inc()
+	m.httpDuration.With(labels).Observe(r.Duration.Seconds())
+
+	vars := map[string]string{
+		"direction":    labels["direction"],
+		"method":       method,
+		"host":         labels["host"],
+		"caller":       labels["caller"],
+		"status":       strconv.Itoa(r.StatusCode),
+		"status_class": labels["status_class"],
+	}
+	if r.StatusCode != 0 {
+		if r.IsInbound {
+			rules.statsd.count(m.statsd, config.StatsdInboundStatus, vars)
+		} else {
+			rules.statsd.count(m.statsd, config.StatsdOutboundStatus, vars)
+		}
+	}
+	rules.statsd.timing(m.statsd, config.StatsdRequestDuration, vars, r.Duration)
+}
+
+// ObserveGRPCRequest counts finished gRPC call, its duration and messages
+func (m *Metrics) ObserveGRPCRequest(r GRPCRequest) {
+	rules := m.rules.Load().(*labelRules)
+	service, method := rules.grpcMethod(r.Service, r.Method)
+	labels := prometheus.Labels{
+		"direction": direction(r.IsInbound),
+		"service":   service,
+		"method":    method,
+		"code":      GRPCCodeName(r.Code),
+	}
+	m.grpcRequests.With(labels).Inc()
+	m.grpcDuration.With(labels).Observe(r.Duration.Seconds())
+	m.grpcMessages.WithLabelValues(labels["direction"], service, method, "request").Add(float64(r.RequestMessages))
+	m.grpcMessages.WithLabelValues(labels["direction"], service, method, "response").Add(float64(r.ResponseMessages))
+
+	rules.statsd.count(m.statsd, config.StatsdGRPCStatus, map[string]string{
+		"direction": labels["direction"],
+		"host":      rules.host(r.Host),
+		"caller":    rules.caller(r.Caller),
+		"service":   service,
+		"method":    method,
+		"code":      labels["code"],
+	})
+}
+
+// ConnectionOpened counts accepted connection as active
+func (m *Metrics) ConnectionOpened(isInbound bool, protocol string) {
+	m.connections.WithLabelValues(direction(isInbound), protocol).Inc()
+	m.activeConnections.WithLabelValues(direction(isInbound), protocol).Inc()
+	m.rules.Load().(*labelRules).statsd.count(m.statsd, config.StatsdConnectionOpen, map[string]string{
+		"direction": direction(isInbound),
+		"protocol":  protocol,
+	})
+}
+
+// ConnectionClosed counts finished connection, received and sent are bytes received from and sent to client
+func (m *Metrics) ConnectionClosed(isInbound bool, protocol string, received uint64, sent uint64) {
+	m.activeConnections.WithLabelValues(direction(isInbound), protocol).Dec()
+	m.receivedBytes.WithLabelValues(direction(isInbound), protocol).Add(float64(received))
+	m.sentBytes.WithLabelValues(direction(isInbound), protocol).Add(float64(sent))
+	m.rules.Load().(*labelRules).statsd.count(m.statsd, config.StatsdConnectionClose, map[string]string{
+		"direction": direction(isInbound),
+		"protocol":  protocol,
+	})
+}
+
+// MTLS handshake results
+const (
+	MTLSResultOK           = "ok"
+	MTLSResultError        = "error"
+	MTLSResultUnauthorized = "unauthorized"
+	// MTLSResultPlaintext is a result of plaintext connection accepted in permissive mode
+	MTLSResultPlaintext = "plaintext"
+)
+
+// MTLSHandshake counts mutual TLS handshakes between sidecars by result
+func (m *Metrics) MTLSHandshake(isInbound bool, result string) {
+	m.mtlsHandshakes.WithLabelValues(direction(isInbound), result).Inc()
+}
+
+// ObserveTLSConnection counts finished outbound TLS connection, its handshake duration and bytes.
+// Server name is limited by host allowlist.
+func (m *Metrics) ObserveTLSConnection(c TLSConnection) {
+	sni := m.rules.Load().(*labelRules).host(c.ServerName)
+	version := c.Version
+	if version == "" {
+		version = labelUnknown
+	}
+	m.tlsConnections.WithLabelValues(sni, version).Inc()
+	if c.HandshakeDuration > 0 {
+		m.tlsHandshake.WithLabelValues(sni, version).Observe(c.HandshakeDuration.Seconds())
+	}
+	m.tlsSentBytes.WithLabelValues(sni).Add(float64(c.SentBytes))
+	m.tlsReceivedBytes.WithLabelValues(sni).Add(float64(c.ReceivedBytes))
+}
+
+// ConfigReload counts configuration reload, nil err means reload succeeded
+func (m *Metrics) ConfigReload(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.configReloads.WithLabelValues(result).Inc()
+	m.statsd.Increment("config.reload." + result)
+}
+
+// DialError counts failed upstream connection attempt
+func (m *Metrics) DialError(isInbound bool, err error) {
+	reason := dialErrorReason(err)
+	m.dialErrors.WithLabelValues(direction(isInbound), reason).Inc()
+	m.rules.Load().(*labelRules).statsd.count(m.statsd, config.StatsdConnectionError, map[string]string{
+		"direction": direction(isInbound),
+		"reason":    reason,
+	})
+}
+
+func direction(isInbound bool) string {
+	if isInbound {
+		return directionInbound
+	}
+	return directionOutbound
+}
+
+func statusClass(code int) string {
+	if code == 0 {
+		return "none"
+	}
+	if code < 100 || code > 599 {
+		return labelOther
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func dialErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return DialErrorResolve
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrorRefused
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return DialErrorTimeout
+	}
+	return DialErrorOther
+}
+
+// labelRules limits label values taken from traffic
+type labelRules struct {
+	hosts   map[string]bool
+	callers map[string]bool
+	// templates are path templates split into segments
+	templates    [][]string
+	grpcServices map[string]bool
+	statsd       *statsdTemplates
+}
+
+func newLabelRules(n config.NetraConfig) *labelRules {
+	r := &labelRules{}
+	if len(n.MetricsHostAllowlist) > 0 {
+		r.hosts = make(map[string]bool, len(n.MetricsHostAllowlist))
+		for _, host := range n.MetricsHostAllowlist {
+			r.hosts[strings.ToLower(host)] = true
+		}
+	}
+	if len(n.MetricsCallerAllowlist) > 0 {
+		r.callers = make(map[string]bool, len(n.MetricsCallerAllowlist))
+		for _, caller := range n.MetricsCallerAllowlist {
+			r.callers[caller] = true
+		}
+	}
+	if len(n.MetricsGRPCServiceAllowlist) > 0 {
+		r.grpcServices = make(map[string]bool, len(n.MetricsGRPCServiceAllowlist))
+		for _, service := range n.MetricsGRPCServiceAllowlist {
+			r.grpcServices[service] = true
+		}
+	}
+	for _, template := range n.MetricsPathTemplates {
+		r.templates = append(r.templates, strings.Split(template, "/"))
+	}
+	r.statsd = newStatsdTemplates(n.StatsdTemplates, n.StatsdTagFormat != "")
+	return r
+}
+
+// host strips port from host and checks it against allowlist
+func (r *labelRules) host(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if host == "" {
+		return labelUnknown
+	}
+	if r.hosts != nil && !r.hosts[host] {
+		return labelOther
+	}
+	return host
+}
+
+func (r *labelRules) caller(caller string) string {
+	if caller == "" {
+		return labelUnknown
+	}
+	if r.callers != nil && !r.callers[caller] {
+		return labelOther
+	}
+	return caller
+}
+
+// grpcMethod checks service against allowlist, methods of services which aren't allowed are reported as "other"
+func (r *labelRules) grpcMethod(service string, method string) (string, string) {
+	if service == "" {
+		return labelUnknown, labelUnknown
+	}
+	if r.grpcServices != nil && !r.grpcServices[service] {
+		return labelOther, labelOther
+	}
+	return service, method
+}
+
+// path returns first template matching path, {name} template segment matches any non-empty path segment
+func (r *labelRules) path(path string) string {
+	segments := strings.Split(path, "/")
+	for _, template := range r.templates {
+		if matchTemplate(template, segments) {
+			return strings.Join(template, "/")
+		}
+	}
+	return labelOther
+}
+
+func matchTemplate(template []string, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if t != segments[i] {
+			return false
+		}
+	}
+	return true
+}
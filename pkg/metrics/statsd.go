@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+)
+
+// statsdTemplates renders statsd metric names from configured templates
+type statsdTemplates struct {
+	// segments are dot separated template parts, placeholders are kept with braces
+	segments map[string][]string
+	// tagged sends placeholder values as tags instead of embedding them into metric name
+	tagged bool
+}
+
+func newStatsdTemplates(templates map[string]string, tagged bool) *statsdTemplates {
+	t := &statsdTemplates{
+		segments: make(map[string][]string),
+		tagged:   tagged,
+	}
+	for metric, template := range config.DefaultStatsdTemplates() {
+		if configured, ok := templates[metric]; ok {
+			template = configured
+		}
+		t.segments[metric] = strings.Split(template, ".")
+	}
+	return t
+}
+
+func (t *statsdTemplates) count(c *statsd.Client, metric string, vars map[string]string) {
+	name, tags := t.render(metric, vars)
+	withTags(c, tags).Increment(name)
+}
+
+func (t *statsdTemplates) timing(c *statsd.Client, metric string, vars map[string]string, d time.Duration) {
+	name, tags := t.render(metric, vars)
+	withTags(c, tags).Timing(name, float64(d)/float64(time.Millisecond))
+}
+
+// render returns metric name and tags as key-value pairs, tags are returned only in tagged mode
+func (t *statsdTemplates) render(metric string, vars map[string]string) (string, []string) {
+	segments := t.segments[metric]
+	parts := make([]string, 0, len(segments))
+	var tags []string
+	for _, segment := range segments {
+		if !strings.HasPrefix(segment, "{") {
+			parts = append(parts, segment)
+			continue
+		}
+		name := strings.Trim(segment, "{}")
+		value := sanitize(vars[name])
+		if t.tagged {
+			tags = append(tags, name, value)
+			continue
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, "."), tags
+}
+
+func withTags(c *statsd.Client, tags []string) *statsd.Client {
+	if len(tags) == 0 {
+		return c
+	}
+	return c.Clone(statsd.Tags(tags...))
+}
+
+// sanitize replaces characters which have special meaning in statsd names and tags, e.g. dots of host names
+func sanitize(v string) string {
+	if v == "" {
+		return labelUnknown
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, v)
+}
@@ -0,0 +1,270 @@
+// Package mtls provides mutual TLS between netra sidecars.
+// Workload certificate and CA bundle are loaded from files and reloaded when they are changed,
+// so certificates rotated by external tooling are picked up without restart.
+package mtls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// Store keeps workload certificate and CA pool used to verify peers
+type Store struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+	// hash is a hash of loaded files content, files are reloaded only in case it's changed
+	hash []byte
+}
+
+// NewStore loads certificate, its private key and CA bundle from PEM files
+func NewStore(certFile string, keyFile string, caFile string) (*Store, error) {
+	s := &Store{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads files and replaces certificate and CA pool in case files content is changed.
+// Previously loaded ones are kept in case files are invalid, e.g. they are being replaced.
+func (s *Store) Reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(s.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(s.keyFile)
+	if err != nil {
+		return false, err
+	}
+	caPEM, err := ioutil.ReadFile(s.caFile)
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	h.Write(certPEM)
+	h.Write(keyPEM)
+	h.Write(caPEM)
+	hash := h.Sum(nil)
+
+	s.mu.RLock()
+	changed := !bytes.Equal(hash, s.hash)
+	s.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", s.certFile, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return false, fmt.Errorf("%s: no CA certificates found", s.caFile)
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.pool = pool
+	s.hash = hash
+	s.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads files every interval until done is closed
+func (s *Store) Watch(logger *log.Logger, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			changed, err := s.Reload()
+			if err != nil {
+				logger.Warningf("Can't reload mTLS certificates: %s", err.Error())
+				continue
+			}
+			if changed {
+				logger.Infof("mTLS certificates reloaded from %s", s.certFile)
+			}
+		}
+	}
+}
+
+func (s *Store) certificate() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert
+}
+
+func (s *Store) certPool() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool
+}
+
+// ServerConfig returns TLS config of inbound connections, client certificate is required
+// and verified against CA pool loaded at the moment of handshake
+func (s *Store) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.certificate(), nil
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: s.verifyPeer,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+// ClientConfig returns TLS config of outbound connections.
+// Sidecars are dialed by IP address, so server certificate is verified against CA pool only,
+// caller must authorize its identity (see Allowed) before sending data.
+func (s *Store) ClientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.certificate(), nil
+		},
+		// verifyPeer replaces standard verification which requires server name
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: s.verifyPeer,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+func (s *Store) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("mtls: peer didn't provide certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("mtls: invalid peer certificate: %s", err.Error())
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.certPool(),
+		Intermediates: intermediates,
+		// the same workload certificate is used both as client and server one
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// PeerIdentity returns identity of verified peer certificate:
+// URI SAN (e.g. SPIFFE ID), DNS SAN or subject common name
+func PeerIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// Allowed checks identity against patterns, empty list allows any identity.
+// Pattern matches identity exactly or by prefix in case it ends with *.
+func Allowed(identity string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(identity, p[:len(p)-1]) {
+				return true
+			}
+			continue
+		}
+		if identity == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Destination is a set of upstream addresses which are sidecars accepting mutual TLS
+type Destination struct {
+	// network is nil for port only destinations
+	network *net.IPNet
+	// port is empty for destinations matching any port
+	port string
+}
+
+// ParseDestination parses destination written as port, ip, ip:port, CIDR or CIDR:port.
+// IPv6 addresses with port are enclosed in brackets, e.g. [fd00::/8]:8080.
+func ParseDestination(dst string) (Destination, error) {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		host, port = dst, ""
+	}
+	if _, err := strconv.ParseUint(host, 10, 16); err == nil && port == "" {
+		return Destination{port: host}, nil
+	}
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return Destination{}, fmt.Errorf("invalid port in destination '%s'", dst)
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return Destination{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port}, nil
+	}
+	_, network, err := net.ParseCIDR(host)
+	if err != nil {
+		return Destination{}, fmt.Errorf("invalid destination '%s', expected <port>, <ip>[:port] or <cidr>[:port]", dst)
+	}
+	return Destination{network: network, port: port}, nil
+}
+
+// Match checks whether address matches destination
+func (d Destination) Match(addr *net.TCPAddr) bool {
+	if d.port != "" && d.port != strconv.Itoa(addr.Port) {
+		return false
+	}
+	return d.network == nil || d.network.Contains(addr.IP)
+}
+
+// MatchDestination checks whether address matches one of destinations, invalid destinations are skipped
+func MatchDestination(addr *net.TCPAddr, destinations []string) bool {
+	for _, dst := range destinations {
+		d, err := ParseDestination(dst)
+		if err == nil && d.Match(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns PEM encoded workload certificate and key, identity is either URI or DNS name
+func (ca *testCA) issue(t *testing.T, identity string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "workload"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if u, err := url.Parse(identity); err == nil && u.Scheme != "" {
+		template.URIs = []*url.URL{u}
+	} else {
+		template.DNSNames = []string{identity}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeStoreFiles writes workload certificate, key and CA bundle into dir
+func writeStoreFiles(t *testing.T, dir string, ca *testCA, identity string) (string, string, string) {
+	certPEM, keyPEM := ca.issue(t, identity)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"cert.pem", certPEM},
+		{"key.pem", keyPEM},
+		{"ca.pem", ca.pem},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), f.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+}
+
+func newTestStore(t *testing.T, ca *testCA, identity string) *Store {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := NewStore(writeStoreFiles(t, dir, ca, identity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// handshake connects client and server stores and returns identities seen by each side
+func handshake(t *testing.T, client *Store, server *Store) (serverIdentity string, clientIdentity string, err error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	serverTLS := tls.Server(serverConn, server.ServerConfig())
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- serverTLS.Handshake()
+		// unblock client waiting for server messages
+		serverConn.Close()
+	}()
+	clientTLS := tls.Client(clientConn, client.ClientConfig())
+	clientErr := clientTLS.Handshake()
+	if err := <-serverErr; err != nil {
+		return "", "", err
+	}
+	if clientErr != nil {
+		return "", "", clientErr
+	}
+	return PeerIdentity(clientTLS.ConnectionState()), PeerIdentity(serverTLS.ConnectionState()), nil
+}
+
+func TestStoreHandshake(t *testing.T) {
+	ca := newTestCA(t, "mesh")
+	client := newTestStore(t, ca, "spiffe://mesh/ns/default/sa/frontend")
+	server := newTestStore(t, ca, "backend.default.svc")
+
+	serverIdentity, clientIdentity, err := handshake(t, client, server)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	if serverIdentity != "backend.default.svc" {
+		t.Errorf("unexpected server identity %q", serverIdentity)
+	}
+	if clientIdentity != "spiffe://mesh/ns/default/sa/frontend" {
+		t.Errorf("unexpected client identity %q", clientIdentity)
+	}
+}
+
+func TestStoreRejectsUnknownCA(t *testing.T) {
+	ca := newTestCA(t, "mesh")
+	server := newTestStore(t, ca, "backend")
+	client := newTestStore(t, newTestCA(t, "other"), "intruder")
+
+	if _, _, err := handshake(t, client, server); err == nil {
+		t.Error("expected handshake with certificate of unknown CA to fail")
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	ca := newTestCA(t, "mesh")
+	server := newTestStore(t, ca, "backend")
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := writeStoreFiles(t, dir, ca, "frontend-v1")
+	client, err := NewStore(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := client.Reload(); changed || err != nil {
+		t.Errorf("expected unchanged files not to be reloaded, got %v %v", changed, err)
+	}
+	writeStoreFiles(t, dir, ca, "frontend-v2")
+	if changed, err := client.Reload(); !changed || err != nil {
+		t.Fatalf("expected rotated certificate to be reloaded, got %v %v", changed, err)
+	}
+	if _, identity, err := handshake(t, client, server); err != nil || identity != "frontend-v2" {
+		t.Errorf("expected rotated certificate to be used, got %q %v", identity, err)
+	}
+
+	// certificate being written is invalid for a moment, previous one is kept
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Reload(); err == nil {
+		t.Error("expected invalid certificate to be reported")
+	}
+	if _, identity, err := handshake(t, client, server); err != nil || identity != "frontend-v2" {
+		t.Errorf("expected previous certificate to be kept, got %q %v", identity, err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	patterns := []string{"spiffe://mesh/ns/default/*", "payments"}
+	cases := map[string]bool{
+		"spiffe://mesh/ns/default/sa/frontend": true,
+		"spiffe://mesh/ns/other/sa/frontend":   false,
+		"payments":                             true,
+		"payments-v2":                          false,
+	}
+	for identity, expected := range cases {
+		if Allowed(identity, patterns) != expected {
+			t.Errorf("%s: expected %v", identity, expected)
+		}
+	}
+	if !Allowed("anyone", nil) {
+		t.Error("expected empty patterns to allow any identity")
+	}
+}
+
+func TestMatchDestination(t *testing.T) {
+	destinations := []string{"8080", "10.0.0.0/8:9090", "192.168.1.1", "[fd00::/8]:443"}
+	cases := []struct {
+		addr     string
+		expected bool
+	}{
+		{"1.2.3.4:8080", true},
+		{"10.1.2.3:9090", true},
+		{"10.1.2.3:9091", false},
+		{"11.1.2.3:9090", false},
+		{"192.168.1.1:1", true},
+		{"[fd00::1]:443", true},
+		{"[fe00::1]:443", false},
+	}
+	for _, c := range cases {
+		addr, err := net.ResolveTCPAddr("tcp", c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if MatchDestination(addr, destinations) != c.expected {
+			t.Errorf("%s: expected %v", c.addr, c.expected)
+		}
+	}
+	for _, dst := range []string{"host:80", "10.0.0.0/8:http", "70000"} {
+		if _, err := ParseDestination(dst); err == nil {
+			t.Errorf("%s: expected invalid destination", dst)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// AddrConn is TCP connection with overridden remote address,
+// e.g. client address received in PROXY protocol header
+type AddrConn struct {
+	*net.TCPConn
+	remoteAddr net.Addr
+}
+
+// NewAddrConn returns conn reporting remoteAddr as its remote address
+func NewAddrConn(conn *net.TCPConn, remoteAddr net.Addr) *AddrConn {
+	return &AddrConn{
+		TCPConn:    conn,
+		remoteAddr: remoteAddr,
+	}
+}
+
+// RemoteAddr returns overridden remote address
+func (c *AddrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// PeerConn is connection of peer sidecar with terminated mutual TLS,
+// decrypted stream is buffered, so it can be peeked to detect protocol
+type PeerConn struct {
+	*tls.Conn
+	reader   *bufio.Reader
+	identity string
+}
+
+// NewPeerConn returns conn with verified peer identity, handshake must be completed
+func NewPeerConn(conn *tls.Conn, identity string) *PeerConn {
+	return &PeerConn{
+		Conn:     conn,
+		reader:   bufio.NewReader(conn),
+		identity: identity,
+	}
+}
+
+func (c *PeerConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// PeerIdentity returns identity of peer certificate
+func (c *PeerConn) PeerIdentity() string {
+	return c.identity
+}
+
+// peek reads available decrypted bytes into buf leaving them in reader buffer, n is 0 on EOF
+func (c *PeerConn) peek(buf []byte, deadline time.Time) (int, error) {
+	if err := c.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+	if _, err := c.reader.Peek(1); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := c.reader.Buffered()
+	if n > len(buf) {
+		n = len(buf)
+	}
+	b, _ := c.reader.Peek(n)
+	return copy(buf, b), nil
+}
+
+// tcpConn returns underlying TCP connection of v if it has one
+func tcpConn(v interface{}) (*net.TCPConn, bool) {
+	switch conn := v.(type) {
+	case *net.TCPConn:
+		return conn, true
+	case *AddrConn:
+		return conn.TCPConn, true
+	}
+	return nil, false
+}
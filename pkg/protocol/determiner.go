@@ -1,22 +1,76 @@
 package protocol
 
 import (
-	"strings"
+	"net"
 
-	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/config"
 )
 
 type Proto string
 
 const (
-	HTTPProto Proto = "http"
-	TCPProto  Proto = "tcp"
+	HTTPProto     Proto = "http"
+	TCPProto      Proto = "tcp"
+	HTTP2Proto    Proto = "http2"
+	TLSProto      Proto = "tls"
+	PostgresProto Proto = "postgres"
+	MongoProto    Proto = "mongodb"
+	RedisProto    Proto = "redis"
 )
 
-func Determine(addr string) Proto {
-	httpPorts := config.GetNetraConfig().HTTPProtoPorts
-	port := strings.Split(addr, ":")[1]
-	if _, ok := httpPorts[port]; ok {
+// Determine detects protocol by destination port
+func (f *Factory) Determine(addr string) Proto {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return TCPProto
+	}
+	return determineByPort(f.deps.Config.Get().Netra, port)
+}
+
+// DetermineConn detects protocol of connection to addr.
+// Configured protocol map and port lists have priority, then in case sniffing is enabled
+// cached result for destination is used or first client bytes are inspected.
+func (f *Factory) DetermineConn(conn net.Conn, addr string) Proto {
+	netraConfig := f.deps.Config.Get().Netra
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return TCPProto
+	}
+	if name, ok := netraConfig.ProtocolMap[addr]; ok {
+		return Proto(name)
+	}
+	if name, ok := netraConfig.ProtocolMap[port]; ok {
+		return Proto(name)
+	}
+	if !netraConfig.ProtocolSniffingEnabled {
+		return determineByPort(netraConfig, port)
+	}
+	if _, ok := netraConfig.HTTPProtoPorts[port]; ok {
+		// HTTP/2 with prior knowledge uses the same ports as HTTP/1
+		if proto, _ := sniff(conn, netraConfig.ProtocolSniffingTimeout, len(http2Preface)); proto == HTTP2Proto {
+			return HTTP2Proto
+		}
+		return HTTPProto
+	}
+	if _, ok := netraConfig.TCPProtoPorts[port]; ok {
+		return TCPProto
+	}
+
+	if proto, ok := f.sniffCache.Get(addr); ok {
+		return proto.(Proto)
+	}
+	proto, cacheable := sniff(conn, netraConfig.ProtocolSniffingTimeout, netraConfig.ProtocolSniffingMaxBytes)
+	if cacheable {
+		f.sniffCache.SetDefault(addr, proto)
+	}
+	return proto
+}
+
+func determineByPort(netraConfig config.NetraConfig, port string) Proto {
+	if name, ok := netraConfig.ProtocolMap[port]; ok {
+		return Proto(name)
+	}
+	if _, ok := netraConfig.HTTPProtoPorts[port]; ok {
 		return HTTPProto
 	}
 	return TCPProto
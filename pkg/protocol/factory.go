@@ -1,52 +1,114 @@
 package protocol
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/opentracing/opentracing-go"
 	"github.com/patrickmn/go-cache"
-	statsd "gopkg.in/alexcesaro/statsd.v2"
 
-	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 )
 
-var httpHandler *HTTPHandler
-var tcpHandler *TCPHandler
-var netTCPRequest *NetTCPRequest
-
-func InitHandlerRequest(
-	logger *log.Logger,
-	statsdMetrics *statsd.Client,
-	tracingContextMapping *cache.Cache,
-	routingInfoContextMapping *cache.Cache) {
-	httpHandler = NewHTTPHandler(logger, statsdMetrics, tracingContextMapping, routingInfoContextMapping)
-	tcpHandler = NewTCPHandler(logger)
-	netTCPRequest = NewNetTCPRequest(logger)
+// Factory creates protocol handlers and requests for a single proxy instance
+type Factory struct {
+	deps     Dependencies
+	handlers map[Proto]NetHandler
+	// sniffCache keeps sniffing results per destination address
+	sniffCache *cache.Cache
+}
+
+// NewFactory initializes handlers of registered protocols
+// and checks that configuration refers only to registered protocols
+func NewFactory(deps Dependencies) (*Factory, error) {
+	if deps.Logger == nil {
+		return nil, errors.New("protocol: logger is required")
+	}
+	if deps.StatsdMetrics == nil {
+		return nil, errors.New("protocol: statsd client is required")
+	}
+	if deps.Config == nil {
+		deps.Config = config.NewHolder(config.Default())
+	}
+	if deps.Metrics == nil {
+		m, err := metrics.New(nil, deps.StatsdMetrics, deps.Config.Get())
+		if err != nil {
+			return nil, err
+		}
+		deps.Metrics = m
+	}
+	if deps.Tracer == nil {
+		deps.Tracer = opentracing.GlobalTracer()
+	}
+	if deps.Drain == nil {
+		deps.Drain = drain.NewTracker()
+	}
+	if deps.TracingContextMapping == nil {
+		deps.TracingContextMapping = cache.New(cache.NoExpiration, cache.NoExpiration)
+	}
+	if deps.RoutingInfoContextMapping == nil {
+		deps.RoutingInfoContextMapping = cache.New(cache.NoExpiration, cache.NoExpiration)
+	}
+
+	if err := ValidateConfig(deps.Config.Get()); err != nil {
+		return nil, err
+	}
+	netraConfig := deps.Config.Get().Netra
+	return &Factory{
+		deps:     deps,
+		handlers: newHandlers(deps),
+		sniffCache: cache.New(
+			netraConfig.ProtocolSniffingCacheExpiration,
+			netraConfig.ProtocolSniffingCacheExpiration,
+		),
+	}, nil
+}
+
+// ValidateConfig checks that configuration refers only to registered protocols
+func ValidateConfig(cfg *config.Config) error {
+	e := &config.ValidationError{}
+	for dst, name := range cfg.Netra.ProtocolMap {
+		if !IsRegistered(Proto(name)) {
+			e.Problems = append(e.Problems, fmt.Sprintf("protocols.map: unknown protocol %s for %s", name, dst))
+		}
+	}
+	if len(e.Problems) > 0 {
+		sort.Strings(e.Problems)
+		return e
+	}
+	return nil
+}
+
+// ResetSniffing forgets cached sniffing results, it's used when protocol configuration is changed
+func (f *Factory) ResetSniffing() {
+	f.sniffCache.Flush()
+}
+
+// ResetTLSOrigination forgets TLS configs of origination rules, it's used when configuration is reloaded
+func (f *Factory) ResetTLSOrigination() {
+	if h, ok := f.handlers[HTTPProto].(*HTTPHandler); ok {
+		h.origination.reset()
+	}
 }
 
-func GetNetworkHandler(
-	proto Proto,
-	logger *log.Logger,
-	tracingContextMapping *cache.Cache) NetHandler {
-	switch proto {
-	case HTTPProto:
-		return httpHandler
-	case TCPProto:
-		return tcpHandler
-	default:
-		return tcpHandler
+// GetNetworkHandler returns handler of protocol, TCP handler is used for protocols without own handler
+func (f *Factory) GetNetworkHandler(proto Proto) NetHandler {
+	if h, ok := f.handlers[proto]; ok {
+		return h
 	}
+	return f.handlers[TCPProto]
 }
 
-func GetNetRequest(
-	proto Proto,
-	isInbound bool,
-	logger *log.Logger,
-	tracingContextMapping *cache.Cache,
-	statsdMetrics *statsd.Client) NetRequest {
-	switch proto {
-	case HTTPProto:
-		return NewNetHTTPRequest(logger, isInbound, tracingContextMapping, statsdMetrics)
-	case TCPProto:
-		return netTCPRequest
-	default:
-		return netTCPRequest
+// GetNetRequest returns new request state of protocol, TCP request is used for protocols without own handler
+func (f *Factory) GetNetRequest(proto Proto, isInbound bool) NetRequest {
+	registry.mu.RLock()
+	p, ok := registry.protocols[proto]
+	if !ok || p.NewHandler == nil || p.NewRequest == nil {
+		p = registry.protocols[TCPProto]
 	}
+	registry.mu.RUnlock()
+	return p.NewRequest(f.deps, isInbound)
 }
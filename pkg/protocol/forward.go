@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"io"
+)
+
+// forward copies data from src to dst until EOF or error.
+// When both sides are plain TCP connections it uses zero-copy splice(2) if it's available,
+// otherwise it falls back to io.CopyBuffer with pooled buffer.
+func forward(dst io.Writer, src io.Reader) (int64, error) {
+	dstConn, dstOk := tcpConn(dst)
+	srcConn, srcOk := tcpConn(src)
+	if dstOk && srcOk {
+		written, handled, err := spliceCopy(dstConn, srcConn)
+		if handled {
+			return written, err
+		}
+	}
+	return copyBuffer(dst, src)
+}
+
+// copyBuffer copies data from src to dst through user space buffer
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := bufferPool.Get().([]byte)
+	written, err := io.CopyBuffer(dst, src, buf)
+	bufferPool.Put(buf)
+	return written, err
+}
@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of established loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *net.TCPConn)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.Fatal("accept failed")
+	}
+	return client, server
+}
+
+// onlyWriter and onlyReader hide ReaderFrom/WriterTo so copy goes through user space buffer
+type onlyWriter struct{ io.Writer }
+type onlyReader struct{ io.Reader }
+
+func userSpaceCopy(dst *net.TCPConn, src *net.TCPConn) (int64, error) {
+	return copyBuffer(onlyWriter{dst}, onlyReader{src})
+}
+
+func spliceForward(dst *net.TCPConn, src *net.TCPConn) (int64, error) {
+	return forward(dst, src)
+}
+
+func TestForward(t *testing.T) {
+	for name, copyFn := range map[string]func(dst *net.TCPConn, src *net.TCPConn) (int64, error){
+		"copy":   userSpaceCopy,
+		"splice": spliceForward,
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, proxyIn := tcpPair(t)
+			proxyOut, upstream := tcpPair(t)
+			defer client.Close()
+			defer proxyIn.Close()
+			defer proxyOut.Close()
+			defer upstream.Close()
+
+			payload := make([]byte, 1<<20+17)
+			rand.Read(payload)
+
+			go func() {
+				copyFn(proxyOut, proxyIn)
+				proxyOut.CloseWrite()
+			}()
+			go func() {
+				client.Write(payload)
+				client.CloseWrite()
+			}()
+
+			upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			received, err := ioutil.ReadAll(upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, received) {
+				t.Fatalf("payload mismatch: sent %d bytes, received %d bytes", len(payload), len(received))
+			}
+		})
+	}
+}
+
+func BenchmarkForwardCopyBuffer(b *testing.B) {
+	benchmarkForward(b, userSpaceCopy)
+}
+
+func BenchmarkForwardSplice(b *testing.B) {
+	benchmarkForward(b, spliceForward)
+}
+
+func benchmarkForward(b *testing.B, copyFn func(dst *net.TCPConn, src *net.TCPConn) (int64, error)) {
+	client, proxyIn := tcpPair(b)
+	proxyOut, upstream := tcpPair(b)
+	defer client.Close()
+	defer proxyIn.Close()
+	defer proxyOut.Close()
+	defer upstream.Close()
+
+	go func() {
+		copyFn(proxyOut, proxyIn)
+		proxyOut.CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, upstream)
+		close(done)
+	}()
+
+	chunk := make([]byte, 1<<20)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	cpuStart := cpuTime()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.CloseWrite()
+	<-done
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime()-cpuStart)/float64(b.N), "cpu-ns/op")
+}
+
+// cpuTime returns user and system CPU time consumed by the process
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
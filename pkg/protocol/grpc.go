@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"golang.org/x/net/http2/hpack"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// grpcMessagePrefixLen is a length of message prefix: compressed flag and big endian message length
+const grpcMessagePrefixLen = 5
+
+// isGRPC checks content type of request, e.g. application/grpc or application/grpc+proto
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" ||
+		strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcMethod splits path like /package.Service/Method into service and method
+func grpcMethod(path string) (service string, method string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", false
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 || i == len(path)-1 {
+		return "", "", false
+	}
+	return path[1:i], path[i+1:], true
+}
+
+// grpcMessageCounter counts length-prefixed messages of stream without buffering them
+type grpcMessageCounter struct {
+	prefix    [grpcMessagePrefixLen]byte
+	prefixLen int
+	// remaining is a number of bytes of current message which aren't written yet
+	remaining uint32
+	count     int
+}
+
+// write consumes DATA frame payload, message and its prefix can be split between frames
+func (c *grpcMessageCounter) write(data []byte) {
+	for len(data) > 0 {
+		if c.remaining > 0 {
+			n := uint32(len(data))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			c.remaining -= n
+			data = data[n:]
+			continue
+		}
+		n := copy(c.prefix[c.prefixLen:], data)
+		c.prefixLen += n
+		data = data[n:]
+		if c.prefixLen == grpcMessagePrefixLen {
+			c.count++
+			c.remaining = binary.BigEndian.Uint32(c.prefix[1:])
+			c.prefixLen = 0
+		}
+	}
+}
+
+// grpcCall is a state of gRPC call carried by HTTP/2 stream
+type grpcCall struct {
+	service string
+	method  string
+	// status is grpc-status of response, -1 until it's received
+	status           int
+	message          string
+	requestMessages  grpcMessageCounter
+	responseMessages grpcMessageCounter
+}
+
+func newGRPCCall(req *nhttp.Request) *grpcCall {
+	if !isGRPC(req.Header.Get("Content-Type")) {
+		return nil
+	}
+	service, method, ok := grpcMethod(req.URL.Path)
+	if !ok {
+		return nil
+	}
+	return &grpcCall{service: service, method: method, status: -1}
+}
+
+// operationName returns span operation name in service/method form
+func (c *grpcCall) operationName() string {
+	return c.service + "/" + c.method
+}
+
+// setStatus takes status from response headers or trailers, trailers-only responses carry it in headers
+func (c *grpcCall) setStatus(fields []hpack.HeaderField) {
+	for _, f := range fields {
+		switch f.Name {
+		case "grpc-status":
+			if status, err := strconv.Atoi(f.Value); err == nil {
+				c.status = status
+			}
+		case "grpc-message":
+			// message is percent-encoded
+			if message, err := url.PathUnescape(f.Value); err == nil {
+				c.message = message
+			} else {
+				c.message = f.Value
+			}
+		}
+	}
+}
+
+func (c *grpcCall) startSpan(span opentracing.Span) {
+	span.SetTag("rpc.system", "grpc")
+	span.SetTag("rpc.service", c.service)
+	span.SetTag("rpc.method", c.method)
+}
+
+func (c *grpcCall) fillSpan(span opentracing.Span) {
+	span.SetTag("rpc.grpc.request_messages", c.requestMessages.count)
+	span.SetTag("rpc.grpc.response_messages", c.responseMessages.count)
+	if c.status < 0 {
+		return
+	}
+	span.SetTag("rpc.grpc.status_code", c.status)
+	if c.message != "" {
+		span.SetTag("rpc.grpc.message", c.message)
+	}
+	if c.status != 0 {
+		span.SetTag("error", true)
+	}
+}
+
+func (c *grpcCall) observe(m *metrics.Metrics, isInbound bool, req *nhttp.Request, caller string, startTime time.Time) {
+	m.ObserveGRPCRequest(metrics.GRPCRequest{
+		IsInbound:        isInbound,
+		Host:             req.Host,
+		Caller:           caller,
+		Service:          c.service,
+		Method:           c.method,
+		Code:             c.status,
+		Duration:         time.Since(startTime),
+		RequestMessages:  c.requestMessages.count,
+		ResponseMessages: c.responseMessages.count,
+	})
+}
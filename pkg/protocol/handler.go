@@ -6,17 +6,41 @@ import (
 )
 
 type NetHandler interface {
-	// HandleRequest should get all data from r, process it and write result to w
+	// HandleRequest should get all data from r, process it and write result to w.
+	// In case w is nil upstream connection should be opened with dialer.
+	// It returns last upstream connection used.
 	HandleRequest(
-		r *net.TCPConn,
-		w *net.TCPConn,
-		connCh chan *net.TCPConn,
-		addrCh chan string,
+		r net.Conn,
+		w net.Conn,
+		dialer Dialer,
 		netRequest NetRequest,
 		isInboundConn bool,
-		originalDst string) *net.TCPConn
+		originalDst string) net.Conn
 	// HandleResponse should get all data from r, process it and write result to w
-	HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool)
+	HandleResponse(r net.Conn, w net.Conn, netRequest NetRequest, isInboundConn bool, forceClose bool)
+}
+
+// Dialer opens upstream connections for handlers which choose destination per request (e.g. HTTP routing).
+// Response processing of opened connection is managed by dialer.
+type Dialer interface {
+	Dial(addr string) (net.Conn, error)
+}
+
+// HalfCloser is implemented by connections supporting half-close, e.g. *net.TCPConn
+type HalfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// CloseConn closes both directions of conn and releases it.
+// Closing read side is important to avoid waiting for never ending read operation
+// when client doesn't close connection.
+func CloseConn(conn net.Conn) {
+	if hc, ok := conn.(HalfCloser); ok {
+		hc.CloseRead()
+		hc.CloseWrite()
+	}
+	conn.Close()
 }
 
 var bufferPool = sync.Pool{
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+const harnessTimeout = 5 * time.Second
+
+// recordingTracer wraps jaeger tracer (handlers rely on jaeger span context) and records finished spans
+type recordingTracer struct {
+	opentracing.Tracer
+	mu       sync.Mutex
+	finished []*recordedSpan
+}
+
+func newRecordingTracer() *recordingTracer {
+	tracer, _ := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	return &recordingTracer{Tracer: tracer}
+}
+
+func (t *recordingTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	return &recordedSpan{
+		Span:          t.Tracer.StartSpan(operationName, opts...),
+		tracer:        t,
+		operationName: operationName,
+		tags:          make(map[string]interface{}),
+	}
+}
+
+// FinishedSpans returns spans finished so far
+func (t *recordingTracer) FinishedSpans() []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*recordedSpan(nil), t.finished...)
+}
+
+type recordedSpan struct {
+	opentracing.Span
+	tracer        *recordingTracer
+	mu            sync.Mutex
+	operationName string
+	tags          map[string]interface{}
+}
+
+func (s *recordedSpan) SetTag(key string, value interface{}) opentracing.Span {
+	s.mu.Lock()
+	s.tags[key] = value
+	s.mu.Unlock()
+	s.Span.SetTag(key, value)
+	return s
+}
+
+func (s *recordedSpan) Finish() {
+	s.Span.Finish()
+	s.tracer.mu.Lock()
+	s.tracer.finished = append(s.tracer.finished, s)
+	s.tracer.mu.Unlock()
+}
+
+func (s *recordedSpan) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+// Tag returns recorded tag value
+func (s *recordedSpan) Tag(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tags[key]
+}
+
+// handlerHarness drives handler end-to-end over in-memory connections:
+// client <-> (r) handler (w) <-> upstream
+type handlerHarness struct {
+	// client is application side of proxied connection
+	client net.Conn
+	// upstream is destination side of proxied connection
+	upstream   net.Conn
+	tracer     *recordingTracer
+	netRequest NetRequest
+	done       chan struct{}
+}
+
+func newHTTPHarness(t *testing.T, isInbound bool) *handlerHarness {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	tracingContextMapping := cache.New(time.Minute, time.Minute)
+	routingInfoContextMapping := cache.New(time.Minute, time.Minute)
+	tracer := newRecordingTracer()
+	cfg := config.NewHolder(config.Default())
+	handler := NewHTTPHandler(
+		logger,
+		statsdClient,
+		tracer,
+		cfg,
+		drain.NewTracker(),
+		tracingContextMapping,
+		routingInfoContextMapping)
+	m, err := metrics.New(nil, statsdClient, cfg.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	netRequest := NewNetHTTPRequest(logger, isInbound, tracer, cfg, tracingContextMapping, m, nil)
+	return newHarness(t, handler, netRequest, isInbound, tracer)
+}
+
+func newHarness(
+	t *testing.T,
+	handler NetHandler,
+	netRequest NetRequest,
+	isInbound bool,
+	tracer *recordingTracer) *handlerHarness {
+	client, proxyIn := net.Pipe()
+	proxyOut, upstream := net.Pipe()
+	deadline := time.Now().Add(harnessTimeout)
+	for _, conn := range []net.Conn{client, proxyIn, proxyOut, upstream} {
+		conn.SetDeadline(deadline)
+	}
+
+	h := &handlerHarness{
+		client:     client,
+		upstream:   upstream,
+		tracer:     tracer,
+		netRequest: netRequest,
+		done:       make(chan struct{}),
+	}
+
+	// the same way transport runs handlers
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		handler.HandleRequest(proxyIn, proxyOut, nil, netRequest, isInbound, "127.0.0.1:80")
+		CloseConn(proxyIn)
+		CloseConn(proxyOut)
+		wg.Done()
+	}()
+	go func() {
+		handler.HandleResponse(proxyOut, proxyIn, netRequest, isInbound, false)
+		CloseConn(proxyOut)
+		CloseConn(proxyIn)
+		wg.Done()
+	}()
+	go func() {
+		wg.Wait()
+		netRequest.CleanUp()
+		close(h.done)
+	}()
+	return h
+}
+
+// Close closes client and upstream and waits for handlers to finish
+func (h *handlerHarness) Close(t *testing.T) {
+	h.client.Close()
+	h.upstream.Close()
+	select {
+	case <-h.done:
+	case <-time.After(harnessTimeout):
+		t.Fatal("handlers didn't finish")
+	}
+}
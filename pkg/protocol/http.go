@@ -3,13 +3,12 @@ package protocol
 import (
 	"bufio"
 	"bytes"
-	"container/list"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/opentracing/opentracing-go"
@@ -17,9 +16,12 @@ import (
 	"github.com/uber/jaeger-client-go"
 	"gopkg.in/alexcesaro/statsd.v2"
 
-	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
 	nhttp "github.com/Lookyan/netramesh/pkg/http"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 )
 
 var dumbReader = bytes.NewReader([]byte{})
@@ -38,35 +40,45 @@ var writerPool = sync.Pool{
 
 // HTTPHandler process HTTP protocol
 type HTTPHandler struct {
+	config                    *config.Holder
+	tracer                    opentracing.Tracer
+	drain                     *drain.Tracker
 	tracingContextMapping     *cache.Cache
 	routingInfoContextMapping *cache.Cache
 	logger                    *log.Logger
 	statsdMetrics             *statsd.Client
+	origination               *tlsOrigination
 }
 
 // NewHTTPHandler returns HTTP handler
 func NewHTTPHandler(
 	logger *log.Logger,
 	statsdMetrics *statsd.Client,
+	tracer opentracing.Tracer,
+	cfg *config.Holder,
+	drainTracker *drain.Tracker,
 	tracingContextMapping *cache.Cache,
 	routingInfoContextMapping *cache.Cache) *HTTPHandler {
 	return &HTTPHandler{
+		config:                    cfg,
+		tracer:                    tracer,
+		drain:                     drainTracker,
 		tracingContextMapping:     tracingContextMapping,
 		routingInfoContextMapping: routingInfoContextMapping,
 		logger:                    logger,
 		statsdMetrics:             statsdMetrics,
+		origination:               newTLSOrigination(),
 	}
 }
 
 // HandleRequest handles HTTP request
 func (h *HTTPHandler) HandleRequest(
-	r *net.TCPConn,
-	w *net.TCPConn,
-	connCh chan *net.TCPConn,
-	addrCh chan string,
+	r net.Conn,
+	w net.Conn,
+	dialer Dialer,
 	netRequest NetRequest,
 	isInboundConn bool,
-	originalDst string) *net.TCPConn {
+	originalDst string) net.Conn {
 
 	netHTTPRequest := netRequest.(*NetHTTPRequest)
 	tmpWriter := NewTempWriter()
@@ -75,14 +87,9 @@ func (h *HTTPHandler) HandleRequest(
 	bufioHTTPReader := readerPool.Get().(*bufio.Reader)
 	bufioHTTPReader.Reset(readerWithFallback)
 	defer readerPool.Put(bufioHTTPReader)
-	if config.GetHTTPConfig().RoutingEnabled {
-		defer func() {
-			if addrCh != nil {
-				close(addrCh)
-			}
-		}()
-	}
 	for {
+		// configuration can be reloaded, keep the same snapshot during request processing
+		httpConfig := h.config.Get().HTTP
 		tmpWriter.Start()
 		req, err := nhttp.ReadRequest(bufioHTTPReader)
 		if err == io.EOF {
@@ -95,73 +102,84 @@ func (h *HTTPHandler) HandleRequest(
 		}
 
 		if req != nil {
-			if req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName) == "" {
-				req.Header.Set(config.GetHTTPConfig().RequestIdHeaderName, uuid.New().String())
+			if req.Header.Get(httpConfig.RequestIdHeaderName) == "" {
+				req.Header.Set(httpConfig.RequestIdHeaderName, uuid.New().String())
 			}
 
-			if config.GetHTTPConfig().RoutingEnabled {
+			if httpConfig.RoutingEnabled {
 				// check Cookie if enabled
 				currentRoutingHeaderValue := ""
-				if config.GetHTTPConfig().RoutingCookieEnabled {
-					cookie, err := req.Cookie(config.GetHTTPConfig().RoutingCookieName)
+				if httpConfig.RoutingCookieEnabled {
+					cookie, err := req.Cookie(httpConfig.RoutingCookieName)
 					if err == nil {
 						currentRoutingHeaderValue = cookie.Value
 					}
 				}
 				if currentRoutingHeaderValue == "" {
-					currentRoutingHeaderValue = req.Header.Get(config.GetHTTPConfig().RoutingHeaderName)
+					currentRoutingHeaderValue = req.Header.Get(httpConfig.RoutingHeaderName)
 				}
 				if currentRoutingHeaderValue == "" {
 					routingContext, ok := h.routingInfoContextMapping.Get(
-						req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
+						req.Header.Get(httpConfig.RequestIdHeaderName),
 					)
 					if ok {
 						currentRoutingHeaderValue = routingContext.(string)
-						req.Header.Add(config.GetHTTPConfig().RoutingHeaderName, currentRoutingHeaderValue)
+						req.Header.Add(httpConfig.RoutingHeaderName, currentRoutingHeaderValue)
 					}
 				}
 
 				// here we can override destination (DNS allowed)
+				dstAddr := originalDst
 				if currentRoutingHeaderValue != "" {
 					addr, err := getRoutingDestination(currentRoutingHeaderValue, req.Host, originalDst)
 					if err != nil {
 						log.Warning(err.Error())
-						addrCh <- originalDst
 					} else {
 						if isInboundConn {
-							if rID := req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName); rID != "" {
+							if rID := req.Header.Get(httpConfig.RequestIdHeaderName); rID != "" {
 								h.routingInfoContextMapping.SetDefault(
 									rID,
 									currentRoutingHeaderValue,
 								)
 							}
-							addrCh <- originalDst
 						} else {
-							addrCh <- addr
+							dstAddr = addr
 						}
 					}
-				} else {
-					addrCh <- originalDst
 				}
 
-				w = <-connCh
-				if w == nil {
-					return w
+				var dialErr error
+				w, dialErr = h.dial(dialer, req, dstAddr, netHTTPRequest, isInboundConn, httpConfig)
+				if dialErr != nil {
+					return nil
+				}
+			} else if dialer != nil {
+				// outbound connection is handled with dialer to originate TLS for requests matching rules,
+				// dialer keeps upstream connection while requests go to the same upstream
+				var dialErr error
+				w, dialErr = h.dial(dialer, req, originalDst, netHTTPRequest, isInboundConn, httpConfig)
+				if dialErr != nil {
+					return nil
 				}
 			}
 		}
 
+		if w == nil && err != nil && dialer != nil && !httpConfig.RoutingEnabled {
+			// malformed first request is forwarded as is to original destination
+			w, _ = dialer.Dial(originalDst)
+		}
 		if w == nil {
 			return nil
 		}
 
 		if isInboundConn {
-			netHTTPRequest.remoteAddr = r.RemoteAddr().String()
+			netHTTPRequest.setRemoteAddr(r.RemoteAddr().String())
 		} else {
 			if w != nil {
-				netHTTPRequest.remoteAddr = w.RemoteAddr().String()
+				netHTTPRequest.setRemoteAddr(w.RemoteAddr().String())
 			}
 		}
+		netHTTPRequest.setUpstreamAddr(w.RemoteAddr().String())
 		if err != nil {
 			h.logger.Warningf("Error while parsing http request '%s'", err.Error())
 			buf := bufferPool.Get().([]byte)
@@ -174,58 +192,28 @@ func (h *HTTPHandler) HandleRequest(
 			if bufioHTTPReader.Buffered() > 0 {
 				bufioHTTPReader.Discard(bufioHTTPReader.Buffered())
 			}
-			buf = bufferPool.Get().([]byte)
-			_, err = io.CopyBuffer(w, bufioHTTPReader, buf)
-			bufferPool.Put(buf)
+			// temp writer is stopped and bufio reader is drained, so we can forward raw connection
+			_, err = forward(w, r)
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
 			return w
 		}
-		// avoid ws connections and other upgrade protos
-		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
-			buf := bufferPool.Get().([]byte)
-			_, err = io.CopyBuffer(w, tmpWriter, buf)
-			bufferPool.Put(buf)
-			if err != nil {
-				h.logger.Warning(err.Error())
-			}
-			tmpWriter.Stop()
-			if bufioHTTPReader.Buffered() > 0 {
-				bufioHTTPReader.Discard(bufioHTTPReader.Buffered())
-			}
-			buf = bufferPool.Get().([]byte)
-			_, err = io.CopyBuffer(w, bufioHTTPReader, buf)
-			bufferPool.Put(buf)
-			if err != nil {
-				h.logger.Warning(err.Error())
-			}
-			return w
-		}
-
 		tmpWriter.Stop()
 
 		if !isInboundConn {
-			traceCtx := req.Header.Get(jaeger.TraceContextHeaderName)
-			if traceCtx == "" {
-				// we need to generate context header and propagate it
-				tracingInfoByRequestID, ok := h.tracingContextMapping.Get(
-					req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName),
-				)
-				if ok {
-					//h.logger.Debugf("Found request-id matching: %#v", tracingInfoByRequestID)
-					tracingContext := tracingInfoByRequestID.(jaeger.SpanContext)
-					req.Header[jaeger.TraceContextHeaderName] = []string{tracingContext.String()}
-					//h.logger.Debugf("Outbound span: %s", tracingContext.String())
-				}
-			}
-			req.Header.Set(config.GetHTTPConfig().XSourceHeaderName, config.GetHTTPConfig().XSourceValue)
+			prepareOutboundRequest(req, httpConfig, h.tracingContextMapping)
 		}
 
 		netHTTPRequest.SetHTTPRequest(req)
-		if !config.GetHTTPConfig().TracingIgnoredPaths[req.URL.Path] {
+		if !httpConfig.TracingIgnoredPaths[req.URL.Path] {
 			netHTTPRequest.StartRequest()
 		}
+		// upgrade handshake is traced as a normal request, response decides whether connection is switched
+		var upgrade <-chan bool
+		if isUpgrade(req.Header) {
+			upgrade = netHTTPRequest.expectUpgrade()
+		}
 
 		bufioWriter := writerPool.Get().(*bufio.Writer)
 		bufioWriter.Reset(w)
@@ -236,12 +224,77 @@ func (h *HTTPHandler) HandleRequest(
 		if err != nil && err != io.ErrUnexpectedEOF {
 			h.logger.Errorf("Error while writing request to w: %s", err.Error())
 		}
+
+		if upgrade != nil && <-upgrade {
+			// the rest of client stream belongs to other protocol (e.g. websocket), forward it as is
+			session := netHTTPRequest.getSession()
+			var stream io.Writer
+			if session != nil {
+				stream = &session.client
+			}
+			_, err = forwardSession(w, bufioHTTPReader, r, stream)
+			if err != nil {
+				h.logger.Debug(err.Error())
+			}
+			if session != nil {
+				session.done()
+			}
+			return w
+		}
 	}
 
 	return w
 }
 
-func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+// dial opens upstream connection of request, TLS is originated for outbound requests matching rules
+func (h *HTTPHandler) dial(
+	dialer Dialer,
+	req *nhttp.Request,
+	dstAddr string,
+	netHTTPRequest *NetHTTPRequest,
+	isInboundConn bool,
+	httpConfig config.HTTPConfig) (net.Conn, error) {
+	var rule *config.TLSOriginationRule
+	if !isInboundConn {
+		rule = matchTLSOrigination(httpConfig.TLSOrigination, req.Host)
+	}
+	if rule == nil {
+		netHTTPRequest.setUpstreamTLS(nil)
+		return dialer.Dial(dstAddr)
+	}
+	tlsDialer, ok := dialer.(TLSDialer)
+	if !ok {
+		h.logger.Warningf("Can't originate TLS for %s: %s", req.Host, errTLSDialerRequired.Error())
+		return nil, errTLSDialerRequired
+	}
+	tlsConfig, err := h.origination.clientConfig(*rule, req.Host)
+	if err != nil {
+		h.logger.Warningf("Can't originate TLS for %s: %s", req.Host, err.Error())
+		return nil, err
+	}
+	conn, err := tlsDialer.DialTLS(originationAddr(dstAddr, rule.Port), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	netHTTPRequest.setUpstreamTLS(&upstreamTLS{serverName: tlsConfig.ServerName, state: conn.ConnectionState()})
+	return conn, nil
+}
+
+// prepareOutboundRequest propagates trace context of inbound request with the same request id
+// in case request doesn't have one and sets X-Source header
+func prepareOutboundRequest(req *nhttp.Request, httpConfig config.HTTPConfig, tracingContextMapping *cache.Cache) {
+	if req.Header.Get(jaeger.TraceContextHeaderName) == "" {
+		tracingInfoByRequestID, ok := tracingContextMapping.Get(req.Header.Get(httpConfig.RequestIdHeaderName))
+		if ok {
+			if tracingContext, ok := tracingInfoByRequestID.(jaeger.SpanContext); ok {
+				req.Header.Set(jaeger.TraceContextHeaderName, tracingContext.String())
+			}
+		}
+	}
+	req.Header.Set(httpConfig.XSourceHeaderName, httpConfig.XSourceValue)
+}
+
+func (h *HTTPHandler) HandleResponse(r net.Conn, w net.Conn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
 	netHTTPRequest := netRequest.(*NetHTTPRequest)
 	tmpWriter := NewTempWriter()
 	defer tmpWriter.Close()
@@ -249,9 +302,11 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 	bufioHTTPReader := readerPool.Get().(*bufio.Reader)
 	bufioHTTPReader.Reset(readerWithFallback)
 	defer readerPool.Put(bufioHTTPReader)
-	if !config.GetHTTPConfig().RoutingEnabled {
+	if !h.config.Get().HTTP.RoutingEnabled {
 		defer netHTTPRequest.CleanUp()
 	}
+	// request side shouldn't wait for upgrade response which won't be read
+	defer netHTTPRequest.resolveUpgrade(false)
 	for {
 		tmpWriter.Start()
 		resp, err := nhttp.ReadResponse(bufioHTTPReader, nil)
@@ -273,24 +328,7 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 			if bufioHTTPReader.Buffered() > 0 {
 				bufioHTTPReader.Discard(bufioHTTPReader.Buffered())
 			}
-			_, err = io.Copy(w, bufioHTTPReader)
-			if err != nil {
-				h.logger.Warning(err.Error())
-			}
-			return
-		}
-
-		// avoid ws connections and other upgrade protos
-		if strings.ToLower(resp.Header.Get("Connection")) == "upgrade" {
-			_, err = io.Copy(w, tmpWriter)
-			if err != nil {
-				h.logger.Warning(err.Error())
-			}
-			tmpWriter.Stop()
-			if bufioHTTPReader.Buffered() > 0 {
-				bufioHTTPReader.Discard(bufioHTTPReader.Buffered())
-			}
-			_, err = io.Copy(w, bufioHTTPReader)
+			_, err = forward(w, r)
 			if err != nil {
 				h.logger.Warning(err.Error())
 			}
@@ -298,15 +336,21 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 		}
 
 		tmpWriter.Stop()
+		upgraded := resp.StatusCode == nhttp.StatusSwitchingProtocols
+
+		// while draining close keep-alive connections at the response boundary
+		closeAfterResponse := h.drain.Draining() && resp.StatusCode >= 200
+		if closeAfterResponse {
+			resp.Close = true
+			resp.Header.Set("Connection", "close")
+		}
 
 		// if method == HEAD and content-length != 0, it will hang on read with LimitReader, handle this:
-		rq := netHTTPRequest.httpRequests.Peek()
-		if rq != nil && rq.(*nhttp.Request).Method == nhttp.MethodHead {
+		rq, _ := netHTTPRequest.currentExchange()
+		if rq != nil && rq.Method == nhttp.MethodHead {
 			// server side can hold connection which leads to stuck Close() method in Write(w)
 			if forceClose && resp.StatusCode != 100 {
-				r.CloseRead()
-				r.CloseWrite()
-				r.Close()
+				CloseConn(r)
 			}
 			err = resp.Write(w)
 		} else {
@@ -322,72 +366,137 @@ func (h *HTTPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest
 			h.logger.Errorf("Error while writing response to w: %s", err.Error())
 		}
 
+		if upgraded {
+			session := netHTTPRequest.startSession()
+			netHTTPRequest.SetHTTPResponse(resp)
+			netHTTPRequest.StopRequest()
+			netHTTPRequest.resolveUpgrade(true)
+			var stream io.Writer
+			if session != nil {
+				stream = &session.server
+			}
+			_, err = forwardSession(w, bufioHTTPReader, r, stream)
+			if err != nil {
+				h.logger.Debug(err.Error())
+			}
+			if session != nil {
+				session.done()
+			}
+			return
+		}
+
 		netHTTPRequest.SetHTTPResponse(resp)
 		netHTTPRequest.StopRequest()
+		if resp.StatusCode >= 200 && rq != nil && isUpgrade(rq.Header) {
+			// upgrade is rejected, connection keeps on speaking HTTP
+			netHTTPRequest.resolveUpgrade(false)
+		}
 		// in case of 100 response we can't close connection (server can keep on sending responses)
 		if forceClose && resp.StatusCode != 100 {
-			r.CloseRead()
-			r.CloseWrite()
-			r.Close()
+			CloseConn(r)
+		}
+		if closeAfterResponse {
+			return
 		}
 	}
 }
 
+// httpExchange is a request read from client with its span and response,
+// exchanges are queued until response is written or connection times out
+type httpExchange struct {
+	request   *nhttp.Request
+	response  *nhttp.Response
+	span      opentracing.Span
+	startTime time.Time
+}
+
 type NetHTTPRequest struct {
-	httpRequests          *Queue
-	httpResponses         *Queue
-	spans                 *Queue
+	// exchangesMu guards exchanges queue and fields of queued exchanges,
+	// exchange is owned by the goroutine which popped it
+	exchangesMu           sync.Mutex
+	exchanges             []*httpExchange
 	isInbound             bool
+	tracer                opentracing.Tracer
+	config                *config.Holder
 	tracingContextMapping *cache.Cache
 	logger                *log.Logger
+	remoteAddrMu          sync.Mutex
 	remoteAddr            string
-	statsdClient          *statsd.Client
+	upstreamAddr          string
+	metrics               *metrics.Metrics
+	accessLog             *accesslog.Logger
+	onRequest             func()
+	// peerIdentity is identity of mutual TLS peer sidecar, it's guarded by remoteAddrMu
+	peerIdentity string
+	// upstreamTLS is TLS connection originated to upstream of current request, it's guarded by remoteAddrMu
+	upstreamTLS *upstreamTLS
+	// upgradeMu guards upgrade result channel of request waiting for response and session of upgraded connection
+	upgradeMu sync.Mutex
+	upgrade   chan bool
+	session   *upgradeSession
 }
 
 func NewNetHTTPRequest(
 	logger *log.Logger,
 	isInbound bool,
+	tracer opentracing.Tracer,
+	cfg *config.Holder,
 	tracingContextMapping *cache.Cache,
-	statsdMetrics *statsd.Client) *NetHTTPRequest {
+	m *metrics.Metrics,
+	accessLog *accesslog.Logger) *NetHTTPRequest {
 	return &NetHTTPRequest{
-		httpRequests:          NewQueue(),
-		httpResponses:         NewQueue(),
-		spans:                 NewQueue(),
 		logger:                logger,
 		isInbound:             isInbound,
+		tracer:                tracer,
+		config:                cfg,
 		tracingContextMapping: tracingContextMapping,
-		statsdClient:          statsdMetrics,
+		metrics:               m,
+		accessLog:             accessLog,
 	}
 }
 
 func (nr *NetHTTPRequest) StartRequest() {
-	request := nr.httpRequests.Peek()
-	if request == nil {
+	nr.exchangesMu.Lock()
+	defer nr.exchangesMu.Unlock()
+	// previous request can still be in the queue if its response is being written
+	if len(nr.exchanges) == 0 {
 		return
 	}
-	httpRequest := request.(*nhttp.Request)
-	carrier := opentracing.HTTPHeadersCarrier(httpRequest.Header)
-	wireContext, err := opentracing.GlobalTracer().Extract(opentracing.HTTPHeaders, carrier)
-
-	operation := httpRequest.URL.Path
+	e := nr.exchanges[len(nr.exchanges)-1]
+	e.span = nr.startSpan(e.request, nr.operationName(e.request))
+	if upstream := nr.getUpstreamTLS(); upstream != nil {
+		upstream.tag(e.span)
+	}
+}
 
+// operationName returns span operation name of request, outbound requests are prefixed with host
+func (nr *NetHTTPRequest) operationName(httpRequest *nhttp.Request) string {
 	if !nr.isInbound {
-		operation = httpRequest.Host + httpRequest.URL.Path
+		return httpRequest.Host + httpRequest.URL.Path
 	}
-	httpConfig := config.GetHTTPConfig()
+	return httpRequest.URL.Path
+}
+
+// startSpan starts span of request continuing trace of its headers and injects span context into them
+func (nr *NetHTTPRequest) startSpan(httpRequest *nhttp.Request, operation string) opentracing.Span {
+	carrier := opentracing.HTTPHeadersCarrier(httpRequest.Header)
+	wireContext, err := nr.tracer.Extract(opentracing.HTTPHeaders, carrier)
+
+	httpConfig := nr.config.Get().HTTP
 	var span opentracing.Span
 	if err != nil {
 		nr.logger.Infof("Carrier extract error: %s", err.Error())
-		span = opentracing.StartSpan(
+		span = nr.tracer.StartSpan(
 			operation,
 		)
 
 		if nr.isInbound {
-			context := span.Context().(jaeger.SpanContext)
-			nr.tracingContextMapping.SetDefault(
-				httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
-				context,
-			)
+			if context, ok := span.Context().(jaeger.SpanContext); ok {
+				nr.tracingContextMapping.SetDefault(
+					httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
+					context,
+				)
+			}
 
 			if len(httpConfig.HeadersMap) > 0 {
 				// prefer httpConfig iteration, headers are already parsed into a map
@@ -407,54 +516,190 @@ func (nr *NetHTTPRequest) StartRequest() {
 			}
 		}
 	} else {
-		span = opentracing.StartSpan(
+		span = nr.tracer.StartSpan(
 			operation,
 			opentracing.ChildOf(wireContext),
 		)
 
 		if nr.isInbound {
-			context := span.Context().(jaeger.SpanContext)
-			nr.tracingContextMapping.SetDefault(
-				httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
-				context,
-			)
+			if context, ok := span.Context().(jaeger.SpanContext); ok {
+				nr.tracingContextMapping.SetDefault(
+					httpRequest.Header.Get(httpConfig.RequestIdHeaderName),
+					context,
+				)
+			}
 		}
 	}
+	// tag request id using the same configuration snapshot the span was started with
+	if requestID := httpRequest.Header.Get(httpConfig.RequestIdHeaderName); requestID != "" {
+		span.SetTag("http.request_id", requestID)
+	}
 	httpRequest.Header.Del("uber-trace-id")
 	span.Tracer().Inject(
 		span.Context(),
 		opentracing.HTTPHeaders,
 		opentracing.HTTPHeadersCarrier(httpRequest.Header))
-
-	nr.spans.Push(span)
+	return span
 }
 
 func (nr *NetHTTPRequest) StopRequest() {
-	request := nr.httpRequests.Pop()
-	response := nr.httpResponses.Pop()
+	e := nr.popExchange()
+	if e == nil {
+		return
+	}
+	nr.observe(e.request, e.response, e.startTime)
+	if e.response != nil {
+		if e.span != nil {
+			nr.fillSpan(e.span, e.request, e.response)
+			e.span.Finish()
+		}
+		nr.logAccess(e.request, e.response, e.span, e.startTime)
+	} else if e.span != nil {
+		nr.fillSpan(e.span, e.request, nil)
+		e.span.SetTag("error", true)
+		e.span.SetTag("timeout", true)
+		e.span.Finish()
+	}
+}
+
+// popExchange removes the oldest exchange from queue, it's nil in case queue is empty
+func (nr *NetHTTPRequest) popExchange() *httpExchange {
+	nr.exchangesMu.Lock()
+	defer nr.exchangesMu.Unlock()
+	if len(nr.exchanges) == 0 {
+		return nil
+	}
+	e := nr.exchanges[0]
+	nr.exchanges[0] = nil
+	nr.exchanges = nr.exchanges[1:]
+	return e
+}
+
+// currentExchange returns request and span of the oldest exchange, i.e. the one being answered
+func (nr *NetHTTPRequest) currentExchange() (*nhttp.Request, opentracing.Span) {
+	nr.exchangesMu.Lock()
+	defer nr.exchangesMu.Unlock()
+	if len(nr.exchanges) == 0 {
+		return nil, nil
+	}
+	return nr.exchanges[0].request, nr.exchanges[0].span
+}
 
-	if request != nil && response != nil {
-		httpRequest := request.(*nhttp.Request)
-		httpResponse := response.(*nhttp.Response)
-		span := nr.spans.Pop()
-		if span != nil {
-			requestSpan := span.(opentracing.Span)
-			nr.fillSpan(requestSpan, httpRequest, httpResponse)
-			requestSpan.Finish()
+// expectUpgrade returns channel which receives whether upgrade request is accepted by response
+func (nr *NetHTTPRequest) expectUpgrade() <-chan bool {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	nr.upgrade = make(chan bool, 1)
+	return nr.upgrade
+}
+
+// resolveUpgrade sends result of upgrade to request waiting for it
+func (nr *NetHTTPRequest) resolveUpgrade(accepted bool) {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	if nr.upgrade != nil {
+		nr.upgrade <- accepted
+		nr.upgrade = nil
+	}
+}
+
+// startSession starts span of upgraded connection following span of handshake request,
+// session isn't traced in case handshake isn't traced
+func (nr *NetHTTPRequest) startSession() *upgradeSession {
+	httpRequest, span := nr.currentExchange()
+	if httpRequest == nil || span == nil {
+		return nil
+	}
+	protocol := strings.ToLower(httpRequest.Header.Get("Upgrade"))
+	sessionSpan := nr.tracer.StartSpan(
+		protocol+" "+nr.operationName(httpRequest),
+		opentracing.FollowsFrom(span.Context()),
+	)
+	nr.fillSpan(sessionSpan, httpRequest, nil)
+	session := newUpgradeSession(sessionSpan, protocol)
+	nr.upgradeMu.Lock()
+	nr.session = session
+	nr.upgradeMu.Unlock()
+	return session
+}
+
+func (nr *NetHTTPRequest) getSession() *upgradeSession {
+	nr.upgradeMu.Lock()
+	defer nr.upgradeMu.Unlock()
+	return nr.session
+}
+
+func (nr *NetHTTPRequest) TimedOut(cause string) {
+	if session := nr.getSession(); session != nil {
+		session.finish(func(span opentracing.Span) {
+			span.SetTag("error", true)
+			span.SetTag("timeout", true)
+			span.SetTag("timeout.cause", cause)
+		})
+	}
+	// exchanges are taken at once, so StopRequest running concurrently can't report them again
+	nr.exchangesMu.Lock()
+	exchanges := nr.exchanges
+	nr.exchanges = nil
+	nr.exchangesMu.Unlock()
+	for _, e := range exchanges {
+		nr.observe(e.request, nil, e.startTime)
+		if e.span == nil {
+			continue
 		}
+		nr.fillSpan(e.span, e.request, nil)
+		e.span.SetTag("error", true)
+		e.span.SetTag("timeout", true)
+		e.span.SetTag("timeout.cause", cause)
+		e.span.Finish()
+	}
+}
+
+// observe reports request metrics, response is nil in case it wasn't received
+func (nr *NetHTTPRequest) observe(req *nhttp.Request, resp *nhttp.Response, startTime time.Time) {
+	r := metrics.HTTPRequest{
+		IsInbound: nr.isInbound,
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+		Caller:    req.Header.Get(nr.config.Get().HTTP.XSourceHeaderName),
 	}
+	if resp != nil {
+		r.StatusCode = resp.StatusCode
+	}
+	r.Duration = time.Since(startTime)
+	nr.metrics.ObserveHTTPRequest(r)
+}
 
-	if request != nil && response == nil {
-		httpRequest := request.(*nhttp.Request)
-		span := nr.spans.Pop()
-		if span != nil {
-			requestSpan := span.(opentracing.Span)
-			nr.fillSpan(requestSpan, httpRequest, nil)
-			requestSpan.SetTag("error", true)
-			requestSpan.SetTag("timeout", true)
-			requestSpan.Finish()
+// logAccess writes access log entry of request/response pair, span is nil for requests which aren't traced
+func (nr *NetHTTPRequest) logAccess(req *nhttp.Request, resp *nhttp.Response, span opentracing.Span, startTime time.Time) {
+	if nr.accessLog == nil {
+		return
+	}
+	httpConfig := nr.config.Get().HTTP
+	e := accesslog.Entry{
+		Time:         startTime,
+		Duration:     time.Since(startTime),
+		Direction:    "outbound",
+		Method:       req.Method,
+		Host:         req.Host,
+		Path:         req.URL.Path,
+		Status:       resp.StatusCode,
+		RequestSize:  req.ContentLength,
+		ResponseSize: resp.ContentLength,
+		RequestID:    req.Header.Get(httpConfig.RequestIdHeaderName),
+		Source:       req.Header.Get(httpConfig.XSourceHeaderName),
+		UpstreamAddr: nr.getUpstreamAddr(),
+	}
+	if nr.isInbound {
+		e.Direction = "inbound"
+	}
+	if span != nil {
+		if sc, ok := span.Context().(jaeger.SpanContext); ok {
+			e.TraceID = sc.TraceID().String()
 		}
 	}
+	nr.accessLog.Log(e)
 }
 
 func (nr *NetHTTPRequest) CleanUp() {
@@ -470,7 +715,10 @@ func (nr *NetHTTPRequest) fillSpan(
 	} else {
 		span.SetTag("span.kind", "client")
 	}
-	span.SetTag("remote_addr", nr.remoteAddr)
+	span.SetTag("remote_addr", nr.getRemoteAddr())
+	if identity := nr.getPeerIdentity(); identity != "" {
+		span.SetTag("peer.identity", identity)
+	}
 	if req != nil {
 		span.SetTag("http.host", req.Host)
 		span.SetTag("http.path", req.URL.String())
@@ -479,9 +727,6 @@ func (nr *NetHTTPRequest) fillSpan(
 		if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
 			span.SetTag("http.user_agent", userAgent)
 		}
-		if requestID := req.Header.Get(config.GetHTTPConfig().RequestIdHeaderName); requestID != "" {
-			span.SetTag("http.request_id", requestID)
-		}
 	}
 	if resp != nil {
 		span.SetTag("http.response_size", resp.ContentLength)
@@ -489,66 +734,79 @@ func (nr *NetHTTPRequest) fillSpan(
 		if resp.StatusCode >= 500 {
 			span.SetTag("error", "true")
 		}
-		// also send inbound metric:
-		if nr.isInbound {
-			nr.statsdClient.Increment("inbound." + strconv.Itoa(resp.StatusCode))
-		}
 	}
 }
 
-func (nr *NetHTTPRequest) SetHTTPRequest(r *nhttp.Request) {
-	nr.httpRequests.Push(r)
+func (nr *NetHTTPRequest) setRemoteAddr(addr string) {
+	nr.remoteAddrMu.Lock()
+	nr.remoteAddr = addr
+	nr.remoteAddrMu.Unlock()
 }
 
-func (nr *NetHTTPRequest) SetHTTPResponse(r *nhttp.Response) {
-	nr.httpResponses.Push(r)
+func (nr *NetHTTPRequest) getRemoteAddr() string {
+	nr.remoteAddrMu.Lock()
+	defer nr.remoteAddrMu.Unlock()
+	return nr.remoteAddr
 }
 
-// NewQueue creates new queue
-func NewQueue() *Queue {
-	return &Queue{
-		elements: list.New(),
-	}
+func (nr *NetHTTPRequest) setUpstreamAddr(addr string) {
+	nr.remoteAddrMu.Lock()
+	nr.upstreamAddr = addr
+	nr.remoteAddrMu.Unlock()
 }
 
-// Queue implements queue data structure
-type Queue struct {
-	mu       sync.Mutex
-	elements *list.List
+func (nr *NetHTTPRequest) getUpstreamAddr() string {
+	nr.remoteAddrMu.Lock()
+	defer nr.remoteAddrMu.Unlock()
+	return nr.upstreamAddr
 }
 
-// Push pushes element to the end of queue
-func (q *Queue) Push(value interface{}) {
-	q.mu.Lock()
-	q.elements.PushBack(value)
-	q.mu.Unlock()
+// SetPeerIdentity sets identity of mutual TLS peer, it's tagged on spans finished after the call
+func (nr *NetHTTPRequest) SetPeerIdentity(identity string) {
+	nr.remoteAddrMu.Lock()
+	nr.peerIdentity = identity
+	nr.remoteAddrMu.Unlock()
 }
 
-// Pop pops first element out of queue
-func (q *Queue) Pop() interface{} {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	el := q.elements.Front()
-	if el == nil {
-		return nil
-	}
-	return q.elements.Remove(el)
+func (nr *NetHTTPRequest) getPeerIdentity() string {
+	nr.remoteAddrMu.Lock()
+	defer nr.remoteAddrMu.Unlock()
+	return nr.peerIdentity
 }
 
-// Peek returns first element in the queue without removing it
-func (q *Queue) Peek() interface{} {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	if el := q.elements.Front(); el != nil {
-		return el.Value
-	} else {
-		return nil
+func (nr *NetHTTPRequest) setUpstreamTLS(upstream *upstreamTLS) {
+	nr.remoteAddrMu.Lock()
+	nr.upstreamTLS = upstream
+	nr.remoteAddrMu.Unlock()
+}
+
+func (nr *NetHTTPRequest) getUpstreamTLS() *upstreamTLS {
+	nr.remoteAddrMu.Lock()
+	defer nr.remoteAddrMu.Unlock()
+	return nr.upstreamTLS
+}
+
+func (nr *NetHTTPRequest) SetHTTPRequest(r *nhttp.Request) {
+	nr.exchangesMu.Lock()
+	nr.exchanges = append(nr.exchanges, &httpExchange{request: r, startTime: time.Now()})
+	nr.exchangesMu.Unlock()
+	if nr.onRequest != nil {
+		nr.onRequest()
 	}
 }
 
-// Clear clears queue
-func (q *Queue) Clear() {
-	for el := q.Pop(); el != nil; {
+// OnRequest registers callback called for each HTTP request read from client.
+// It should be called before request processing is started.
+func (nr *NetHTTPRequest) OnRequest(f func()) {
+	nr.onRequest = f
+}
+
+// SetHTTPResponse sets response of the oldest exchange, response of timed out request is ignored
+func (nr *NetHTTPRequest) SetHTTPResponse(r *nhttp.Response) {
+	nr.exchangesMu.Lock()
+	defer nr.exchangesMu.Unlock()
+	if len(nr.exchanges) > 0 {
+		nr.exchanges[0].response = r
 	}
 }
 
@@ -564,8 +822,9 @@ func getRoutingDestination(routingValue string, host string, originalDst string)
 			continue
 		}
 		if host == keyval[0] {
-			if !strings.Contains(keyval[1], ":") {
-				keyval[1] += ":80"
+			// destination may be host, host:port, [ipv6] or [ipv6]:port
+			if _, _, err := net.SplitHostPort(keyval[1]); err != nil {
+				keyval[1] = net.JoinHostPort(strings.Trim(keyval[1], "[]"), "80")
 			}
 			return keyval[1], nil
 		}
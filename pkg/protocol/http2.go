@@ -0,0 +1,866 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/http2/hpack"
+
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// HTTP/2 frame types, flags and settings used by handler (RFC 7540)
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FrameGoAway       = 0x7
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+
+	http2SettingHeaderTableSize = 0x1
+	http2SettingMaxFrameSize    = 0x5
+
+	http2FrameHeaderLen         = 9
+	http2DefaultMaxFrameSize    = 16384
+	http2DefaultHeaderTableSize = 4096
+)
+
+var errHTTP2Protocol = errors.New("http2: protocol error")
+
+// http2Frame is a frame read from connection, raw contains frame header and payload
+type http2Frame struct {
+	typ      uint8
+	flags    uint8
+	streamID uint32
+	raw      []byte
+}
+
+func (f http2Frame) payload() []byte {
+	return f.raw[http2FrameHeaderLen:]
+}
+
+// http2FrameReader reads frames into reusable buffer, frame is valid until next call
+type http2FrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newHTTP2FrameReader(r *bufio.Reader) *http2FrameReader {
+	return &http2FrameReader{r: r, buf: make([]byte, http2FrameHeaderLen+http2DefaultMaxFrameSize)}
+}
+
+func (fr *http2FrameReader) next() (http2Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.buf[:http2FrameHeaderLen]); err != nil {
+		return http2Frame{}, err
+	}
+	length := int(fr.buf[0])<<16 | int(fr.buf[1])<<8 | int(fr.buf[2])
+	if cap(fr.buf) < http2FrameHeaderLen+length {
+		buf := make([]byte, http2FrameHeaderLen+length)
+		copy(buf, fr.buf[:http2FrameHeaderLen])
+		fr.buf = buf
+	}
+	raw := fr.buf[:http2FrameHeaderLen+length]
+	if _, err := io.ReadFull(fr.r, raw[http2FrameHeaderLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return http2Frame{}, err
+	}
+	return http2Frame{
+		typ:      raw[3],
+		flags:    raw[4],
+		streamID: binary.BigEndian.Uint32(raw[5:9]) & (1<<31 - 1),
+		raw:      raw,
+	}, nil
+}
+
+func appendHTTP2FrameHeader(b []byte, length int, typ uint8, flags uint8, streamID uint32) []byte {
+	return append(b,
+		byte(length>>16), byte(length>>8), byte(length),
+		typ, flags,
+		byte(streamID>>24)&0x7f, byte(streamID>>16), byte(streamID>>8), byte(streamID))
+}
+
+// http2HeaderBlockFragment strips padding and priority of HEADERS or PUSH_PROMISE payload,
+// priority is nil in case frame doesn't have PRIORITY flag
+func http2HeaderBlockFragment(f http2Frame) (fragment []byte, priority []byte, err error) {
+	payload := f.payload()
+	padding := 0
+	if f.flags&http2FlagPadded != 0 {
+		if len(payload) < 1 {
+			return nil, nil, errHTTP2Protocol
+		}
+		padding = int(payload[0])
+		payload = payload[1:]
+	}
+	prefix := 0
+	if f.typ == http2FrameHeaders && f.flags&http2FlagPriority != 0 {
+		prefix = 5
+	} else if f.typ == http2FramePushPromise {
+		// promised stream id
+		prefix = 4
+	}
+	if len(payload) < prefix+padding {
+		return nil, nil, errHTTP2Protocol
+	}
+	if f.typ == http2FrameHeaders && prefix > 0 {
+		priority = payload[:prefix]
+	}
+	return payload[prefix : len(payload)-padding], priority, nil
+}
+
+// http2Data returns DATA frame payload without padding
+func http2Data(f http2Frame) []byte {
+	payload := f.payload()
+	if f.flags&http2FlagPadded == 0 || len(payload) == 0 {
+		return payload
+	}
+	n := len(payload) - 1 - int(payload[0])
+	if n < 0 {
+		return nil
+	}
+	return payload[1 : 1+n]
+}
+
+// forEachHTTP2Setting calls f for each parameter of SETTINGS frame
+func forEachHTTP2Setting(f http2Frame, fn func(id uint16, value uint32)) {
+	if f.flags&http2FlagAck != 0 {
+		return
+	}
+	for payload := f.payload(); len(payload) >= 6; payload = payload[6:] {
+		fn(binary.BigEndian.Uint16(payload), binary.BigEndian.Uint32(payload[2:]))
+	}
+}
+
+// writeHTTP2HeaderBlock writes header block as HEADERS frame followed by CONTINUATION frames
+// in case block doesn't fit into one frame
+func writeHTTP2HeaderBlock(
+	w io.Writer,
+	streamID uint32,
+	flags uint8,
+	priority []byte,
+	block []byte,
+	maxFrameSize int) error {
+	frames := make([]byte, 0, len(block)+len(priority)+http2FrameHeaderLen)
+	for first := true; first || len(block) > 0; first = false {
+		typ := uint8(http2FrameContinuation)
+		var frameFlags uint8
+		var prefix []byte
+		if first {
+			typ = http2FrameHeaders
+			frameFlags = flags & http2FlagEndStream
+			if priority != nil {
+				frameFlags |= http2FlagPriority
+				prefix = priority
+			}
+		}
+		n := maxFrameSize - len(prefix)
+		if n >= len(block) {
+			n = len(block)
+			frameFlags |= http2FlagEndHeaders
+		}
+		frames = appendHTTP2FrameHeader(frames, len(prefix)+n, typ, frameFlags, streamID)
+		frames = append(frames, prefix...)
+		frames = append(frames, block[:n]...)
+		block = block[n:]
+	}
+	_, err := w.Write(frames)
+	return err
+}
+
+// forwardBuffered writes bytes buffered by reader and copies the rest of src to dst
+func forwardBuffered(dst io.Writer, reader *bufio.Reader, src io.Reader) (int64, error) {
+	var written int64
+	if n := reader.Buffered(); n > 0 {
+		buffered, _ := reader.Peek(n)
+		m, err := dst.Write(buffered)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		reader.Discard(n)
+	}
+	n, err := forward(dst, src)
+	return written + n, err
+}
+
+// HTTP2Handler process HTTP/2 connections with prior knowledge (h2c).
+// Streams are demultiplexed to trace each request separately, request header blocks are
+// re-encoded to inject trace context, other frames (including flow control) are forwarded as is.
+type HTTP2Handler struct {
+	config                *config.Holder
+	tracer                opentracing.Tracer
+	drain                 *drain.Tracker
+	tracingContextMapping *cache.Cache
+	logger                *log.Logger
+}
+
+// NewHTTP2Handler returns HTTP/2 handler
+func NewHTTP2Handler(
+	logger *log.Logger,
+	tracer opentracing.Tracer,
+	cfg *config.Holder,
+	drainTracker *drain.Tracker,
+	tracingContextMapping *cache.Cache) *HTTP2Handler {
+	return &HTTP2Handler{
+		config:                cfg,
+		tracer:                tracer,
+		drain:                 drainTracker,
+		tracingContextMapping: tracingContextMapping,
+		logger:                logger,
+	}
+}
+
+// HandleRequest handles client side of HTTP/2 connection.
+// Requests aren't routed separately, all streams are sent to original destination.
+func (h *HTTP2Handler) HandleRequest(
+	r net.Conn,
+	w net.Conn,
+	dialer Dialer,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) net.Conn {
+
+	netHTTP2Request := netRequest.(*NetHTTP2Request)
+	if w == nil {
+		var err error
+		w, err = dialer.Dial(originalDst)
+		if err != nil {
+			return nil
+		}
+	}
+	if isInboundConn {
+		netHTTP2Request.http.setRemoteAddr(r.RemoteAddr().String())
+	} else {
+		netHTTP2Request.http.setRemoteAddr(w.RemoteAddr().String())
+	}
+	netHTTP2Request.http.setUpstreamAddr(w.RemoteAddr().String())
+
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(r)
+	defer readerPool.Put(bufioReader)
+
+	preface, err := bufioReader.Peek(len(http2Preface))
+	if err != nil || !bytes.Equal(preface, http2Preface) {
+		// e.g. HTTP/1 request on port configured as http2, proxy it as is
+		h.logger.Debug("Connection doesn't start with HTTP/2 preface")
+		if _, err := forwardBuffered(w, bufioReader, r); err != nil {
+			h.logger.Warning(err.Error())
+		}
+		return w
+	}
+	if _, err := w.Write(http2Preface); err != nil {
+		h.logger.Warning(err.Error())
+		return w
+	}
+	bufioReader.Discard(len(http2Preface))
+
+	frameReader := newHTTP2FrameReader(bufioReader)
+	for {
+		frame, err := frameReader.next()
+		if err == io.EOF {
+			h.logger.Debug("EOF while reading HTTP/2 frame")
+			return w
+		}
+		if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+			h.logger.Debug(err.Error())
+			return w
+		}
+		if err != nil {
+			h.logger.Warningf("Error while reading HTTP/2 frame: %s", err.Error())
+			return w
+		}
+
+		switch frame.typ {
+		case http2FrameHeaders:
+			err = h.handleRequestHeaders(w, frameReader, frame, netHTTP2Request, isInboundConn)
+		case http2FrameData:
+			netHTTP2Request.addRequestData(frame.streamID, http2Data(frame))
+			_, err = w.Write(frame.raw)
+		case http2FrameRSTStream:
+			netHTTP2Request.finishStream(frame.streamID, true)
+			_, err = w.Write(frame.raw)
+		case http2FrameSettings:
+			forEachHTTP2Setting(frame, func(id uint16, value uint32) {
+				if id == http2SettingHeaderTableSize {
+					netHTTP2Request.setClientHeaderTableSize(value)
+				}
+			})
+			_, err = w.Write(frame.raw)
+		default:
+			_, err = w.Write(frame.raw)
+		}
+		if err != nil {
+			h.logger.Warningf("Error while writing HTTP/2 frame to w: %s", err.Error())
+			return w
+		}
+	}
+}
+
+// handleRequestHeaders reads the rest of header block, traces new stream and writes re-encoded block to w
+func (h *HTTP2Handler) handleRequestHeaders(
+	w net.Conn,
+	frameReader *http2FrameReader,
+	frame http2Frame,
+	netHTTP2Request *NetHTTP2Request,
+	isInboundConn bool) error {
+	fragment, priority, err := http2HeaderBlockFragment(frame)
+	if err != nil {
+		return err
+	}
+	streamID, flags := frame.streamID, frame.flags
+	// frame buffer is reused by reader
+	block := append([]byte(nil), fragment...)
+	if priority != nil {
+		priority = append([]byte(nil), priority...)
+	}
+	for end := flags&http2FlagEndHeaders != 0; !end; {
+		continuation, err := frameReader.next()
+		if err != nil {
+			return err
+		}
+		if continuation.typ != http2FrameContinuation || continuation.streamID != streamID {
+			return errHTTP2Protocol
+		}
+		block = append(block, continuation.payload()...)
+		end = continuation.flags&http2FlagEndHeaders != 0
+	}
+
+	fields, err := netHTTP2Request.decodeRequestHeaders(block)
+	if err != nil {
+		return fmt.Errorf("request headers decoding: %s", err.Error())
+	}
+	if netHTTP2Request.isNewStream(streamID) {
+		fields = h.startStream(streamID, fields, netHTTP2Request, isInboundConn)
+	}
+	block, maxFrameSize, err := netHTTP2Request.encodeRequestHeaders(fields)
+	if err != nil {
+		return err
+	}
+	return writeHTTP2HeaderBlock(w, streamID, flags, priority, block, maxFrameSize)
+}
+
+// startStream starts tracing of request and returns its header fields with injected headers
+func (h *HTTP2Handler) startStream(
+	streamID uint32,
+	fields []hpack.HeaderField,
+	netHTTP2Request *NetHTTP2Request,
+	isInboundConn bool) []hpack.HeaderField {
+	httpConfig := h.config.Get().HTTP
+	req, err := newHTTP2Request(fields)
+	if err != nil {
+		h.logger.Warningf("Error while parsing http2 request '%s'", err.Error())
+		netHTTP2Request.startStream(streamID, nil, nil, nil)
+		return fields
+	}
+	if req.Header.Get(httpConfig.RequestIdHeaderName) == "" {
+		req.Header.Set(httpConfig.RequestIdHeaderName, uuid.New().String())
+	}
+	if !isInboundConn {
+		prepareOutboundRequest(req, httpConfig, h.tracingContextMapping)
+	}
+	call := newGRPCCall(req)
+	var span opentracing.Span
+	if !httpConfig.TracingIgnoredPaths[req.URL.Path] {
+		operation := netHTTP2Request.http.operationName(req)
+		if call != nil {
+			operation = call.operationName()
+		}
+		span = netHTTP2Request.http.startSpan(req, operation)
+		span.SetTag("http2.stream_id", streamID)
+		if call != nil {
+			call.startSpan(span)
+		}
+	}
+	netHTTP2Request.startStream(streamID, req, span, call)
+	return http2RequestFields(fields, req.Header)
+}
+
+// HandleResponse handles upstream side of HTTP/2 connection, frames are forwarded as is
+func (h *HTTP2Handler) HandleResponse(r net.Conn, w net.Conn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	netHTTP2Request := netRequest.(*NetHTTP2Request)
+	bufioReader := readerPool.Get().(*bufio.Reader)
+	bufioReader.Reset(r)
+	defer readerPool.Put(bufioReader)
+	if !h.config.Get().HTTP.RoutingEnabled {
+		defer netHTTP2Request.CleanUp()
+	}
+
+	// server preface is SETTINGS frame, anything else is proxied as is
+	if header, err := bufioReader.Peek(http2FrameHeaderLen); err != nil || header[3] != http2FrameSettings {
+		if _, err := forwardBuffered(w, bufioReader, r); err != nil {
+			h.logger.Warning(err.Error())
+		}
+		return
+	}
+
+	frameReader := newHTTP2FrameReader(bufioReader)
+	// header block of HEADERS or PUSH_PROMISE frame which is continued by CONTINUATION frames
+	var block []byte
+	var blockFrame http2Frame
+	goAwaySent := false
+	for {
+		frame, err := frameReader.next()
+		if err == io.EOF {
+			h.logger.Debug("EOF while reading HTTP/2 frame")
+			return
+		}
+		if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+			h.logger.Debug(err.Error())
+			return
+		}
+		if err != nil {
+			h.logger.Warningf("Error while reading HTTP/2 frame: %s", err.Error())
+			return
+		}
+		if _, err := w.Write(frame.raw); err != nil {
+			h.logger.Warningf("Error while writing HTTP/2 frame to w: %s", err.Error())
+			return
+		}
+
+		finished := false
+		switch frame.typ {
+		case http2FrameHeaders, http2FramePushPromise:
+			fragment, _, err := http2HeaderBlockFragment(frame)
+			if err != nil {
+				h.logger.Warning(err.Error())
+				continue
+			}
+			block = append(block[:0], fragment...)
+			blockFrame = http2Frame{typ: frame.typ, flags: frame.flags, streamID: frame.streamID}
+			if frame.flags&http2FlagEndHeaders != 0 {
+				finished = h.handleResponseHeaders(blockFrame, block, netHTTP2Request)
+			}
+		case http2FrameContinuation:
+			block = append(block, frame.payload()...)
+			if frame.flags&http2FlagEndHeaders != 0 {
+				finished = h.handleResponseHeaders(blockFrame, block, netHTTP2Request)
+			}
+		case http2FrameData:
+			netHTTP2Request.addResponseData(frame.streamID, http2Data(frame))
+			if frame.flags&http2FlagEndStream != 0 {
+				finished = netHTTP2Request.finishStream(frame.streamID, false)
+			}
+		case http2FrameRSTStream:
+			finished = netHTTP2Request.finishStream(frame.streamID, true)
+		case http2FrameSettings:
+			forEachHTTP2Setting(frame, func(id uint16, value uint32) {
+				switch id {
+				case http2SettingHeaderTableSize:
+					netHTTP2Request.setUpstreamHeaderTableSize(value)
+				case http2SettingMaxFrameSize:
+					netHTTP2Request.setUpstreamMaxFrameSize(value)
+				}
+			})
+		}
+
+		// while draining ask client to stop opening streams and close connection when they are finished
+		if h.drain.Draining() && !goAwaySent {
+			goAway := appendHTTP2FrameHeader(nil, 8, http2FrameGoAway, 0, 0)
+			goAway = append(goAway, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(goAway[http2FrameHeaderLen:], netHTTP2Request.getLastStreamID())
+			if _, err := w.Write(goAway); err != nil {
+				h.logger.Warning(err.Error())
+				return
+			}
+			goAwaySent = true
+		}
+		if goAwaySent && finished && netHTTP2Request.pendingStreams() == 0 {
+			return
+		}
+	}
+}
+
+// handleResponseHeaders sets response of stream and reports whether stream is finished
+func (h *HTTP2Handler) handleResponseHeaders(frame http2Frame, block []byte, netHTTP2Request *NetHTTP2Request) bool {
+	fields, err := netHTTP2Request.decodeResponseHeaders(block)
+	if err != nil {
+		h.logger.Warningf("Error while decoding HTTP/2 response headers: %s", err.Error())
+		return false
+	}
+	if frame.typ == http2FramePushPromise {
+		return false
+	}
+	netHTTP2Request.setResponseHeaders(frame.streamID, fields)
+	if frame.flags&http2FlagEndStream != 0 {
+		return netHTTP2Request.finishStream(frame.streamID, false)
+	}
+	return false
+}
+
+// newHTTP2Request creates request of header fields, body isn't set
+func newHTTP2Request(fields []hpack.HeaderField) (*nhttp.Request, error) {
+	req := &nhttp.Request{
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(nhttp.Header),
+		ContentLength: -1,
+	}
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			req.Method = f.Value
+		case ":path":
+			req.RequestURI = f.Value
+		case ":authority":
+			req.Host = f.Value
+		default:
+			if !f.IsPseudo() {
+				req.Header.Add(f.Name, f.Value)
+			}
+		}
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	if req.Method == nhttp.MethodConnect && req.RequestURI == "" {
+		req.URL = &url.URL{Host: req.Host}
+		return req, nil
+	}
+	u, err := url.ParseRequestURI(req.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	return req, nil
+}
+
+// newHTTP2Response creates response of header fields, it returns nil for trailers
+func newHTTP2Response(fields []hpack.HeaderField) *nhttp.Response {
+	resp := &nhttp.Response{
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        make(nhttp.Header),
+		ContentLength: -1,
+	}
+	hasStatus := false
+	for _, f := range fields {
+		if f.Name == ":status" {
+			resp.StatusCode, _ = strconv.Atoi(f.Value)
+			hasStatus = true
+		} else if !f.IsPseudo() {
+			resp.Header.Add(f.Name, f.Value)
+		}
+	}
+	if !hasStatus {
+		return nil
+	}
+	return resp
+}
+
+// http2RequestFields returns fields of modified request header keeping order of original fields,
+// added headers are appended in lower case
+func http2RequestFields(fields []hpack.HeaderField, header nhttp.Header) []hpack.HeaderField {
+	result := make([]hpack.HeaderField, 0, len(fields)+4)
+	written := make(map[string]bool, len(header))
+	for _, f := range fields {
+		if f.IsPseudo() {
+			result = append(result, f)
+			continue
+		}
+		key := nhttp.CanonicalHeaderKey(f.Name)
+		if written[key] {
+			continue
+		}
+		written[key] = true
+		for _, value := range header[key] {
+			result = append(result, hpack.HeaderField{Name: f.Name, Value: value, Sensitive: f.Sensitive})
+		}
+	}
+	added := make([]string, 0, len(header)-len(written))
+	for key := range header {
+		if !written[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		for _, value := range header[key] {
+			result = append(result, hpack.HeaderField{Name: strings.ToLower(key), Value: value})
+		}
+	}
+	return result
+}
+
+// http2Stream is a state of traced stream
+type http2Stream struct {
+	request      *nhttp.Request
+	response     *nhttp.Response
+	span         opentracing.Span
+	startTime    time.Time
+	requestSize  int64
+	responseSize int64
+	// grpc is nil for streams which aren't gRPC calls
+	grpc *grpcCall
+}
+
+// NetHTTP2Request keeps state of HTTP/2 connection: streams being processed and HPACK contexts.
+// Request header blocks are decoded and re-encoded, so proxy has own encoder towards upstream,
+// response header blocks are forwarded as is and decoded only to follow client's decoder state.
+type NetHTTP2Request struct {
+	// http is used to trace streams the same way as HTTP/1 requests
+	http *NetHTTPRequest
+
+	mu           sync.Mutex
+	streams      map[uint32]*http2Stream
+	lastStreamID uint32
+
+	hpackMu      sync.Mutex
+	reqDecoder   *hpack.Decoder
+	reqEncoder   *hpack.Encoder
+	reqBuf       bytes.Buffer
+	respDecoder  *hpack.Decoder
+	maxFrameSize int
+
+	onRequest func()
+}
+
+// NewNetHTTP2Request creates state of HTTP/2 connection
+func NewNetHTTP2Request(
+	logger *log.Logger,
+	isInbound bool,
+	tracer opentracing.Tracer,
+	cfg *config.Holder,
+	tracingContextMapping *cache.Cache,
+	m *metrics.Metrics,
+	accessLog *accesslog.Logger) *NetHTTP2Request {
+	nr := &NetHTTP2Request{
+		http:         NewNetHTTPRequest(logger, isInbound, tracer, cfg, tracingContextMapping, m, accessLog),
+		streams:      make(map[uint32]*http2Stream),
+		reqDecoder:   hpack.NewDecoder(http2DefaultHeaderTableSize, nil),
+		respDecoder:  hpack.NewDecoder(http2DefaultHeaderTableSize, nil),
+		maxFrameSize: http2DefaultMaxFrameSize,
+	}
+	nr.reqEncoder = hpack.NewEncoder(&nr.reqBuf)
+	return nr
+}
+
+func (nr *NetHTTP2Request) decodeRequestHeaders(block []byte) ([]hpack.HeaderField, error) {
+	nr.hpackMu.Lock()
+	defer nr.hpackMu.Unlock()
+	return nr.reqDecoder.DecodeFull(block)
+}
+
+// encodeRequestHeaders returns header block and max frame size of upstream
+func (nr *NetHTTP2Request) encodeRequestHeaders(fields []hpack.HeaderField) ([]byte, int, error) {
+	nr.hpackMu.Lock()
+	defer nr.hpackMu.Unlock()
+	nr.reqBuf.Reset()
+	for _, f := range fields {
+		if err := nr.reqEncoder.WriteField(f); err != nil {
+			return nil, 0, err
+		}
+	}
+	return append([]byte(nil), nr.reqBuf.Bytes()...), nr.maxFrameSize, nil
+}
+
+func (nr *NetHTTP2Request) decodeResponseHeaders(block []byte) ([]hpack.HeaderField, error) {
+	nr.hpackMu.Lock()
+	defer nr.hpackMu.Unlock()
+	return nr.respDecoder.DecodeFull(block)
+}
+
+// setClientHeaderTableSize applies HEADER_TABLE_SIZE announced by client, it limits upstream's encoder
+func (nr *NetHTTP2Request) setClientHeaderTableSize(size uint32) {
+	nr.hpackMu.Lock()
+	nr.respDecoder.SetAllowedMaxDynamicTableSize(size)
+	nr.hpackMu.Unlock()
+}
+
+// setUpstreamHeaderTableSize applies HEADER_TABLE_SIZE announced by upstream,
+// it limits both client's encoder and proxy's one
+func (nr *NetHTTP2Request) setUpstreamHeaderTableSize(size uint32) {
+	nr.hpackMu.Lock()
+	nr.reqDecoder.SetAllowedMaxDynamicTableSize(size)
+	nr.reqEncoder.SetMaxDynamicTableSizeLimit(size)
+	nr.hpackMu.Unlock()
+}
+
+func (nr *NetHTTP2Request) setUpstreamMaxFrameSize(size uint32) {
+	nr.hpackMu.Lock()
+	nr.maxFrameSize = int(size)
+	nr.hpackMu.Unlock()
+}
+
+// isNewStream checks whether HEADERS frame opens stream, otherwise it's trailers
+func (nr *NetHTTP2Request) isNewStream(streamID uint32) bool {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return streamID > nr.lastStreamID
+}
+
+func (nr *NetHTTP2Request) getLastStreamID() uint32 {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return nr.lastStreamID
+}
+
+func (nr *NetHTTP2Request) pendingStreams() int {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	return len(nr.streams)
+}
+
+// startStream registers stream opened by client, request is nil in case its headers are malformed
+func (nr *NetHTTP2Request) startStream(streamID uint32, req *nhttp.Request, span opentracing.Span, call *grpcCall) {
+	nr.mu.Lock()
+	nr.lastStreamID = streamID
+	if req != nil {
+		nr.streams[streamID] = &http2Stream{request: req, span: span, startTime: time.Now(), grpc: call}
+	}
+	nr.mu.Unlock()
+	if nr.onRequest != nil {
+		nr.onRequest()
+	}
+}
+
+func (nr *NetHTTP2Request) addRequestData(streamID uint32, data []byte) {
+	nr.mu.Lock()
+	if s, ok := nr.streams[streamID]; ok {
+		s.requestSize += int64(len(data))
+		if s.grpc != nil {
+			s.grpc.requestMessages.write(data)
+		}
+	}
+	nr.mu.Unlock()
+}
+
+func (nr *NetHTTP2Request) addResponseData(streamID uint32, data []byte) {
+	nr.mu.Lock()
+	if s, ok := nr.streams[streamID]; ok {
+		s.responseSize += int64(len(data))
+		if s.grpc != nil {
+			s.grpc.responseMessages.write(data)
+		}
+	}
+	nr.mu.Unlock()
+}
+
+// setResponseHeaders handles response headers or trailers, informational responses are skipped
+func (nr *NetHTTP2Request) setResponseHeaders(streamID uint32, fields []hpack.HeaderField) {
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	s, ok := nr.streams[streamID]
+	if !ok {
+		return
+	}
+	if resp := newHTTP2Response(fields); resp != nil && resp.StatusCode >= 200 && s.response == nil {
+		s.response = resp
+	}
+	if s.grpc != nil {
+		s.grpc.setStatus(fields)
+	}
+}
+
+// finishStream finishes tracing of stream closed by END_STREAM of response or reset by RST_STREAM,
+// it reports whether stream was traced
+func (nr *NetHTTP2Request) finishStream(streamID uint32, reset bool) bool {
+	nr.mu.Lock()
+	s, ok := nr.streams[streamID]
+	delete(nr.streams, streamID)
+	nr.mu.Unlock()
+	if !ok {
+		return false
+	}
+	nr.finish(s, func(span opentracing.Span) {
+		if reset {
+			span.SetTag("error", true)
+			span.SetTag("http2.reset", true)
+		}
+	})
+	return true
+}
+
+// finishAll finishes streams which won't get response
+func (nr *NetHTTP2Request) finishAll(tag func(span opentracing.Span)) {
+	nr.mu.Lock()
+	streams := nr.streams
+	nr.streams = make(map[uint32]*http2Stream)
+	nr.mu.Unlock()
+	for _, s := range streams {
+		nr.finish(s, tag)
+	}
+}
+
+func (nr *NetHTTP2Request) finish(s *http2Stream, tag func(span opentracing.Span)) {
+	// sizes of HTTP/2 messages are known only when stream is finished
+	s.request.ContentLength = s.requestSize
+	if s.response != nil {
+		s.response.ContentLength = s.responseSize
+	}
+	nr.http.observe(s.request, s.response, s.startTime)
+	if s.grpc != nil {
+		caller := s.request.Header.Get(nr.http.config.Get().HTTP.XSourceHeaderName)
+		s.grpc.observe(nr.http.metrics, nr.http.isInbound, s.request, caller, s.startTime)
+	}
+	if s.span != nil {
+		nr.http.fillSpan(s.span, s.request, s.response)
+		if s.grpc != nil {
+			s.grpc.fillSpan(s.span)
+		}
+		tag(s.span)
+		s.span.Finish()
+	}
+	if s.response != nil {
+		nr.http.logAccess(s.request, s.response, s.span, s.startTime)
+	}
+}
+
+// StartRequest does nothing, streams are started by handler
+func (nr *NetHTTP2Request) StartRequest() {}
+
+// StopRequest does nothing, streams are finished by handler
+func (nr *NetHTTP2Request) StopRequest() {}
+
+// CleanUp finishes streams interrupted by connection close
+func (nr *NetHTTP2Request) CleanUp() {
+	nr.finishAll(func(span opentracing.Span) {
+		span.SetTag("error", true)
+	})
+}
+
+func (nr *NetHTTP2Request) TimedOut(cause string) {
+	nr.finishAll(func(span opentracing.Span) {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+		span.SetTag("timeout.cause", cause)
+	})
+}
+
+// SetPeerIdentity sets identity of mutual TLS peer, it's tagged on spans of streams finished after the call
+func (nr *NetHTTP2Request) SetPeerIdentity(identity string) {
+	nr.http.SetPeerIdentity(identity)
+}
+
+// OnRequest registers callback called for each stream opened by client.
+// It should be called before request processing is started.
+func (nr *NetHTTP2Request) OnRequest(f func()) {
+	nr.onRequest = f
+}
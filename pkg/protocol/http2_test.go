@@ -0,0 +1,348 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/uber/jaeger-client-go"
+	"golang.org/x/net/http2/hpack"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+func newHTTP2Harness(t *testing.T, isInbound bool) *handlerHarness {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	tracingContextMapping := cache.New(time.Minute, time.Minute)
+	tracer := newRecordingTracer()
+	cfg := config.NewHolder(config.Default())
+	handler := NewHTTP2Handler(logger, tracer, cfg, drain.NewTracker(), tracingContextMapping)
+	m, err := metrics.New(nil, statsdClient, cfg.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	netRequest := NewNetHTTP2Request(logger, isInbound, tracer, cfg, tracingContextMapping, m, nil)
+	return newHarness(t, handler, netRequest, isInbound, tracer)
+}
+
+func encodeHeaders(t *testing.T, enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		if err := enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func http2TestFrame(typ uint8, flags uint8, streamID uint32, payload []byte) []byte {
+	return append(appendHTTP2FrameHeader(nil, len(payload), typ, flags, streamID), payload...)
+}
+
+// readHeaderBlock reads HEADERS frame and its CONTINUATION frames
+func readHeaderBlock(t *testing.T, fr *http2FrameReader, dec *hpack.Decoder) (http2Frame, []hpack.HeaderField) {
+	frame, err := fr.next()
+	if err != nil {
+		t.Fatalf("read frame: %s", err)
+	}
+	if frame.typ != http2FrameHeaders {
+		t.Fatalf("expected HEADERS frame, got %d", frame.typ)
+	}
+	fragment, _, err := http2HeaderBlockFragment(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := append([]byte(nil), fragment...)
+	first := http2Frame{typ: frame.typ, flags: frame.flags, streamID: frame.streamID}
+	for flags := frame.flags; flags&http2FlagEndHeaders == 0; {
+		continuation, err := fr.next()
+		if err != nil || continuation.typ != http2FrameContinuation {
+			t.Fatalf("expected CONTINUATION frame: %v", err)
+		}
+		block = append(block, continuation.payload()...)
+		flags = continuation.flags
+	}
+	fields, err := dec.DecodeFull(block)
+	if err != nil {
+		t.Fatalf("decode headers: %s", err)
+	}
+	return first, fields
+}
+
+func headerValue(fields []hpack.HeaderField, name string) string {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func TestHTTP2HandlerInbound(t *testing.T) {
+	h := newHTTP2Harness(t, true)
+	var clientBuf bytes.Buffer
+	clientEnc := hpack.NewEncoder(&clientBuf)
+	request := encodeHeaders(t, clientEnc, &clientBuf,
+		":method", "POST",
+		":scheme", "http",
+		":authority", "users",
+		":path", "/users?id=1",
+		"x-request-id", "req-1",
+		"user-agent", "test",
+	)
+	// big header forces proxy to split re-encoded block into CONTINUATION frames
+	trailers := encodeHeaders(t, clientEnc, &clientBuf, "x-checksum", string(bytes.Repeat([]byte("a"), 20000)))
+	go func() {
+		var b []byte
+		b = append(b, http2Preface...)
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, request)...)
+		b = append(b, http2TestFrame(http2FrameData, 0, 1, []byte("body"))...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, trailers)...)
+		h.client.Write(b)
+	}()
+
+	upstreamReader := bufio.NewReader(h.upstream)
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(upstreamReader, preface); err != nil || !bytes.Equal(preface, http2Preface) {
+		t.Fatalf("upstream read preface: %q %v", preface, err)
+	}
+	upstreamFrames := newHTTP2FrameReader(upstreamReader)
+	if frame, err := upstreamFrames.next(); err != nil || frame.typ != http2FrameSettings {
+		t.Fatalf("upstream expected SETTINGS frame: %v", err)
+	}
+	upstreamDec := hpack.NewDecoder(http2DefaultHeaderTableSize, nil)
+	_, fields := readHeaderBlock(t, upstreamFrames, upstreamDec)
+	if frame, err := upstreamFrames.next(); err != nil || frame.typ != http2FrameData || string(frame.payload()) != "body" {
+		t.Fatalf("upstream expected DATA frame: %v", err)
+	}
+	trailersFrame, trailerFields := readHeaderBlock(t, upstreamFrames, upstreamDec)
+
+	if headerValue(fields, jaeger.TraceContextHeaderName) == "" {
+		t.Error("trace context isn't injected into upstream request")
+	}
+	if headerValue(fields, ":path") != "/users?id=1" || headerValue(fields, "x-request-id") != "req-1" {
+		t.Errorf("unexpected upstream request headers %v", fields)
+	}
+	if trailersFrame.flags&http2FlagEndStream == 0 || len(headerValue(trailerFields, "x-checksum")) != 20000 {
+		t.Error("trailers aren't forwarded")
+	}
+
+	var serverBuf bytes.Buffer
+	serverEnc := hpack.NewEncoder(&serverBuf)
+	response := encodeHeaders(t, serverEnc, &serverBuf, ":status", "200")
+	go func() {
+		var b []byte
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, response)...)
+		b = append(b, http2TestFrame(http2FrameData, http2FlagEndStream, 1, []byte("hello"))...)
+		h.upstream.Write(b)
+	}()
+	clientFrames := newHTTP2FrameReader(bufio.NewReader(h.client))
+	if frame, err := clientFrames.next(); err != nil || frame.typ != http2FrameSettings {
+		t.Fatalf("client expected SETTINGS frame: %v", err)
+	}
+	_, responseFields := readHeaderBlock(t, clientFrames, hpack.NewDecoder(http2DefaultHeaderTableSize, nil))
+	if headerValue(responseFields, ":status") != "200" {
+		t.Errorf("unexpected response headers %v", responseFields)
+	}
+	if frame, err := clientFrames.next(); err != nil || string(frame.payload()) != "hello" {
+		t.Fatalf("client expected DATA frame: %v", err)
+	}
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.operationName != "/users" {
+		t.Errorf("unexpected operation name %s", span.operationName)
+	}
+	for key, expected := range map[string]interface{}{
+		"span.kind":          "server",
+		"http.method":        "POST",
+		"http.host":          "users",
+		"http.path":          "/users?id=1",
+		"http.status_code":   200,
+		"http.request_id":    "req-1",
+		"http.user_agent":    "test",
+		"http.request_size":  int64(4),
+		"http.response_size": int64(5),
+		"http2.stream_id":    uint32(1),
+	} {
+		if actual := span.Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v (%T), got %v (%T)", key, expected, expected, actual, actual)
+		}
+	}
+}
+
+func TestHTTP2HandlerNotHTTP2(t *testing.T) {
+	h := newHTTP2Harness(t, true)
+	request := "GET / HTTP/1.1\r\nHost: users\r\n\r\n"
+	go io.WriteString(h.client, request)
+	buf := make([]byte, len(request))
+	if _, err := io.ReadFull(h.upstream, buf); err != nil || string(buf) != request {
+		t.Fatalf("upstream expected request as is: %q %v", buf, err)
+	}
+	h.Close(t)
+	if spans := h.tracer.FinishedSpans(); len(spans) != 0 {
+		t.Errorf("expected no spans, got %d", len(spans))
+	}
+}
+
+func grpcMessage(payload string) []byte {
+	b := []byte{0, 0, 0, 0, byte(len(payload))}
+	return append(b, payload...)
+}
+
+func TestHTTP2HandlerGRPC(t *testing.T) {
+	h := newHTTP2Harness(t, false)
+	var clientBuf bytes.Buffer
+	request := encodeHeaders(t, hpack.NewEncoder(&clientBuf), &clientBuf,
+		":method", "POST",
+		":scheme", "http",
+		":authority", "users:9000",
+		":path", "/users.v1.Users/Watch",
+		"content-type", "application/grpc",
+	)
+	// second message and its prefix are split between frames
+	messages := append(grpcMessage("first"), grpcMessage("second")...)
+	go func() {
+		var b []byte
+		b = append(b, http2Preface...)
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, request)...)
+		b = append(b, http2TestFrame(http2FrameData, 0, 1, messages[:12])...)
+		b = append(b, http2TestFrame(http2FrameData, http2FlagEndStream, 1, messages[12:])...)
+		h.client.Write(b)
+	}()
+	upstreamReader := bufio.NewReader(h.upstream)
+	io.ReadFull(upstreamReader, make([]byte, len(http2Preface)))
+	upstreamFrames := newHTTP2FrameReader(upstreamReader)
+	for i := 0; i < 4; i++ {
+		if _, err := upstreamFrames.next(); err != nil {
+			t.Fatalf("upstream read frame: %s", err)
+		}
+	}
+
+	var serverBuf bytes.Buffer
+	serverEnc := hpack.NewEncoder(&serverBuf)
+	response := encodeHeaders(t, serverEnc, &serverBuf, ":status", "200", "content-type", "application/grpc")
+	trailers := encodeHeaders(t, serverEnc, &serverBuf, "grpc-status", "5", "grpc-message", "user%20not%20found")
+	go func() {
+		var b []byte
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, response)...)
+		b = append(b, http2TestFrame(http2FrameData, 0, 1, grpcMessage("event"))...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, trailers)...)
+		h.upstream.Write(b)
+	}()
+	clientFrames := newHTTP2FrameReader(bufio.NewReader(h.client))
+	for i := 0; i < 4; i++ {
+		if _, err := clientFrames.next(); err != nil {
+			t.Fatalf("client read frame: %s", err)
+		}
+	}
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.operationName != "users.v1.Users/Watch" {
+		t.Errorf("unexpected operation name %s", span.operationName)
+	}
+	for key, expected := range map[string]interface{}{
+		"span.kind":                  "client",
+		"rpc.system":                 "grpc",
+		"rpc.service":                "users.v1.Users",
+		"rpc.method":                 "Watch",
+		"rpc.grpc.status_code":       5,
+		"rpc.grpc.message":           "user not found",
+		"rpc.grpc.request_messages":  2,
+		"rpc.grpc.response_messages": 1,
+		"http.status_code":           200,
+		"error":                      true,
+	} {
+		if actual := span.Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v (%T), got %v (%T)", key, expected, expected, actual, actual)
+		}
+	}
+}
+
+func TestHTTP2HandlerGRPCTrailersOnly(t *testing.T) {
+	h := newHTTP2Harness(t, true)
+	var clientBuf bytes.Buffer
+	request := encodeHeaders(t, hpack.NewEncoder(&clientBuf), &clientBuf,
+		":method", "POST",
+		":scheme", "http",
+		":authority", "users",
+		":path", "/users.v1.Users/Get",
+		"content-type", "application/grpc+proto",
+	)
+	go func() {
+		var b []byte
+		b = append(b, http2Preface...)
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1, request)...)
+		b = append(b, http2TestFrame(http2FrameData, http2FlagEndStream, 1, grpcMessage("id"))...)
+		h.client.Write(b)
+	}()
+	upstreamReader := bufio.NewReader(h.upstream)
+	io.ReadFull(upstreamReader, make([]byte, len(http2Preface)))
+	upstreamFrames := newHTTP2FrameReader(upstreamReader)
+	for i := 0; i < 3; i++ {
+		if _, err := upstreamFrames.next(); err != nil {
+			t.Fatalf("upstream read frame: %s", err)
+		}
+	}
+
+	var serverBuf bytes.Buffer
+	response := encodeHeaders(t, hpack.NewEncoder(&serverBuf), &serverBuf,
+		":status", "200",
+		"content-type", "application/grpc",
+		"grpc-status", "14",
+	)
+	go func() {
+		var b []byte
+		b = append(b, http2TestFrame(http2FrameSettings, 0, 0, nil)...)
+		b = append(b, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, response)...)
+		h.upstream.Write(b)
+	}()
+	clientFrames := newHTTP2FrameReader(bufio.NewReader(h.client))
+	for i := 0; i < 2; i++ {
+		if _, err := clientFrames.next(); err != nil {
+			t.Fatalf("client read frame: %s", err)
+		}
+	}
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	for key, expected := range map[string]interface{}{
+		"rpc.grpc.status_code":       14,
+		"rpc.grpc.request_messages":  1,
+		"rpc.grpc.response_messages": 0,
+		"error":                      true,
+	} {
+		if actual := spans[0].Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v (%T), got %v (%T)", key, expected, expected, actual, actual)
+		}
+	}
+}
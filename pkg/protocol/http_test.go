@@ -0,0 +1,234 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/uber/jaeger-client-go"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// serveUpstream reads one request on upstream side and answers with status and body
+func serveUpstream(t *testing.T, h *handlerHarness, r *bufio.Reader, status int, body string) *http.Request {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Fatalf("upstream read request: %s", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		t.Fatalf("upstream read body: %s", err)
+	}
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if err := resp.Write(h.upstream); err != nil {
+		t.Fatalf("upstream write response: %s", err)
+	}
+	return req
+}
+
+func readResponse(t *testing.T, r *bufio.Reader) (*http.Response, string) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("client read response: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("client read body: %s", err)
+	}
+	return resp, string(body)
+}
+
+func TestHTTPHandlerInbound(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+
+	go io.WriteString(h.client, "GET /users?id=1 HTTP/1.1\r\nHost: users\r\nX-Request-Id: req-1\r\n\r\n")
+	upstreamReq := serveUpstream(t, h, upstreamReader, http.StatusOK, "hello")
+	resp, body := readResponse(t, clientReader)
+	h.Close(t)
+
+	if upstreamReq.Header.Get(jaeger.TraceContextHeaderName) == "" {
+		t.Error("trace context isn't injected into upstream request")
+	}
+	if resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.operationName != "/users" {
+		t.Errorf("unexpected operation name %s", span.operationName)
+	}
+	for key, expected := range map[string]interface{}{
+		"span.kind":        "server",
+		"http.method":      "GET",
+		"http.host":        "users",
+		"http.path":        "/users?id=1",
+		"http.status_code": http.StatusOK,
+		"http.request_id":  "req-1",
+	} {
+		if actual := span.Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v, got %v", key, expected, actual)
+		}
+	}
+}
+
+func TestHTTPHandlerOutbound(t *testing.T) {
+	h := newHTTPHarness(t, false)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+
+	go io.WriteString(h.client, "POST /orders HTTP/1.1\r\nHost: orders\r\nContent-Length: 4\r\n\r\nbody")
+	upstreamReq := serveUpstream(t, h, upstreamReader, http.StatusServiceUnavailable, "")
+	resp, _ := readResponse(t, clientReader)
+	h.Close(t)
+
+	if upstreamReq.Header.Get("X-Source") != "netra" {
+		t.Errorf("unexpected X-Source %q", upstreamReq.Header.Get("X-Source"))
+	}
+	if upstreamReq.Header.Get("X-Request-Id") == "" {
+		t.Error("request id isn't generated")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.operationName != "orders/orders" {
+		t.Errorf("unexpected operation name %s", span.operationName)
+	}
+	for key, expected := range map[string]interface{}{
+		"span.kind":         "client",
+		"http.method":       "POST",
+		"http.status_code":  http.StatusServiceUnavailable,
+		"http.request_size": int64(4),
+		"error":             "true",
+	} {
+		if actual := span.Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v, got %v", key, expected, actual)
+		}
+	}
+}
+
+func TestHTTPHandlerPeerIdentity(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+	// transport sets identity of mutual TLS peer before handlers read requests
+	h.netRequest.(PeerIdentityReceiver).SetPeerIdentity("spiffe://mesh/ns/default/sa/frontend")
+
+	go io.WriteString(h.client, "GET /users HTTP/1.1\r\nHost: users\r\n\r\n")
+	serveUpstream(t, h, upstreamReader, http.StatusOK, "ok")
+	readResponse(t, clientReader)
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if identity := spans[0].Tag("peer.identity"); identity != "spiffe://mesh/ns/default/sa/frontend" {
+		t.Errorf("unexpected peer.identity tag %v", identity)
+	}
+}
+
+func TestHTTPHandlerKeepAlive(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+
+	for _, path := range []string{"/first", "/second"} {
+		go io.WriteString(h.client, "GET "+path+" HTTP/1.1\r\nHost: svc\r\n\r\n")
+		serveUpstream(t, h, upstreamReader, http.StatusOK, path)
+		if _, body := readResponse(t, clientReader); body != path {
+			t.Errorf("unexpected body %q", body)
+		}
+	}
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].operationName != "/first" || spans[1].operationName != "/second" {
+		t.Errorf("unexpected operations %s, %s", spans[0].operationName, spans[1].operationName)
+	}
+}
+
+func TestHTTPHandlerPassthroughOnParseError(t *testing.T) {
+	h := newHTTPHarness(t, false)
+
+	raw := "NOT HTTP AT ALL\r\n\r\nsome binary tail"
+	go func() {
+		io.WriteString(h.client, raw)
+		h.client.Close()
+	}()
+	received := make([]byte, len(raw))
+	if _, err := io.ReadFull(h.upstream, received); err != nil {
+		t.Fatalf("upstream read: %s", err)
+	}
+	h.Close(t)
+
+	if string(received) != raw {
+		t.Errorf("unexpected passthrough data %q", received)
+	}
+	if spans := h.tracer.FinishedSpans(); len(spans) != 0 {
+		t.Errorf("expected no spans, got %d", len(spans))
+	}
+}
+
+func TestNetHTTPRequestTimedOutWhileStopping(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	nr := h.netRequest.(*NetHTTPRequest)
+	for _, path := range []string{"/first", "/ignored", "/third"} {
+		req, err := nhttp.NewRequest(http.MethodGet, "http://svc"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nr.SetHTTPRequest(req)
+		// ignored paths are queued without span
+		if path != "/ignored" {
+			nr.StartRequest()
+		}
+	}
+	nr.SetHTTPResponse(&nhttp.Response{StatusCode: http.StatusOK})
+	done := make(chan struct{})
+	go func() {
+		nr.StopRequest()
+		close(done)
+	}()
+	nr.TimedOut("idle")
+	<-done
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected each span to be finished once, got %d spans", len(spans))
+	}
+	for _, span := range spans {
+		path, _ := span.Tag("http.path").(string)
+		if !strings.HasSuffix(path, span.operationName) {
+			t.Errorf("span %s is filled with request %s", span.operationName, path)
+		}
+		if span.operationName == "/third" && span.Tag("timeout.cause") != "idle" {
+			t.Errorf("expected /third to time out, got %v", span.Tag("timeout.cause"))
+		}
+	}
+}
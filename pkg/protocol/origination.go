@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+)
+
+// TLSDialer is implemented by dialers able to open TLS connections to upstream.
+// HTTP handler originates TLS for plaintext requests matching configured rules with it,
+// such requests fail in case dialer doesn't implement TLSDialer.
+type TLSDialer interface {
+	DialTLS(addr string, tlsConfig *tls.Config) (*tls.Conn, error)
+}
+
+// matchTLSOrigination returns rule of request host, host can contain port
+func matchTLSOrigination(rules []config.TLSOriginationRule, host string) *config.TLSOriginationRule {
+	host = strings.ToLower(requestHostname(host))
+	for i := range rules {
+		pattern := strings.ToLower(rules[i].Host)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return &rules[i]
+			}
+			continue
+		}
+		if host == pattern {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// requestHostname strips port from Host header value
+func requestHostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// originationAddr returns upstream address of TLS connection: destination IP with rule port
+func originationAddr(dstAddr string, port uint16) string {
+	host := requestHostname(dstAddr)
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// tlsOrigination keeps TLS client configs of origination rules, so rule files are read
+// only when they are modified, e.g. rotated certificates are picked up by new connections
+type tlsOrigination struct {
+	mu      sync.Mutex
+	configs map[originationKey]*originationConfig
+}
+
+// originationKey is a rule with server name used for request host
+type originationKey struct {
+	rule       config.TLSOriginationRule
+	serverName string
+}
+
+type originationConfig struct {
+	config *tls.Config
+	// modTimes are modification times of rule files config is loaded from
+	modTimes []time.Time
+}
+
+func newTLSOrigination() *tlsOrigination {
+	return &tlsOrigination{configs: make(map[originationKey]*originationConfig)}
+}
+
+// reset forgets configs, it's used when configuration is reloaded so configs of removed rules aren't kept
+func (o *tlsOrigination) reset() {
+	o.mu.Lock()
+	o.configs = make(map[originationKey]*originationConfig)
+	o.mu.Unlock()
+}
+
+// clientConfig returns TLS config of rule, host is used as server name in case rule doesn't set one.
+// The same config is returned until rule files are modified, so dialer can reuse connection opened with it.
+// Returned config is shared and must not be modified.
+func (o *tlsOrigination) clientConfig(rule config.TLSOriginationRule, host string) (*tls.Config, error) {
+	modTimes, err := ruleModTimes(rule)
+	if err != nil {
+		return nil, err
+	}
+	key := originationKey{rule: rule, serverName: rule.ServerName}
+	if key.serverName == "" {
+		key.serverName = requestHostname(host)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c, ok := o.configs[key]
+	if !ok || !equalTimes(c.modTimes, modTimes) {
+		cfg, err := newOriginationConfig(rule, key.serverName)
+		if err != nil {
+			return nil, err
+		}
+		c = &originationConfig{config: cfg, modTimes: modTimes}
+		o.configs[key] = c
+	}
+	return c.config, nil
+}
+
+// ruleModTimes returns modification times of CA, certificate and key files set in rule
+func ruleModTimes(rule config.TLSOriginationRule) ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range []string{rule.CAFile, rule.CertFile, rule.KeyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func equalTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func newOriginationConfig(rule config.TLSOriginationRule, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		// requests are forwarded as HTTP/1.1
+		NextProtos: []string{"http/1.1"},
+		MinVersion: tls.VersionTLS12,
+	}
+	if rule.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(rule.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%s: no CA certificates found", rule.CAFile)
+		}
+	}
+	if rule.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(rule.CertFile, rule.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", rule.CertFile, err.Error())
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+var errTLSDialerRequired = errors.New("dialer can't open TLS connections")
+
+// upstreamTLS describes TLS connection originated to upstream
+type upstreamTLS struct {
+	serverName string
+	state      tls.ConnectionState
+}
+
+func (u *upstreamTLS) tag(span opentracing.Span) {
+	span.SetTag("tls.origination", true)
+	span.SetTag("tls.server_name", u.serverName)
+	span.SetTag("tls.version", tlsVersionName(u.state.Version))
+	span.SetTag("tls.cipher_suite", tls.CipherSuiteName(u.state.CipherSuite))
+	if len(u.state.PeerCertificates) > 0 {
+		span.SetTag("tls.peer_subject", u.state.PeerCertificates[0].Subject.CommonName)
+	}
+}
@@ -0,0 +1,282 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+func TestMatchTLSOrigination(t *testing.T) {
+	rules := []config.TLSOriginationRule{
+		{Host: "api.partner.com", Port: 443},
+		{Host: "*.example.org", Port: 8443},
+	}
+	cases := map[string]uint16{
+		"api.partner.com":      443,
+		"API.Partner.com:80":   443,
+		"eu.api.example.org":   8443,
+		"example.org":          0,
+		"api.partner.com.evil": 0,
+	}
+	for host, port := range cases {
+		rule := matchTLSOrigination(rules, host)
+		if (rule == nil && port != 0) || (rule != nil && rule.Port != port) {
+			t.Errorf("%s: expected port %d, got %v", host, port, rule)
+		}
+	}
+	if addr := originationAddr("10.0.0.1:80", 443); addr != "10.0.0.1:443" {
+		t.Errorf("unexpected address %s", addr)
+	}
+	if addr := originationAddr("[fd00::1]:80", 443); addr != "[fd00::1]:443" {
+		t.Errorf("unexpected address %s", addr)
+	}
+}
+
+// loopbackDialer opens loopback upstream connections and processes their responses the way transport dialer does.
+// Unlike net.Pipe loopback connections are buffered, so TLS alerts written on close don't block.
+type loopbackDialer struct {
+	t          *testing.T
+	handler    NetHandler
+	netRequest NetRequest
+	client     net.Conn
+	// upstreams are server sides of opened connections, addrs are dialed addresses
+	upstreams chan net.Conn
+	addrs     chan string
+	wg        sync.WaitGroup
+}
+
+func (d *loopbackDialer) pair(addr string) net.Conn {
+	proxyOut, upstream := tcpPair(d.t)
+	deadline := time.Now().Add(harnessTimeout)
+	proxyOut.SetDeadline(deadline)
+	upstream.SetDeadline(deadline)
+	d.addrs <- addr
+	d.upstreams <- upstream
+	return proxyOut
+}
+
+func (d *loopbackDialer) serve(conn net.Conn) {
+	d.wg.Add(1)
+	go func() {
+		d.handler.HandleResponse(conn, d.client, d.netRequest, false, true)
+		CloseConn(conn)
+		d.wg.Done()
+	}()
+}
+
+func (d *loopbackDialer) Dial(addr string) (net.Conn, error) {
+	conn := d.pair(addr)
+	d.serve(conn)
+	return conn, nil
+}
+
+func (d *loopbackDialer) DialTLS(addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	conn := tls.Client(d.pair(addr), tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	d.serve(conn)
+	return conn, nil
+}
+
+// writeCAFile writes certificate as PEM file, self-signed certificate is its own CA
+func writeCAFile(t *testing.T, cert tls.Certificate) string {
+	dir, err := ioutil.TempDir("", "origination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHTTPHandlerTLSOrigination(t *testing.T) {
+	cert := testCertificate(t)
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Default()
+	c.HTTP.TLSOrigination = []config.TLSOriginationRule{
+		{Host: "api.example.com", Port: 443, CAFile: writeCAFile(t, cert)},
+	}
+	cfg := config.NewHolder(c)
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	tracingContextMapping := cache.New(time.Minute, time.Minute)
+	tracer := newRecordingTracer()
+	handler := NewHTTPHandler(
+		logger,
+		statsdClient,
+		tracer,
+		cfg,
+		drain.NewTracker(),
+		tracingContextMapping,
+		cache.New(time.Minute, time.Minute))
+	m, err := metrics.New(nil, statsdClient, cfg.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	netRequest := NewNetHTTPRequest(logger, false, tracer, cfg, tracingContextMapping, m, nil)
+
+	client, proxyIn := net.Pipe()
+	client.SetDeadline(time.Now().Add(harnessTimeout))
+	dialer := &loopbackDialer{
+		t:          t,
+		handler:    handler,
+		netRequest: netRequest,
+		client:     proxyIn,
+		upstreams:  make(chan net.Conn, 2),
+		addrs:      make(chan string, 2),
+	}
+	done := make(chan struct{})
+	go func() {
+		handler.HandleRequest(proxyIn, nil, dialer, netRequest, false, "10.0.0.1:80")
+		dialer.wg.Wait()
+		CloseConn(proxyIn)
+		close(done)
+	}()
+	clientReader := bufio.NewReader(client)
+
+	// request to matching host is sent over TLS
+	go io.WriteString(client, "GET /v1/orders HTTP/1.1\r\nHost: api.example.com\r\n\r\n")
+	upstream := tls.Server(<-dialer.upstreams, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if addr := <-dialer.addrs; addr != "10.0.0.1:443" {
+		t.Errorf("expected TLS upstream address 10.0.0.1:443, got %s", addr)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(upstream))
+	if err != nil {
+		t.Fatalf("upstream read request: %s", err)
+	}
+	if req.Host != "api.example.com" || req.URL.Path != "/v1/orders" {
+		t.Errorf("unexpected upstream request %s %s", req.Host, req.URL.Path)
+	}
+	if upstream.ConnectionState().ServerName != "api.example.com" {
+		t.Errorf("expected SNI api.example.com, got %q", upstream.ConnectionState().ServerName)
+	}
+	go io.WriteString(upstream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	if _, body := readResponse(t, clientReader); body != "ok" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// other hosts stay plaintext
+	go io.WriteString(client, "GET /status HTTP/1.1\r\nHost: other\r\n\r\n")
+	plain := <-dialer.upstreams
+	if addr := <-dialer.addrs; addr != "10.0.0.1:80" {
+		t.Errorf("expected original destination, got %s", addr)
+	}
+	if _, err := http.ReadRequest(bufio.NewReader(plain)); err != nil {
+		t.Fatalf("plaintext upstream read request: %s", err)
+	}
+	go io.WriteString(plain, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	readResponse(t, clientReader)
+
+	client.Close()
+	upstream.Close()
+	plain.Close()
+	select {
+	case <-done:
+	case <-time.After(harnessTimeout):
+		t.Fatal("handlers didn't finish")
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	for key, expected := range map[string]interface{}{
+		"tls.origination":  true,
+		"tls.server_name":  "api.example.com",
+		"tls.version":      "TLS 1.3",
+		"tls.peer_subject": "api.example.com",
+		"http.status_code": http.StatusOK,
+	} {
+		if actual := spans[0].Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v, got %v", key, expected, actual)
+		}
+	}
+	if spans[1].Tag("tls.origination") != nil {
+		t.Error("expected plaintext request not to be tagged with TLS origination")
+	}
+}
+
+func TestHTTPHandlerTLSOriginationUnknownCA(t *testing.T) {
+	cert := testCertificate(t)
+	rule := config.TLSOriginationRule{Host: "api.example.com", Port: 443, CAFile: writeCAFile(t, testCertificate(t))}
+	tlsConfig, err := newTLSOrigination().clientConfig(rule, "api.example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := tcpPair(t)
+	defer server.Close()
+	go tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+	client.SetDeadline(time.Now().Add(harnessTimeout))
+	if err := tls.Client(client, tlsConfig).Handshake(); err == nil {
+		t.Error("expected certificate of unknown CA to be rejected")
+	}
+}
+
+func TestTLSOriginationConfigCache(t *testing.T) {
+	file := writeCAFile(t, testCertificate(t))
+	rule := config.TLSOriginationRule{Host: "api.example.com", Port: 443, CAFile: file}
+	o := newTLSOrigination()
+	roots := func() interface{} {
+		cfg, err := o.clientConfig(rule, "api.example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.ServerName != "api.example.com" {
+			t.Errorf("unexpected server name %s", cfg.ServerName)
+		}
+		return cfg.RootCAs
+	}
+
+	first := roots()
+	if roots() != first {
+		t.Error("expected cached config while CA file isn't modified")
+	}
+	// rotated CA file is read again
+	data, err := ioutil.ReadFile(writeCAFile(t, testCertificate(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	rotated := roots()
+	if rotated == first {
+		t.Error("expected config of rotated CA file")
+	}
+	o.reset()
+	if roots() == rotated {
+		t.Error("expected config to be loaded again after reset")
+	}
+	os.Remove(file)
+	if _, err := o.clientConfig(rule, "api.example.com"); err == nil {
+		t.Error("expected error of removed CA file")
+	}
+}
@@ -0,0 +1,743 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// PostgreSQL message types (frontend/backend protocol v3)
+const (
+	// frontend
+	pgMsgQuery     = 'Q'
+	pgMsgParse     = 'P'
+	pgMsgBind      = 'B'
+	pgMsgExecute   = 'E'
+	pgMsgSync      = 'S'
+	pgMsgClose     = 'C'
+	pgMsgTerminate = 'X'
+
+	// backend
+	pgMsgAuthentication   = 'R'
+	pgMsgCommandComplete  = 'C'
+	pgMsgErrorResponse    = 'E'
+	pgMsgDataRow          = 'D'
+	pgMsgPortalSuspended  = 's'
+	pgMsgEmptyQuery       = 'I'
+	pgMsgReadyForQuery    = 'Z'
+	pgEncryptionAccepted  = 'S'
+	pgEncryptionGSSAPI    = 'G'
+	pgEncryptionRefused   = 'N'
+	pgMessageHeaderLen    = 5
+	pgStartupHeaderLen    = 4
+	pgMaxMessageLen       = 1 << 30
+	pgMaxKeptMessageBytes = 16 * 1024
+)
+
+// pgMessageReader follows message boundaries of one direction of PostgreSQL connection without buffering messages,
+// only first bytes of messages of kept types are collected
+type pgMessageReader struct {
+	// startup is set while untyped startup packets are expected
+	startup   bool
+	header    [pgMessageHeaderLen]byte
+	headerLen int
+	// remaining is a number of body bytes of current message which aren't consumed yet
+	remaining int
+	typ       byte
+	body      []byte
+	keep      bool
+	// keepType tells whether body of typed message is needed, startup packets are always kept
+	keepType func(typ byte) bool
+	// onMessage is called when message is complete, body is set only for kept messages and can be truncated.
+	// Body is reused by following messages. It returns true when reading can be stopped.
+	onMessage func(typ byte, body []byte) bool
+	done      bool
+}
+
+func (p *pgMessageReader) headerSize() int {
+	if p.startup {
+		return pgStartupHeaderLen
+	}
+	return pgMessageHeaderLen
+}
+
+// write consumes forwarded bytes, it returns true when reading is finished
+func (p *pgMessageReader) write(b []byte) bool {
+	for len(b) > 0 && !p.done {
+		if size := p.headerSize(); p.headerLen < size {
+			n := copy(p.header[p.headerLen:size], b)
+			p.headerLen += n
+			b = b[n:]
+			if p.headerLen < size {
+				break
+			}
+			if !p.startMessage() {
+				// not a PostgreSQL stream, there is nothing to read
+				p.done = true
+				break
+			}
+		}
+		n := len(b)
+		if n > p.remaining {
+			n = p.remaining
+		}
+		if p.keep && len(p.body) < pgMaxKeptMessageBytes {
+			kept := n
+			if room := pgMaxKeptMessageBytes - len(p.body); kept > room {
+				kept = room
+			}
+			p.body = append(p.body, b[:kept]...)
+		}
+		p.remaining -= n
+		b = b[n:]
+		if p.remaining == 0 {
+			p.headerLen = 0
+			p.done = p.onMessage(p.typ, p.body)
+		}
+	}
+	return p.done
+}
+
+// startMessage reads length of message from header, it returns false in case length is invalid
+func (p *pgMessageReader) startMessage() bool {
+	var length uint32
+	if p.startup {
+		p.typ = 0
+		length = binary.BigEndian.Uint32(p.header[:4])
+		if length < 8 || length > postgresMaxStartupSize {
+			return false
+		}
+	} else {
+		p.typ = p.header[0]
+		length = binary.BigEndian.Uint32(p.header[1:5])
+		if length < 4 || length > pgMaxMessageLen {
+			return false
+		}
+	}
+	p.remaining = int(length) - 4
+	p.keep = p.startup || p.keepType(p.typ)
+	p.body = p.body[:0]
+	return true
+}
+
+// pgString returns null-terminated string at the beginning of b and bytes following it,
+// string of truncated body isn't terminated and takes the rest of b
+func pgString(b []byte) (string, []byte) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:]
+		}
+	}
+	return string(b), nil
+}
+
+// pgStream is one direction of PostgreSQL connection
+type pgStream struct {
+	request *NetPostgresRequest
+	reader  pgMessageReader
+	// server is set for backend direction which answers SSLRequest and GSSENCRequest with single byte
+	server bool
+}
+
+// watch consumes forwarded bytes, it returns true when parsing is finished, e.g. TLS is negotiated
+func (s *pgStream) watch(b []byte) bool {
+	r := s.request
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.encrypted {
+		return true
+	}
+	if s.server && r.encryptionRequested {
+		r.encryptionRequested = false
+		switch b[0] {
+		case pgEncryptionAccepted, pgEncryptionGSSAPI:
+			// encrypted stream is passed through untouched
+			r.encrypted = true
+			return true
+		case pgEncryptionRefused:
+			b = b[1:]
+		}
+	}
+	done := s.reader.write(b)
+	if done && !r.terminated {
+		r.logger.Debugf("PostgreSQL stream to %s isn't parsed anymore", r.originalDst)
+	}
+	return done
+}
+
+// add counts bytes forwarded without watching, they aren't reported for PostgreSQL connections
+func (s *pgStream) add(int64) {}
+
+// pgQuery is a query traced with span, its response is matched by order of requests.
+// Sync entry has no span, it marks end of extended query pipeline answered with ReadyForQuery.
+type pgQuery struct {
+	span opentracing.Span
+	// simple query is finished by ReadyForQuery, extended one by CommandComplete, ErrorResponse,
+	// EmptyQueryResponse or PortalSuspended
+	simple   bool
+	sync     bool
+	rows     int64
+	hasRows  bool
+	dataRows int64
+}
+
+func (q *pgQuery) finish() {
+	if q.hasRows {
+		q.span.SetTag("db.rows", q.rows)
+	}
+	q.span.Finish()
+}
+
+// PostgresHandler proxies PostgreSQL connections, queries of outbound connections are traced
+type PostgresHandler struct {
+	logger *log.Logger
+}
+
+func NewPostgresHandler(logger *log.Logger) *PostgresHandler {
+	return &PostgresHandler{
+		logger: logger,
+	}
+}
+
+func (h *PostgresHandler) HandleRequest(
+	r net.Conn,
+	w net.Conn,
+	dialer Dialer,
+	netRequest NetRequest,
+	isInboundConn bool,
+	originalDst string) net.Conn {
+
+	if w == nil {
+		var err error
+		w, err = dialer.Dial(originalDst)
+		if err != nil {
+			return nil
+		}
+	}
+
+	var written int64
+	var err error
+	if pgRequest, ok := netRequest.(*NetPostgresRequest); ok && pgRequest.trace {
+		written, err = pgRequest.forwardClient(w, r, originalDst)
+	} else {
+		written, err = forward(w, r)
+	}
+	h.logger.Debugf("Written: %d", written)
+	if err != nil {
+		h.logger.Debugf("Err forward: %s", err.Error())
+	}
+	return w
+}
+
+func (h *PostgresHandler) HandleResponse(r net.Conn, w net.Conn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	var written int64
+	var err error
+	if pgRequest, ok := netRequest.(*NetPostgresRequest); ok && pgRequest.trace {
+		written, err = pgRequest.forwardServer(w, r)
+	} else {
+		written, err = forward(w, r)
+	}
+	h.logger.Debugf("Written: %d", written)
+	if err != nil {
+		h.logger.Debugf("Err forward: %s", err.Error())
+	}
+}
+
+// NetPostgresRequest keeps protocol state of PostgreSQL connection.
+// Queries of outbound connections are traced with client spans, inbound connections are proxied as is.
+type NetPostgresRequest struct {
+	logger *log.Logger
+	tracer opentracing.Tracer
+	trace  bool
+
+	mu          sync.Mutex
+	originalDst string
+	client      pgStream
+	server      pgStream
+	user        string
+	database    string
+	startTime   time.Time
+	// encryptionRequested is set when SSLRequest or GSSENCRequest isn't answered yet
+	encryptionRequested bool
+	// encrypted is set when server accepted encryption, connection isn't parsed then
+	encrypted     bool
+	authenticated bool
+	terminated    bool
+	// statements and portals map names of prepared statements and portals to normalized statements
+	statements map[string]string
+	portals    map[string]string
+	// pending are queries and syncs waiting for response in order they were sent
+	pending []*pgQuery
+}
+
+func NewNetPostgresRequest(logger *log.Logger, isInbound bool, tracer opentracing.Tracer) *NetPostgresRequest {
+	r := &NetPostgresRequest{
+		logger:     logger,
+		tracer:     tracer,
+		trace:      !isInbound,
+		statements: make(map[string]string),
+		portals:    make(map[string]string),
+	}
+	r.client = pgStream{
+		request: r,
+		reader: pgMessageReader{
+			startup:   true,
+			keepType:  keepPostgresFrontendMessage,
+			onMessage: r.onFrontendMessage,
+		},
+	}
+	r.server = pgStream{
+		request: r,
+		server:  true,
+		reader: pgMessageReader{
+			keepType:  keepPostgresBackendMessage,
+			onMessage: r.onBackendMessage,
+		},
+	}
+	return r
+}
+
+func (r *NetPostgresRequest) StartRequest() {}
+
+func (r *NetPostgresRequest) StopRequest() {}
+
+// CleanUp finishes queries which weren't answered before connection was closed
+func (r *NetPostgresRequest) CleanUp() {
+	r.finishPending(func(span opentracing.Span) {
+		span.SetTag("error", true)
+		span.SetTag("db.interrupted", true)
+	})
+}
+
+func (r *NetPostgresRequest) TimedOut(cause string) {
+	r.finishPending(func(span opentracing.Span) {
+		span.SetTag("error", true)
+		span.SetTag("timeout", true)
+		span.SetTag("timeout.cause", cause)
+	})
+}
+
+func (r *NetPostgresRequest) finishPending(tag func(span opentracing.Span)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, q := range r.pending {
+		if q.span != nil {
+			tag(q.span)
+			q.finish()
+		}
+	}
+	r.pending = nil
+}
+
+// forwardClient forwards client stream to server parsing startup packet and queries
+func (r *NetPostgresRequest) forwardClient(w net.Conn, c net.Conn, originalDst string) (int64, error) {
+	r.mu.Lock()
+	r.originalDst = originalDst
+	r.mu.Unlock()
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	return forwardRead(w, c, buf[:0], nil, &r.client)
+}
+
+// forwardServer forwards server stream to client parsing responses to queries
+func (r *NetPostgresRequest) forwardServer(w net.Conn, c net.Conn) (int64, error) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	return forwardRead(w, c, buf[:0], nil, &r.server)
+}
+
+func keepPostgresFrontendMessage(typ byte) bool {
+	switch typ {
+	case pgMsgQuery, pgMsgParse, pgMsgBind, pgMsgExecute, pgMsgClose:
+		return true
+	}
+	return false
+}
+
+func keepPostgresBackendMessage(typ byte) bool {
+	switch typ {
+	case pgMsgAuthentication, pgMsgCommandComplete, pgMsgErrorResponse:
+		return true
+	}
+	return false
+}
+
+// onFrontendMessage is called with client message under lock
+func (r *NetPostgresRequest) onFrontendMessage(typ byte, body []byte) bool {
+	if r.client.reader.startup {
+		return r.onStartupPacket(body)
+	}
+	switch typ {
+	case pgMsgQuery:
+		statement, _ := pgString(body)
+		r.startQuery(normalizePostgresQuery(statement), true)
+	case pgMsgParse:
+		name, rest := pgString(body)
+		statement, _ := pgString(rest)
+		r.statements[name] = normalizePostgresQuery(statement)
+	case pgMsgBind:
+		portal, rest := pgString(body)
+		statement, _ := pgString(rest)
+		r.portals[portal] = r.statements[statement]
+	case pgMsgExecute:
+		portal, _ := pgString(body)
+		r.startQuery(r.portals[portal], false)
+	case pgMsgSync:
+		r.pending = append(r.pending, &pgQuery{sync: true})
+	case pgMsgClose:
+		if len(body) == 0 {
+			break
+		}
+		name, _ := pgString(body[1:])
+		if body[0] == 'S' {
+			delete(r.statements, name)
+		} else {
+			delete(r.portals, name)
+		}
+	case pgMsgTerminate:
+		r.terminated = true
+		return true
+	}
+	return false
+}
+
+// onStartupPacket handles untyped packet: startup message, SSLRequest, GSSENCRequest or CancelRequest.
+// Encryption request is followed by another startup packet in case server refuses it.
+func (r *NetPostgresRequest) onStartupPacket(body []byte) bool {
+	switch binary.BigEndian.Uint32(body[:4]) {
+	case postgresSSLRequest, postgresGSSENCRequest:
+		r.encryptionRequested = true
+		return false
+	case postgresProtocolV3:
+		r.startTime = time.Now()
+		params := body[4:]
+		for len(params) > 0 && params[0] != 0 {
+			var key, value string
+			key, params = pgString(params)
+			value, params = pgString(params)
+			switch key {
+			case "user":
+				r.user = value
+			case "database":
+				r.database = value
+			}
+		}
+		if r.database == "" {
+			r.database = r.user
+		}
+		r.client.reader.startup = false
+		return false
+	}
+	// CancelRequest is the only packet of connection
+	r.terminated = true
+	return true
+}
+
+// onBackendMessage is called with server message under lock
+func (r *NetPostgresRequest) onBackendMessage(typ byte, body []byte) bool {
+	switch typ {
+	case pgMsgAuthentication:
+		// AuthenticationOk
+		if len(body) >= 4 && binary.BigEndian.Uint32(body) == 0 {
+			r.authenticated = true
+		}
+	case pgMsgCommandComplete:
+		q := r.currentQuery()
+		if q == nil {
+			break
+		}
+		tag, _ := pgString(body)
+		if rows, ok := postgresCommandRows(tag); ok {
+			q.rows += rows
+			q.hasRows = true
+		}
+		if !q.simple {
+			r.popQuery()
+		}
+	case pgMsgDataRow:
+		if q := r.currentQuery(); q != nil {
+			q.dataRows++
+		}
+	case pgMsgPortalSuspended:
+		if q := r.currentQuery(); q != nil && !q.simple {
+			q.span.SetTag("db.portal_suspended", true)
+			q.rows, q.hasRows = q.dataRows, true
+			r.popQuery()
+		}
+	case pgMsgEmptyQuery:
+		if q := r.currentQuery(); q != nil && !q.simple {
+			r.popQuery()
+		}
+	case pgMsgErrorResponse:
+		q := r.currentQuery()
+		if q == nil {
+			if !r.authenticated {
+				r.connectionFailed(body)
+			}
+			break
+		}
+		tagPostgresError(q.span, body)
+		if !q.simple {
+			r.popQuery()
+		}
+	case pgMsgReadyForQuery:
+		r.readyForQuery()
+	}
+	return false
+}
+
+// currentQuery returns query which is answered by server now, it's nil when sync is answered
+func (r *NetPostgresRequest) currentQuery() *pgQuery {
+	if len(r.pending) == 0 || r.pending[0].sync {
+		return nil
+	}
+	return r.pending[0]
+}
+
+func (r *NetPostgresRequest) popQuery() {
+	q := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	q.finish()
+}
+
+// readyForQuery finishes simple query or extended queries up to Sync. Extended queries which aren't answered
+// were skipped by server because of error in preceding message of pipeline.
+func (r *NetPostgresRequest) readyForQuery() {
+	end := -1
+	for i, q := range r.pending {
+		if q.sync || q.simple {
+			end = i
+			break
+		}
+	}
+	for _, q := range r.pending[:end+1] {
+		if q.sync {
+			continue
+		}
+		if !q.simple {
+			q.span.SetTag("error", true)
+			q.span.SetTag("db.skipped", true)
+		}
+		q.finish()
+	}
+	r.pending = r.pending[end+1:]
+}
+
+func (r *NetPostgresRequest) startQuery(statement string, simple bool) {
+	operation := postgresOperation(statement)
+	name := "postgres"
+	if operation != "" {
+		name += " " + operation
+	}
+	span := r.tracer.StartSpan(name)
+	r.tagSpan(span)
+	span.SetTag("db.statement", statement)
+	if operation != "" {
+		span.SetTag("db.operation", operation)
+	}
+	r.pending = append(r.pending, &pgQuery{span: span, simple: simple})
+}
+
+// connectionFailed traces startup or authentication error, e.g. wrong password or unknown database
+func (r *NetPostgresRequest) connectionFailed(body []byte) {
+	startTime := r.startTime
+	if startTime.IsZero() {
+		startTime = time.Now()
+	}
+	span := r.tracer.StartSpan("postgres connect", opentracing.StartTime(startTime))
+	r.tagSpan(span)
+	tagPostgresError(span, body)
+	span.Finish()
+}
+
+func (r *NetPostgresRequest) tagSpan(span opentracing.Span) {
+	span.SetTag("span.kind", "client")
+	span.SetTag("peer.address", r.originalDst)
+	span.SetTag("db.system", "postgresql")
+	span.SetTag("db.name", r.database)
+	span.SetTag("db.user", r.user)
+}
+
+// tagPostgresError tags span with SQLSTATE code and message of ErrorResponse fields
+func tagPostgresError(span opentracing.Span, body []byte) {
+	span.SetTag("error", true)
+	for len(body) > 0 && body[0] != 0 {
+		field := body[0]
+		var value string
+		value, body = pgString(body[1:])
+		switch field {
+		case 'C':
+			span.SetTag("db.sql_state", value)
+		case 'M':
+			span.SetTag("db.error_message", value)
+		}
+	}
+}
+
+// postgresCommandRows returns number of rows of CommandComplete tag, e.g. "INSERT 0 5" or "SELECT 3"
+func postgresCommandRows(tag string) (int64, bool) {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	rows, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	return rows, err == nil
+}
+
+// postgresOperation returns first keyword of statement in upper case
+func postgresOperation(statement string) string {
+	statement = strings.TrimLeft(statement, "( ")
+	end := 0
+	for end < len(statement) && isLetter(statement[end]) {
+		end++
+	}
+	return strings.ToUpper(statement[:end])
+}
+
+// normalizePostgresQuery replaces string, dollar-quoted and numeric literals with ?,
+// strips comments and collapses whitespace. Quoted identifiers and $n parameters are kept.
+func normalizePostgresQuery(q string) string {
+	out := make([]byte, 0, len(q))
+	space := false
+	// identBefore tells whether previous output byte continues identifier or keyword
+	identBefore := func() bool {
+		return !space && len(out) > 0 && isIdentByte(out[len(out)-1])
+	}
+	write := func(s string) {
+		if space && len(out) > 0 {
+			out = append(out, ' ')
+		}
+		space = false
+		out = append(out, s...)
+	}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			space = true
+			i++
+		case strings.HasPrefix(q[i:], "--"):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q) - i
+			}
+			space = true
+			i += end
+		case strings.HasPrefix(q[i:], "/*"):
+			space = true
+			i = skipPostgresComment(q, i)
+		case c == '\'':
+			escape := false
+			// E'', B'', X'' and N'' prefixes belong to literal
+			if n := len(out); !space && n > 0 && strings.IndexByte("EeBbXxNn", out[n-1]) >= 0 && (n == 1 || !isIdentByte(out[n-2])) {
+				escape = out[n-1] == 'E' || out[n-1] == 'e'
+				out = out[:n-1]
+			}
+			write("?")
+			i = skipPostgresString(q, i, escape)
+		case c == '"':
+			end := skipPostgresString(q, i, false)
+			write(q[i:end])
+			i = end
+		case c == '$' && !identBefore():
+			end := i + 1
+			for end < len(q) && isIdentByte(q[end]) && q[end] != '$' {
+				end++
+			}
+			switch {
+			case end == i+1 || !isDigit(q[i+1]):
+				if end < len(q) && q[end] == '$' {
+					delimiter := q[i : end+1]
+					write("?")
+					if closing := strings.Index(q[end+1:], delimiter); closing >= 0 {
+						i = end + 1 + closing + len(delimiter)
+					} else {
+						i = len(q)
+					}
+					continue
+				}
+				write("$")
+				i++
+			default:
+				// positional parameter
+				write(q[i:end])
+				i = end
+			}
+		case (isDigit(c) || (c == '.' && i+1 < len(q) && isDigit(q[i+1]))) && !identBefore():
+			end := i
+			for end < len(q) && (isIdentByte(q[end]) || q[end] == '.') && q[end] != '$' {
+				if (q[end] == 'e' || q[end] == 'E') && end+1 < len(q) && (q[end+1] == '+' || q[end+1] == '-') {
+					end++
+				}
+				end++
+			}
+			write("?")
+			i = end
+		default:
+			write(q[i : i+1])
+			i++
+		}
+	}
+	return string(out)
+}
+
+// skipPostgresString returns index following literal or quoted identifier started at i,
+// doubled quote is a quote inside of it, backslash escapes are used in literals with E prefix
+func skipPostgresString(q string, i int, escape bool) int {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		switch {
+		case escape && q[j] == '\\':
+			j++
+		case q[j] == quote:
+			if j+1 < len(q) && q[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(q)
+}
+
+// skipPostgresComment returns index following block comment started at i, block comments can be nested
+func skipPostgresComment(q string, i int) int {
+	depth := 0
+	for i < len(q) {
+		switch {
+		case strings.HasPrefix(q[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(q[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(q)
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isIdentByte checks whether c can be part of identifier, non-ASCII bytes are letters of UTF-8 identifiers
+func isIdentByte(c byte) bool {
+	return isLetter(c) || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
@@ -0,0 +1,261 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+func TestNormalizePostgresQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM users WHERE id = 42 AND name = 'O''Brien'":                       "SELECT * FROM users WHERE id = ? AND name = ?",
+		"select  E'a\\'b', $1::int, $$te'xt$$, $tag$x$tag$ -- comment\n FROM t":         "select ?, $1::int, ?, ? FROM t",
+		"INSERT INTO t2 (c1, c2) VALUES (1.5e-3, -7), (.5, x'1f')":                      "INSERT INTO t2 (c1, c2) VALUES (?, -?), (?, ?)",
+		"/* a /* nested */ hint */ SELECT \"col1\", t1.c2 FROM \"Ta\"\"b\"\n\tLIMIT 10": "SELECT \"col1\", t1.c2 FROM \"Ta\"\"b\" LIMIT ?",
+		"UPDATE a$b SET e = e2 WHERE x = 'unterminated":                                 "UPDATE a$b SET e = e2 WHERE x = ?",
+	}
+	for query, expected := range cases {
+		if actual := normalizePostgresQuery(query); actual != expected {
+			t.Errorf("%q: expected %q, got %q", query, expected, actual)
+		}
+	}
+	if op := postgresOperation("(select 1) union (select 2)"); op != "SELECT" {
+		t.Errorf("unexpected operation %s", op)
+	}
+}
+
+// pgMessage builds typed PostgreSQL message, string parts are null-terminated
+func pgMessage(typ byte, parts ...interface{}) []byte {
+	body := []byte{}
+	for _, part := range parts {
+		switch p := part.(type) {
+		case string:
+			body = append(append(body, p...), 0)
+		case []byte:
+			body = append(body, p...)
+		case uint16:
+			body = append(body, byte(p>>8), byte(p))
+		case uint32:
+			body = append(body, byte(p>>24), byte(p>>16), byte(p>>8), byte(p))
+		}
+	}
+	msg := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// pgStartupPacket builds untyped startup packet with code and parameters
+func pgStartupPacket(code uint32, params ...string) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b[4:], code)
+	for _, param := range params {
+		b = append(append(b, param...), 0)
+	}
+	if len(params) > 0 {
+		b = append(b, 0)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func pgReadyForQuery() []byte {
+	return pgMessage(pgMsgReadyForQuery, []byte{'I'})
+}
+
+func pgErrorResponse(code string, message string) []byte {
+	return pgMessage(pgMsgErrorResponse, []byte{'S'}, "ERROR", []byte{'C'}, code, []byte{'M'}, message, []byte{0})
+}
+
+func newPostgresHarness(t *testing.T) *handlerHarness {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := newRecordingTracer()
+	netRequest := NewNetPostgresRequest(logger, false, tracer)
+	return newHarness(t, NewPostgresHandler(logger), netRequest, false, tracer)
+}
+
+// exchange writes client bytes, expects them to reach upstream as is and answers with server bytes
+func (h *handlerHarness) exchange(t *testing.T, client []byte, server []byte) {
+	go h.client.Write(client)
+	buf := make([]byte, len(client))
+	if _, err := io.ReadFull(h.upstream, buf); err != nil || string(buf) != string(client) {
+		t.Fatalf("upstream expected client bytes as is, got %q %v", buf, err)
+	}
+	go h.upstream.Write(server)
+	buf = make([]byte, len(server))
+	if _, err := io.ReadFull(h.client, buf); err != nil || string(buf) != string(server) {
+		t.Fatalf("client expected server bytes as is, got %q %v", buf, err)
+	}
+}
+
+func TestPostgresHandlerQueries(t *testing.T) {
+	h := newPostgresHarness(t)
+	join := func(msgs ...[]byte) []byte {
+		var b []byte
+		for _, msg := range msgs {
+			b = append(b, msg...)
+		}
+		return b
+	}
+
+	h.exchange(t,
+		pgStartupPacket(postgresProtocolV3, "user", "app", "database", "orders"),
+		join(pgMessage(pgMsgAuthentication, uint32(0)),
+			pgMessage('S', "server_version", "13.3"),
+			pgMessage('K', uint32(1), uint32(2)),
+			pgReadyForQuery()))
+	h.exchange(t,
+		pgMessage(pgMsgQuery, "SELECT * FROM orders WHERE id = 42"),
+		join(pgMessage('T', uint16(0)),
+			pgMessage(pgMsgDataRow, uint16(0)),
+			pgMessage(pgMsgCommandComplete, "SELECT 1"),
+			pgReadyForQuery()))
+	// extended query protocol with named statement executed twice, second execution fails and
+	// third one is skipped by server until Sync
+	h.exchange(t,
+		join(pgMessage(pgMsgParse, "ins", "INSERT INTO items VALUES ($1, 'new')", uint16(0)),
+			pgMessage(pgMsgBind, "", "ins", uint16(0), uint16(0), uint16(0)),
+			pgMessage(pgMsgExecute, "", uint32(0)),
+			pgMessage(pgMsgBind, "", "ins", uint16(0), uint16(0), uint16(0)),
+			pgMessage(pgMsgExecute, "", uint32(0)),
+			pgMessage(pgMsgBind, "", "ins", uint16(0), uint16(0), uint16(0)),
+			pgMessage(pgMsgExecute, "", uint32(0)),
+			pgMessage(pgMsgSync)),
+		join(pgMessage('1'),
+			pgMessage('2'),
+			pgMessage(pgMsgCommandComplete, "INSERT 0 1"),
+			pgMessage('2'),
+			pgErrorResponse("23505", "duplicate key value violates unique constraint"),
+			pgReadyForQuery()))
+	h.exchange(t,
+		join(pgMessage(pgMsgQuery, "SELECT 1/0"), pgMessage(pgMsgTerminate)),
+		join(pgErrorResponse("22012", "division by zero"), pgReadyForQuery()))
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans, got %d", len(spans))
+	}
+	expected := []struct {
+		operation string
+		tags      map[string]interface{}
+	}{
+		{"postgres SELECT", map[string]interface{}{
+			"span.kind":    "client",
+			"peer.address": "127.0.0.1:80",
+			"db.system":    "postgresql",
+			"db.name":      "orders",
+			"db.user":      "app",
+			"db.statement": "SELECT * FROM orders WHERE id = ?",
+			"db.operation": "SELECT",
+			"db.rows":      int64(1),
+			"error":        nil,
+		}},
+		{"postgres INSERT", map[string]interface{}{
+			"db.statement": "INSERT INTO items VALUES ($1, ?)",
+			"db.rows":      int64(1),
+			"error":        nil,
+		}},
+		{"postgres INSERT", map[string]interface{}{
+			"error":            true,
+			"db.sql_state":     "23505",
+			"db.error_message": "duplicate key value violates unique constraint",
+			"db.rows":          nil,
+		}},
+		{"postgres INSERT", map[string]interface{}{
+			"error":      true,
+			"db.skipped": true,
+		}},
+		{"postgres SELECT", map[string]interface{}{
+			"db.statement": "SELECT ?/?",
+			"error":        true,
+			"db.sql_state": "22012",
+		}},
+	}
+	for i, e := range expected {
+		if spans[i].operationName != e.operation {
+			t.Errorf("span %d: expected operation %s, got %s", i, e.operation, spans[i].operationName)
+		}
+		for key, value := range e.tags {
+			if actual := spans[i].Tag(key); actual != value {
+				t.Errorf("span %d tag %s: expected %v, got %v", i, key, value, actual)
+			}
+		}
+	}
+}
+
+func TestPostgresHandlerAuthenticationError(t *testing.T) {
+	h := newPostgresHarness(t)
+	h.exchange(t,
+		pgStartupPacket(postgresProtocolV3, "user", "app"),
+		pgErrorResponse("28P01", "password authentication failed for user \"app\""))
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	for key, expected := range map[string]interface{}{
+		"db.name":      "app",
+		"error":        true,
+		"db.sql_state": "28P01",
+	} {
+		if actual := spans[0].Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v, got %v", key, expected, actual)
+		}
+	}
+	if spans[0].operationName != "postgres connect" {
+		t.Errorf("unexpected operation %s", spans[0].operationName)
+	}
+}
+
+func TestPostgresHandlerSSLRequest(t *testing.T) {
+	// refused SSLRequest is followed by plaintext startup
+	h := newPostgresHarness(t)
+	h.exchange(t, pgStartupPacket(postgresSSLRequest), []byte{pgEncryptionRefused})
+	h.exchange(t, pgStartupPacket(postgresProtocolV3, "user", "app"), pgReadyForQuery())
+	h.exchange(t, pgMessage(pgMsgQuery, "SELECT 1"), pgReadyForQuery())
+	h.Close(t)
+	if spans := h.tracer.FinishedSpans(); len(spans) != 1 || spans[0].Tag("db.statement") != "SELECT ?" {
+		t.Errorf("expected query span after refused SSLRequest, got %d spans", len(spans))
+	}
+
+	// TLS negotiated with SSLRequest is passed through untouched
+	h = newPostgresHarness(t)
+	h.exchange(t, pgStartupPacket(postgresSSLRequest), []byte{pgEncryptionAccepted})
+	cert := testCertificate(t)
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		tlsServer := tls.Server(h.upstream, &tls.Config{Certificates: []tls.Certificate{cert}})
+		buf := make([]byte, len(startupQuery()))
+		if _, err := io.ReadFull(tlsServer, buf); err != nil {
+			return
+		}
+		tlsServer.Write(pgReadyForQuery())
+	}()
+	tlsClient := tls.Client(h.client, testClientConfig())
+	if _, err := tlsClient.Write(startupQuery()); err != nil {
+		t.Fatalf("client write: %s", err)
+	}
+	buf := make([]byte, len(pgReadyForQuery()))
+	if _, err := io.ReadFull(tlsClient, buf); err != nil || string(buf) != string(pgReadyForQuery()) {
+		t.Fatalf("client expected ReadyForQuery, got %q %v", buf, err)
+	}
+	<-serverDone
+	h.Close(t)
+	if spans := h.tracer.FinishedSpans(); len(spans) != 0 {
+		t.Errorf("expected no spans of encrypted connection, got %d", len(spans))
+	}
+}
+
+// startupQuery returns startup packet followed by query
+func startupQuery() []byte {
+	return append(pgStartupPacket(postgresProtocolV3, "user", "app"), pgMessage(pgMsgQuery, "SELECT 1")...)
+}
@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// DetectResult is a result of protocol detection by first client bytes
+type DetectResult int
+
+const (
+	// DetectNoMatch means bytes don't belong to protocol
+	DetectNoMatch DetectResult = iota
+	// DetectNeedMore means there is not enough bytes to make a decision
+	DetectNeedMore
+	// DetectMatch means bytes belong to protocol
+	DetectMatch
+)
+
+// Detector checks first bytes of client stream
+type Detector func(b []byte) DetectResult
+
+// Dependencies are shared objects passed to protocol handler and request constructors
+type Dependencies struct {
+	Logger                    *log.Logger
+	StatsdMetrics             *statsd.Client
+	Metrics                   *metrics.Metrics
+	AccessLog                 *accesslog.Logger
+	Tracer                    opentracing.Tracer
+	Config                    *config.Holder
+	Drain                     *drain.Tracker
+	TracingContextMapping     *cache.Cache
+	RoutingInfoContextMapping *cache.Cache
+}
+
+// Protocol describes application level protocol which can be plugged into netra
+type Protocol struct {
+	// Name is used in configuration to map ports and destinations to protocol
+	Name Proto
+	// Detector is used by protocol sniffing, protocol without detector is chosen only by configuration
+	Detector Detector
+	// NewHandler creates handler shared by all connections of protocol,
+	// protocol without handler is proxied as TCP
+	NewHandler func(deps Dependencies) NetHandler
+	// NewRequest creates request state for each connection
+	NewRequest func(deps Dependencies, isInbound bool) NetRequest
+}
+
+var registry = struct {
+	mu        sync.RWMutex
+	protocols map[Proto]*Protocol
+	// order keeps registration order, detectors are applied in it
+	order []*Protocol
+}{
+	protocols: make(map[Proto]*Protocol),
+}
+
+// Register makes protocol available by name. It should be called from init function of protocol package.
+// It panics if protocol with the same name is already registered.
+func Register(p Protocol) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if p.Name == "" {
+		panic("protocol: Register protocol without name")
+	}
+	if _, ok := registry.protocols[p.Name]; ok {
+		panic(fmt.Sprintf("protocol: Register called twice for protocol %s", p.Name))
+	}
+	registry.protocols[p.Name] = &p
+	registry.order = append(registry.order, &p)
+}
+
+// IsRegistered checks whether protocol is registered
+func IsRegistered(name Proto) bool {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	_, ok := registry.protocols[name]
+	return ok
+}
+
+// newHandlers creates handlers of all registered protocols
+func newHandlers(deps Dependencies) map[Proto]NetHandler {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	handlers := make(map[Proto]NetHandler, len(registry.protocols))
+	for name, p := range registry.protocols {
+		if p.NewHandler != nil {
+			handlers[name] = p.NewHandler(deps)
+		}
+	}
+	return handlers
+}
+
+func init() {
+	Register(Protocol{
+		Name:       TCPProto,
+		NewHandler: func(deps Dependencies) NetHandler { return NewTCPHandler(deps.Logger.Named("tcp")) },
+		NewRequest: func(deps Dependencies, isInbound bool) NetRequest {
+			return NewNetTCPRequest(
+				deps.Logger.Named("tcp"),
+				isInbound,
+				deps.Tracer,
+				deps.Config,
+				deps.Metrics)
+		},
+	})
+	Register(Protocol{
+		Name:     HTTP2Proto,
+		Detector: detectHTTP2,
+		NewHandler: func(deps Dependencies) NetHandler {
+			return NewHTTP2Handler(
+				deps.Logger.Named("http2"),
+				deps.Tracer,
+				deps.Config,
+				deps.Drain,
+				deps.TracingContextMapping)
+		},
+		NewRequest: func(deps Dependencies, isInbound bool) NetRequest {
+			return NewNetHTTP2Request(
+				deps.Logger.Named("http2"),
+				isInbound,
+				deps.Tracer,
+				deps.Config,
+				deps.TracingContextMapping,
+				deps.Metrics,
+				deps.AccessLog)
+		},
+	})
+	Register(Protocol{
+		Name:     HTTPProto,
+		Detector: detectHTTP1,
+		NewHandler: func(deps Dependencies) NetHandler {
+			return NewHTTPHandler(
+				deps.Logger.Named("http"),
+				deps.StatsdMetrics,
+				deps.Tracer,
+				deps.Config,
+				deps.Drain,
+				deps.TracingContextMapping,
+				deps.RoutingInfoContextMapping)
+		},
+		NewRequest: func(deps Dependencies, isInbound bool) NetRequest {
+			return NewNetHTTPRequest(
+				deps.Logger.Named("http"),
+				isInbound,
+				deps.Tracer,
+				deps.Config,
+				deps.TracingContextMapping,
+				deps.Metrics,
+				deps.AccessLog)
+		},
+	})
+	Register(Protocol{
+		Name:     TLSProto,
+		Detector: detectTLS,
+	})
+	Register(Protocol{
+		Name:     PostgresProto,
+		Detector: detectPostgres,
+		NewHandler: func(deps Dependencies) NetHandler {
+			return NewPostgresHandler(deps.Logger.Named("postgres"))
+		},
+		NewRequest: func(deps Dependencies, isInbound bool) NetRequest {
+			return NewNetPostgresRequest(deps.Logger.Named("postgres"), isInbound, deps.Tracer)
+		},
+	})
+	Register(Protocol{
+		Name:     MongoProto,
+		Detector: detectMongo,
+	})
+	Register(Protocol{
+		Name:     RedisProto,
+		Detector: detectRedis,
+	})
+}
@@ -4,4 +4,18 @@ type NetRequest interface {
 	StartRequest()
 	StopRequest()
 	CleanUp()
+	// TimedOut finishes pending requests interrupted by connection timeout
+	TimedOut(cause string)
+}
+
+// RequestObserver is implemented by requests of protocols with request/response semantics
+type RequestObserver interface {
+	// OnRequest registers callback called for each request read from client
+	OnRequest(f func())
+}
+
+// PeerIdentityReceiver is implemented by requests which tag spans with identity of mutual TLS peer
+type PeerIdentityReceiver interface {
+	// SetPeerIdentity sets identity of peer sidecar certificate, it can be called while requests are processed
+	SetPeerIdentity(identity string)
 }
@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// sniffRetryInterval is a pause between peeks while first bytes are not enough to classify protocol
+const sniffRetryInterval = time.Millisecond
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+var http1Methods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("PATCH "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// postgres startup packet codes
+const (
+	postgresProtocolV3     = 196608
+	postgresCancelRequest  = 80877102
+	postgresSSLRequest     = 80877103
+	postgresGSSENCRequest  = 80877104
+	postgresMaxStartupSize = 10000
+)
+
+// mongodb op codes
+const (
+	mongoOpQuery = 2004
+	mongoOpMsg   = 2013
+)
+
+// sniff peeks first client bytes without consuming them and classifies protocol.
+// It waits no longer than timeout and looks at no more than maxBytes.
+// cacheable is false when connection failed before any decision could be made.
+func sniff(conn net.Conn, timeout time.Duration, maxBytes int) (proto Proto, cacheable bool) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, maxBytes)
+	for {
+		n, err := Peek(conn, buf, deadline)
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			// client-silent (server first) protocols end up here
+			return TCPProto, ok && netErr.Timeout()
+		}
+		if n == 0 {
+			// EOF
+			return TCPProto, false
+		}
+		if proto, ok := classify(buf[:n]); ok {
+			return proto, true
+		}
+		if n == len(buf) || time.Now().After(deadline) {
+			return TCPProto, true
+		}
+		time.Sleep(sniffRetryInterval)
+	}
+}
+
+// Peek reads available bytes into buf leaving them in socket receive buffer.
+// It waits until at least one byte is available or deadline is exceeded, n is 0 on EOF.
+// Connections with terminated TLS are peeked at decrypted stream.
+func Peek(c net.Conn, buf []byte, deadline time.Time) (int, error) {
+	if peerConn, ok := c.(*PeerConn); ok {
+		return peerConn.peek(buf, deadline)
+	}
+	conn, ok := tcpConn(c)
+	if !ok {
+		return 0, errors.New("connection can't be peeked")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	err = conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var n int
+	var peekErr error
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			n, _, peekErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK)
+			if peekErr != syscall.EINTR {
+				break
+			}
+		}
+		// wait until socket becomes readable
+		return peekErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, peekErr
+}
+
+// classify detects protocol by first bytes of client stream applying registered detectors,
+// ok is false when there is not enough bytes to make a decision
+func classify(b []byte) (proto Proto, ok bool) {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	undecided := false
+	for _, p := range registry.order {
+		if p.Detector == nil {
+			continue
+		}
+		switch p.Detector(b) {
+		case DetectMatch:
+			return p.Name, true
+		case DetectNeedMore:
+			undecided = true
+		}
+	}
+	if undecided {
+		return TCPProto, false
+	}
+	return TCPProto, true
+}
+
+func detectHTTP2(b []byte) DetectResult {
+	return prefixMatch(b, http2Preface)
+}
+
+func detectHTTP1(b []byte) DetectResult {
+	result := DetectNoMatch
+	for _, method := range http1Methods {
+		switch prefixMatch(b, method) {
+		case DetectMatch:
+			return DetectMatch
+		case DetectNeedMore:
+			result = DetectNeedMore
+		}
+	}
+	return result
+}
+
+// detectTLS checks TLS record: handshake content type, major version 3, handshake type ClientHello
+func detectTLS(b []byte) DetectResult {
+	if b[0] != 0x16 {
+		return DetectNoMatch
+	}
+	if len(b) < 6 {
+		return DetectNeedMore
+	}
+	if b[1] == 0x03 && b[2] <= 0x04 && b[5] == 0x01 {
+		return DetectMatch
+	}
+	return DetectNoMatch
+}
+
+// detectPostgres checks startup packet: int32 length, int32 protocol version or request code
+func detectPostgres(b []byte) DetectResult {
+	if len(b) < 8 {
+		return DetectNeedMore
+	}
+	length := binary.BigEndian.Uint32(b[0:4])
+	code := binary.BigEndian.Uint32(b[4:8])
+	if length < 8 || length > postgresMaxStartupSize {
+		return DetectNoMatch
+	}
+	switch code {
+	case postgresProtocolV3, postgresCancelRequest, postgresSSLRequest, postgresGSSENCRequest:
+		return DetectMatch
+	}
+	return DetectNoMatch
+}
+
+// detectMongo checks message header: int32 length, requestID, responseTo, opCode (little endian)
+func detectMongo(b []byte) DetectResult {
+	if len(b) < 16 {
+		return DetectNeedMore
+	}
+	responseTo := binary.LittleEndian.Uint32(b[8:12])
+	opCode := binary.LittleEndian.Uint32(b[12:16])
+	if responseTo == 0 && (opCode == mongoOpMsg || opCode == mongoOpQuery) {
+		return DetectMatch
+	}
+	return DetectNoMatch
+}
+
+// detectRedis checks RESP command: array of bulk strings
+func detectRedis(b []byte) DetectResult {
+	if b[0] != '*' {
+		return DetectNoMatch
+	}
+	if len(b) < 2 {
+		return DetectNeedMore
+	}
+	if b[1] >= '0' && b[1] <= '9' {
+		return DetectMatch
+	}
+	return DetectNoMatch
+}
+
+// prefixMatch checks whether b starts with prefix, b shorter than prefix requires more bytes if it matches so far
+func prefixMatch(b []byte, prefix []byte) DetectResult {
+	if len(b) >= len(prefix) {
+		if bytes.HasPrefix(b, prefix) {
+			return DetectMatch
+		}
+		return DetectNoMatch
+	}
+	if bytes.HasPrefix(prefix, b) {
+		return DetectNeedMore
+	}
+	return DetectNoMatch
+}
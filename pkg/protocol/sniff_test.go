@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+)
+
+// startupBytes builds first bytes of PostgreSQL startup packet
+func startupBytes(length uint32, code uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, length)
+	binary.BigEndian.PutUint32(b[4:], code)
+	return b
+}
+
+// mongoHeader builds MongoDB message header
+func mongoHeader(responseTo uint32, opCode uint32) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b, 64)
+	binary.LittleEndian.PutUint32(b[8:], responseTo)
+	binary.LittleEndian.PutUint32(b[12:], opCode)
+	return b
+}
+
+func TestDetectors(t *testing.T) {
+	cases := []struct {
+		name     string
+		detector Detector
+		b        []byte
+		expected DetectResult
+	}{
+		{"http1 method", detectHTTP1, []byte("GET / HTTP/1.1\r\n"), DetectMatch},
+		{"http1 exact method", detectHTTP1, []byte("DELETE "), DetectMatch},
+		{"http1 method prefix", detectHTTP1, []byte("DELE"), DetectNeedMore},
+		{"http1 common prefix", detectHTTP1, []byte("P"), DetectNeedMore},
+		{"http1 method without space", detectHTTP1, []byte("GETX"), DetectNoMatch},
+		{"http1 lowercase", detectHTTP1, []byte("get / HTTP/1.1"), DetectNoMatch},
+
+		{"h2 preface", detectHTTP2, http2Preface, DetectMatch},
+		{"h2 preface prefix", detectHTTP2, http2Preface[:len(http2Preface)-1], DetectNeedMore},
+		{"h2 broken preface", detectHTTP2, []byte("PRI * HTTP/1.1\r\n"), DetectNoMatch},
+
+		{"tls client hello", detectTLS, []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}, DetectMatch},
+		{"tls short record", detectTLS, []byte{0x16, 0x03, 0x01, 0x02, 0x00}, DetectNeedMore},
+		{"tls server hello", detectTLS, []byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02}, DetectNoMatch},
+		{"tls unknown version", detectTLS, []byte{0x16, 0x03, 0x05, 0x00, 0x40, 0x01}, DetectNoMatch},
+		{"tls application data", detectTLS, []byte{0x17, 0x03, 0x03}, DetectNoMatch},
+
+		{"postgres startup", detectPostgres, startupBytes(40, postgresProtocolV3), DetectMatch},
+		{"postgres ssl request", detectPostgres, startupBytes(8, postgresSSLRequest), DetectMatch},
+		{"postgres gssenc request", detectPostgres, startupBytes(8, postgresGSSENCRequest), DetectMatch},
+		{"postgres cancel request", detectPostgres, startupBytes(16, postgresCancelRequest), DetectMatch},
+		{"postgres short", detectPostgres, startupBytes(8, postgresSSLRequest)[:7], DetectNeedMore},
+		{"postgres too short length", detectPostgres, startupBytes(7, postgresSSLRequest), DetectNoMatch},
+		{"postgres too long length", detectPostgres, startupBytes(postgresMaxStartupSize+1, postgresProtocolV3), DetectNoMatch},
+		{"postgres unknown code", detectPostgres, startupBytes(40, 0x00020000), DetectNoMatch},
+
+		{"mongo op_msg", detectMongo, mongoHeader(0, mongoOpMsg), DetectMatch},
+		{"mongo op_query", detectMongo, mongoHeader(0, mongoOpQuery), DetectMatch},
+		{"mongo short", detectMongo, mongoHeader(0, mongoOpMsg)[:15], DetectNeedMore},
+		{"mongo reply", detectMongo, mongoHeader(1, mongoOpMsg), DetectNoMatch},
+		{"mongo unknown op", detectMongo, mongoHeader(0, 1), DetectNoMatch},
+
+		{"redis command", detectRedis, []byte("*1\r\n$4\r\nPING\r\n"), DetectMatch},
+		{"redis array start", detectRedis, []byte("*"), DetectNeedMore},
+		{"redis inline", detectRedis, []byte("PING\r\n"), DetectNoMatch},
+		{"redis not array length", detectRedis, []byte("*x"), DetectNoMatch},
+	}
+	for _, c := range cases {
+		if actual := c.detector(c.b); actual != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		b       []byte
+		proto   Proto
+		decided bool
+	}{
+		{[]byte("GET / HTTP/1.1"), HTTPProto, true},
+		// h2 preface starts with HTTP/1 like method until it's complete
+		{[]byte("PRI * HTTP/2.0"), TCPProto, false},
+		{http2Preface, HTTP2Proto, true},
+		{startupBytes(8, postgresSSLRequest), PostgresProto, true},
+		{[]byte("P"), TCPProto, false},
+		{[]byte("SSH-2.0-OpenSSH_8.9\r\n"), TCPProto, true},
+	}
+	for _, c := range cases {
+		proto, decided := classify(c.b)
+		if proto != c.proto || decided != c.decided {
+			t.Errorf("%q: expected %s %v, got %s %v", c.b, c.proto, c.decided, proto, decided)
+		}
+	}
+}
+
+func newTestFactory(t *testing.T, c *config.Config) *Factory {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	f, err := NewFactory(Dependencies{Logger: logger, StatsdMetrics: statsdClient, Config: config.NewHolder(c)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// determine writes first client bytes into new connection and returns protocol determined for addr
+func determine(t *testing.T, f *Factory, addr string, first []byte) Proto {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	if _, err := client.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	return f.DetermineConn(server, addr)
+}
+
+func TestDetermineConnPrecedence(t *testing.T) {
+	c := config.Default()
+	c.Netra.ProtocolSniffingEnabled = true
+	c.Netra.ProtocolSniffingTimeout = time.Second
+	c.Netra.HTTPProtoPorts = map[string]struct{}{"8080": {}}
+	c.Netra.TCPProtoPorts = map[string]struct{}{"22": {}}
+	c.Netra.ProtocolMap = map[string]string{"15432": "postgres", "10.0.0.2:8080": "tcp"}
+	f := newTestFactory(t, c)
+	get := []byte("GET / HTTP/1.1\r\n\r\n")
+	startup := startupBytes(40, postgresProtocolV3)
+
+	cases := []struct {
+		addr     string
+		first    []byte
+		expected Proto
+	}{
+		// port lists and map are overrides, first bytes aren't looked at
+		{"10.0.0.1:15432", get, PostgresProto},
+		{"10.0.0.1:22", get, TCPProto},
+		{"10.0.0.1:8080", startup, HTTPProto},
+		// ip:port mapping has priority over port lists
+		{"10.0.0.2:8080", get, TCPProto},
+		// sniffing result is cached per destination
+		{"10.0.0.1:5432", startup, PostgresProto},
+		{"10.0.0.1:5432", get, PostgresProto},
+		{"10.0.0.2:5432", get, HTTPProto},
+	}
+	for _, c := range cases {
+		if proto := determine(t, f, c.addr, c.first); proto != c.expected {
+			t.Errorf("%s %q: expected %s, got %s", c.addr, c.first[:4], c.expected, proto)
+		}
+	}
+
+	// configured mapping overrides cached result
+	updated := *c
+	updated.Netra.ProtocolMap = map[string]string{"10.0.0.1:5432": "tcp"}
+	f.deps.Config.Set(&updated)
+	if proto := determine(t, f, "10.0.0.1:5432", startup); proto != TCPProto {
+		t.Errorf("expected mapping to override cache, got %s", proto)
+	}
+	updated.Netra.ProtocolMap = map[string]string{}
+	f.deps.Config.Set(&updated)
+	if proto := determine(t, f, "10.0.0.1:5432", get); proto != PostgresProto {
+		t.Errorf("expected cached result, got %s", proto)
+	}
+	f.ResetSniffing()
+	if proto := determine(t, f, "10.0.0.1:5432", get); proto != HTTPProto {
+		t.Errorf("expected sniffing after reset, got %s", proto)
+	}
+
+	// silent client is classified as TCP after timeout
+	updated.Netra.ProtocolSniffingTimeout = 20 * time.Millisecond
+	f.deps.Config.Set(&updated)
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	if proto := f.DetermineConn(server, "10.0.0.1:6000"); proto != TCPProto {
+		t.Errorf("expected TCP for silent client, got %s", proto)
+	}
+}
+
+func TestDetermineConnHTTP2OnHTTPPorts(t *testing.T) {
+	c := config.Default()
+	c.Netra.ProtocolSniffingTimeout = time.Second
+	c.Netra.HTTPProtoPorts = map[string]struct{}{"8080": {}}
+	c.Netra.ProtocolMap = map[string]string{"50051": "http2"}
+	f := newTestFactory(t, c)
+
+	// without sniffing HTTP ports aren't inspected, h2c needs explicit mapping
+	if proto := determine(t, f, "10.0.0.1:8080", http2Preface); proto != HTTPProto {
+		t.Errorf("expected http without sniffing, got %s", proto)
+	}
+	if proto := determine(t, f, "10.0.0.1:50051", http2Preface); proto != HTTP2Proto {
+		t.Errorf("expected mapped http2, got %s", proto)
+	}
+
+	updated := *c
+	updated.Netra.ProtocolSniffingEnabled = true
+	f.deps.Config.Set(&updated)
+	if proto := determine(t, f, "10.0.0.1:8080", http2Preface); proto != HTTP2Proto {
+		t.Errorf("expected http2 detected by preface, got %s", proto)
+	}
+	if proto := determine(t, f, "10.0.0.1:8080", []byte("GET / HTTP/1.1\r\n\r\n")); proto != HTTPProto {
+		t.Errorf("expected http, got %s", proto)
+	}
+}
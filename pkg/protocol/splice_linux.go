@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package protocol
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	// maxSpliceSize is the maximum amount of data moved by single splice call, default pipe capacity
+	maxSpliceSize = 1 << 16
+	// maxPooledPipes limits amount of idle pipes kept open
+	maxPooledPipes = 1024
+
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+)
+
+// splicePipe is a pipe pair used as intermediate kernel buffer
+type splicePipe struct {
+	r int
+	w int
+}
+
+var pipePool = make(chan *splicePipe, maxPooledPipes)
+
+func getPipe() (*splicePipe, error) {
+	select {
+	case p := <-pipePool:
+		return p, nil
+	default:
+	}
+	var fds [2]int
+	if err := syscall.Pipe2(fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return nil, err
+	}
+	return &splicePipe{r: fds[0], w: fds[1]}, nil
+}
+
+func putPipe(p *splicePipe) {
+	select {
+	case pipePool <- p:
+	default:
+		p.close()
+	}
+}
+
+func (p *splicePipe) close() {
+	syscall.Close(p.r)
+	syscall.Close(p.w)
+}
+
+// spliceCopy moves data from src to dst inside kernel: src socket -> pipe -> dst socket.
+// handled is false when splice can't be used and nothing has been transferred yet.
+func spliceCopy(dst *net.TCPConn, src *net.TCPConn) (written int64, handled bool, err error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	p, err := getPipe()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	for {
+		var n int64
+		var spliceErr error
+		err = srcRaw.Read(func(fd uintptr) bool {
+			for {
+				n, spliceErr = syscall.Splice(int(fd), nil, p.w, nil, maxSpliceSize, spliceMove|spliceNonblock)
+				if spliceErr != syscall.EINTR {
+					break
+				}
+			}
+			// wait until socket becomes readable
+			return spliceErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			// pipe is empty here, so it can be reused
+			putPipe(p)
+			if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS) {
+				return 0, false, nil
+			}
+			return written, true, err
+		}
+		if n == 0 {
+			// EOF
+			putPipe(p)
+			return written, true, nil
+		}
+
+		for n > 0 {
+			var m int64
+			err = dstRaw.Write(func(fd uintptr) bool {
+				for {
+					m, spliceErr = syscall.Splice(p.r, nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+					if spliceErr != syscall.EINTR {
+						break
+					}
+				}
+				// wait until socket becomes writable
+				return spliceErr != syscall.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err != nil {
+				// pipe may contain data, don't reuse it
+				p.close()
+				return written, true, err
+			}
+			n -= m
+			written += m
+		}
+	}
+}
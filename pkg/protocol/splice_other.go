@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package protocol
+
+import (
+	"net"
+)
+
+// spliceCopy is supported only on linux
+func spliceCopy(dst *net.TCPConn, src *net.TCPConn) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -3,8 +3,14 @@ package protocol
 import (
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/config"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
 )
 
 type TCPHandler struct {
@@ -18,52 +24,182 @@ func NewTCPHandler(logger *log.Logger) *TCPHandler {
 }
 
 func (h *TCPHandler) HandleRequest(
-	r *net.TCPConn,
-	w *net.TCPConn,
-	connCh chan *net.TCPConn,
-	addrCh chan string,
+	r net.Conn,
+	w net.Conn,
+	dialer Dialer,
 	netRequest NetRequest,
 	isInboundConn bool,
-	originalDst string) *net.TCPConn {
+	originalDst string) net.Conn {
 
 	if w == nil {
-		defer close(addrCh)
-		addrCh <- originalDst
-		w = <-connCh
-		if w == nil {
-			return w
+		var err error
+		w, err = dialer.Dial(originalDst)
+		if err != nil {
+			return nil
 		}
 	}
 
-	buf := bufferPool.Get().([]byte)
-	written, err := io.CopyBuffer(w, r, buf)
-	bufferPool.Put(buf)
+	var written int64
+	var err error
+	if tcpRequest, ok := netRequest.(*NetTCPRequest); ok && tcpRequest.inspectTLS {
+		written, err = tcpRequest.forwardClient(w, r, originalDst)
+	} else {
+		written, err = forward(w, r)
+	}
 	h.logger.Debugf("Written: %d", written)
 	if err != nil {
-		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+		h.logger.Debugf("Err forward: %s", err.Error())
 	}
 	return w
 }
 
-func (h *TCPHandler) HandleResponse(r *net.TCPConn, w *net.TCPConn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
-	buf := bufferPool.Get().([]byte)
-	written, err := io.CopyBuffer(w, r, buf)
-	bufferPool.Put(buf)
+func (h *TCPHandler) HandleResponse(r net.Conn, w net.Conn, netRequest NetRequest, isInboundConn bool, forceClose bool) {
+	var written int64
+	var err error
+	if tcpRequest, ok := netRequest.(*NetTCPRequest); ok && tcpRequest.inspectTLS {
+		written, err = tcpRequest.forwardServer(w, r)
+	} else {
+		written, err = forward(w, r)
+	}
 	h.logger.Debugf("Written: %d", written)
 	if err != nil {
-		h.logger.Debugf("Err CopyBuffer: %s", err.Error())
+		h.logger.Debugf("Err forward: %s", err.Error())
 	}
 }
 
+// NetTCPRequest keeps state of TCP connection, outbound TLS connections are traced
+// with connection-level span in case TLS inspection is enabled
 type NetTCPRequest struct {
+	tracer  opentracing.Tracer
+	metrics *metrics.Metrics
+	// inspectTLS is set for outbound connections when TLS inspection is enabled
+	inspectTLS bool
+
+	mu      sync.Mutex
+	session *tlsSession
+	// open is a number of directions which aren't closed yet
+	open int32
 }
 
-func NewNetTCPRequest(logger *log.Logger) *NetTCPRequest {
-	return &NetTCPRequest{}
+func NewNetTCPRequest(
+	logger *log.Logger,
+	isInbound bool,
+	tracer opentracing.Tracer,
+	cfg *config.Holder,
+	m *metrics.Metrics) *NetTCPRequest {
+	return &NetTCPRequest{
+		tracer:     tracer,
+		metrics:    m,
+		inspectTLS: !isInbound && cfg.Get().Netra.TLSInspectionEnabled,
+		open:       2,
+	}
 }
 
 func (r *NetTCPRequest) StartRequest() {}
 
 func (r *NetTCPRequest) StopRequest() {}
 
-func (r *NetTCPRequest) CleanUp() {}
+// CleanUp finishes TLS session in case one of directions wasn't handled, e.g. upstream wasn't dialed
+func (r *NetTCPRequest) CleanUp() {
+	if session := r.getSession(); session != nil {
+		session.finish(nil)
+	}
+}
+
+func (r *NetTCPRequest) TimedOut(cause string) {
+	if session := r.getSession(); session != nil {
+		session.finish(func(span opentracing.Span) {
+			span.SetTag("error", true)
+			span.SetTag("timeout", true)
+			span.SetTag("timeout.cause", cause)
+		})
+	}
+}
+
+func (r *NetTCPRequest) getSession() *tlsSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.session
+}
+
+// done is called when direction is closed, TLS session is finished when both of them are closed
+func (r *NetTCPRequest) done() {
+	if atomic.AddInt32(&r.open, -1) == 0 {
+		r.CleanUp()
+	}
+}
+
+// forwardClient forwards client stream to server reading ClientHello first.
+// Session is started in case stream begins with ClientHello, records are watched until handshake is finished.
+func (r *NetTCPRequest) forwardClient(w net.Conn, c net.Conn, originalDst string) (int64, error) {
+	defer r.done()
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	n, hello, err := readTLSClientHello(c, buf)
+	if hello == nil {
+		return forwardRead(w, c, buf[:n], err, nil)
+	}
+	session := newTLSSession(r.tracer, r.metrics, hello, originalDst)
+	r.mu.Lock()
+	r.session = session
+	r.mu.Unlock()
+	return forwardRead(w, c, buf[:n], err, &session.client)
+}
+
+// forwardServer forwards server stream to client, records are watched until ServerHello is read.
+// Server doesn't send anything before ClientHello, so session is known once first bytes are read.
+func (r *NetTCPRequest) forwardServer(w net.Conn, c net.Conn) (int64, error) {
+	defer r.done()
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	n, err := c.Read(buf)
+	var stream streamWatcher
+	if session := r.getSession(); session != nil {
+		stream = &session.server
+	}
+	return forwardRead(w, c, buf[:n], err, stream)
+}
+
+// streamWatcher consumes forwarded bytes of one direction of connection until watching is finished
+type streamWatcher interface {
+	// watch consumes forwarded bytes, it returns true when watching is finished
+	watch(b []byte) bool
+	// add counts bytes forwarded without watching
+	add(n int64)
+}
+
+// forwardRead writes bytes already read from src with readErr and forwards the rest of src.
+// Bytes are passed through stream until watching is finished, stream can be nil for connections without session.
+func forwardRead(dst net.Conn, src net.Conn, read []byte, readErr error, stream streamWatcher) (int64, error) {
+	buf := read[:cap(read)]
+	var written int64
+	watching := stream != nil
+	for {
+		if len(read) > 0 {
+			if watching {
+				watching = !stream.watch(read)
+			}
+			n, err := dst.Write(read)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return written, nil
+			}
+			return written, readErr
+		}
+		if !watching {
+			break
+		}
+		n, err := src.Read(buf)
+		read, readErr = buf[:n], err
+	}
+	n, err := forward(dst, src)
+	if stream != nil {
+		stream.add(n)
+	}
+	return written + n, err
+}
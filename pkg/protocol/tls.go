@@ -0,0 +1,459 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// TLS record content types and handshake message types (RFC 8446)
+const (
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+	tlsMaxRecordLen       = 1<<14 + 2048
+
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordAlert            = 0x15
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+
+	tlsHandshakeClientHello = 0x01
+	tlsHandshakeServerHello = 0x02
+
+	tlsExtServerName        = 0
+	tlsExtALPN              = 16
+	tlsExtSupportedVersions = 43
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionSSL30: "SSL 3.0",
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsVersionName returns name of TLS version, unknown versions are written in hex
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersions[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// tlsParser reads TLS structures, it stops reading at first malformed field
+type tlsParser struct {
+	b  []byte
+	ok bool
+}
+
+func newTLSParser(b []byte) *tlsParser {
+	return &tlsParser{b: b, ok: true}
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if !p.ok || len(p.b) < n {
+		p.ok = false
+		return nil
+	}
+	res := p.b[:n]
+	p.b = p.b[n:]
+	return res
+}
+
+func (p *tlsParser) uint8() int {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (p *tlsParser) uint16() int {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// vector reads vector with length prefix of lenSize bytes
+func (p *tlsParser) vector(lenSize int) *tlsParser {
+	var n int
+	switch lenSize {
+	case 1:
+		n = p.uint8()
+	case 2:
+		n = p.uint16()
+	}
+	return &tlsParser{b: p.bytes(n), ok: p.ok}
+}
+
+// extensions calls f for each extension, hello messages without extensions are valid
+func (p *tlsParser) extensions(f func(typ int, data *tlsParser)) {
+	if !p.ok || len(p.b) == 0 {
+		return
+	}
+	exts := p.vector(2)
+	for exts.ok && len(exts.b) > 0 {
+		typ := exts.uint16()
+		data := exts.vector(2)
+		if !exts.ok {
+			break
+		}
+		f(typ, data)
+	}
+}
+
+// tlsHandshakeMessage returns first handshake message of stream beginning with handshake records.
+// Message can be fragmented into several records. Result is DetectNoMatch in case stream isn't TLS
+// and DetectNeedMore in case message isn't complete yet.
+func tlsHandshakeMessage(b []byte) (typ int, body []byte, result DetectResult) {
+	var message []byte
+	for {
+		if len(b) < tlsRecordHeaderLen {
+			return 0, nil, DetectNeedMore
+		}
+		if b[0] != tlsRecordHandshake || b[1] != 0x03 {
+			return 0, nil, DetectNoMatch
+		}
+		length := int(binary.BigEndian.Uint16(b[3:5]))
+		if length == 0 || length > tlsMaxRecordLen {
+			return 0, nil, DetectNoMatch
+		}
+		if len(b) < tlsRecordHeaderLen+length {
+			return 0, nil, DetectNeedMore
+		}
+		message = append(message, b[tlsRecordHeaderLen:tlsRecordHeaderLen+length]...)
+		b = b[tlsRecordHeaderLen+length:]
+		if len(message) < tlsHandshakeHeaderLen {
+			continue
+		}
+		size := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+		if len(message) >= tlsHandshakeHeaderLen+size {
+			return int(message[0]), message[tlsHandshakeHeaderLen : tlsHandshakeHeaderLen+size], DetectMatch
+		}
+	}
+}
+
+// tlsClientHello is a part of ClientHello visible without decryption
+type tlsClientHello struct {
+	serverName string
+	alpn       []string
+	// version is the highest offered version
+	version uint16
+}
+
+func parseTLSClientHello(body []byte) (*tlsClientHello, bool) {
+	p := newTLSParser(body)
+	hello := &tlsClientHello{version: uint16(p.uint16())}
+	p.bytes(32) // random
+	p.vector(1) // session id
+	p.vector(2) // cipher suites
+	p.vector(1) // compression methods
+	if !p.ok {
+		return nil, false
+	}
+	p.extensions(func(typ int, data *tlsParser) {
+		switch typ {
+		case tlsExtServerName:
+			names := data.vector(2)
+			for names.ok && len(names.b) > 0 {
+				nameType := names.uint8()
+				name := names.vector(2)
+				if names.ok && nameType == 0 {
+					hello.serverName = string(name.b)
+				}
+			}
+		case tlsExtALPN:
+			protocols := data.vector(2)
+			for protocols.ok && len(protocols.b) > 0 {
+				if proto := protocols.vector(1); protocols.ok {
+					hello.alpn = append(hello.alpn, string(proto.b))
+				}
+			}
+		case tlsExtSupportedVersions:
+			versions := data.vector(1)
+			for versions.ok && len(versions.b) > 0 {
+				// GREASE and other unknown versions are skipped
+				if v := uint16(versions.uint16()); versions.ok && tlsVersions[v] != "" && v > hello.version {
+					hello.version = v
+				}
+			}
+		}
+	})
+	return hello, true
+}
+
+// tlsServerHello is a part of ServerHello visible without decryption
+type tlsServerHello struct {
+	version     uint16
+	cipherSuite uint16
+	// alpn is negotiated protocol, it's encrypted in TLS 1.3
+	alpn string
+}
+
+func parseTLSServerHello(body []byte) (*tlsServerHello, bool) {
+	p := newTLSParser(body)
+	hello := &tlsServerHello{version: uint16(p.uint16())}
+	p.bytes(32) // random
+	p.vector(1) // session id
+	hello.cipherSuite = uint16(p.uint16())
+	p.uint8() // compression method
+	if !p.ok {
+		return nil, false
+	}
+	p.extensions(func(typ int, data *tlsParser) {
+		switch typ {
+		case tlsExtSupportedVersions:
+			if v := data.uint16(); data.ok {
+				hello.version = uint16(v)
+			}
+		case tlsExtALPN:
+			protocols := data.vector(2)
+			if proto := protocols.vector(1); protocols.ok {
+				hello.alpn = string(proto.b)
+			}
+		}
+	})
+	return hello, true
+}
+
+// readTLSClientHello reads first client bytes into buf until ClientHello is complete.
+// hello is nil in case stream doesn't start with ClientHello, read bytes are returned anyway to be forwarded.
+func readTLSClientHello(r io.Reader, buf []byte) (n int, hello *tlsClientHello, err error) {
+	for {
+		var m int
+		m, err = r.Read(buf[n:])
+		n += m
+		if err != nil || n == 0 {
+			return n, nil, err
+		}
+		typ, body, result := tlsHandshakeMessage(buf[:n])
+		switch result {
+		case DetectNoMatch:
+			return n, nil, nil
+		case DetectMatch:
+			if typ != tlsHandshakeClientHello {
+				return n, nil, nil
+			}
+			hello, _ := parseTLSClientHello(body)
+			return n, hello, nil
+		}
+		if n == len(buf) {
+			return n, nil, nil
+		}
+	}
+}
+
+// tlsRecordWatcher follows record boundaries of one direction of TLS connection without buffering records,
+// only payload of first handshake record can be kept to read ServerHello
+type tlsRecordWatcher struct {
+	// keepHandshake enables keeping of first handshake record
+	keepHandshake bool
+	header        [tlsRecordHeaderLen]byte
+	headerLen     int
+	// remaining is a number of payload bytes of current record which aren't consumed yet
+	remaining int
+	typ       byte
+	// record keeps payload of first handshake record
+	record []byte
+	keep   bool
+	// onRecord is called when record is complete, payload is set only for kept record.
+	// It returns true when watching can be stopped.
+	onRecord func(typ byte, payload []byte) bool
+	done     bool
+}
+
+// write consumes forwarded bytes, it returns true when watching is finished
+func (w *tlsRecordWatcher) write(b []byte) bool {
+	for len(b) > 0 && !w.done {
+		if w.headerLen < tlsRecordHeaderLen {
+			n := copy(w.header[w.headerLen:], b)
+			w.headerLen += n
+			b = b[n:]
+			if w.headerLen < tlsRecordHeaderLen {
+				break
+			}
+			w.typ = w.header[0]
+			w.remaining = int(binary.BigEndian.Uint16(w.header[3:5]))
+			if w.header[1] != 0x03 || w.remaining > tlsMaxRecordLen {
+				// not a TLS stream, there is nothing to watch
+				w.done = true
+				break
+			}
+			w.keep = w.keepHandshake && w.typ == tlsRecordHandshake && w.record == nil
+			if w.keep {
+				w.record = make([]byte, 0, w.remaining)
+			}
+		}
+		n := len(b)
+		if n > w.remaining {
+			n = w.remaining
+		}
+		if w.keep {
+			w.record = append(w.record, b[:n]...)
+		}
+		w.remaining -= n
+		b = b[n:]
+		if w.remaining == 0 {
+			var payload []byte
+			if w.keep {
+				payload = w.record
+			}
+			w.done = w.onRecord(w.typ, payload)
+			w.headerLen = 0
+		}
+	}
+	return w.done
+}
+
+// tlsSession is outbound TLS connection inspected without decryption, it's traced with connection-level span
+type tlsSession struct {
+	mu          sync.Mutex
+	span        opentracing.Span
+	metrics     *metrics.Metrics
+	clientHello *tlsClientHello
+	serverHello *tlsServerHello
+	startTime   time.Time
+	// handshakeDuration is time from ClientHello to encrypted Finished of client
+	handshakeDuration time.Duration
+	// clientChangeCipherSpec is set when client switches to encrypted records
+	clientChangeCipherSpec bool
+	alert                  bool
+	client                 tlsStream
+	server                 tlsStream
+	once                   sync.Once
+}
+
+// tlsStream counts bytes of one direction of session, its records are watched until watching is finished
+type tlsStream struct {
+	session *tlsSession
+	bytes   int64
+	watcher tlsRecordWatcher
+}
+
+// watch consumes forwarded bytes, it returns true when watching is finished
+func (s *tlsStream) watch(b []byte) bool {
+	s.session.mu.Lock()
+	defer s.session.mu.Unlock()
+	s.bytes += int64(len(b))
+	return s.watcher.write(b)
+}
+
+// add counts bytes forwarded without watching
+func (s *tlsStream) add(n int64) {
+	s.session.mu.Lock()
+	s.bytes += n
+	s.session.mu.Unlock()
+}
+
+func newTLSSession(
+	tracer opentracing.Tracer,
+	m *metrics.Metrics,
+	hello *tlsClientHello,
+	originalDst string) *tlsSession {
+	operation := "tls " + originalDst
+	if hello.serverName != "" {
+		operation = "tls " + hello.serverName
+	}
+	s := &tlsSession{
+		span:        tracer.StartSpan(operation),
+		metrics:     m,
+		clientHello: hello,
+		startTime:   time.Now(),
+	}
+	s.span.SetTag("span.kind", "client")
+	s.span.SetTag("peer.address", originalDst)
+	if hello.serverName != "" {
+		s.span.SetTag("tls.sni", hello.serverName)
+	}
+	if len(hello.alpn) > 0 {
+		s.span.SetTag("tls.alpn", strings.Join(hello.alpn, ","))
+	}
+	s.span.SetTag("tls.client_version", tlsVersionName(hello.version))
+	// TLS 1.2 client sends encrypted Finished in handshake record following ChangeCipherSpec,
+	// TLS 1.3 one is sent in application data record
+	s.client.session = s
+	s.server.session = s
+	s.client.watcher.onRecord = func(typ byte, _ []byte) bool {
+		switch typ {
+		case tlsRecordChangeCipherSpec:
+			s.clientChangeCipherSpec = true
+			return false
+		case tlsRecordHandshake:
+			if !s.clientChangeCipherSpec {
+				return false
+			}
+		case tlsRecordApplicationData:
+		default:
+			return false
+		}
+		s.handshakeDuration = time.Since(s.startTime)
+		return true
+	}
+	s.server.watcher.keepHandshake = true
+	s.server.watcher.onRecord = func(typ byte, payload []byte) bool {
+		switch typ {
+		case tlsRecordAlert:
+			s.alert = true
+			return true
+		case tlsRecordHandshake:
+			if len(payload) >= tlsHandshakeHeaderLen && payload[0] == tlsHandshakeServerHello {
+				if hello, ok := parseTLSServerHello(payload[tlsHandshakeHeaderLen:]); ok {
+					s.serverHello = hello
+				}
+			}
+			return true
+		}
+		return false
+	}
+	return s
+}
+
+// finish finishes session span once, tag adds tags of abnormal termination
+func (s *tlsSession) finish(tag func(span opentracing.Span)) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		c := metrics.TLSConnection{
+			ServerName:        s.clientHello.serverName,
+			HandshakeDuration: s.handshakeDuration,
+			SentBytes:         s.client.bytes,
+			ReceivedBytes:     s.server.bytes,
+		}
+		s.span.SetTag("tls.client_bytes", s.client.bytes)
+		s.span.SetTag("tls.server_bytes", s.server.bytes)
+		if s.serverHello != nil {
+			c.Version = tlsVersionName(s.serverHello.version)
+			s.span.SetTag("tls.version", c.Version)
+			s.span.SetTag("tls.cipher_suite", tls.CipherSuiteName(s.serverHello.cipherSuite))
+			if s.serverHello.alpn != "" {
+				s.span.SetTag("tls.negotiated_alpn", s.serverHello.alpn)
+			}
+		}
+		if s.handshakeDuration > 0 {
+			s.span.SetTag("tls.handshake_ms", s.handshakeDuration.Milliseconds())
+		} else {
+			// connection is closed before client finished handshake
+			s.span.SetTag("error", true)
+			s.span.SetTag("tls.handshake_failed", true)
+		}
+		if s.alert {
+			s.span.SetTag("tls.server_alert", true)
+		}
+		s.mu.Unlock()
+		s.metrics.ObserveTLSConnection(c)
+		if tag != nil {
+			tag(s.span)
+		}
+		s.span.Finish()
+	})
+}
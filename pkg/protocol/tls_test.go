@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+)
+
+// testCertificate returns self-signed server certificate
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "api.example.com"},
+		DNSNames:     []string{"api.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testClientConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         "api.example.com",
+		NextProtos:         []string{"h2", "http/1.1"},
+		InsecureSkipVerify: true,
+	}
+}
+
+// captureClientHello returns first bytes written by TLS client
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(harnessTimeout))
+	buf := make([]byte, 0xffff)
+	n, hello, err := readTLSClientHello(server, buf)
+	if err != nil || hello == nil {
+		t.Fatalf("ClientHello expected, got %v after %d bytes", err, n)
+	}
+	return buf[:n]
+}
+
+func TestParseTLSClientHello(t *testing.T) {
+	cases := []struct {
+		maxVersion uint16
+		expected   uint16
+	}{
+		{tls.VersionTLS12, tls.VersionTLS12},
+		{tls.VersionTLS13, tls.VersionTLS13},
+	}
+	for _, c := range cases {
+		cfg := testClientConfig()
+		cfg.MaxVersion = c.maxVersion
+		b := captureClientHello(t, cfg)
+		typ, body, result := tlsHandshakeMessage(b)
+		if result != DetectMatch || typ != tlsHandshakeClientHello {
+			t.Fatalf("unexpected handshake message %d %v", typ, result)
+		}
+		hello, ok := parseTLSClientHello(body)
+		if !ok {
+			t.Fatal("ClientHello isn't parsed")
+		}
+		if hello.serverName != "api.example.com" {
+			t.Errorf("unexpected server name %q", hello.serverName)
+		}
+		if len(hello.alpn) != 2 || hello.alpn[0] != "h2" || hello.alpn[1] != "http/1.1" {
+			t.Errorf("unexpected ALPN %v", hello.alpn)
+		}
+		if hello.version != c.expected {
+			t.Errorf("expected version %s, got %s", tlsVersionName(c.expected), tlsVersionName(hello.version))
+		}
+
+		// ClientHello is read until it is complete
+		if _, _, result := tlsHandshakeMessage(b[:len(b)-1]); result != DetectNeedMore {
+			t.Errorf("expected incomplete ClientHello to need more bytes, got %v", result)
+		}
+	}
+
+	for _, b := range [][]byte{[]byte("GET / HTTP/1.1\r\n"), {0x16, 0x02, 0x00, 0x00, 0x10}} {
+		if _, _, result := tlsHandshakeMessage(b); result != DetectNoMatch {
+			t.Errorf("%q: expected no match, got %v", b, result)
+		}
+	}
+}
+
+func TestTLSRecordWatcherServerHello(t *testing.T) {
+	cert := testCertificate(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		tlsServer := tls.Server(server, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"http/1.1"},
+			MaxVersion:   tls.VersionTLS12,
+		})
+		tlsServer.Handshake()
+		server.Close()
+	}()
+	clientHello := captureClientHello(t, testClientConfig())
+	go client.Write(clientHello)
+	client.SetReadDeadline(time.Now().Add(harnessTimeout))
+
+	var hello *tlsServerHello
+	w := tlsRecordWatcher{
+		keepHandshake: true,
+		onRecord: func(typ byte, payload []byte) bool {
+			if typ == tlsRecordHandshake && payload[0] == tlsHandshakeServerHello {
+				hello, _ = parseTLSServerHello(payload[tlsHandshakeHeaderLen:])
+			}
+			return true
+		},
+	}
+	// records are split between writes
+	buf := make([]byte, 7)
+	for !w.done {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("ServerHello expected: %s", err)
+		}
+		w.write(buf[:n])
+	}
+	if hello == nil {
+		t.Fatal("ServerHello isn't parsed")
+	}
+	if hello.version != tls.VersionTLS12 || hello.alpn != "http/1.1" {
+		t.Errorf("unexpected ServerHello %s %q", tlsVersionName(hello.version), hello.alpn)
+	}
+	if tls.CipherSuiteName(hello.cipherSuite) == "" {
+		t.Errorf("unexpected cipher suite %x", hello.cipherSuite)
+	}
+}
+
+func newTCPHarness(t *testing.T, isInbound bool) *handlerHarness {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Default()
+	c.Netra.TLSInspectionEnabled = true
+	cfg := config.NewHolder(c)
+	m, err := metrics.New(nil, nil, cfg.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := newRecordingTracer()
+	netRequest := NewNetTCPRequest(logger, isInbound, tracer, cfg, m)
+	return newHarness(t, NewTCPHandler(logger), netRequest, isInbound, tracer)
+}
+
+func TestTCPHandlerTLSInspection(t *testing.T) {
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		h := newTCPHarness(t, false)
+		cert := testCertificate(t)
+		serverDone := make(chan struct{})
+		go func() {
+			defer close(serverDone)
+			tlsServer := tls.Server(h.upstream, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"h2"},
+			})
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(tlsServer, buf); err != nil {
+				return
+			}
+			tlsServer.Write([]byte("pong"))
+		}()
+		cfg := testClientConfig()
+		cfg.MaxVersion = version
+		tlsClient := tls.Client(h.client, cfg)
+		if _, err := tlsClient.Write([]byte("ping")); err != nil {
+			t.Fatalf("client write: %s", err)
+		}
+		if b, err := ioutil.ReadAll(io.LimitReader(tlsClient, 4)); err != nil || string(b) != "pong" {
+			t.Fatalf("client expected pong, got %q %v", b, err)
+		}
+		<-serverDone
+		h.Close(t)
+
+		spans := h.tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("expected 1 span, got %d", len(spans))
+		}
+		span := spans[0]
+		if span.operationName != "tls api.example.com" {
+			t.Errorf("unexpected operation name %s", span.operationName)
+		}
+		for key, expected := range map[string]interface{}{
+			"span.kind":          "client",
+			"peer.address":       "127.0.0.1:80",
+			"tls.sni":            "api.example.com",
+			"tls.alpn":           "h2,http/1.1",
+			"tls.client_version": tlsVersionName(version),
+			"tls.version":        tlsVersionName(version),
+			"error":              nil,
+		} {
+			if actual := span.Tag(key); actual != expected {
+				t.Errorf("%s tag %s: expected %v, got %v", tlsVersionName(version), key, expected, actual)
+			}
+		}
+		if _, ok := span.Tag("tls.handshake_ms").(int64); !ok {
+			t.Errorf("%s: handshake duration expected", tlsVersionName(version))
+		}
+		if version == tls.VersionTLS12 && span.Tag("tls.negotiated_alpn") != "h2" {
+			t.Errorf("negotiated ALPN expected, got %v", span.Tag("tls.negotiated_alpn"))
+		}
+		if span.Tag("tls.client_bytes").(int64) == 0 || span.Tag("tls.server_bytes").(int64) == 0 {
+			t.Error("bytes expected")
+		}
+	}
+}
+
+func TestTCPHandlerWithoutTLS(t *testing.T) {
+	for _, isInbound := range []bool{false, true} {
+		h := newTCPHarness(t, isInbound)
+		go io.WriteString(h.client, "plain")
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(h.upstream, buf); err != nil || string(buf) != "plain" {
+			t.Fatalf("upstream expected bytes as is, got %q %v", buf, err)
+		}
+		go io.WriteString(h.upstream, "reply")
+		if _, err := io.ReadFull(h.client, buf); err != nil || string(buf) != "reply" {
+			t.Fatalf("client expected bytes as is, got %q %v", buf, err)
+		}
+		h.Close(t)
+		if spans := h.tracer.FinishedSpans(); len(spans) != 0 {
+			t.Errorf("expected no spans, got %d", len(spans))
+		}
+	}
+}
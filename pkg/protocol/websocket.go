@@ -0,0 +1,275 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	nhttp "github.com/Lookyan/netramesh/pkg/http"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+
+	// wsMaxControlPayload is a max payload length of control frames
+	wsMaxControlPayload = 125
+	// wsCloseNoStatus is reported for close frames without status code
+	wsCloseNoStatus = 1005
+)
+
+// isUpgrade checks whether message asks to switch connection to other protocol,
+// Connection header is a list of tokens, e.g. "keep-alive, Upgrade"
+func isUpgrade(header nhttp.Header) bool {
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsFrameParser counts WebSocket frames and messages of one direction without buffering them,
+// only payload of close frame is kept to get close code and reason
+type wsFrameParser struct {
+	// header is a frame header: 2 bytes, extended payload length and masking key
+	header    [14]byte
+	headerLen int
+	// remaining is a number of payload bytes of current frame which aren't consumed yet
+	remaining uint64
+	opcode    byte
+	fin       bool
+	masked    bool
+	// offset is a number of consumed payload bytes of current frame, it's used to unmask close payload
+	offset  uint64
+	control []byte
+
+	frames      int
+	messages    int
+	closeCode   int
+	closeReason string
+	closedAt    time.Time
+}
+
+// headerSize returns size of current frame header, it's known once first two bytes are read
+func (p *wsFrameParser) headerSize() int {
+	if p.headerLen < 2 {
+		return 2
+	}
+	size := 2
+	switch p.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if p.header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (p *wsFrameParser) write(b []byte) {
+	for len(b) > 0 {
+		if p.headerLen == 0 && p.remaining > 0 {
+			n := uint64(len(b))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			if p.opcode == wsOpClose {
+				p.appendControl(b[:n])
+			}
+			p.offset += n
+			p.remaining -= n
+			b = b[n:]
+			if p.remaining == 0 {
+				p.endFrame()
+			}
+			continue
+		}
+		n := copy(p.header[p.headerLen:p.headerSize()], b)
+		p.headerLen += n
+		b = b[n:]
+		if p.headerLen == p.headerSize() {
+			p.startFrame()
+		}
+	}
+}
+
+func (p *wsFrameParser) startFrame() {
+	p.fin = p.header[0]&0x80 != 0
+	p.opcode = p.header[0] & 0x0f
+	p.masked = p.header[1]&0x80 != 0
+	maskOffset := 2
+	switch length := p.header[1] & 0x7f; length {
+	case 126:
+		p.remaining = uint64(binary.BigEndian.Uint16(p.header[2:]))
+		maskOffset += 2
+	case 127:
+		p.remaining = binary.BigEndian.Uint64(p.header[2:])
+		maskOffset += 8
+	default:
+		p.remaining = uint64(length)
+	}
+	if p.masked {
+		// masking key is kept at the end of header
+		copy(p.header[10:], p.header[maskOffset:maskOffset+4])
+	}
+	p.headerLen = 0
+	p.offset = 0
+	p.control = p.control[:0]
+	p.frames++
+	if p.remaining == 0 {
+		p.endFrame()
+	}
+}
+
+func (p *wsFrameParser) appendControl(b []byte) {
+	for i, c := range b {
+		if len(p.control) >= wsMaxControlPayload {
+			return
+		}
+		if p.masked {
+			c ^= p.header[10+(p.offset+uint64(i))%4]
+		}
+		p.control = append(p.control, c)
+	}
+}
+
+func (p *wsFrameParser) endFrame() {
+	switch {
+	case p.opcode == wsOpClose:
+		if !p.closedAt.IsZero() {
+			return
+		}
+		p.closedAt = time.Now()
+		p.closeCode = wsCloseNoStatus
+		if len(p.control) >= 2 {
+			p.closeCode = int(binary.BigEndian.Uint16(p.control))
+			p.closeReason = string(p.control[2:])
+		}
+	case p.opcode <= wsOpBinary && p.fin:
+		// data message ends with FIN frame, fragmented messages are continued by continuation frames
+		p.messages++
+	}
+}
+
+// upgradeSession is a connection switched to other protocol by 101 response.
+// It's traced with span started when handshake is finished and finished when both directions are closed.
+type upgradeSession struct {
+	span     opentracing.Span
+	protocol string
+	mu       sync.Mutex
+	client   sessionStream
+	server   sessionStream
+	// open is a number of directions which aren't closed yet
+	open int32
+	once sync.Once
+}
+
+// sessionStream counts bytes of one direction of session, WebSocket frames are parsed in case of websocket protocol
+type sessionStream struct {
+	session *upgradeSession
+	bytes   int64
+	ws      *wsFrameParser
+}
+
+func (s *sessionStream) Write(b []byte) (int, error) {
+	s.session.mu.Lock()
+	s.bytes += int64(len(b))
+	if s.ws != nil {
+		s.ws.write(b)
+	}
+	s.session.mu.Unlock()
+	return len(b), nil
+}
+
+func newUpgradeSession(span opentracing.Span, protocol string) *upgradeSession {
+	s := &upgradeSession{
+		span:     span,
+		protocol: protocol,
+		open:     2,
+	}
+	s.client.session = s
+	s.server.session = s
+	if protocol == "websocket" {
+		s.client.ws = &wsFrameParser{}
+		s.server.ws = &wsFrameParser{}
+	}
+	span.SetTag("upgrade.protocol", protocol)
+	return s
+}
+
+// done is called when direction is closed, session is finished when both of them are closed
+func (s *upgradeSession) done() {
+	if atomic.AddInt32(&s.open, -1) == 0 {
+		s.finish(nil)
+	}
+}
+
+// finish finishes session span once, tag adds tags of abnormal termination
+func (s *upgradeSession) finish(tag func(span opentracing.Span)) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.span.SetTag("session.client_bytes", s.client.bytes)
+		s.span.SetTag("session.server_bytes", s.server.bytes)
+		if s.client.ws != nil {
+			s.fillWebSocketTags()
+		}
+		s.mu.Unlock()
+		if tag != nil {
+			tag(s.span)
+		}
+		s.span.Finish()
+	})
+}
+
+func (s *upgradeSession) fillWebSocketTags() {
+	client, server := s.client.ws, s.server.ws
+	s.span.SetTag("websocket.client_frames", client.frames)
+	s.span.SetTag("websocket.client_messages", client.messages)
+	s.span.SetTag("websocket.server_frames", server.frames)
+	s.span.SetTag("websocket.server_messages", server.messages)
+	// close code is taken from side which started closing handshake
+	initiator, closing := "client", client
+	if client.closedAt.IsZero() || (!server.closedAt.IsZero() && server.closedAt.Before(client.closedAt)) {
+		initiator, closing = "server", server
+	}
+	if closing.closedAt.IsZero() {
+		return
+	}
+	s.span.SetTag("websocket.close_initiator", initiator)
+	s.span.SetTag("websocket.close_code", closing.closeCode)
+	if closing.closeReason != "" {
+		s.span.SetTag("websocket.close_reason", closing.closeReason)
+	}
+}
+
+// forwardSession forwards direction of upgraded connection passing bytes through session stream,
+// bytes buffered by reader are forwarded first. Session stream can be nil for untraced sessions.
+func forwardSession(dst io.Writer, reader *bufio.Reader, src io.Reader, stream io.Writer) (int64, error) {
+	if stream == nil {
+		return forwardBuffered(dst, reader, src)
+	}
+	var written int64
+	if n := reader.Buffered(); n > 0 {
+		buffered, _ := reader.Peek(n)
+		m, err := io.MultiWriter(dst, stream).Write(buffered)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		reader.Discard(n)
+	}
+	n, err := copyBuffer(dst, io.TeeReader(src, stream))
+	return written + n, err
+}
@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// wsFrame builds WebSocket frame, client frames are masked
+func wsFrame(fin bool, opcode byte, payload []byte, masked bool) []byte {
+	b := []byte{opcode, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		b[1] = 126
+		b = append(b, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		b[1] = 127
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(payload)))
+		b = append(b, length[:]...)
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func wsClosePayload(code uint16, reason string) []byte {
+	return append([]byte{byte(code >> 8), byte(code)}, reason...)
+}
+
+func TestWSFrameParser(t *testing.T) {
+	var stream []byte
+	stream = append(stream, wsFrame(true, 0x1, []byte("hello"), true)...)
+	// fragmented message
+	stream = append(stream, wsFrame(false, 0x2, bytes.Repeat([]byte("a"), 300), true)...)
+	stream = append(stream, wsFrame(false, 0x0, bytes.Repeat([]byte("b"), 70000), true)...)
+	// control frame between fragments
+	stream = append(stream, wsFrame(true, 0x9, nil, true)...)
+	stream = append(stream, wsFrame(true, 0x0, []byte("c"), true)...)
+	stream = append(stream, wsFrame(true, 0x8, wsClosePayload(4001, "going away"), true)...)
+
+	// frames and their headers are split between writes
+	for _, chunk := range []int{1, 3, 7, 1000, len(stream)} {
+		p := &wsFrameParser{}
+		for b := stream; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+			p.write(b[:n])
+			b = b[n:]
+		}
+		if p.frames != 6 || p.messages != 2 {
+			t.Errorf("chunk %d: expected 6 frames and 2 messages, got %d and %d", chunk, p.frames, p.messages)
+		}
+		if p.closeCode != 4001 || p.closeReason != "going away" {
+			t.Errorf("chunk %d: unexpected close %d %q", chunk, p.closeCode, p.closeReason)
+		}
+	}
+}
+
+func TestHTTPHandlerWebSocket(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+
+	go io.WriteString(h.client, "GET /chat HTTP/1.1\r\nHost: chat\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Upgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	upstreamReq, err := http.ReadRequest(upstreamReader)
+	if err != nil {
+		t.Fatalf("upstream read request: %s", err)
+	}
+	if upstreamReq.Header.Get("Uber-Trace-Id") == "" || upstreamReq.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("unexpected upstream handshake headers %v", upstreamReq.Header)
+	}
+	go io.WriteString(h.upstream, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+	resp, err := http.ReadResponse(clientReader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("client expected 101 response: %v", err)
+	}
+
+	clientFrames := append(wsFrame(true, 0x1, []byte("hello"), true), wsFrame(true, 0x8, wsClosePayload(1000, "bye"), true)...)
+	go h.client.Write(clientFrames)
+	received := make([]byte, len(clientFrames))
+	if _, err := io.ReadFull(upstreamReader, received); err != nil || !bytes.Equal(received, clientFrames) {
+		t.Fatalf("upstream expected client frames as is: %v", err)
+	}
+	serverFrames := append(wsFrame(true, 0x1, []byte("hi"), false), wsFrame(true, 0x8, wsClosePayload(1000, ""), false)...)
+	go h.upstream.Write(serverFrames)
+	received = make([]byte, len(serverFrames))
+	if _, err := io.ReadFull(clientReader, received); err != nil || !bytes.Equal(received, serverFrames) {
+		t.Fatalf("client expected server frames as is: %v", err)
+	}
+	h.Close(t)
+
+	spans := h.tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected handshake and session spans, got %d", len(spans))
+	}
+	handshake, session := spans[0], spans[1]
+	if handshake.operationName != "/chat" || handshake.Tag("http.status_code") != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected handshake span %s %v", handshake.operationName, handshake.Tag("http.status_code"))
+	}
+	if session.operationName != "websocket /chat" {
+		t.Errorf("unexpected session operation name %s", session.operationName)
+	}
+	for key, expected := range map[string]interface{}{
+		"upgrade.protocol":          "websocket",
+		"session.client_bytes":      int64(len(clientFrames)),
+		"session.server_bytes":      int64(len(serverFrames)),
+		"websocket.client_frames":   2,
+		"websocket.client_messages": 1,
+		"websocket.server_frames":   2,
+		"websocket.server_messages": 1,
+		"websocket.close_initiator": "client",
+		"websocket.close_code":      1000,
+		"websocket.close_reason":    "bye",
+	} {
+		if actual := session.Tag(key); actual != expected {
+			t.Errorf("tag %s: expected %v (%T), got %v (%T)", key, expected, expected, actual, actual)
+		}
+	}
+}
+
+func TestHTTPHandlerUpgradeRejected(t *testing.T) {
+	h := newHTTPHarness(t, true)
+	clientReader := bufio.NewReader(h.client)
+	upstreamReader := bufio.NewReader(h.upstream)
+
+	go io.WriteString(h.client, "GET /chat HTTP/1.1\r\nHost: chat\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	serveUpstream(t, h, upstreamReader, http.StatusBadRequest, "no")
+	readResponse(t, clientReader)
+	// connection keeps on speaking HTTP
+	go io.WriteString(h.client, "GET /next HTTP/1.1\r\nHost: chat\r\n\r\n")
+	serveUpstream(t, h, upstreamReader, http.StatusOK, "ok")
+	if _, body := readResponse(t, clientReader); body != "ok" {
+		t.Errorf("unexpected body %q", body)
+	}
+	h.Close(t)
+
+	if spans := h.tracer.FinishedSpans(); len(spans) != 2 {
+		t.Errorf("expected 2 spans, got %d", len(spans))
+	}
+}
@@ -0,0 +1,283 @@
+// Package proxy allows to embed netra sidecar into other binaries.
+// Each Proxy keeps its own configuration, protocol handlers and connection tracking,
+// so several differently configured instances can run in one process.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/accesslog"
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/drain"
+	"github.com/Lookyan/netramesh/pkg/estabcache"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/mtls"
+	"github.com/Lookyan/netramesh/pkg/protocol"
+	"github.com/Lookyan/netramesh/pkg/transport"
+)
+
+// drainProgressInterval is an interval of draining progress logging
+const drainProgressInterval = time.Second
+
+// Options are used to construct Proxy. Only Listeners and Logger are required.
+type Options struct {
+	// Listeners accept intercepted connections, they are closed by Shutdown
+	Listeners []*net.TCPListener
+	// Config is proxy configuration, config.Default() is used if nil
+	Config *config.Config
+	Logger *log.Logger
+	// Tracer is used to report HTTP spans, opentracing.GlobalTracer() is used if nil
+	Tracer opentracing.Tracer
+	// StatsdMetrics is metrics sink, muted client is used if nil
+	StatsdMetrics *statsd.Client
+	// Metrics are Prometheus metrics of proxied traffic, unregistered metrics are used if nil
+	Metrics *metrics.Metrics
+	// AccessLog writes entry per completed HTTP request, access log is disabled if nil
+	AccessLog *accesslog.Logger
+	// TracingContextMapping keeps inbound span contexts by request id
+	TracingContextMapping *cache.Cache
+	// RoutingInfoContextMapping keeps routing header values by request id
+	RoutingInfoContextMapping *cache.Cache
+	EstablishedCache          *estabcache.EstablishedCache
+	// MTLSStore keeps certificates of mutual TLS between sidecars. In case it's nil and mTLS is enabled
+	// it's loaded from configured files which are watched until Shutdown.
+	MTLSStore *mtls.Store
+}
+
+// Proxy is a single netra sidecar instance
+type Proxy struct {
+	listeners        []*net.TCPListener
+	config           *config.Holder
+	logger           *log.Logger
+	statsdMetrics    *statsd.Client
+	metrics          *metrics.Metrics
+	establishedCache *estabcache.EstablishedCache
+	factory          *protocol.Factory
+	tracker          *drain.Tracker
+	mtlsStore        *mtls.Store
+	// stopWatch stops watching of certificate files
+	stopWatch chan struct{}
+
+	// serving is set to 1 when Serve is called
+	serving   int32
+	closeOnce sync.Once
+	reloadMu  sync.Mutex
+}
+
+// New creates proxy from options, missing optional dependencies are filled with defaults
+func New(opts Options) (*Proxy, error) {
+	if len(opts.Listeners) == 0 {
+		return nil, errors.New("proxy: at least one listener is required")
+	}
+	if opts.Logger == nil {
+		return nil, errors.New("proxy: logger is required")
+	}
+	if opts.Config == nil {
+		opts.Config = config.Default()
+	}
+	if opts.Tracer == nil {
+		opts.Tracer = opentracing.GlobalTracer()
+	}
+	if opts.StatsdMetrics == nil {
+		statsdMetrics, err := statsd.New(statsd.Mute(true))
+		if err != nil {
+			return nil, err
+		}
+		opts.StatsdMetrics = statsdMetrics
+	}
+	if opts.Metrics == nil {
+		m, err := metrics.New(nil, opts.StatsdMetrics, opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		opts.Metrics = m
+	}
+	if opts.TracingContextMapping == nil {
+		opts.TracingContextMapping = cache.New(
+			opts.Config.Netra.TracingContextExpiration,
+			opts.Config.Netra.TracingContextCleanupInterval,
+		)
+	}
+	if opts.RoutingInfoContextMapping == nil {
+		opts.RoutingInfoContextMapping = cache.New(
+			opts.Config.Netra.RoutingContextExpiration,
+			opts.Config.Netra.RoutingContextCleanupInterval,
+		)
+	}
+	if opts.EstablishedCache == nil {
+		opts.EstablishedCache = estabcache.NewEstablishedCache()
+	}
+
+	p := &Proxy{
+		listeners:        opts.Listeners,
+		config:           config.NewHolder(opts.Config),
+		logger:           opts.Logger,
+		statsdMetrics:    opts.StatsdMetrics,
+		metrics:          opts.Metrics,
+		establishedCache: opts.EstablishedCache,
+		tracker:          drain.NewTracker(),
+		mtlsStore:        opts.MTLSStore,
+		stopWatch:        make(chan struct{}),
+	}
+	if p.mtlsStore == nil && opts.Config.Netra.MTLSEnabled {
+		netraConfig := opts.Config.Netra
+		store, err := mtls.NewStore(netraConfig.MTLSCertFile, netraConfig.MTLSKeyFile, netraConfig.MTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: can't load mTLS certificates: %s", err.Error())
+		}
+		p.mtlsStore = store
+		go store.Watch(opts.Logger.Named("mtls"), netraConfig.MTLSReloadInterval, p.stopWatch)
+	}
+	factory, err := protocol.NewFactory(protocol.Dependencies{
+		Logger:                    opts.Logger,
+		StatsdMetrics:             opts.StatsdMetrics,
+		Metrics:                   opts.Metrics,
+		AccessLog:                 opts.AccessLog,
+		Tracer:                    opts.Tracer,
+		Config:                    p.config,
+		Drain:                     p.tracker,
+		TracingContextMapping:     opts.TracingContextMapping,
+		RoutingInfoContextMapping: opts.RoutingInfoContextMapping,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.factory = factory
+	return p, nil
+}
+
+// Config returns current configuration snapshot of proxy, it must not be modified
+func (p *Proxy) Config() *config.Config {
+	return p.config.Get()
+}
+
+// Reload atomically replaces proxy configuration. Connections accepted after it and
+// new HTTP requests of existing connections use the new configuration, in-flight requests
+// keep the snapshot they were started with. Configuration is rejected in case it's invalid
+// or changes fields which require restart (e.g. listener port).
+func (p *Proxy) Reload(cfg *config.Config) ([]config.Change, error) {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+
+	changes, err := p.checkReload(cfg)
+	p.metrics.ConfigReload(err)
+	if err != nil {
+		return nil, err
+	}
+	p.config.Set(cfg)
+	p.metrics.Configure(cfg)
+	p.factory.ResetSniffing()
+	p.factory.ResetTLSOrigination()
+	if len(changes) == 0 {
+		p.logger.Info("Config reloaded, nothing is changed")
+	}
+	for _, c := range changes {
+		p.logger.Infof("Config reloaded, %s", c)
+	}
+	return changes, nil
+}
+
+func (p *Proxy) checkReload(cfg *config.Config) ([]config.Change, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := protocol.ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return config.CheckReload(p.config.Get(), cfg)
+}
+
+// ActiveConnections returns number of connections being proxied
+func (p *Proxy) ActiveConnections() int64 {
+	return p.tracker.Active()
+}
+
+// Ready returns error in case proxy doesn't accept connections: Serve isn't called yet or proxy is draining
+func (p *Proxy) Ready() error {
+	if p.tracker.Draining() {
+		return errors.New("draining")
+	}
+	if atomic.LoadInt32(&p.serving) == 0 {
+		return errors.New("listeners aren't served yet")
+	}
+	return nil
+}
+
+// Serve accepts connections on all listeners and blocks until Shutdown is called
+func (p *Proxy) Serve() error {
+	atomic.StoreInt32(&p.serving, 1)
+	wg := sync.WaitGroup{}
+	for _, ln := range p.listeners {
+		wg.Add(1)
+		go func(ln *net.TCPListener) {
+			p.serve(ln)
+			wg.Done()
+		}(ln)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *Proxy) serve(ln *net.TCPListener) {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			if p.tracker.Draining() {
+				return
+			}
+			p.logger.Warning(err.Error())
+			continue
+		}
+		// register connection before spawning handler to avoid race with Shutdown waiting,
+		// connection accepted after draining is started could be missed by Wait and is closed
+		p.tracker.Add()
+		if p.tracker.Draining() {
+			conn.Close()
+			p.tracker.Done()
+			return
+		}
+		go func() {
+			transport.HandleConnection(
+				p.logger.Named("transport"),
+				conn,
+				p.establishedCache,
+				p.config.Get(),
+				p.factory,
+				p.statsdMetrics,
+				p.metrics,
+				p.mtlsStore)
+			p.tracker.Done()
+		}()
+	}
+}
+
+// Shutdown stops accepting new connections and waits for active ones to finish.
+// Keep-alive HTTP connections are closed at the next response boundary.
+// It returns context error in case ctx is done before all connections are finished.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.tracker.Start()
+	p.closeOnce.Do(func() {
+		for _, ln := range p.listeners {
+			ln.Close()
+		}
+		close(p.stopWatch)
+	})
+	drained := p.tracker.Wait(ctx.Done(), drainProgressInterval, func(active int64) {
+		p.logger.Infof("Draining: %d active connections", active)
+	})
+	if !drained {
+		return ctx.Err()
+	}
+	return nil
+}
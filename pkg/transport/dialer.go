@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/estabcache"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/protocol"
+)
+
+// routingDialer opens upstream connections of requests dialed by handler
+// and processes responses of opened connections sequentially.
+// Without keepUpstream new connection is opened for each request (e.g. HTTP routing), otherwise
+// connection is reused by following requests to the same address with the same TLS config.
+type routingDialer struct {
+	logger        *log.Logger
+	statsdMetrics *statsd.Client
+	metrics       *metrics.Metrics
+	conn          net.Conn
+	srcAddr       *net.TCPAddr
+	// proxyHeaderSrc is client address announced to upstream with PROXY protocol v2 header, nil disables header
+	proxyHeaderSrc *net.TCPAddr
+	// entry is connection registry entry, its destination is updated on each dial
+	entry       *estabcache.Entry
+	dialTimeout time.Duration
+	// mtls wraps connections to mesh destinations into mutual TLS, nil disables it
+	mtls          *mtlsOrigination
+	netRequest    protocol.NetRequest
+	netHandler    protocol.NetHandler
+	isInBoundConn bool
+	keepUpstream  bool
+
+	// mu guards upstream, it's the last dialed connection in case keepUpstream is set
+	mu       sync.Mutex
+	upstream *upstreamConn
+
+	callCh chan func()
+	// responses counts scheduled response processing which isn't finished yet
+	responses sync.WaitGroup
+}
+
+func newRoutingDialer(
+	logger *log.Logger,
+	statsdMetrics *statsd.Client,
+	m *metrics.Metrics,
+	conn net.Conn,
+	srcAddr *net.TCPAddr,
+	proxyHeaderSrc *net.TCPAddr,
+	entry *estabcache.Entry,
+	dialTimeout time.Duration,
+	mtls *mtlsOrigination,
+	netRequest protocol.NetRequest,
+	netHandler protocol.NetHandler,
+	isInBoundConn bool,
+	keepUpstream bool,
+) *routingDialer {
+	d := &routingDialer{
+		logger:         logger,
+		statsdMetrics:  statsdMetrics,
+		metrics:        m,
+		conn:           conn,
+		srcAddr:        srcAddr,
+		proxyHeaderSrc: proxyHeaderSrc,
+		entry:          entry,
+		dialTimeout:    dialTimeout,
+		mtls:           mtls,
+		netRequest:     netRequest,
+		netHandler:     netHandler,
+		isInBoundConn:  isInBoundConn,
+		keepUpstream:   keepUpstream,
+		callCh:         make(chan func(), 10),
+	}
+	go func() {
+		for f := range d.callCh {
+			f()
+		}
+	}()
+	return d
+}
+
+// upstreamConn is dialed connection, key identifies address and TLS config it's opened with
+type upstreamConn struct {
+	conn net.Conn
+	key  string
+	// closed is set when response processing of connection is finished
+	closed bool
+}
+
+// Dial connects to addr and schedules response processing of the new connection
+func (d *routingDialer) Dial(addr string) (net.Conn, error) {
+	if conn := d.reuse(addr); conn != nil {
+		return conn, nil
+	}
+	return d.dial(addr, addr, nil)
+}
+
+// DialTLS connects to addr with TLS client config and schedules response processing of the new connection.
+// It's used to originate TLS for plaintext requests, so mutual TLS between sidecars isn't applied.
+func (d *routingDialer) DialTLS(addr string, tlsConfig *tls.Config) (*tls.Conn, error) {
+	// TLS config is the same until origination rule or its files are changed
+	key := fmt.Sprintf("%s tls %p", addr, tlsConfig)
+	if conn := d.reuse(key); conn != nil {
+		return conn.(*tls.Conn), nil
+	}
+	conn, err := d.dial(addr, key, func(tcpConn *net.TCPConn) (net.Conn, error) {
+		tlsConn := tls.Client(tcpConn, tlsConfig)
+		var deadline time.Time
+		if d.dialTimeout > 0 {
+			deadline = time.Now().Add(d.dialTimeout)
+		}
+		if err := tlsConn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+		// handshake error is returned as is, so timeouts are reported as dial timeouts
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*tls.Conn), nil
+}
+
+// reuse returns open upstream connection of key in case upstream is kept between requests
+func (d *routingDialer) reuse(key string) net.Conn {
+	if !d.keepUpstream {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.upstream != nil && d.upstream.key == key && !d.upstream.closed {
+		return d.upstream.conn
+	}
+	return nil
+}
+
+// dial connects to addr, wrap replaces upstream connection in case it's set
+func (d *routingDialer) dial(addr string, key string, wrap func(tcpConn *net.TCPConn) (net.Conn, error)) (net.Conn, error) {
+	tcpDstAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		d.logger.Warningf("Error while resolving tcp addr %s", addr)
+		d.metrics.DialError(d.isInBoundConn, err)
+		return nil, err
+	}
+	tcpConn, err := dialTCP(tcpDstAddr, d.srcAddr, d.dialTimeout)
+	if err != nil {
+		reportDialError(d.logger, d.statsdMetrics, d.metrics, d.conn, addr, d.isInBoundConn, err)
+		return nil, err
+	}
+	if d.proxyHeaderSrc != nil {
+		if err := writeProxyHeaderV2(tcpConn, d.proxyHeaderSrc, tcpDstAddr); err != nil {
+			d.logger.Warningf("Error while sending PROXY protocol header to %s: %s", addr, err.Error())
+			closeConn(d.logger, tcpConn)
+			return nil, err
+		}
+	}
+	var targetConn net.Conn = tcpConn
+	if wrap != nil {
+		targetConn, err = wrap(tcpConn)
+		if err != nil {
+			reportDialError(d.logger, d.statsdMetrics, d.metrics, d.conn, addr, d.isInBoundConn, err)
+			closeConn(d.logger, tcpConn)
+			return nil, err
+		}
+	} else if d.mtls.match(tcpDstAddr) {
+		targetConn, err = d.mtls.wrap(d.logger, d.statsdMetrics, d.metrics, tcpConn, d.netRequest, d.entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.entry.SetDestination(addr)
+
+	upstream := &upstreamConn{conn: targetConn, key: key}
+	if d.keepUpstream {
+		d.mu.Lock()
+		previous := d.upstream
+		d.upstream = upstream
+		d.mu.Unlock()
+		d.release(previous)
+	}
+
+	d.responses.Add(1)
+	d.callCh <- func() {
+		d.netHandler.HandleResponse(targetConn, d.conn, d.netRequest, d.isInBoundConn, !d.keepUpstream)
+		d.mu.Lock()
+		upstream.closed = true
+		d.mu.Unlock()
+		closeConn(d.logger, targetConn)
+		d.responses.Done()
+	}
+	return targetConn, nil
+}
+
+// release closes write side of kept upstream connection which isn't used by following requests,
+// so upstream closes it after responses to already sent requests and their processing is finished
+func (d *routingDialer) release(upstream *upstreamConn) {
+	if upstream == nil {
+		return
+	}
+	if cw, ok := upstream.conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			d.logger.Debug(err.Error())
+		}
+		return
+	}
+	closeConn(d.logger, upstream.conn)
+}
+
+// Close stops accepting new connections and waits until scheduled responses are processed
+func (d *routingDialer) Close() {
+	close(d.callCh)
+	d.mu.Lock()
+	upstream := d.upstream
+	d.mu.Unlock()
+	// kept connection isn't closed by handler in case request side failed
+	d.release(upstream)
+	d.responses.Wait()
+}
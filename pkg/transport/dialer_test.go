@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/estabcache"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/protocol"
+)
+
+func TestRoutingDialerKeepsUpstream(t *testing.T) {
+	var connections int32
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, r.URL.Path)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&connections, 1)
+			}
+		},
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	cfg := config.Default()
+	// requests to other hosts stay plaintext
+	cfg.HTTP.TLSOrigination = []config.TLSOriginationRule{{Host: "api.partner.com", Port: 443}}
+	factory, err := protocol.NewFactory(protocol.Dependencies{
+		Logger:        logger,
+		StatsdMetrics: statsdClient,
+		Config:        config.NewHolder(cfg),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := metrics.New(nil, statsdClient, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := estabcache.NewEstablishedCache().Add(estabcache.Connection{}, func() {}, func() (uint64, uint64) { return 0, 0 })
+
+	client, proxyIn := tcpPair(t)
+	defer client.Close()
+	netRequest := factory.GetNetRequest(protocol.HTTPProto, false)
+	netHandler := factory.GetNetworkHandler(protocol.HTTPProto)
+	dialer := newRoutingDialer(logger, statsdClient, m, proxyIn, nil, nil, entry, time.Second, nil,
+		netRequest, netHandler, false, true)
+	done := make(chan struct{})
+	go func() {
+		TcpCopyRequest(logger, proxyIn, nil, dialer, netRequest, netHandler, false, ln.Addr().String())
+		dialer.Close()
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	for _, path := range []string{"/first", "/second", "/third"} {
+		fmt.Fprintf(client, "GET %s HTTP/1.1\r\nHost: svc.local\r\n\r\n", path)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Errorf("expected %s response, got %q", path, body)
+		}
+	}
+	client.CloseWrite()
+	<-done
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("expected requests to share upstream connection, got %d connections", n)
+	}
+}
@@ -5,41 +5,36 @@ import (
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
+	"unsafe"
 
-	"github.com/patrickmn/go-cache"
 	"gopkg.in/alexcesaro/statsd.v2"
 
-	"github.com/Lookyan/netramesh/internal/config"
+	"github.com/Lookyan/netramesh/pkg/config"
 	"github.com/Lookyan/netramesh/pkg/estabcache"
 	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/mtls"
 	"github.com/Lookyan/netramesh/pkg/protocol"
 )
 
-const SO_ORIGINAL_DST = 80
-
-var addrPool = &sync.Pool{
-	New: func() interface{} {
-		return make([]byte, 0, 20)
-	},
-}
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
 
 func TcpCopyRequest(
 	logger *log.Logger,
-	r *net.TCPConn,
-	w *net.TCPConn,
-	connCh chan *net.TCPConn,
+	r net.Conn,
+	w net.Conn,
+	dialer protocol.Dialer,
 	netRequest protocol.NetRequest,
 	netHandler protocol.NetHandler,
 	isInBoundConn bool,
-	f *os.File,
-	addrCh chan string,
 	originalDst string,
 ) {
-	w = netHandler.HandleRequest(r, w, connCh, addrCh, netRequest, isInBoundConn, originalDst)
-	f.Close()
+	w = netHandler.HandleRequest(r, w, dialer, netRequest, isInBoundConn, originalDst)
 	closeConn(logger, r)
 	if w != nil {
 		closeConn(logger, w)
@@ -48,15 +43,13 @@ func TcpCopyRequest(
 
 func TcpCopyResponse(
 	logger *log.Logger,
-	r *net.TCPConn,
-	w *net.TCPConn,
+	r net.Conn,
+	w net.Conn,
 	netRequest protocol.NetRequest,
 	netHandler protocol.NetHandler,
 	isInBoundConn bool,
-	f *os.File,
 ) {
 	netHandler.HandleResponse(r, w, netRequest, isInBoundConn, false)
-	f.Close()
 	closeConn(logger, r)
 	closeConn(logger, w)
 }
@@ -65,9 +58,11 @@ func HandleConnection(
 	logger *log.Logger,
 	conn *net.TCPConn,
 	ec *estabcache.EstablishedCache,
-	tracingContextMapping *cache.Cache,
-	routingInfoContextMapping *cache.Cache,
+	cfg *config.Config,
+	factory *protocol.Factory,
 	statsdMetrics *statsd.Client,
+	m *metrics.Metrics,
+	tlsStore *mtls.Store,
 ) {
 	if conn == nil {
 		return
@@ -79,155 +74,276 @@ func HandleConnection(
 		logger.Debug("Closed src conn")
 		return
 	}
+	// duplicated descriptor keeps socket TCP_INFO available after connection is closed
+	defer f.Close()
 
 	err = syscall.SetNonblock(int(f.Fd()), true)
 	if err != nil {
 		logger.Debug("Can't turn fd into non-blocking mode")
 	}
 
-	addr, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
-	if err != nil {
-		f.Close()
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
 		closeConn(logger, conn)
 		return
 	}
+	var originalDst *net.TCPAddr
+	var isInBoundConn bool
+	// address to bind upstream connection to, used only in tproxy mode
+	var srcAddr *net.TCPAddr
+	if cfg.Netra.InterceptionMode == config.InterceptionModeTProxy {
+		// TPROXY doesn't change destination, so accepted socket local address is the original one
+		originalDst = localAddr
+		isInBoundConn = isLocalIP(originalDst.IP)
+		if isInBoundConn {
+			srcAddr, _ = conn.RemoteAddr().(*net.TCPAddr)
+		}
+	} else {
+		originalDst, err = getOriginalDst(f, localAddr.IP.To4() == nil)
+		if err != nil {
+			logger.Debugf("Can't retrieve original destination: %s", err.Error())
+			closeConn(logger, conn)
+			return
+		}
+		isInBoundConn = originalDst.IP.Equal(localAddr.IP)
+	}
+	originalDstAddr := originalDst.String()
+	port := strconv.Itoa(originalDst.Port)
 
-	ipBuilder := addrPool.Get().([]byte)
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[4]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[5]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[6]))...)
-	ipBuilder = append(ipBuilder, '.')
-	ipBuilder = append(ipBuilder, strconv.Itoa(int(addr.Multiaddr[7]))...)
-	ipv4 := string(ipBuilder)
-	ipBuilder = ipBuilder[:0]
-	addrPool.Put(ipBuilder)
-	port := uint16(addr.Multiaddr[2])<<8 + uint16(addr.Multiaddr[3])
-
-	isInBoundConn := ipv4 == strings.Split(conn.LocalAddr().String(), ":")[0]
+	// client is application side of connection, its remote address can be overridden by PROXY protocol header
+	var client net.Conn = conn
+	clientAddr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if _, ok := cfg.Netra.ProxyProtocolAcceptPorts[port]; ok && isInBoundConn {
+		header, err := readProxyHeader(conn, cfg.Netra.ProxyProtocolTimeout)
+		if err != nil {
+			logger.Warningf("Invalid PROXY protocol header from %s: %s", conn.RemoteAddr().String(), err.Error())
+			statsdMetrics.Increment("proxy_protocol.error")
+			closeConn(logger, conn)
+			return
+		}
+		if header != nil && header.src != nil {
+			clientAddr = header.src
+			client = protocol.NewAddrConn(conn, header.src)
+		}
+	}
+	// address announced to application with PROXY protocol v2 header
+	var proxyHeaderSrc *net.TCPAddr
+	if _, ok := cfg.Netra.ProxyProtocolSendPorts[port]; ok && isInBoundConn {
+		proxyHeaderSrc = clientAddr
+	}
 
-	dstAddrBuilder := addrPool.Get().([]byte)
-	dstAddrBuilder = append(dstAddrBuilder, ipv4...)
-	dstAddrBuilder = append(dstAddrBuilder, ':')
-	dstAddrBuilder = append(dstAddrBuilder, strconv.Itoa(int(port))...)
-	originalDstAddr := string(dstAddrBuilder)
-	dstAddrBuilder = dstAddrBuilder[:0]
-	addrPool.Put(dstAddrBuilder)
+	// mutual TLS of peer sidecar is terminated before protocol detection, so handlers see decrypted stream
+	var peerIdentity string
+	if _, ok := cfg.Netra.MTLSInboundPorts[port]; ok && isInBoundConn && tlsStore != nil {
+		peerConn, identity, err := acceptMTLS(client, tlsStore, cfg.Netra)
+		if err != nil {
+			logger.Warningf("mTLS connection from %s (peer %q) is rejected: %s",
+				client.RemoteAddr().String(), identity, err.Error())
+			m.MTLSHandshake(isInBoundConn, mtlsResult(err))
+			statsdMetrics.Increment("mtls." + mtlsResult(err))
+			closeConn(logger, conn)
+			return
+		}
+		if peerConn == client {
+			m.MTLSHandshake(isInBoundConn, metrics.MTLSResultPlaintext)
+		} else {
+			m.MTLSHandshake(isInBoundConn, metrics.MTLSResultOK)
+			client = peerConn
+			peerIdentity = identity
+		}
+	}
 
 	// determine protocol and choose logic
-	p := protocol.Determine(originalDstAddr)
-	netRequest := protocol.GetNetRequest(p, isInBoundConn, logger, tracingContextMapping, statsdMetrics)
-	netHandler := protocol.GetNetworkHandler(p, logger, tracingContextMapping)
+	p := factory.DetermineConn(client, originalDstAddr)
+	netRequest := factory.GetNetRequest(p, isInBoundConn)
+	netHandler := factory.GetNetworkHandler(p)
+	if receiver, ok := netRequest.(protocol.PeerIdentityReceiver); ok && peerIdentity != "" {
+		receiver.SetPeerIdentity(peerIdentity)
+	}
+
+	m.ConnectionOpened(isInBoundConn, string(p))
+	defer func() {
+		received, sent := bytesTransferred(f)
+		m.ConnectionClosed(isInBoundConn, string(p), received, sent)
+	}()
+
+	direction := estabcache.DirectionOutbound
+	if isInBoundConn {
+		direction = estabcache.DirectionInbound
+	}
+	entry := ec.Add(
+		estabcache.Connection{
+			Source:              client.RemoteAddr().String(),
+			OriginalDestination: originalDstAddr,
+			Destination:         originalDstAddr,
+			Direction:           direction,
+			Protocol:            string(p),
+			PeerIdentity:        peerIdentity,
+		},
+		func() {
+			conn.Close()
+		},
+		func() (uint64, uint64) {
+			return bytesTransferred(conn)
+		})
+	defer ec.Remove(entry)
+	logger = logger.With(
+		"conn_id", entry.ID(),
+		"direction", direction,
+		"original_dst", originalDstAddr,
+		"protocol", string(p))
+	if observer, ok := netRequest.(protocol.RequestObserver); ok {
+		observer.OnRequest(entry.IncHTTPRequests)
+	}
+
+	timeouts := watchTimeouts(
+		conn,
+		cfg.Netra.IdleTimeout,
+		cfg.Netra.MaxConnectionLifetime,
+		func(cause string) {
+			reportTimeout(logger, statsdMetrics, conn, originalDstAddr, cause)
+			netRequest.TimedOut(cause)
+			closeConn(logger, conn)
+		})
+	defer timeouts.Stop()
 
-	//ec.Add(dstAddr)
-	if config.GetHTTPConfig().RoutingEnabled {
-		addrCh := make(chan string)
-		connCh := make(chan *net.TCPConn)
-		go TcpCopyRequest(
+	// outbound HTTP requests are dialed by handler to originate TLS for hosts matching rules,
+	// upstream connection is kept until request of other rule comes
+	dialByHandler := !isInBoundConn && p == protocol.HTTPProto && len(cfg.HTTP.TLSOrigination) > 0
+	if cfg.HTTP.RoutingEnabled || dialByHandler {
+		dialer := newRoutingDialer(
 			logger,
-			conn,
+			statsdMetrics,
+			m,
+			client,
+			srcAddr,
+			proxyHeaderSrc,
+			entry,
+			cfg.Netra.DialTimeout,
+			newMTLSOrigination(tlsStore, cfg.Netra, isInBoundConn),
+			netRequest,
+			netHandler,
+			isInBoundConn,
+			!cfg.HTTP.RoutingEnabled)
+		TcpCopyRequest(
+			logger,
+			client,
 			nil,
-			connCh,
+			dialer,
 			netRequest,
 			netHandler,
 			isInBoundConn,
-			f,
-			addrCh,
 			originalDstAddr)
-
-		defer netRequest.CleanUp()
-
-		callCh := make(chan func(), 10)
-		wg := sync.WaitGroup{}
-		go func() {
-			for f := range callCh {
-				f()
-				wg.Done()
-			}
-		}()
-		for {
-			dstAddr := <-addrCh
-			if dstAddr == "" {
-				f.Close()
-				closeConn(logger, conn)
-				close(connCh)
-				close(callCh)
-				return
-			}
-
-			tcpDstAddr, err := net.ResolveTCPAddr("tcp", dstAddr)
-			if err != nil {
-				logger.Warningf("Error while resolving tcp addr %s", originalDstAddr)
-				connCh <- nil
-				f.Close()
-				closeConn(logger, conn)
-				close(connCh)
-				close(callCh)
-				return
-			}
-			targetConn, err := net.DialTCP("tcp", nil, tcpDstAddr)
-			if err != nil {
-				logger.Warning(err.Error())
-				connCh <- nil
-				f.Close()
-				closeConn(logger, conn)
-				close(connCh)
-				close(callCh)
-				return
-			}
-
-			connCh <- targetConn
-			respRoutine := func() {
-				netHandler.HandleResponse(targetConn, conn, netRequest, isInBoundConn, true)
-				closeConn(logger, targetConn)
-			}
-			wg.Add(1)
-			callCh <- respRoutine
-		}
-		wg.Wait()
-		close(callCh)
+		dialer.Close()
+		netRequest.CleanUp()
 	} else {
 		tcpDstAddr, err := net.ResolveTCPAddr("tcp", originalDstAddr)
 		if err != nil {
 			logger.Warningf("Error while resolving tcp addr %s", originalDstAddr)
-			f.Close()
+			m.DialError(isInBoundConn, err)
 			closeConn(logger, conn)
 			return
 		}
-		targetConn, err := net.DialTCP("tcp", nil, tcpDstAddr)
+		tcpConn, err := dialTCP(tcpDstAddr, srcAddr, cfg.Netra.DialTimeout)
 		if err != nil {
-			logger.Warning(err.Error())
-			f.Close()
+			reportDialError(logger, statsdMetrics, m, conn, originalDstAddr, isInBoundConn, err)
 			closeConn(logger, conn)
 			return
 		}
+		var targetConn net.Conn = tcpConn
+		if origination := newMTLSOrigination(tlsStore, cfg.Netra, isInBoundConn); origination.match(tcpDstAddr) {
+			targetConn, err = origination.wrap(logger, statsdMetrics, m, tcpConn, netRequest, entry)
+			if err != nil {
+				closeConn(logger, conn)
+				return
+			}
+		}
+		if proxyHeaderSrc != nil {
+			if err := writeProxyHeaderV2(targetConn, proxyHeaderSrc, originalDst); err != nil {
+				logger.Warningf("Error while sending PROXY protocol header to %s: %s", originalDstAddr, err.Error())
+				closeConn(logger, conn)
+				closeConn(logger, targetConn)
+				return
+			}
+		}
 
-		go TcpCopyRequest(
-			logger,
-			conn,
-			targetConn,
-			nil,
-			netRequest,
-			netHandler,
-			isInBoundConn,
-			f,
-			nil,
-			originalDstAddr)
+		// wait for both directions to keep connection tracked while it's active
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			TcpCopyRequest(
+				logger,
+				client,
+				targetConn,
+				nil,
+				netRequest,
+				netHandler,
+				isInBoundConn,
+				originalDstAddr)
+			wg.Done()
+		}()
 
-		go TcpCopyResponse(logger, targetConn, conn, netRequest, netHandler, isInBoundConn, f)
+		go func() {
+			TcpCopyResponse(logger, targetConn, client, netRequest, netHandler, isInBoundConn)
+			wg.Done()
+		}()
+		wg.Wait()
 	}
+}
 
-	//ec.Remove(dstAddr)
+func reportDialError(
+	logger *log.Logger,
+	statsdMetrics *statsd.Client,
+	m *metrics.Metrics,
+	conn net.Conn,
+	dstAddr string,
+	isInBoundConn bool,
+	err error,
+) {
+	m.DialError(isInBoundConn, err)
+	if isTimeout(err) {
+		reportTimeout(logger, statsdMetrics, conn, dstAddr, TimeoutCauseDial)
+		return
+	}
+	logger.Warning(err.Error())
+}
+
+func reportTimeout(logger *log.Logger, statsdMetrics *statsd.Client, conn net.Conn, dstAddr string, cause string) {
+	logger.Warningf("Connection %s -> %s closed by %s timeout", conn.RemoteAddr().String(), dstAddr, cause)
+	statsdMetrics.Increment("timeout." + cause)
+}
+
+// getOriginalDst returns destination address of connection before it was redirected by iptables (ip6tables)
+func getOriginalDst(f *os.File, isIPv6 bool) (*net.TCPAddr, error) {
+	if isIPv6 {
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(f.Fd()), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+		if err != nil {
+			return nil, err
+		}
+		// port is stored in network byte order
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		return &net.TCPAddr{
+			IP:   ip,
+			Port: int(port[0])<<8 + int(port[1]),
+		}, nil
+	}
+
+	addr, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, err
+	}
+	// Multiaddr contains struct sockaddr_in: family (2 bytes), port (2 bytes), ipv4 addr (4 bytes)
+	return &net.TCPAddr{
+		IP:   net.IPv4(addr.Multiaddr[4], addr.Multiaddr[5], addr.Multiaddr[6], addr.Multiaddr[7]),
+		Port: int(addr.Multiaddr[2])<<8 + int(addr.Multiaddr[3]),
+	}, nil
 }
 
-func closeConn(logger *log.Logger, conn *net.TCPConn) {
+func closeConn(logger *log.Logger, conn net.Conn) {
 	logger.Debug("Closing conn")
-	// Important to close read operations
-	// to avoid waiting for never ending read operation when client doesn't close connection
-	conn.CloseRead()
-	conn.CloseWrite()
-	conn.Close()
+	protocol.CloseConn(conn)
 	logger.Debug("Closed conn")
 }
 
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/estabcache"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/mtls"
+	"github.com/Lookyan/netramesh/pkg/protocol"
+)
+
+// tlsRecordHandshake is a content type of TLS record carrying ClientHello
+const tlsRecordHandshake = 0x16
+
+var errMTLSPeerNotAllowed = errors.New("peer isn't allowed")
+
+// acceptMTLS terminates mutual TLS of peer sidecar on inbound connection and authorizes peer identity.
+// In permissive mode connections which don't start with TLS handshake are returned as is with empty identity.
+func acceptMTLS(conn net.Conn, store *mtls.Store, netraConfig config.NetraConfig) (net.Conn, string, error) {
+	deadline := time.Now().Add(netraConfig.MTLSHandshakeTimeout)
+	if netraConfig.MTLSPermissive {
+		buf := make([]byte, 1)
+		n, err := protocol.Peek(conn, buf, deadline)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// client waits for server greeting, so it's not a sidecar
+				return conn, "", nil
+			}
+			return nil, "", err
+		}
+		if n == 0 || buf[0] != tlsRecordHandshake {
+			return conn, "", nil
+		}
+	}
+
+	tlsConn := tls.Server(conn, store.ServerConfig())
+	identity, err := handshake(tlsConn, deadline)
+	if err != nil {
+		return nil, "", err
+	}
+	if !mtls.Allowed(identity, netraConfig.MTLSAllowedPeers) {
+		tlsConn.Close()
+		return nil, identity, errMTLSPeerNotAllowed
+	}
+	return protocol.NewPeerConn(tlsConn, identity), identity, nil
+}
+
+// mtlsOrigination wraps outbound connections to mesh destinations into mutual TLS
+type mtlsOrigination struct {
+	store        *mtls.Store
+	destinations []string
+	allowedPeers []string
+	timeout      time.Duration
+}
+
+// newMTLSOrigination returns nil in case connections aren't wrapped: mTLS is disabled or connection is inbound
+func newMTLSOrigination(store *mtls.Store, netraConfig config.NetraConfig, isInBoundConn bool) *mtlsOrigination {
+	if store == nil || isInBoundConn || len(netraConfig.MTLSDestinations) == 0 {
+		return nil
+	}
+	return &mtlsOrigination{
+		store:        store,
+		destinations: netraConfig.MTLSDestinations,
+		allowedPeers: netraConfig.MTLSAllowedPeers,
+		timeout:      netraConfig.MTLSHandshakeTimeout,
+	}
+}
+
+// match checks whether upstream address is served by sidecar
+func (o *mtlsOrigination) match(addr *net.TCPAddr) bool {
+	return o != nil && mtls.MatchDestination(addr, o.destinations)
+}
+
+// wrap makes handshake with peer sidecar, authorizes its identity and sets it to request and connection entry.
+// Upstream connection is closed in case of error.
+func (o *mtlsOrigination) wrap(
+	logger *log.Logger,
+	statsdMetrics *statsd.Client,
+	m *metrics.Metrics,
+	conn *net.TCPConn,
+	netRequest protocol.NetRequest,
+	entry *estabcache.Entry,
+) (net.Conn, error) {
+	tlsConn := tls.Client(conn, o.store.ClientConfig())
+	identity, err := handshake(tlsConn, time.Now().Add(o.timeout))
+	if err == nil && !mtls.Allowed(identity, o.allowedPeers) {
+		// server certificate isn't bound to dialed address, so identity is the only proof of peer
+		err = errMTLSPeerNotAllowed
+	}
+	m.MTLSHandshake(false, mtlsResult(err))
+	if err != nil {
+		logger.Warningf("mTLS connection to %s (%s) failed: %s", conn.RemoteAddr().String(), identity, err.Error())
+		statsdMetrics.Increment("mtls." + mtlsResult(err))
+		closeConn(logger, conn)
+		return nil, err
+	}
+	entry.SetPeerIdentity(identity)
+	if receiver, ok := netRequest.(protocol.PeerIdentityReceiver); ok {
+		receiver.SetPeerIdentity(identity)
+	}
+	return tlsConn, nil
+}
+
+func handshake(conn *tls.Conn, deadline time.Time) (string, error) {
+	if err := conn.SetDeadline(deadline); err != nil {
+		return "", err
+	}
+	if err := conn.Handshake(); err != nil {
+		return "", fmt.Errorf("mTLS handshake: %s", err.Error())
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+	return mtls.PeerIdentity(conn.ConnectionState()), nil
+}
+
+// mtlsResult returns handshake result label of error returned by acceptMTLS or handshake
+func mtlsResult(err error) string {
+	switch err {
+	case nil:
+		return metrics.MTLSResultOK
+	case errMTLSPeerNotAllowed:
+		return metrics.MTLSResultUnauthorized
+	}
+	return metrics.MTLSResultError
+}
@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+
+	"github.com/Lookyan/netramesh/pkg/config"
+	"github.com/Lookyan/netramesh/pkg/log"
+	"github.com/Lookyan/netramesh/pkg/metrics"
+	"github.com/Lookyan/netramesh/pkg/mtls"
+)
+
+// newSelfSignedStore creates store which certificate is its own CA, so two stores of the same identity trust each other
+func newSelfSignedStore(t *testing.T, identity string) *mtls.Store {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: identity},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	store, err := mtls.NewStore(certFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestMTLSOriginationAuthorizesServer(t *testing.T) {
+	logger, err := log.Init("TEST", "error", os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdClient, _ := statsd.New(statsd.Mute(true))
+	cfg := config.Default()
+	m, err := metrics.New(nil, statsdClient, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newSelfSignedStore(t, "backend")
+	netraConfig := cfg.Netra
+	netraConfig.MTLSDestinations = []string{"8080"}
+	netraConfig.MTLSAllowedPeers = []string{"frontend*"}
+	o := newMTLSOrigination(store, netraConfig, false)
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	go tls.Server(server, store.ServerConfig()).Handshake()
+
+	// certificate of server is issued by trusted CA, but its identity isn't allowed
+	if _, err := o.wrap(logger, statsdClient, m, client, nil, nil); err != errMTLSPeerNotAllowed {
+		t.Errorf("expected %v, got %v", errMTLSPeerNotAllowed, err)
+	}
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Lookyan/netramesh/pkg/protocol"
+)
+
+// proxyHeaderRetryInterval is a pause between peeks while header is incomplete
+const proxyHeaderRetryInterval = time.Millisecond
+
+const (
+	// proxyV1MaxLen is maximum length of PROXY protocol v1 header line including CRLF
+	proxyV1MaxLen = 107
+	// proxyV2HeaderLen is length of PROXY protocol v2 fixed header part
+	proxyV2HeaderLen = 16
+
+	proxyV2VersionCommandLocal = 0x20
+	proxyV2VersionCommandProxy = 0x21
+	proxyV2FamilyTCP4          = 0x11
+	proxyV2FamilyTCP6          = 0x21
+	proxyV2AddrLenTCP4         = 12
+	proxyV2AddrLenTCP6         = 36
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyHeader is PROXY protocol header, addresses are nil for LOCAL (v2) and UNKNOWN (v1) connections
+type proxyHeader struct {
+	src *net.TCPAddr
+	dst *net.TCPAddr
+}
+
+// readProxyHeader consumes PROXY protocol v1 or v2 header in case connection starts with it,
+// otherwise it returns nil header and leaves client bytes untouched.
+// Connections without client bytes during timeout are treated as connections without header.
+func readProxyHeader(conn *net.TCPConn, timeout time.Duration) (*proxyHeader, error) {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, proxyV1MaxLen)
+	b, err := peekUntil(conn, buf, deadline, func(b []byte) bool {
+		return !couldBeProxyHeader(b) ||
+			bytes.HasPrefix(b, proxyV1Prefix) ||
+			bytes.HasPrefix(b, proxyV2Signature)
+	})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(b, proxyV2Signature):
+		return readProxyHeaderV2(conn, deadline)
+	case bytes.HasPrefix(b, proxyV1Prefix):
+		b, err = peekUntil(conn, buf, deadline, func(b []byte) bool {
+			return bytes.Contains(b, []byte("\r\n")) || len(b) == len(buf)
+		})
+		if err != nil {
+			return nil, err
+		}
+		end := bytes.Index(b, []byte("\r\n"))
+		if end < 0 {
+			return nil, errors.New("PROXY v1 header is too long")
+		}
+		line := make([]byte, end+2)
+		if err := readFull(conn, line, deadline); err != nil {
+			return nil, err
+		}
+		return parseProxyHeaderV1(string(line[:end]))
+	}
+	return nil, nil
+}
+
+// couldBeProxyHeader checks whether first bytes match beginning of PROXY protocol signatures
+func couldBeProxyHeader(b []byte) bool {
+	for _, sig := range [][]byte{proxyV1Prefix, proxyV2Signature} {
+		n := len(b)
+		if n > len(sig) {
+			n = len(sig)
+		}
+		if bytes.Equal(b[:n], sig[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxyHeaderV1 parses "PROXY TCP4 <src ip> <dst ip> <src port> <dst port>" line
+func parseProxyHeaderV1(line string) (*proxyHeader, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header '%s'", line)
+	}
+	isV6 := fields[1] == "TCP6"
+	src, err := parseProxyV1Addr(fields[2], fields[4], isV6)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header '%s': %s", line, err.Error())
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], isV6)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header '%s': %s", line, err.Error())
+	}
+	return &proxyHeader{src: src, dst: dst}, nil
+}
+
+// parseProxyV1Addr parses address of TCP4 or TCP6 header, ip must be written in format of header family
+func parseProxyV1Addr(ip string, port string, isV6 bool) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip %s", ip)
+	}
+	if strings.Contains(ip, ":") != isV6 {
+		return nil, fmt.Errorf("ip %s doesn't match address family", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(conn *net.TCPConn, deadline time.Time) (*proxyHeader, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if err := readFull(conn, header, deadline); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if err := readFull(conn, payload, deadline); err != nil {
+		return nil, err
+	}
+
+	switch header[12] {
+	case proxyV2VersionCommandLocal:
+		// health checks of load balancer, connection endpoints are real ones
+		return &proxyHeader{}, nil
+	case proxyV2VersionCommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 version and command 0x%x", header[12])
+	}
+
+	// TLVs after addresses are ignored
+	switch header[13] {
+	case proxyV2FamilyTCP4:
+		if len(payload) < proxyV2AddrLenTCP4 {
+			return nil, errors.New("PROXY v2 header is too short for TCP over IPv4")
+		}
+		return &proxyHeader{
+			src: &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			dst: &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))},
+		}, nil
+	case proxyV2FamilyTCP6:
+		if len(payload) < proxyV2AddrLenTCP6 {
+			return nil, errors.New("PROXY v2 header is too short for TCP over IPv6")
+		}
+		return &proxyHeader{
+			src: &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			dst: &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))},
+		}, nil
+	}
+	// UDP and unix sockets can't be represented as TCP address
+	return &proxyHeader{}, nil
+}
+
+// writeProxyHeaderV2 writes PROXY protocol v2 header announcing connection from src to dst
+func writeProxyHeaderV2(w io.Writer, src *net.TCPAddr, dst *net.TCPAddr) error {
+	buf := bytes.NewBuffer(make([]byte, 0, proxyV2HeaderLen+proxyV2AddrLenTCP6))
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(proxyV2VersionCommandProxy)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		buf.WriteByte(proxyV2FamilyTCP4)
+		binary.Write(buf, binary.BigEndian, uint16(proxyV2AddrLenTCP4))
+		buf.Write(src4)
+		buf.Write(dst4)
+	} else {
+		buf.WriteByte(proxyV2FamilyTCP6)
+		binary.Write(buf, binary.BigEndian, uint16(proxyV2AddrLenTCP6))
+		buf.Write(src.IP.To16())
+		buf.Write(dst.IP.To16())
+	}
+	binary.Write(buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// peekUntil peeks client bytes into buf until done reports true for them or buf is full
+func peekUntil(conn *net.TCPConn, buf []byte, deadline time.Time, done func(b []byte) bool) ([]byte, error) {
+	for {
+		n, err := protocol.Peek(conn, buf, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, io.EOF
+		}
+		if done(buf[:n]) || n == len(buf) {
+			return buf[:n], nil
+		}
+		if time.Now().After(deadline) {
+			return buf[:n], nil
+		}
+		time.Sleep(proxyHeaderRetryInterval)
+	}
+}
+
+// readFull consumes exactly len(buf) bytes
+func readFull(conn *net.TCPConn, buf []byte, deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := io.ReadFull(conn, buf)
+	return err
+}
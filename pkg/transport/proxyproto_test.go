@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *net.TCPConn)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.Fatal("accept failed")
+	}
+	return client, server
+}
+
+// proxyV2 builds PROXY protocol v2 header with version and command, family and address payload
+func proxyV2(command byte, family byte, payload []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x30, 0x39, 0, 80}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0, 80)
+	// TLVs after addresses are skipped
+	tcp4WithTLV := append(append([]byte{}, tcp4...), 0x04, 0, 1, 0)
+	truncated := proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP4, tcp4)[:proxyV2HeaderLen+4]
+
+	cases := []struct {
+		name  string
+		input []byte
+		src   string
+		dst   string
+		err   bool
+	}{
+		{name: "no header", input: []byte("GET / HTTP/1.1\r\n")},
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345 80\r\n"), src: "10.0.0.1:12345", dst: "10.0.0.2:80"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"), src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:80"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN 10.0.0.1 10.0.0.2 12345 80\r\n")},
+		{name: "v1 ipv6 under tcp4", input: []byte("PROXY TCP4 2001:db8::1 10.0.0.2 12345 80\r\n"), err: true},
+		{name: "v1 ipv4 under tcp6", input: []byte("PROXY TCP6 2001:db8::1 10.0.0.2 12345 80\r\n"), err: true},
+		{name: "v1 unknown protocol", input: []byte("PROXY UDP4 10.0.0.1 10.0.0.2 12345 80\r\n"), err: true},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345\r\n"), err: true},
+		{name: "v1 invalid port", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2 12345 65536\r\n"), err: true},
+		{name: "v1 invalid ip", input: []byte("PROXY TCP4 10.0.0.256 10.0.0.2 12345 80\r\n"), err: true},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 10.0.0.1 10.0.0.2"), err: true},
+		{name: "v1 too long", input: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLen)...), err: true},
+		{name: "v2 tcp4", input: proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP4, tcp4), src: "10.0.0.1:12345", dst: "10.0.0.2:80"},
+		{name: "v2 tcp4 with tlv", input: proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP4, tcp4WithTLV), src: "10.0.0.1:12345", dst: "10.0.0.2:80"},
+		{name: "v2 tcp6", input: proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP6, tcp6), src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:80"},
+		{name: "v2 local", input: proxyV2(proxyV2VersionCommandLocal, 0, nil)},
+		{name: "v2 unspec family", input: proxyV2(proxyV2VersionCommandProxy, 0, nil)},
+		{name: "v2 unsupported version", input: proxyV2(0x11, proxyV2FamilyTCP4, tcp4), err: true},
+		{name: "v2 short tcp4 addresses", input: proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP4, tcp4[:8]), err: true},
+		{name: "v2 short tcp6 addresses", input: proxyV2(proxyV2VersionCommandProxy, proxyV2FamilyTCP6, tcp4), err: true},
+		{name: "v2 truncated", input: truncated, err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+			rest := []byte("application data")
+			input := append(append([]byte{}, c.input...), rest...)
+			if c.err {
+				input = c.input
+			}
+			if _, err := client.Write(input); err != nil {
+				t.Fatal(err)
+			}
+			client.CloseWrite()
+
+			header, err := readProxyHeader(server, 100*time.Millisecond)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected error, got header %+v", header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if c.src != "" {
+				if header == nil || header.src == nil || header.dst == nil {
+					t.Fatalf("expected addresses, got header %+v", header)
+				}
+				if header.src.String() != c.src || header.dst.String() != c.dst {
+					t.Errorf("expected %s -> %s, got %s -> %s", c.src, c.dst, header.src, header.dst)
+				}
+			} else if header != nil && (header.src != nil || header.dst != nil) {
+				t.Errorf("expected no addresses, got %s -> %s", header.src, header.dst)
+			}
+
+			// only header is consumed, application bytes follow it
+			expected := rest
+			if c.name == "no header" {
+				expected = input
+			}
+			b, err := ioutil.ReadAll(server)
+			if err != nil || !bytes.Equal(b, expected) {
+				t.Errorf("expected remaining %q, got %q %v", expected, b, err)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderV2RoundTrip(t *testing.T) {
+	cases := []struct {
+		src *net.TCPAddr
+		dst *net.TCPAddr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+		// mixed families are sent as TCP over IPv6 with IPv4-mapped address
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}},
+	}
+	for _, c := range cases {
+		client, server := tcpPair(t)
+		if err := writeProxyHeaderV2(client, c.src, c.dst); err != nil {
+			t.Fatal(err)
+		}
+		header, err := readProxyHeader(server, time.Second)
+		client.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s -> %s: %s", c.src, c.dst, err)
+		}
+		if header == nil || header.src.String() != c.src.String() || header.dst.String() != c.dst.String() {
+			t.Errorf("expected %s -> %s, got %+v", c.src, c.dst, header)
+		}
+	}
+}
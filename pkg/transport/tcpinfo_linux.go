@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpInfo is struct tcp_info extended with fields missing in syscall.TCPInfo.
+// Kernels older than 4.1 don't fill byte counters, they stay zero.
+type tcpInfo struct {
+	syscall.TCPInfo
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+}
+
+// getTCPInfo returns TCP_INFO of socket, conn is either *net.TCPConn or its file
+func getTCPInfo(conn syscall.Conn) (*tcpInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var info tcpInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT,
+			fd,
+			syscall.SOL_TCP,
+			syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)),
+			uintptr(unsafe.Pointer(&size)),
+			0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return &info, nil
+}
+
+// idleTime returns time passed since last data was sent or received on conn, taken from TCP_INFO
+func idleTime(conn *net.TCPConn) (time.Duration, error) {
+	info, err := getTCPInfo(conn)
+	if err != nil {
+		return 0, err
+	}
+	idle := info.Last_data_recv
+	if info.Last_data_sent < idle {
+		idle = info.Last_data_sent
+	}
+	return time.Duration(idle) * time.Millisecond, nil
+}
+
+// bytesTransferred returns number of bytes received from peer and sent (acknowledged by peer) on conn
+func bytesTransferred(conn syscall.Conn) (received uint64, sent uint64) {
+	info, err := getTCPInfo(conn)
+	if err != nil {
+		return 0, 0
+	}
+	return info.BytesReceived, info.BytesAcked
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// idleTime is supported only on linux
+func idleTime(conn *net.TCPConn) (time.Duration, error) {
+	return 0, errors.New("idle time is supported only on linux")
+}
+
+// bytesTransferred is supported only on linux, it always returns zeros
+func bytesTransferred(conn syscall.Conn) (received uint64, sent uint64) {
+	return 0, 0
+}
@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeout causes
+const (
+	TimeoutCauseDial     = "dial"
+	TimeoutCauseIdle     = "idle"
+	TimeoutCauseLifetime = "lifetime"
+)
+
+// timeoutWatcher fires when connection is idle (no bytes in either direction) for too long
+// or when it exceeds maximum lifetime
+type timeoutWatcher struct {
+	conn          *net.TCPConn
+	idleTimeout   time.Duration
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+	once          sync.Once
+	onTimeout     func(cause string)
+}
+
+// watchTimeouts starts watching conn, zero timeout disables corresponding check
+func watchTimeouts(
+	conn *net.TCPConn,
+	idleTimeout time.Duration,
+	lifetime time.Duration,
+	onTimeout func(cause string),
+) *timeoutWatcher {
+	tw := &timeoutWatcher{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		onTimeout:   onTimeout,
+	}
+	if idleTimeout > 0 {
+		tw.idleTimer = time.AfterFunc(idleTimeout, tw.checkIdle)
+	}
+	if lifetime > 0 {
+		tw.lifetimeTimer = time.AfterFunc(lifetime, func() {
+			tw.fire(TimeoutCauseLifetime)
+		})
+	}
+	return tw
+}
+
+// checkIdle asks kernel how long connection is idle and rearms timer for the rest of idle timeout
+func (tw *timeoutWatcher) checkIdle() {
+	idle, err := idleTime(tw.conn)
+	if err != nil {
+		// connection is closed or idle time can't be retrieved on this platform
+		return
+	}
+	if idle >= tw.idleTimeout {
+		tw.fire(TimeoutCauseIdle)
+		return
+	}
+	tw.idleTimer.Reset(tw.idleTimeout - idle)
+}
+
+func (tw *timeoutWatcher) fire(cause string) {
+	tw.once.Do(func() {
+		tw.Stop()
+		tw.onTimeout(cause)
+	})
+}
+
+// Stop stops watching
+func (tw *timeoutWatcher) Stop() {
+	if tw.idleTimer != nil {
+		tw.idleTimer.Stop()
+	}
+	if tw.lifetimeTimer != nil {
+		tw.lifetimeTimer.Stop()
+	}
+}
+
+// isTimeout checks whether err is timeout error
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
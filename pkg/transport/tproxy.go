@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var localIPs struct {
+	once sync.Once
+	ips  []net.IP
+}
+
+// Listen opens TCP listener, transparent listener is able to accept TPROXY redirected connections
+func Listen(network string, addr string, transparent bool) (*net.TCPListener, error) {
+	lc := net.ListenConfig{}
+	if transparent {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return setTransparent(network, c)
+		}
+	}
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// dialTCP connects to dst, binding to srcAddr with IP_TRANSPARENT in case it's not nil
+func dialTCP(dst *net.TCPAddr, srcAddr *net.TCPAddr, timeout time.Duration) (*net.TCPConn, error) {
+	d := net.Dialer{
+		Timeout: timeout,
+	}
+	if srcAddr != nil {
+		// keep only ip, port is chosen by kernel to avoid collisions with original connection
+		d.LocalAddr = &net.TCPAddr{IP: srcAddr.IP, Zone: srcAddr.Zone}
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return setTransparent(network, c)
+		}
+	}
+	conn, err := d.Dial("tcp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// isLocalIP checks whether ip is assigned to one of the host interfaces
+func isLocalIP(ip net.IP) bool {
+	localIPs.once.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				localIPs.ips = append(localIPs.ips, ipNet.IP)
+			}
+		}
+	})
+	for _, localIP := range localIPs.ips {
+		if localIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"syscall"
+)
+
+// IPV6_TRANSPARENT is missing in syscall package
+const IPV6_TRANSPARENT = 75
+
+// setTransparent sets IP_TRANSPARENT (IPV6_TRANSPARENT) option which allows
+// to accept TPROXY redirected connections and to bind to non-local addresses
+func setTransparent(network string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
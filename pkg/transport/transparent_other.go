@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setTransparent is supported only on linux
+func setTransparent(network string, c syscall.RawConn) error {
+	return errors.New("transparent proxy mode is supported only on linux")
+}